@@ -0,0 +1,111 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"paqet/cmd/version"
+	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/store"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	confPath string
+	sizeMB   int
+	parallel int
+)
+
+func init() {
+	Cmd.Flags().StringVarP(&confPath, "config", "c", "config.yaml", "Path to the client configuration file.")
+	Cmd.Flags().IntVar(&sizeMB, "size", 16, "Megabytes to send in each direction.")
+	Cmd.Flags().IntVarP(&parallel, "parallel", "P", 0, "Parallel streams per direction (default: transport.conn).")
+}
+
+var Cmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measures goodput, latency and retransmissions through the tunnel.",
+	Long: `The 'bench' command dials the server from the client configuration on
+its own connections, then times echo round trips while idle, uploads and
+downloads --size megabytes while timing round trips under load, and reports
+goodput, RTT percentiles, the KCP retransmission rate and its CPU use. Run it
+with different transport or network settings to compare them. The server
+must run a version that supports bench.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := conf.LoadFromFile(confPath)
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		if cfg.Role != "client" {
+			log.Fatalf("bench command requires client configuration")
+		}
+		if sizeMB < 1 || int64(sizeMB)<<20 > protocol.MaxBenchBytes {
+			log.Fatalf("--size must be between 1-%d megabytes", protocol.MaxBenchBytes>>20)
+		}
+		if parallel == 0 {
+			parallel = cfg.Transport.Conn
+		}
+		if parallel < 1 || parallel > 64 {
+			log.Fatalf("--parallel must be between 1-64")
+		}
+		run(cfg)
+	},
+}
+
+func run(cfg *conf.Conf) {
+	flog.SetLevel(cfg.Log.Level)
+	protocol.Software = version.Version
+	// A port of its own, so a client running on this machine is unaffected.
+	cfg.Network.Port = 0
+	st, _ := store.Open(&conf.Store{Backend: "memory"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := client.New(cfg, st)
+	if err != nil {
+		log.Fatalf("Failed to initialize client: %v", err)
+	}
+	if err := c.Start(ctx); err != nil {
+		log.Fatalf("Failed to connect to %s: %v", cfg.Server.Addr, err)
+	}
+
+	fmt.Printf("Benchmarking %s: %d MB each way over %d stream(s)...\n", cfg.Server.Addr, sizeMB, parallel)
+	cpu0, cpuOK := cpuTime()
+	start := time.Now()
+	res, err := c.Bench(ctx, int64(sizeMB)<<20, parallel)
+	if err != nil {
+		log.Fatalf("Benchmark failed: %v", err)
+	}
+	elapsed := time.Since(start)
+	cpu1, _ := cpuTime()
+
+	fmt.Printf("Upload:      %8.2f Mbit/s\n", res.Up*8/1e6)
+	fmt.Printf("Download:    %8.2f Mbit/s\n", res.Down*8/1e6)
+	fmt.Printf("RTT idle:    %s\n", percentiles(res.Idle))
+	fmt.Printf("RTT loaded:  %s\n", percentiles(res.Loaded))
+	if res.OutSegs > 0 {
+		fmt.Printf("Retransmit:  %.2f%% (%d of %d segments)\n", 100*float64(res.RetransSegs)/float64(res.OutSegs), res.RetransSegs, res.OutSegs)
+	}
+	if cpuOK {
+		used := cpu1 - cpu0
+		fmt.Printf("CPU:         %v over %v (%.0f%% of one core)\n", used.Round(time.Millisecond), elapsed.Round(time.Millisecond), 100*used.Seconds()/elapsed.Seconds())
+	}
+}
+
+// percentiles formats p50/p90/p99 of sorted round trips.
+func percentiles(rtts []time.Duration) string {
+	if len(rtts) == 0 {
+		return "no samples"
+	}
+	at := func(p float64) time.Duration {
+		return rtts[min(len(rtts)-1, int(p*float64(len(rtts))))].Round(100 * time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %v  p90 %v  p99 %v  (%d samples)", at(0.5), at(0.9), at(0.99), len(rtts))
+}
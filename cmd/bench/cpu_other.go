@@ -0,0 +1,8 @@
+//go:build !unix
+
+package bench
+
+import "time"
+
+// cpuTime is not measured on this platform.
+func cpuTime() (time.Duration, bool) { return 0, false }
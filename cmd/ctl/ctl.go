@@ -0,0 +1,291 @@
+package ctl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"paqet/internal/conf"
+	"paqet/internal/pkg/admin"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	confPath  string
+	adminAddr string
+)
+
+func init() {
+	Cmd.PersistentFlags().StringVarP(&confPath, "config", "c", "config.yaml", "Configuration file to read admin.listen from.")
+	Cmd.PersistentFlags().StringVarP(&adminAddr, "admin", "a", "", "Admin endpoint (unix:/path or host:port), overriding the config.")
+	logCmd.Flags().DurationVar(&logFor, "for", 0, "Revert to the previous level after this long.")
+	forwardCmd.PersistentFlags().StringVarP(&fwdProtocol, "protocol", "p", "tcp", "Protocol of the rule: tcp or udp.")
+	forwardAddCmd.Flags().StringVar(&fwdPriority, "priority", "", "Priority class of the rule's streams.")
+	forwardRemoveCmd.Flags().DurationVar(&fwdDrain, "drain", 30*time.Second, "How long open connections may finish before they are closed; 0 closes them at once.")
+	forwardCmd.AddCommand(forwardAddCmd, forwardRemoveCmd)
+	Cmd.AddCommand(connsCmd, streamsCmd, usersCmd, revokeCmd, forwardsCmd, forwardCmd, closeConnCmd, closeStreamCmd, configCmd, reloadCmd, logCmd)
+}
+
+var Cmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Controls a running client or server through its admin endpoint.",
+	Long:  `Talks to the endpoint a running process serves on admin.listen: lists and closes connections and streams, lists and revokes a server's users, adds and removes a client's forward rules, prints the effective configuration and changes the log level.`,
+}
+
+var connsCmd = &cobra.Command{
+	Use:   "conns",
+	Short: "Lists the connections.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var conns []admin.Conn
+		call("GET", "/conns", nil, nil, &conns)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tREMOTE\tSTREAMS\tRTT\tUSER\tVERSION\tHEALTH")
+		for _, c := range conns {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", c.ID, c.Remote, c.Streams, c.RTT, c.User, c.Version, c.Health)
+		}
+		w.Flush()
+	},
+}
+
+var streamsCmd = &cobra.Command{
+	Use:   "streams",
+	Short: "Lists the relayed streams with their destinations and byte counts.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var streams []admin.StreamInfo
+		call("GET", "/streams", nil, nil, &streams)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tPROTO\tPEER\tDEST\tUSER\tAGE\tUP\tDOWN")
+		for _, s := range streams {
+			age := time.Since(s.Started).Round(time.Second)
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%v\t%d\t%d\n", s.ID, s.Proto, s.Peer, s.Dest, s.User, age, s.Up, s.Down)
+		}
+		w.Flush()
+	},
+}
+
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "Lists a server's users with their byte counts and quota use.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var users []admin.User
+		call("GET", "/users", nil, nil, &users)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCONNS\tUP\tDOWN\tTODAY\tMONTH\tREVOKED")
+		for _, u := range users {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\t%v\n", u.ID, u.Conns, u.Up, u.Down, quota(u.Today, u.DailyQuota), quota(u.Month, u.MonthlyQuota), u.Revoked)
+		}
+		w.Flush()
+	},
+}
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Refuses a server's user until restart and closes its sessions.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		call("POST", "/users/revoke", url.Values{"id": {args[0]}}, nil, nil)
+	},
+}
+
+// quota formats bytes used against a quota, if there is one.
+func quota(used, limit uint64) string {
+	if limit == 0 {
+		return fmt.Sprint(used)
+	}
+	return fmt.Sprintf("%d/%d", used, limit)
+}
+
+var forwardsCmd = &cobra.Command{
+	Use:   "forwards",
+	Short: "Lists a client's forward rules with the connections each relays.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var forwards []admin.Forward
+		call("GET", "/forwards", nil, nil, &forwards)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PROTO\tLISTEN\tTARGET\tSOURCE\tACTIVE\tSTATE")
+		for _, f := range forwards {
+			state := "running"
+			if f.Draining {
+				state = "draining"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", f.Protocol, f.Listen, f.Target, f.Source, f.Active, state)
+		}
+		w.Flush()
+	},
+}
+
+var (
+	fwdProtocol string
+	fwdPriority string
+	fwdDrain    time.Duration
+)
+
+var forwardCmd = &cobra.Command{
+	Use:   "forward",
+	Short: "Adds or removes a client's forward rules without a restart.",
+	Long: `Adds or removes forward rules of a running client. They are kept across
+reloads until the config file's forward rules change: removed rules of the
+file then come back, and a rule of the file replaces an added one on the
+same port. Add a rule to the file as well to keep it after a restart.`,
+}
+
+var forwardAddCmd = &cobra.Command{
+	Use:   "add <listen> <target>",
+	Short: "Starts forwarding listen to target through the tunnel.",
+	Long:  `Starts forwarding listen to target through the tunnel, e.g. "ctl forward add 127.0.0.1:8080 10.0.0.5:80". A listen port range such as 127.0.0.1:9000-9010 adds one rule per port.`,
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		f := admin.Forward{Listen: args[0], Target: args[1], Protocol: fwdProtocol, Priority: fwdPriority}
+		call("POST", "/forwards/add", nil, f, nil)
+	},
+}
+
+var forwardRemoveCmd = &cobra.Command{
+	Use:   "remove <listen>",
+	Short: "Stops a forward rule, letting its connections finish for --drain.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		q := url.Values{"listen": {args[0]}, "protocol": {fwdProtocol}, "drain": {fwdDrain.String()}}
+		call("POST", "/forwards/remove", q, nil, nil)
+	},
+}
+
+var closeConnCmd = &cobra.Command{
+	Use:   "close-conn <id>",
+	Short: "Closes a connection listed by conns.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		call("POST", "/conns/close", url.Values{"id": {args[0]}}, nil, nil)
+	},
+}
+
+var closeStreamCmd = &cobra.Command{
+	Use:   "close-stream <id>",
+	Short: "Closes a stream listed by streams.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		call("POST", "/streams/close", url.Values{"id": {args[0]}}, nil, nil)
+	},
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Prints the effective configuration, without secrets.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		call("GET", "/config", nil, nil, os.Stdout)
+	},
+}
+
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reloads the config file, applying what can change without a restart.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var summary string
+		call("POST", "/reload", nil, nil, &summary)
+		fmt.Println(summary)
+	},
+}
+
+var logFor time.Duration
+
+var logCmd = &cobra.Command{
+	Use:   "log [level]",
+	Short: "Prints or sets the log level (none, debug, info, warn, error, fatal).",
+	Long:  `Prints the log level, or sets it. With --for the level reverts to the one before after that long, e.g. "ctl log debug --for 10m".`,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			var level string
+			call("GET", "/log", nil, nil, &level)
+			fmt.Println(level)
+			return
+		}
+		q := url.Values{"level": {args[0]}}
+		if logFor > 0 {
+			q.Set("for", logFor.String())
+		}
+		call("POST", "/log", q, nil, nil)
+	},
+}
+
+func endpoint() string {
+	if adminAddr != "" {
+		return adminAddr
+	}
+	// A config that fails validation here (e.g. the interface of another
+	// machine) still names the endpoint.
+	cfg, err := conf.LoadFromFile(confPath)
+	if cfg == nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if cfg.Admin.Listen == "" {
+		log.Fatalf("%s has no admin.listen; set it or pass --admin", confPath)
+	}
+	return cfg.Admin.Listen
+}
+
+// call sends a request to the endpoint, with in as its JSON body if not
+// nil, and decodes the JSON reply into out, or copies the body if out is
+// a writer.
+func call(method, path string, query url.Values, in, out any) {
+	addr := endpoint()
+	host := addr
+	tr := &http.Transport{}
+	if p, ok := strings.CutPrefix(addr, "unix:"); ok {
+		host = "localhost" // the endpoint only answers loopback hosts
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", p)
+		}
+	}
+	u := url.URL{Scheme: "http", Host: host, Path: path, RawQuery: query.Encode()}
+	var body bytes.Buffer
+	if in != nil {
+		json.NewEncoder(&body).Encode(in)
+	}
+	req, err := http.NewRequest(method, u.String(), &body)
+	if err != nil {
+		log.Fatalf("Invalid request: %v", err)
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := &http.Client{Transport: tr, Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalf("Failed to reach admin endpoint %s: %v", addr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		log.Fatalf("Admin endpoint refused: %s", e.Error)
+	}
+	switch out := out.(type) {
+	case nil:
+	case io.Writer:
+		io.Copy(out, resp.Body)
+	default:
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			log.Fatalf("Invalid reply from admin endpoint: %v", err)
+		}
+	}
+}
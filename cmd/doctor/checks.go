@@ -0,0 +1,278 @@
+package doctor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"paqet/internal/conf"
+	"paqet/internal/socket"
+)
+
+func ifaceName(cfg *conf.Network) string {
+	if runtime.GOOS == "windows" {
+		return cfg.GUID
+	}
+	return cfg.Interface.Name
+}
+
+// checkInterface makes sure the interface is up, has a MAC to send
+// frames from and carries the configured addresses.
+func checkInterface(cfg *conf.Conf) result {
+	r := result{name: "interface"}
+	iface := cfg.Network.Interface
+	if iface.Flags&net.FlagUp == 0 {
+		r.status, r.detail = fail, fmt.Sprintf("%s is down", iface.Name)
+		r.fix = fmt.Sprintf("sudo ip link set %s up", iface.Name)
+		return r
+	}
+	if len(iface.HardwareAddr) == 0 && cfg.Network.Backend != "windivert" {
+		r.status, r.detail = fail, fmt.Sprintf("%s has no MAC address; raw frames need an Ethernet interface", iface.Name)
+		r.fix = "use the physical interface, not a tunnel or loopback"
+		return r
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		r.status, r.detail = warn, fmt.Sprintf("failed to list addresses of %s: %v", iface.Name, err)
+		return r
+	}
+	for _, a := range []*net.UDPAddr{cfg.Network.IPv4.Addr, cfg.Network.IPv6.Addr} {
+		if a == nil || a.IP.IsUnspecified() {
+			continue
+		}
+		found := false
+		for _, ifa := range addrs {
+			if n, ok := ifa.(*net.IPNet); ok && n.IP.Equal(a.IP) {
+				found = true
+			}
+		}
+		if !found {
+			r.status, r.detail = fail, fmt.Sprintf("%s is not assigned to %s", a.IP, iface.Name)
+			r.fix = fmt.Sprintf("set network.ipv4/ipv6 addr to an address of %s (see `paqet iface`)", iface.Name)
+			return r
+		}
+	}
+	r.status, r.detail = pass, fmt.Sprintf("%s is up at %s", iface.Name, iface.HardwareAddr)
+	return r
+}
+
+func checkPcap(cfg *conf.Conf) result {
+	r := result{name: "pcap permissions"}
+	netCfg := cfg.Network
+	h, err := socket.NewRecvHandle(&netCfg)
+	if err != nil {
+		r.status, r.detail = fail, err.Error()
+		r.fix = "run as root, or grant capabilities: sudo setcap cap_net_raw,cap_net_admin=eip $(which paqet)"
+		if runtime.GOOS == "windows" {
+			r.fix = "install Npcap from https://npcap.com and run from an elevated prompt"
+			if netCfg.Backend == "windivert" {
+				r.fix = "place WinDivert.dll and WinDivert64.sys next to paqet.exe and run from an elevated prompt"
+			}
+		}
+		return r
+	}
+	h.Close()
+	r.status, r.detail = pass, fmt.Sprintf("opened capture on %s", cfg.Network.Interface.Name)
+	return r
+}
+
+// checkOffloads warns about receive coalescing: GRO/LRO merge consecutive
+// segments before pcap sees them, which glues separate KCP packets together.
+func checkOffloads(cfg *conf.Conf) result {
+	r := result{name: "interface offloads"}
+	if runtime.GOOS != "linux" {
+		r.status, r.detail = skip, "only checked on linux"
+		return r
+	}
+	out, err := exec.Command("ethtool", "-k", cfg.Network.Interface.Name).Output()
+	if err != nil {
+		r.status, r.detail = skip, fmt.Sprintf("ethtool unavailable: %v", err)
+		return r
+	}
+
+	var on []string
+	for _, f := range []struct{ key, name string }{
+		{"generic-receive-offload:", "gro"},
+		{"large-receive-offload:", "lro"},
+	} {
+		for _, line := range strings.Split(string(out), "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, f.key) && strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(line, f.key)), "on") {
+				on = append(on, f.name)
+			}
+		}
+	}
+	if len(on) > 0 {
+		r.status, r.detail = warn, fmt.Sprintf("%s enabled", strings.Join(on, ", "))
+		r.fix = fmt.Sprintf("sudo ethtool -K %s %s off", cfg.Network.Interface.Name, strings.Join(on, " off "))
+		return r
+	}
+	r.status, r.detail = pass, "receive coalescing disabled"
+	return r
+}
+
+// checkFirewall looks for the NOTRACK and RST drop rules from the README.
+func checkFirewall(cfg *conf.Conf) result {
+	r := result{name: "firewall RST rules"}
+	if cfg.Role != "server" {
+		r.status, r.detail = skip, "only required on the server"
+		return r
+	}
+	if runtime.GOOS != "linux" {
+		r.status, r.detail = skip, "only checked on linux"
+		return r
+	}
+	port := cfg.Listen.Addr.Port
+	raw, err := exec.Command("iptables", "-t", "raw", "-S").Output()
+	if err != nil {
+		r.status, r.detail = skip, fmt.Sprintf("iptables unavailable: %v", err)
+		return r
+	}
+	mangle, err := exec.Command("iptables", "-t", "mangle", "-S").Output()
+	if err != nil {
+		r.status, r.detail = skip, fmt.Sprintf("iptables unavailable: %v", err)
+		return r
+	}
+
+	var missing, fixes []string
+	if !hasRule(raw, fmt.Sprintf("--dport %d", port), "NOTRACK") {
+		missing = append(missing, "raw PREROUTING NOTRACK")
+		fixes = append(fixes, fmt.Sprintf("sudo iptables -t raw -A PREROUTING -p tcp --dport %d -j NOTRACK", port))
+	}
+	if !hasRule(raw, fmt.Sprintf("--sport %d", port), "NOTRACK") {
+		missing = append(missing, "raw OUTPUT NOTRACK")
+		fixes = append(fixes, fmt.Sprintf("sudo iptables -t raw -A OUTPUT -p tcp --sport %d -j NOTRACK", port))
+	}
+	if !hasRule(mangle, fmt.Sprintf("--sport %d", port), "RST", "DROP") {
+		missing = append(missing, "mangle OUTPUT RST drop")
+		fixes = append(fixes, fmt.Sprintf("sudo iptables -t mangle -A OUTPUT -p tcp --sport %d --tcp-flags RST RST -j DROP", port))
+	}
+	if len(missing) > 0 {
+		r.status, r.detail = fail, fmt.Sprintf("missing %s", strings.Join(missing, ", "))
+		r.fix = strings.Join(fixes, "\n            ")
+		return r
+	}
+	r.status, r.detail = pass, fmt.Sprintf("NOTRACK and RST drop rules present for port %d", port)
+	return r
+}
+
+func hasRule(rules []byte, parts ...string) bool {
+	for _, line := range strings.Split(string(rules), "\n") {
+		ok := true
+		for _, p := range parts {
+			if !strings.Contains(line, p) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGateway compares the configured router MAC with the ARP entry of
+// the default IPv4 gateway. Without one it shows what discovery will use.
+func checkGateway(cfg *conf.Conf) result {
+	r := result{name: "gateway MAC"}
+	if cfg.Network.IPv4.Addr == nil {
+		r.status, r.detail = skip, "only checked for IPv4"
+		return r
+	}
+	if runtime.GOOS != "linux" {
+		r.status, r.detail = skip, "only checked on linux"
+		return r
+	}
+	gw, err := defaultGateway(cfg.Network.Interface.Name)
+	if err != nil {
+		r.status, r.detail = warn, err.Error()
+		r.fix = "make sure the interface has a default route"
+		return r
+	}
+	mac, err := arpLookup(gw)
+	if err != nil {
+		r.status, r.detail = warn, fmt.Sprintf("gateway %s: %v", gw, err)
+		r.fix = fmt.Sprintf("ping %s once to populate the ARP cache, then re-run", gw)
+		return r
+	}
+	if cfg.Network.IPv4.Router == nil {
+		r.status, r.detail = pass, fmt.Sprintf("gateway %s is at %s, discovered at runtime", gw, mac)
+		return r
+	}
+	if !bytes.Equal(mac, cfg.Network.IPv4.Router) {
+		r.status, r.detail = fail, fmt.Sprintf("gateway %s is at %s, config has %s", gw, mac, cfg.Network.IPv4.Router)
+		r.fix = fmt.Sprintf("set network.ipv4.router_mac to \"%s\"", mac)
+		return r
+	}
+	r.status, r.detail = pass, fmt.Sprintf("gateway %s is at %s", gw, mac)
+	return r
+}
+
+func defaultGateway(iface string) (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[0] != iface || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no default route on %s", iface)
+}
+
+func arpLookup(ip net.IP) (net.HardwareAddr, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || fields[0] != ip.String() {
+			continue
+		}
+		return net.ParseMAC(fields[3])
+	}
+	return nil, fmt.Errorf("not in ARP cache")
+}
+
+// checkMTU makes sure a full KCP segment plus the crafted IP/TCP headers
+// (including the timestamp options) fits in one frame.
+func checkMTU(cfg *conf.Conf) result {
+	r := result{name: "MTU"}
+	overhead := 20 + 32
+	if cfg.Network.IPv6.Addr != nil {
+		overhead = 40 + 32
+	}
+	mtu := cfg.Transport.KCP.MTU
+	ifMTU := cfg.Network.Interface.MTU
+	if mtu+overhead > ifMTU {
+		r.status, r.detail = fail, fmt.Sprintf("KCP MTU %d + %d header bytes exceeds interface MTU %d", mtu, overhead, ifMTU)
+		r.fix = fmt.Sprintf("set transport.kcp.mtu to %d or lower", ifMTU-overhead)
+		return r
+	}
+	r.status, r.detail = pass, fmt.Sprintf("KCP MTU %d fits interface MTU %d (%d bytes spare)", mtu, ifMTU, ifMTU-overhead-mtu)
+	return r
+}
@@ -0,0 +1,116 @@
+package doctor
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"paqet/cmd/version"
+	"paqet/internal/conf"
+	"paqet/internal/protocol"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	confPath string
+	noColor  bool
+)
+
+func init() {
+	Cmd.Flags().StringVarP(&confPath, "config", "c", "config.yaml", "Path to the configuration file.")
+	Cmd.Flags().BoolVar(&noColor, "no-color", false, "Disable colored output.")
+}
+
+var Cmd = &cobra.Command{
+	Use:     "doctor",
+	Aliases: []string{"diag"},
+	Short:   "Checks the raw packet path and reports problems with suggested fixes.",
+	Long:    `The 'doctor' command runs the setup checklist for the configured role: interface, pcap permissions, interface offloads, firewall rules, gateway MAC, MTU and a packet injection test. On the client it then traces the path towards the server with growing TTLs, dials the server for a handshake and sends a full-size segment to check the MTU end to end.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := conf.LoadFromFile(confPath)
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		protocol.Software = version.Version
+
+		results := []result{
+			checkInterface(cfg),
+			checkPcap(cfg),
+			checkOffloads(cfg),
+			checkFirewall(cfg),
+			checkGateway(cfg),
+			checkMTU(cfg),
+			checkInjection(cfg),
+			checkTrace(cfg),
+		}
+		results = append(results, checkTunnel(cfg)...)
+
+		failed := 0
+		for _, r := range results {
+			r.print()
+			if r.status == fail {
+				failed++
+			}
+		}
+		fmt.Println()
+		if failed > 0 {
+			fmt.Printf("%d check(s) failed.\n", failed)
+			os.Exit(1)
+		}
+		fmt.Println("No blocking problems found.")
+	},
+}
+
+type status int
+
+const (
+	pass status = iota
+	warn
+	fail
+	skip
+)
+
+func (s status) String() string {
+	switch s {
+	case pass:
+		return "PASS"
+	case warn:
+		return "WARN"
+	case fail:
+		return "FAIL"
+	default:
+		return "SKIP"
+	}
+}
+
+func (s status) color() string {
+	switch s {
+	case pass:
+		return "\033[32m"
+	case warn:
+		return "\033[33m"
+	case fail:
+		return "\033[31m"
+	default:
+		return "\033[90m"
+	}
+}
+
+type result struct {
+	name   string
+	status status
+	detail string
+	fix    string
+}
+
+func (r result) print() {
+	tag := r.status.String()
+	if !noColor {
+		tag = r.status.color() + tag + "\033[0m"
+	}
+	fmt.Printf("[%s] %s: %s\n", tag, r.name, r.detail)
+	if r.fix != "" && (r.status == warn || r.status == fail) {
+		fmt.Printf("       fix: %s\n", r.fix)
+	}
+}
@@ -0,0 +1,80 @@
+//go:build !nopcap
+
+package doctor
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"time"
+
+	"paqet/internal/conf"
+	"paqet/internal/socket"
+
+	"github.com/gopacket/gopacket/pcap"
+)
+
+const marker = "paqet-doctor"
+
+// checkInjection sends one crafted packet to a documentation address and
+// confirms it is seen leaving the interface.
+func checkInjection(cfg *conf.Conf) result {
+	r := result{name: "packet injection"}
+	netCfg := cfg.Network
+	if netCfg.Port == 0 {
+		netCfg.Port = 32768 + rand.Intn(32768)
+	}
+	if runtime.GOOS == "windows" && netCfg.GUID == "" {
+		r.status, r.detail = skip, "needs an Npcap device guid to watch the interface"
+		return r
+	}
+	dst := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9}
+	if netCfg.IPv4.Addr == nil {
+		dst.IP = net.ParseIP("2001:db8::1")
+	}
+
+	capture, err := pcap.OpenLive(ifaceName(&netCfg), 512, false, 200*time.Millisecond)
+	if err != nil {
+		r.status, r.detail = fail, fmt.Sprintf("failed to open capture: %v", err)
+		r.fix = "see pcap permissions above"
+		return r
+	}
+	defer capture.Close()
+	if runtime.GOOS != "windows" {
+		capture.SetDirection(pcap.DirectionOut)
+	}
+	if err := capture.SetBPFFilter(fmt.Sprintf("tcp and src port %d and dst port %d", netCfg.Port, dst.Port)); err != nil {
+		r.status, r.detail = fail, fmt.Sprintf("failed to set BPF filter: %v", err)
+		return r
+	}
+
+	sh, err := socket.NewSendHandle(&netCfg)
+	if err != nil {
+		r.status, r.detail = fail, err.Error()
+		r.fix = "see pcap permissions above"
+		return r
+	}
+	defer sh.Close()
+	if err := sh.Write([]byte(marker), dst); err != nil {
+		r.status, r.detail = fail, fmt.Sprintf("failed to inject packet: %v", err)
+		r.fix = "check the interface name and that it is up"
+		return r
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		data, _, err := capture.ReadPacketData()
+		if err != nil {
+			continue
+		}
+		if bytes.Contains(data, []byte(marker)) {
+			r.status, r.detail = pass, fmt.Sprintf("injected packet seen on %s", cfg.Network.Interface.Name)
+			return r
+		}
+	}
+	r.status, r.detail = fail, "injected packet was not seen on the interface"
+	r.fix = "check that the interface is the one carrying the configured IP address"
+	return r
+}
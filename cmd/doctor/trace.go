@@ -0,0 +1,123 @@
+//go:build !nopcap
+
+package doctor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+
+	"paqet/internal/conf"
+	"paqet/internal/socket"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+)
+
+const maxHops = 20
+
+// checkTrace sends tunnel-shaped TCP packets towards the server with a
+// growing TTL and lists the routers that report them expired, to show
+// how far along the path they get. The server itself never answers, so
+// the trace ends in silence either way.
+func checkTrace(cfg *conf.Conf) result {
+	r := result{name: "path trace"}
+	if cfg.Role != "client" {
+		r.status, r.detail = skip, "run on the client"
+		return r
+	}
+	netCfg := cfg.Network
+	netCfg.Port = 32768 + rand.Intn(32768)
+	if runtime.GOOS == "windows" && netCfg.GUID == "" {
+		r.status, r.detail = skip, "needs an Npcap device guid to watch the interface"
+		return r
+	}
+
+	capture, err := pcap.OpenLive(ifaceName(&netCfg), 512, false, 100*time.Millisecond)
+	if err != nil {
+		r.status, r.detail = fail, fmt.Sprintf("failed to open capture: %v", err)
+		r.fix = "see pcap permissions above"
+		return r
+	}
+	defer capture.Close()
+	if err := capture.SetBPFFilter("icmp or icmp6"); err != nil {
+		r.status, r.detail = fail, fmt.Sprintf("failed to set BPF filter: %v", err)
+		return r
+	}
+	sh, err := socket.NewSendHandle(&netCfg)
+	if err != nil {
+		r.status, r.detail = fail, err.Error()
+		r.fix = "see pcap permissions above"
+		return r
+	}
+	defer sh.Close()
+
+	var hops []string
+	answered, silent := 0, 0
+	for ttl := 1; ttl <= maxHops && silent < 3; ttl++ {
+		sh.SetTTL(ttl)
+		if err := sh.Write([]byte(marker), cfg.Server.Addr); err != nil {
+			r.status, r.detail = fail, fmt.Sprintf("failed to send probe: %v", err)
+			return r
+		}
+		from := expiredFrom(capture, uint16(netCfg.Port), time.Second)
+		if from == nil {
+			hops = append(hops, "*")
+			silent++
+			continue
+		}
+		hops = append(hops, from.String())
+		answered++
+		silent = 0
+	}
+	// Trailing silence is the server or a filter in front of it.
+	for len(hops) > 0 && hops[len(hops)-1] == "*" {
+		hops = hops[:len(hops)-1]
+	}
+	if answered == 0 {
+		r.status, r.detail = warn, "no router on the path reported the probes; nothing to learn from the trace"
+		return r
+	}
+	for i := range hops {
+		hops[i] = fmt.Sprintf("%d %s", i+1, hops[i])
+	}
+	r.status, r.detail = pass, fmt.Sprintf("%s, then silent towards %s", strings.Join(hops, ", "), cfg.Server.Addr.IP)
+	return r
+}
+
+// expiredFrom waits for an ICMP time exceeded quoting a packet from
+// port and returns the router that sent it.
+func expiredFrom(capture *pcap.Handle, port uint16, wait time.Duration) net.IP {
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		data, _, err := capture.ReadPacketData()
+		if err != nil {
+			continue
+		}
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.NoCopy)
+		if icmp, ok := pkt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok && icmp.TypeCode.Type() == layers.ICMPv4TypeTimeExceeded {
+			// The payload quotes the IPv4 header and the first TCP bytes.
+			q := icmp.Payload
+			if len(q) < 20 {
+				continue
+			}
+			ihl := int(q[0]&0x0f) * 4
+			if len(q) >= ihl+2 && binary.BigEndian.Uint16(q[ihl:]) == port {
+				return pkt.NetworkLayer().(*layers.IPv4).SrcIP
+			}
+		}
+		if icmp, ok := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok && icmp.TypeCode.Type() == layers.ICMPv6TypeTimeExceeded {
+			// 4 unused bytes, then the quoted IPv6 header and TCP bytes.
+			q := icmp.Payload
+			if len(q) >= 4+40+2 && binary.BigEndian.Uint16(q[44:]) == port {
+				return pkt.NetworkLayer().(*layers.IPv6).SrcIP
+			}
+		}
+	}
+	return nil
+}
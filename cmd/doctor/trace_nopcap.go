@@ -0,0 +1,9 @@
+//go:build nopcap
+
+package doctor
+
+import "paqet/internal/conf"
+
+func checkTrace(cfg *conf.Conf) result {
+	return result{name: "path trace", status: skip, detail: "needs pcap, which is not in this build"}
+}
@@ -0,0 +1,85 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"paqet/internal/conf"
+	"paqet/internal/protocol"
+	"paqet/internal/socket"
+	"paqet/internal/tnet/kcp"
+)
+
+// checkTunnel dials the server the way the client does and exchanges a
+// hello, then sends one full-size segment to confirm the configured MTU
+// gets through.
+func checkTunnel(cfg *conf.Conf) []result {
+	hs := result{name: "tunnel handshake"}
+	mtu := result{name: "path MTU"}
+	if cfg.Role != "client" {
+		hs.status, hs.detail = skip, "run on the client"
+		mtu.status, mtu.detail = skip, "run on the client"
+		return []result{hs, mtu}
+	}
+
+	netCfg := cfg.Network
+	netCfg.Port = 0 // a port of its own, next to a running client
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pConn, err := socket.New(ctx, &netCfg)
+	if err != nil {
+		hs.status, hs.detail = fail, fmt.Sprintf("failed to open packet conn: %v", err)
+		hs.fix = "see pcap permissions above"
+		mtu.status, mtu.detail = skip, "needs the handshake"
+		return []result{hs, mtu}
+	}
+	conn, err := kcp.Dial(cfg.Server.Addr, cfg.Transport.KCP, pConn)
+	if err != nil {
+		pConn.Close()
+		hs.status, hs.detail = fail, err.Error()
+		mtu.status, mtu.detail = skip, "needs the handshake"
+		return []result{hs, mtu}
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	version, err := hello(conn.(*kcp.Conn))
+	if err != nil {
+		hs.status, hs.detail = fail, fmt.Sprintf("no answer from %s: %v", cfg.Server.Addr, err)
+		hs.fix = "check that the server runs, transport.kcp key and block match it, its firewall rules are in place and its port is not blocked on the path (see trace above)"
+		mtu.status, mtu.detail = skip, "needs the handshake"
+		return []result{hs, mtu}
+	}
+	hs.status, hs.detail = pass, fmt.Sprintf("server %s runs paqet %s, answered in %v", cfg.Server.Addr, version, time.Since(start).Round(time.Millisecond))
+
+	size := cfg.Transport.KCP.MTU
+	if err := conn.(*kcp.Conn).Probe(size); err != nil {
+		mtu.status, mtu.detail = fail, fmt.Sprintf("a %d byte segment did not get through: %v", size, err)
+		mtu.fix = "lower transport.kcp.mtu, or set transport.kcp.pmtud: true to find the largest size that works"
+		return []result{hs, mtu}
+	}
+	mtu.status, mtu.detail = pass, fmt.Sprintf("%d byte segments get through", size)
+	return []result{hs, mtu}
+}
+
+func hello(conn *kcp.Conn) (string, error) {
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return "", err
+	}
+	defer strm.Close()
+	strm.SetDeadline(time.Now().Add(5 * time.Second))
+	p := protocol.Proto{Type: protocol.PHELLO, Version: protocol.Software, Features: protocol.Features}
+	if err := p.Write(strm); err != nil {
+		return "", err
+	}
+	var reply protocol.Proto
+	if err := reply.Read(strm); err != nil {
+		return "", err
+	}
+	if reply.Type != protocol.PHELLO {
+		return "", fmt.Errorf("unexpected reply type %d", reply.Type)
+	}
+	return reply.Version, nil
+}
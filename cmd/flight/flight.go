@@ -0,0 +1,25 @@
+package flight
+
+import (
+	"bufio"
+	"log"
+	"os"
+
+	"paqet/internal/pkg/flight"
+
+	"github.com/spf13/cobra"
+)
+
+var Cmd = &cobra.Command{
+	Use:   "flight <file>",
+	Short: "Prints the packet log of a file-backed flight recorder.",
+	Long:  `Decodes the ring written by flight.path, oldest packet first. Works on the file of a running or crashed process.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		w := bufio.NewWriter(os.Stdout)
+		defer w.Flush()
+		if err := flight.DumpFile(args[0], w); err != nil {
+			log.Fatalf("Failed to read flight recorder: %v", err)
+		}
+	},
+}
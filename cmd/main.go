@@ -2,11 +2,18 @@ package main
 
 import (
 	"os"
+	"paqet/cmd/bench"
+	"paqet/cmd/ctl"
+	"paqet/cmd/doctor"
 	"paqet/cmd/dump"
+	"paqet/cmd/flight"
 	"paqet/cmd/iface"
 	"paqet/cmd/ping"
 	"paqet/cmd/run"
 	"paqet/cmd/secret"
+	"paqet/cmd/service"
+	"paqet/cmd/testdpi"
+	"paqet/cmd/validate"
 	"paqet/cmd/version"
 	"paqet/internal/flog"
 
@@ -22,9 +29,16 @@ var rootCmd = &cobra.Command{
 func main() {
 	rootCmd.AddCommand(run.Cmd)
 	rootCmd.AddCommand(dump.Cmd)
+	rootCmd.AddCommand(doctor.Cmd)
+	rootCmd.AddCommand(flight.Cmd)
 	rootCmd.AddCommand(ping.Cmd)
 	rootCmd.AddCommand(secret.Cmd)
 	rootCmd.AddCommand(iface.Cmd)
+	rootCmd.AddCommand(ctl.Cmd)
+	rootCmd.AddCommand(bench.Cmd)
+	rootCmd.AddCommand(testdpi.Cmd)
+	rootCmd.AddCommand(service.Cmd)
+	rootCmd.AddCommand(validate.Cmd)
 	rootCmd.AddCommand(version.Cmd)
 
 	if err := rootCmd.Execute(); err != nil {
@@ -0,0 +1,20 @@
+package run
+
+import (
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/admin"
+)
+
+// serveAdmin starts the control endpoint; the role installs its
+// connections once it exists.
+func serveAdmin(cfg *conf.Conf) {
+	if cfg.Admin.Listen == "" {
+		return
+	}
+	admin.SetConfig(func() ([]byte, error) { return effective.Load().Redacted() })
+	if err := admin.Serve(cfg.Admin.Listen); err != nil {
+		flog.Fatalf("Failed to start admin endpoint: %v", err)
+	}
+	flog.Infof("Serving admin endpoint on %s", cfg.Admin.Listen)
+}
@@ -7,14 +7,15 @@ import (
 	"paqet/internal/client"
 	"paqet/internal/conf"
 	"paqet/internal/flog"
-	"paqet/internal/forward"
-	"paqet/internal/socks"
+	"paqet/internal/pkg/admin"
+	"paqet/internal/pkg/debug"
+	"paqet/internal/store"
 	"syscall"
 )
 
-func startClient(cfg *conf.Conf) {
+func startClient(ctx context.Context, cfg *conf.Conf) {
 	flog.Infof("Starting client...")
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
@@ -24,32 +25,52 @@ func startClient(cfg *conf.Conf) {
 		cancel()
 	}()
 
-	client, err := client.New(cfg)
+	st, err := store.Open(&cfg.Store)
+	if err != nil {
+		flog.Fatalf("Failed to open store: %v", err)
+	}
+	defer st.Close()
+
+	client, err := client.New(cfg, st)
 	if err != nil {
 		flog.Fatalf("Failed to initialize client: %v", err)
 	}
+	if cfg.Metrics.Listen != "" {
+		clientMetrics(client)
+	}
+	admin.SetConns(client.Conns, client.CloseConn)
+	debug.Register("conns", func() any { return client.KCPStats() })
 	if err := client.Start(ctx); err != nil {
-		flog.Infof("Client encountered an error: %v", err)
+		flog.Fatalf("Failed to start client: %v", err)
+	}
+	if !client.WaitReady(ctx) && ctx.Err() == nil {
+		flog.Warnf("No connection to %s answered within %ds; starting listeners anyway", cfg.Server.Addr, cfg.Transport.Warmup)
 	}
 
-	for _, ss := range cfg.SOCKS5 {
-		s, err := socks.New(client)
-		if err != nil {
-			flog.Fatalf("Failed to initialize SOCKS5: %v", err)
-		}
-		if err := s.Start(ctx, ss); err != nil {
-			flog.Fatalf("SOCKS5 encountered an error: %v", err)
-		}
+	ls := newListeners(ctx, client)
+	if err := ls.apply(cfg); err != nil {
+		flog.Fatalf("%v", err)
 	}
-	for _, ff := range cfg.Forward {
-		f, err := forward.New(client, ff.Listen.String(), ff.Target.String())
-		if err != nil {
-			flog.Fatalf("Failed to initialize Forward: %v", err)
-		}
-		if err := f.Start(ctx, ff.Protocol); err != nil {
-			flog.Infof("Forward encountered an error: %v", err)
+	admin.SetForwards(ls.forwards, ls.add, ls.remove)
+
+	r := &reloader{path: confPath, hot: func(section string, cur, next *conf.Conf) bool {
+		switch section {
+		case "socks5", "forward", "dns", "route":
+			if err := ls.apply(next); err != nil {
+				flog.Errorf("failed to apply reloaded %s rules: %v", section, err)
+			}
+		case "network":
+			if !tcpOnly(&cur.Network, &next.Network) {
+				return false
+			}
+			client.SetTCPF(&next.Network.TCP)
+		default:
+			return false
 		}
-	}
+		return true
+	}}
+	watchReload(r)
+	admin.SetReload(r.run)
 
 	<-ctx.Done()
 }
@@ -0,0 +1,37 @@
+package run
+
+import (
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/capture"
+	"paqet/internal/pkg/debug"
+)
+
+// serveDebug starts the pprof endpoint with the snapshots both roles
+// share; the role registers its connections once it exists.
+func serveDebug(cfg *conf.Debug) {
+	if cfg.PprofListen == "" {
+		return
+	}
+	debug.Register("buffers", func() any {
+		return map[string]any{"classes": buffer.Stats(), "oversize": buffer.Oversize(), "hibernated": buffer.Hibernated(), "spliced": buffer.Spliced()}
+	})
+	if err := debug.Serve(cfg.PprofListen); err != nil {
+		flog.Fatalf("Failed to start debug endpoint: %v", err)
+	}
+	flog.Infof("Serving pprof on http://%s/debug/pprof/", cfg.PprofListen)
+}
+
+// startCapture mirrors the tunnel packets into cfg.CaptureFile, if set.
+func startCapture(cfg *conf.Debug) {
+	if cfg.CaptureFile == "" {
+		return
+	}
+	w, err := capture.Open(cfg.CaptureFile, int64(cfg.CaptureSize)<<20, cfg.CaptureFiles, cfg.CaptureMarkers)
+	if err != nil {
+		flog.Fatalf("Failed to start packet capture: %v", err)
+	}
+	capture.SetDefault(w)
+	flog.Warnf("Capturing tunnel packets to %s; the file holds traffic metadata, share it with care", cfg.CaptureFile)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package run
+
+import "paqet/internal/pkg/flight"
+
+// watchFlight is a no-op without SIGUSR1; use a file-backed recorder
+// and `paqet flight` instead.
+func watchFlight(rec *flight.Recorder) {}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package run
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/flight"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// watchFlight dumps the flight recorder to a file in the temp directory
+// on SIGUSR1.
+func watchFlight(rec *flight.Recorder) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	go func() {
+		for range sig {
+			path := filepath.Join(os.TempDir(), fmt.Sprintf("paqet-flight-%d-%d.txt", os.Getpid(), time.Now().Unix()))
+			f, err := os.Create(path)
+			if err != nil {
+				flog.Errorf("failed to create flight recorder dump: %v", err)
+				continue
+			}
+			err = rec.Dump(f)
+			f.Close()
+			if err != nil {
+				flog.Errorf("failed to write flight recorder dump %s: %v", path, err)
+				continue
+			}
+			flog.Infof("flight recorder dumped to %s", path)
+		}
+	}()
+}
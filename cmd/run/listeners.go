@@ -0,0 +1,304 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/dns"
+	"paqet/internal/flog"
+	"paqet/internal/forward"
+	"paqet/internal/pkg/admin"
+	"paqet/internal/pkg/class"
+	"paqet/internal/socks"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// listeners runs the SOCKS5, forward and DNS rules of a client, keyed by
+// their settings, so a reload stops and starts only the rules that
+// changed. Connections of a stopped rule are closed with it.
+//
+// Forward rules added and removed through the admin endpoint are kept on
+// top of the config file's across reloads, until a reload changes the
+// file's forward rules: removed ones then come back, and a file rule on
+// the port of an added one replaces it.
+type listeners struct {
+	ctx    context.Context
+	client *client.Client
+
+	mu       sync.Mutex
+	cfg      *conf.Conf
+	added    map[string]conf.Forward // by forwardID
+	removed  map[string]bool         // file rules, by forwardID
+	running  map[string]*listener
+	draining map[*listener]bool
+}
+
+type listener struct {
+	name   string
+	fwd    *conf.Forward // forward rules only
+	source string
+	cancel context.CancelFunc
+	run    runner
+}
+
+// runner is a started SOCKS5, forward or DNS server.
+type runner interface{ Wait() }
+
+type rule struct {
+	name   string
+	fwd    *conf.Forward
+	source string
+	start  func(ctx context.Context) (runner, error)
+}
+
+// forwardID names a forward rule to the admin endpoint. TCP and UDP
+// rules may listen on the same port.
+func forwardID(protocol, listen string) string {
+	return protocol + " " + listen
+}
+
+func newListeners(ctx context.Context, c *client.Client) *listeners {
+	return &listeners{
+		ctx:      ctx,
+		client:   c,
+		added:    make(map[string]conf.Forward),
+		removed:  make(map[string]bool),
+		running:  make(map[string]*listener),
+		draining: make(map[*listener]bool),
+	}
+}
+
+// apply makes the running rules those of cfg, with the changes made
+// through the admin endpoint.
+func (l *listeners) apply(cfg *conf.Conf) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg != nil && slices.Contains(conf.Changed(l.cfg, cfg), "forward") {
+		clear(l.removed)
+		for _, ff := range cfg.Forward {
+			id := forwardID(ff.Protocol, ff.Listen_)
+			if _, ok := l.added[id]; ok {
+				flog.Infof("%s forward %s is in the config file now, replacing the one added through the admin endpoint", ff.Protocol, ff.Listen_)
+				delete(l.added, id)
+			}
+		}
+	}
+	l.cfg = cfg
+	return l.reconcile()
+}
+
+// reconcile starts and stops rules until the running ones are those
+// wanted. The caller holds mu.
+func (l *listeners) reconcile() error {
+	cfg := l.cfg
+	want := make(map[string]rule)
+	for _, ss := range cfg.SOCKS5 {
+		key := fmt.Sprintf("socks5 %s %s %s %s %s %s %t %s %d %s", ss.Listen_, ss.Username, ss.Password, ss.Priority, ss.Resolve, ss.Resolver, ss.Cone, ss.BindIP, ss.Fwmark, cfg.Route.Key())
+		want[key] = rule{name: "SOCKS5 " + ss.Listen_, start: func(ctx context.Context) (runner, error) {
+			s, err := socks.New(l.client)
+			if err != nil {
+				return nil, fmt.Errorf("failed to initialize SOCKS5: %v", err)
+			}
+			if ss.Resolve == "client" {
+				s.ResolveOnClient(ss.Resolver)
+			}
+			if cfg.Route.Enabled() {
+				s.Route(&cfg.Route)
+			}
+			if err := s.Start(ctx, ss); err != nil {
+				return nil, fmt.Errorf("SOCKS5 encountered an error: %v", err)
+			}
+			return s, nil
+		}}
+	}
+	for _, ff := range cfg.Forward {
+		if !l.removed[forwardID(ff.Protocol, ff.Listen_)] {
+			l.forwardRule(want, ff, "config")
+		}
+	}
+	for _, ff := range l.added {
+		l.forwardRule(want, ff, "admin")
+	}
+
+	if d := cfg.DNS; d.Listen_ != "" {
+		key := fmt.Sprintf("dns %s %s %d", d.Listen_, d.Upstream, d.Cache)
+		want[key] = rule{name: fmt.Sprintf("DNS %s -> %s", d.Listen_, d.Upstream), start: func(ctx context.Context) (runner, error) {
+			s := dns.New(l.client, d.Listen.String(), d.Upstream, d.Cache)
+			if err := s.Start(ctx); err != nil {
+				return nil, fmt.Errorf("DNS encountered an error: %v", err)
+			}
+			return s, nil
+		}}
+	}
+
+	// Stop first, so a changed rule can bind its port again.
+	for key, r := range l.running {
+		if _, ok := want[key]; !ok {
+			r.cancel()
+			r.run.Wait()
+			delete(l.running, key)
+			flog.Infof("stopped %s", r.name)
+		}
+	}
+	for key, r := range want {
+		if l.running[key] != nil {
+			continue
+		}
+		ctx, cancel := context.WithCancel(l.ctx)
+		run, err := r.start(ctx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		l.running[key] = &listener{name: r.name, fwd: r.fwd, source: r.source, cancel: cancel, run: run}
+	}
+	return nil
+}
+
+// forwardRule adds forward rule ff to want.
+func (l *listeners) forwardRule(want map[string]rule, ff conf.Forward, source string) {
+	key := fmt.Sprintf("forward %s %s %s %s %d %s %s %t %s %d %s", ff.Listen_, ff.Target_, ff.Protocol, ff.Priority, ff.DSCP, ff.Resolve, ff.Resolver, ff.Proxy, ff.BindIP, ff.Fwmark, source)
+	want[key] = rule{name: fmt.Sprintf("%s forward %s -> %s", ff.Protocol, ff.Listen_, ff.Target_), fwd: &ff, source: source, start: func(ctx context.Context) (runner, error) {
+		f, err := forward.New(l.client, ff.ListenAddr(), ff.Target.String(), class.Parse(ff.Priority), ff.DSCP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Forward: %v", err)
+		}
+		if ff.Resolve == "client" {
+			f.ResolveOnClient(ff.Resolver)
+		}
+		if ff.Proxy {
+			f.AcceptProxy()
+		}
+		if ff.Bind != nil || ff.Fwmark != 0 {
+			f.Egress(ff.Bind, ff.Fwmark)
+		}
+		if err := f.Start(ctx, ff.Protocol); err != nil {
+			return nil, fmt.Errorf("Forward encountered an error: %v", err)
+		}
+		return f, nil
+	}}
+}
+
+// forwards lists the forward rules, draining ones included.
+func (l *listeners) forwards() []admin.Forward {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var list []admin.Forward
+	add := func(r *listener, draining bool) {
+		if r.fwd == nil {
+			return
+		}
+		f := admin.Forward{Listen: r.fwd.Listen_, Target: r.fwd.Target_, Protocol: r.fwd.Protocol, Priority: r.fwd.Priority, Source: r.source, Draining: draining}
+		if fw, ok := r.run.(*forward.Forward); ok {
+			f.Active = fw.Active()
+		}
+		list = append(list, f)
+	}
+	for _, r := range l.running {
+		add(r, false)
+	}
+	for r := range l.draining {
+		add(r, true)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Listen != list[j].Listen {
+			return list[i].Listen < list[j].Listen
+		}
+		return list[i].Protocol < list[j].Protocol
+	})
+	return list
+}
+
+// add starts a forward rule from the admin endpoint. A listen port range
+// adds one rule per port.
+func (l *listeners) add(f admin.Forward) error {
+	rules, err := conf.ParseForward(conf.Forward{Listen_: f.Listen, Target_: f.Target, Protocol: f.Protocol, Priority: f.Priority})
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, ff := range rules {
+		if l.find(forwardID(ff.Protocol, ff.Listen_)) != "" {
+			return fmt.Errorf("a %s forward on %s exists already", ff.Protocol, ff.Listen_)
+		}
+	}
+	for _, ff := range rules {
+		l.added[forwardID(ff.Protocol, ff.Listen_)] = ff
+	}
+	if err := l.reconcile(); err != nil {
+		for _, ff := range rules {
+			delete(l.added, forwardID(ff.Protocol, ff.Listen_))
+		}
+		l.reconcile()
+		return err
+	}
+	return nil
+}
+
+// remove stops the forward rule listening on listen at once and closes
+// its connections after drain, unless they finished by then.
+func (l *listeners) remove(protocol, listen string, drain time.Duration) error {
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	id := forwardID(protocol, listen)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := l.find(id)
+	if key == "" {
+		return fmt.Errorf("no %s forward on %s", protocol, listen)
+	}
+	r := l.running[key]
+	delete(l.running, key)
+	if r.source == "admin" {
+		delete(l.added, id)
+	} else {
+		l.removed[id] = true
+	}
+
+	f, ok := r.run.(*forward.Forward)
+	if !ok || drain == 0 {
+		r.cancel()
+		r.run.Wait()
+		flog.Infof("stopped %s", r.name)
+		return nil
+	}
+	f.Stop()
+	l.draining[r] = true
+	flog.Infof("draining %s for up to %v", r.name, drain)
+	go func() {
+		done := make(chan struct{})
+		go func() {
+			f.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(drain):
+			flog.Infof("closing %d connections left on %s", f.Active(), r.name)
+		}
+		r.cancel()
+		<-done
+		l.mu.Lock()
+		delete(l.draining, r)
+		l.mu.Unlock()
+		flog.Infof("stopped %s", r.name)
+	}()
+	return nil
+}
+
+// find returns the key of the running forward rule id, or "". The
+// caller holds mu.
+func (l *listeners) find(id string) string {
+	for key, r := range l.running {
+		if r.fwd != nil && forwardID(r.fwd.Protocol, r.fwd.Listen_) == id {
+			return key
+		}
+	}
+	return ""
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package run
+
+// watchLogLevel is a no-op without SIGUSR2; use `paqet ctl log debug`
+// instead.
+func watchLogLevel() {}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package run
+
+import (
+	"os"
+	"os/signal"
+	"paqet/internal/flog"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchLogLevel toggles debug logging on SIGUSR2. Turned on, it reverts
+// by itself after log.debug_for; a second signal reverts it at once.
+func watchLogLevel() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2)
+	go func() {
+		for range sig {
+			if level, _, ok := flog.Reverting(); ok {
+				flog.SetLevel(int(level))
+				flog.Infof("log level reverted to %s", strings.ToLower(level.String()))
+				continue
+			}
+			d := time.Duration(effective.Load().Log.DebugFor) * time.Second
+			flog.SetLevelFor(int(flog.Debug), d)
+			flog.Infof("debug logging on for %v; send SIGUSR2 again to revert", d)
+		}
+	}()
+}
@@ -0,0 +1,136 @@
+package run
+
+import (
+	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/metrics"
+	"paqet/internal/protocol"
+	"paqet/internal/server"
+	"paqet/internal/socket"
+	"strconv"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// serveMetrics starts the metrics listener with what both roles share;
+// the role adds its own metrics once it exists.
+func serveMetrics(cfg *conf.Metrics) {
+	if cfg.Listen == "" {
+		return
+	}
+	snmp := func() *kcp.Snmp { return kcp.DefaultSnmp.Copy() }
+	metrics.Labeled("paqet_bytes_total", "Bytes of KCP packets on the wire.", "counter", func() []metrics.Sample {
+		s := snmp()
+		return []metrics.Sample{
+			{Labels: metrics.Label("direction", "in"), Value: float64(s.InBytes)},
+			{Labels: metrics.Label("direction", "out"), Value: float64(s.OutBytes)},
+		}
+	})
+	metrics.Labeled("paqet_kcp_retransmitted_segments_total", "KCP segments sent again, by trigger.", "counter", func() []metrics.Sample {
+		s := snmp()
+		return []metrics.Sample{
+			{Labels: metrics.Label("kind", "timeout"), Value: float64(s.LostSegs)},
+			{Labels: metrics.Label("kind", "fast"), Value: float64(s.FastRetransSegs)},
+			{Labels: metrics.Label("kind", "early"), Value: float64(s.EarlyRetransSegs)},
+		}
+	})
+	metrics.Labeled("paqet_send_errors_total", "Packets the capture backend failed to send, by class.", "counter", func() []metrics.Sample {
+		errs, _ := socket.SendErrors()
+		var samples []metrics.Sample
+		for class, n := range errs {
+			samples = append(samples, metrics.Sample{Labels: metrics.Label("class", class), Value: float64(n)})
+		}
+		return samples
+	})
+	metrics.Labeled("paqet_tcpf_evictions_total", "Per-client TCP flag entries dropped, by reason.", "counter", func() []metrics.Sample {
+		expired, evicted := socket.TCPFEvictions()
+		return []metrics.Sample{
+			{Labels: metrics.Label("reason", "expired"), Value: float64(expired)},
+			{Labels: metrics.Label("reason", "capacity"), Value: float64(evicted)},
+		}
+	})
+
+	metrics.Counter("paqet_decoy_acks_total", "Pure ACKs sent to keep idle flows alive in middleboxes.", func() float64 { return float64(socket.DecoyAcks()) })
+
+	classes := func(value func(buffer.PoolStats) int64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, st := range buffer.Stats() {
+				samples = append(samples, metrics.Sample{Labels: metrics.Label("size", strconv.Itoa(st.Size)), Value: float64(value(st))})
+			}
+			return samples
+		}
+	}
+	metrics.Labeled("paqet_buffers_in_use", "Pooled buffers held, by size class.", "gauge", classes(func(st buffer.PoolStats) int64 { return st.InUse }))
+	metrics.Labeled("paqet_buffer_gets_total", "Buffers taken from the pool, by size class.", "counter", classes(func(st buffer.PoolStats) int64 { return st.Gets }))
+	metrics.Labeled("paqet_buffer_misses_total", "Buffers allocated because the pool was empty, by size class.", "counter", classes(func(st buffer.PoolStats) int64 { return st.Allocated }))
+	metrics.Counter("paqet_buffer_oversize_total", "Buffers larger than every size class, allocated unpooled.", func() float64 { return float64(buffer.Oversize()) })
+	metrics.Gauge("paqet_hibernated_relays", "TCP relay directions waiting on an idle source without a copy buffer.", func() float64 { return float64(buffer.Hibernated()) })
+	metrics.Gauge("paqet_spliced_relays", "TCP relay directions copied by the kernel between two sockets.", func() float64 { return float64(buffer.Spliced()) })
+
+	if err := metrics.Serve(cfg.Listen); err != nil {
+		flog.Fatalf("Failed to start metrics listener: %v", err)
+	}
+	flog.Infof("Serving metrics on http://%s/metrics", cfg.Listen)
+}
+
+func clientMetrics(c *client.Client) {
+	metrics.Gauge("paqet_connections", "Client connections that are up.", func() float64 { return float64(c.Stats().Conns) })
+	metrics.Gauge("paqet_streams", "Streams open across the connections.", func() float64 { return float64(c.Stats().Streams) })
+	metrics.Labeled("paqet_rtt_seconds", "Mean smoothed round trip time of the health pings, a stream through smux and KCP; needs transport.health.interval.", "gauge", func() []metrics.Sample {
+		if rtt := c.Stats().PingRTT; rtt > 0 {
+			return []metrics.Sample{{Value: rtt.Seconds()}}
+		}
+		return nil
+	})
+	metrics.Gauge("paqet_kcp_rtt_seconds", "Mean smoothed KCP round trip time of the connections.", func() float64 { return c.Stats().RTT.Seconds() })
+	metrics.Counter("paqet_stream_open_failures_total", "Streams that could not be opened.", func() float64 { return float64(c.Stats().OpenFailures) })
+	metrics.Counter("paqet_reconnects_total", "Connections replaced after failed health checks.", func() float64 { return float64(c.Stats().Redials) })
+	metrics.Counter("paqet_rotations_total", "Connections replaced on the transport.rotate interval.", func() float64 { return float64(c.Stats().Rotations) })
+	metrics.Counter("paqet_streams_rejected_total", "New streams turned away by transport.admission.", func() float64 { return float64(c.Stats().Rejected) })
+	metrics.Gauge("paqet_streams_waiting", "New streams waiting for transport.admission to let them open.", func() float64 { return float64(c.Stats().Waiting) })
+}
+
+func serverMetrics(s *server.Server) {
+	metrics.Gauge("paqet_connections", "Client sessions connected.", func() float64 { return float64(s.Stats().Conns) })
+	metrics.Gauge("paqet_streams", "Streams being handled.", func() float64 { return float64(s.Stats().Streams) })
+	metrics.Counter("paqet_idle_closed_total", "Relayed streams closed after transport.idle without traffic.", func() float64 { return float64(s.Stats().Idled) })
+	metrics.Counter("paqet_sessions_rejected_total", "New client sessions turned away by listen.accept_rate or accept_global.", func() float64 { return float64(s.Stats().Rejected) })
+	metrics.Counter("paqet_bans_total", "Client IPs banned for exceeding listen.accept_rate.", func() float64 { return float64(s.Stats().Bans) })
+	metrics.Counter("paqet_resolver_lookups_total", "Hostname destinations looked up through a resolver.", func() float64 { return float64(s.ResolverStats().Lookups) })
+	metrics.Counter("paqet_resolver_failures_total", "Hostname lookups that failed every attempt.", func() float64 { return float64(s.ResolverStats().Failures) })
+	metrics.Labeled("paqet_resolver_latency_seconds", "Time to resolve a hostname destination, retries included, by statistic.", "gauge", func() []metrics.Sample {
+		st := s.ResolverStats()
+		return []metrics.Sample{
+			{Labels: metrics.Label("stat", "mean"), Value: st.AvgLatency.Seconds()},
+			{Labels: metrics.Label("stat", "max"), Value: st.MaxLatency.Seconds()},
+		}
+	})
+	metrics.Labeled("paqet_peers", "Client sessions connected, by the paqet version and features they advertised.", "gauge", func() []metrics.Sample {
+		var samples []metrics.Sample
+		for info, n := range s.PeerVersions() {
+			samples = append(samples, metrics.Sample{Labels: metrics.Label("version", info.Version) + "," + metrics.Label("features", protocol.FeatureNames(info.Features)), Value: float64(n)})
+		}
+		return samples
+	})
+	metrics.Labeled("paqet_user_bytes_total", "Bytes relayed for each user since the server started, by direction.", "counter", func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, u := range s.Users() {
+			samples = append(samples,
+				metrics.Sample{Labels: metrics.Label("user", u.ID) + "," + metrics.Label("direction", "up"), Value: float64(u.Up)},
+				metrics.Sample{Labels: metrics.Label("user", u.ID) + "," + metrics.Label("direction", "down"), Value: float64(u.Down)})
+		}
+		return samples
+	})
+	metrics.Labeled("paqet_user_quota_used_bytes", "Bytes each user relayed in the current UTC day and month, counted against its quotas.", "gauge", func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, u := range s.Users() {
+			samples = append(samples,
+				metrics.Sample{Labels: metrics.Label("user", u.ID) + "," + metrics.Label("period", "day"), Value: float64(u.Today)},
+				metrics.Sample{Labels: metrics.Label("user", u.ID) + "," + metrics.Label("period", "month"), Value: float64(u.Month)})
+		}
+		return samples
+	})
+}
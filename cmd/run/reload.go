@@ -0,0 +1,87 @@
+package run
+
+import (
+	"fmt"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// effective is the configuration in force, reloads included.
+var effective atomic.Pointer[conf.Conf]
+
+// reloader applies the config file again on SIGHUP or an admin request.
+// Sections the role can change live are applied; the rest keep their
+// running values until a restart, and are reported on every reload
+// until then.
+type reloader struct {
+	mu   sync.Mutex
+	path string
+	// hot applies section from next and reports whether it could.
+	hot func(section string, cur, next *conf.Conf) bool
+	// reopen runs on every reload, so log files a rotation moved away
+	// are opened again.
+	reopen func()
+}
+
+func (r *reloader) reload() (applied, restart []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := conf.LoadFromFile(r.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("keeping the running configuration: %v", err)
+	}
+	cur := effective.Load()
+	if next.Role != cur.Role {
+		return nil, nil, fmt.Errorf("keeping the running configuration: role changed from %s to %s", cur.Role, next.Role)
+	}
+
+	// Copied so the sections running code holds are never written.
+	merged := *cur
+	for _, section := range conf.Changed(cur, next) {
+		if section == "log" {
+			flog.SetLevel(next.Log.Level)
+		} else if r.hot == nil || !r.hot(section, cur, next) {
+			restart = append(restart, section)
+			continue
+		}
+		conf.CopySection(&merged, next, section)
+		applied = append(applied, section)
+	}
+	effective.Store(&merged)
+	return applied, restart, nil
+}
+
+// run reloads and logs the outcome.
+func (r *reloader) run() string {
+	if r.reopen != nil {
+		r.reopen()
+	}
+	applied, restart, err := r.reload()
+	if err != nil {
+		flog.Errorf("config reload failed: %v", err)
+		return err.Error()
+	}
+	msg := "nothing changed"
+	if len(applied) > 0 {
+		msg = "applied: " + strings.Join(applied, ", ")
+	}
+	if len(restart) > 0 {
+		msg += "; needs a restart: " + strings.Join(restart, ", ")
+		flog.Warnf("config reload: %s", msg)
+	} else {
+		flog.Infof("config reload: %s", msg)
+	}
+	return msg
+}
+
+// tcpOnly reports whether the network sections differ in their TCP
+// flags alone.
+func tcpOnly(cur, next *conf.Network) bool {
+	n := *cur
+	n.TCP.LF_, n.TCP.RF_, n.TCP.Profiles = next.TCP.LF_, next.TCP.RF_, next.TCP.Profiles
+	return len(conf.Changed(&conf.Conf{Network: n}, &conf.Conf{Network: *next})) == 0
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package run
+
+// watchReload is a no-op without SIGHUP; use `paqet ctl reload`.
+func watchReload(r *reloader) {}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package run
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchReload reloads the config file on SIGHUP.
+func watchReload(r *reloader) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			r.run()
+		}
+	}()
+}
@@ -1,18 +1,33 @@
 package run
 
 import (
+	"context"
 	"log"
+	"paqet/cmd/version"
 	"paqet/internal/conf"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/capture"
+	"paqet/internal/pkg/chaos"
+	"paqet/internal/pkg/flight"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet/kcp"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
-var confPath string
+var (
+	confPath    string
+	chaosFaults string
+)
 
 func init() {
 	Cmd.Flags().StringVarP(&confPath, "config", "c", "config.yaml", "Path to the configuration file.")
+	// Fault injection for soak tests, e.g. "health=0.2,open=500ms,kill=60s,corrupt=0.001",
+	// or link impairment, e.g. "loss=0.02,reorder=0.01,dup=0.005,delay=40ms,jitter=10ms,seed=1".
+	Cmd.Flags().StringVar(&chaosFaults, "chaos", "", "Inject faults (testing only).")
+	Cmd.Flags().MarkHidden("chaos")
 }
 
 var Cmd = &cobra.Command{
@@ -20,26 +35,65 @@ var Cmd = &cobra.Command{
 	Short: "Runs the client or server based on the config file.",
 	Long:  `The 'run' command reads the specified YAML configuration file.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		cfg, err := conf.LoadFromFile(confPath)
-		if err != nil {
-			log.Fatalf("Failed to load configuration: %v", err)
-		}
-		initialize(cfg)
-
-		switch cfg.Role {
-		case "client":
-			startClient(cfg)
-			return
-		case "server":
-			startServer(cfg)
-			return
-		}
-
-		log.Fatalf("Failed to load configuration")
+		Main(context.Background(), confPath)
 	},
 }
 
+// Main loads the configuration at path and runs its role until ctx ends
+// or a shutdown signal arrives. The Windows service runs paqet through
+// it, stopping it by ending ctx.
+func Main(ctx context.Context, path string) {
+	confPath = path
+	cfg, err := conf.LoadFromFile(confPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	initialize(cfg)
+	defer capture.Close()
+
+	switch cfg.Role {
+	case "client":
+		startClient(ctx, cfg)
+		return
+	case "server":
+		startServer(ctx, cfg)
+		return
+	}
+
+	log.Fatalf("Failed to load configuration")
+}
+
 func initialize(cfg *conf.Conf) {
 	flog.SetLevel(cfg.Log.Level)
-	buffer.Initialize(cfg.Transport.TCPBuf, cfg.Transport.UDPBuf)
+	effective.Store(cfg)
+	protocol.Software = version.Version
+	if err := protocol.SelfTest(); err != nil {
+		flog.Fatalf("Protocol self-test failed: %v", err)
+	}
+	if cfg.Transport.KCP != nil {
+		if err := kcp.CheckCaps(cfg.Transport.KCP); err != nil {
+			flog.Fatalf("Unsupported transport configuration: %v", err)
+		}
+	}
+	if chaosFaults != "" {
+		f, err := chaos.Parse(chaosFaults)
+		if err != nil {
+			flog.Fatalf("Invalid --chaos: %v", err)
+		}
+		chaos.Enable(f)
+		flog.Warnf("Chaos fault injection enabled: %s", f)
+	}
+	buffer.Initialize(cfg.Transport.BufClasses, cfg.Transport.TCPBuf, cfg.Transport.UDPBuf, cfg.Transport.CopyEngine, time.Duration(cfg.Transport.Hibernate)*time.Second)
+
+	rec, err := flight.Open(cfg.Flight.Path, cfg.Flight.Records)
+	if err != nil {
+		flog.Fatalf("Failed to start flight recorder: %v", err)
+	}
+	flight.SetDefault(rec)
+	watchFlight(rec)
+	watchLogLevel()
+	serveMetrics(&cfg.Metrics)
+	serveAdmin(cfg)
+	serveDebug(&cfg.Debug)
+	startCapture(&cfg.Debug)
 }
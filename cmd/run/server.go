@@ -1,19 +1,63 @@
 package run
 
 import (
+	"context"
 	"paqet/internal/conf"
 	"paqet/internal/flog"
+	"paqet/internal/pkg/admin"
+	"paqet/internal/pkg/debug"
 	"paqet/internal/server"
+	"paqet/internal/store"
+	"slices"
 )
 
-func startServer(cfg *conf.Conf) {
+func startServer(ctx context.Context, cfg *conf.Conf) {
 	flog.Infof("Starting server...")
 
-	server, err := server.New(cfg)
+	st, err := store.Open(&cfg.Store)
+	if err != nil {
+		flog.Fatalf("Failed to open store: %v", err)
+	}
+	defer st.Close()
+
+	server, err := server.New(cfg, st)
 	if err != nil {
 		flog.Fatalf("Failed to initialize server: %v", err)
 	}
-	if err := server.Start(); err != nil {
+	if cfg.Metrics.Listen != "" {
+		serverMetrics(server)
+	}
+	admin.SetConns(server.Conns, server.CloseConn)
+	admin.SetUsers(server.Users, server.Revoke)
+	debug.Register("conns", func() any { return server.KCPStats() })
+
+	r := &reloader{path: confPath, hot: func(section string, cur, next *conf.Conf) bool {
+		switch section {
+		case "acl":
+			server.SetACL(&next.ACL)
+		case "egress":
+			server.SetEgress(&next.Egress)
+		case "limit":
+			server.SetLimit(&next.Limit)
+		case "listen":
+			if next.Listen.Addr_ != cur.Listen.Addr_ || !slices.Equal(next.Listen.Ports_, cur.Listen.Ports_) {
+				return false
+			}
+			server.SetCaps(&next.Listen)
+		case "network":
+			if !tcpOnly(&cur.Network, &next.Network) {
+				return false
+			}
+			f := next.Network.TCP.Pick()
+			server.SetTCPF(f.LF)
+		default:
+			return false
+		}
+		return true
+	}, reopen: server.ReopenLogs}
+	watchReload(r)
+	admin.SetReload(r.run)
+	if err := server.Start(ctx.Done()); err != nil {
 		flog.Fatalf("Server encountered an error: %v", err)
 	}
 }
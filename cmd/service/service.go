@@ -0,0 +1,25 @@
+package service
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var (
+	name     string
+	confPath string
+	logPath  string
+)
+
+var Cmd = &cobra.Command{
+	Use:   "service",
+	Short: "Installs and controls paqet as a Windows service.",
+	Long: `The 'service' commands register paqet with the Windows service manager so
+it starts at boot without a console window, and start, stop or remove it.
+The service logs to the Windows event log under its name, or to --log.
+Stopping the service shuts paqet down as Ctrl+C would. Run them from an
+elevated prompt. On other systems use systemd, launchd or similar instead.`,
+}
+
+func init() {
+	Cmd.PersistentFlags().StringVar(&name, "name", "paqet", "Name of the service.")
+}
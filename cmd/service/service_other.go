@@ -0,0 +1,16 @@
+//go:build !windows
+
+package service
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	Cmd.Args = cobra.ArbitraryArgs
+	Cmd.Run = func(cmd *cobra.Command, args []string) {
+		log.Fatalf("paqet service is only available on Windows; use systemd, launchd or similar here")
+	}
+}
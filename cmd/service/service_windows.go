@@ -0,0 +1,270 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"paqet/cmd/run"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// stopTimeout is how long stop waits for the service to exit; the server
+// may take its drain time to shut down.
+const stopTimeout = 2 * time.Minute
+
+func init() {
+	installCmd.Flags().StringVarP(&confPath, "config", "c", "config.yaml", "Path to the configuration file.")
+	installCmd.Flags().StringVar(&logPath, "log", "", "Log to this file instead of the Windows event log.")
+	runCmd.Flags().StringVarP(&confPath, "config", "c", "config.yaml", "Path to the configuration file.")
+	runCmd.Flags().StringVar(&logPath, "log", "", "Log to this file instead of the Windows event log.")
+	Cmd.AddCommand(installCmd, startCmd, stopCmd, uninstallCmd, runCmd)
+}
+
+var installCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Registers paqet to start at boot with the given configuration.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		path, err := filepath.Abs(confPath)
+		if err != nil {
+			log.Fatalf("Invalid config path: %v", err)
+		}
+		if _, err := conf.LoadFromFile(path); err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		svcArgs := []string{"service", "run", "--name", name, "-c", path}
+		if logPath != "" {
+			abs, err := filepath.Abs(logPath)
+			if err != nil {
+				log.Fatalf("Invalid log path: %v", err)
+			}
+			svcArgs = append(svcArgs, "--log", abs)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatalf("Failed to find the paqet executable: %v", err)
+		}
+
+		m := connect()
+		defer m.Disconnect()
+		if s, err := m.OpenService(name); err == nil {
+			s.Close()
+			log.Fatalf("Service %s already exists; uninstall it first", name)
+		}
+		s, err := m.CreateService(name, exe, mgr.Config{
+			DisplayName: "paqet (" + name + ")",
+			Description: "paqet packet-level proxy",
+			StartType:   mgr.StartAutomatic,
+		}, svcArgs...)
+		if err != nil {
+			log.Fatalf("Failed to create service: %v", err)
+		}
+		defer s.Close()
+		// Restart after a crash, backing off a little each time.
+		s.SetRecoveryActions([]mgr.RecoveryAction{
+			{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+			{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+			{Type: mgr.ServiceRestart, Delay: 2 * time.Minute},
+		}, uint32((24 * time.Hour).Seconds()))
+		if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil && !strings.Contains(err.Error(), "exists") {
+			fmt.Printf("Warning: failed to register event log source: %v\n", err)
+		}
+		fmt.Printf("Installed service %s running %s -c %s\nStart it with `paqet service start` or reboot.\n", name, exe, path)
+	},
+}
+
+var startCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Starts the installed service.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		m := connect()
+		defer m.Disconnect()
+		s := open(m)
+		defer s.Close()
+		if err := s.Start(); err != nil {
+			log.Fatalf("Failed to start service %s: %v", name, err)
+		}
+		fmt.Printf("Started service %s\n", name)
+	},
+}
+
+var stopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stops the service, shutting paqet down cleanly.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		m := connect()
+		defer m.Disconnect()
+		s := open(m)
+		defer s.Close()
+		if err := stop(s); err != nil {
+			log.Fatalf("Failed to stop service %s: %v", name, err)
+		}
+		fmt.Printf("Stopped service %s\n", name)
+	},
+}
+
+var uninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Stops and removes the service.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		m := connect()
+		defer m.Disconnect()
+		s := open(m)
+		defer s.Close()
+		if err := stop(s); err != nil {
+			log.Fatalf("Failed to stop service %s: %v", name, err)
+		}
+		if err := s.Delete(); err != nil {
+			log.Fatalf("Failed to remove service %s: %v", name, err)
+		}
+		eventlog.Remove(name)
+		fmt.Printf("Removed service %s\n", name)
+	},
+}
+
+// runCmd is what the service manager starts.
+var runCmd = &cobra.Command{
+	Use:    "run",
+	Short:  "Runs paqet under the service manager.",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if ok, err := svc.IsWindowsService(); err != nil || !ok {
+			log.Fatalf("service run is started by the service manager; use paqet run in a console")
+		}
+		if logPath != "" {
+			f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+			if err != nil {
+				log.Fatalf("Failed to open log file: %v", err)
+			}
+			defer f.Close()
+			flog.SetOutput(f)
+			log.SetOutput(f)
+		} else if el, err := eventlog.Open(name); err == nil {
+			defer el.Close()
+			flog.SetOutput(&eventWriter{el})
+			log.SetOutput(&eventWriter{el})
+		}
+		if err := svc.Run(name, &handler{path: confPath}); err != nil {
+			log.Fatalf("Service %s failed: %v", name, err)
+		}
+	},
+}
+
+func connect() *mgr.Mgr {
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to the service manager (run elevated): %v", err)
+	}
+	return m
+}
+
+func open(m *mgr.Mgr) *mgr.Service {
+	s, err := m.OpenService(name)
+	if err != nil {
+		log.Fatalf("Service %s is not installed: %v", name, err)
+	}
+	return s
+}
+
+// stop asks s to stop and waits until it has, or stopTimeout passes.
+func stop(s *mgr.Service) error {
+	st, err := s.Query()
+	if err != nil {
+		return err
+	}
+	if st.State == svc.Stopped {
+		return nil
+	}
+	if st.State != svc.StopPending {
+		if _, err := s.Control(svc.Stop); err != nil {
+			return err
+		}
+	}
+	deadline := time.Now().Add(stopTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(300 * time.Millisecond)
+		if st, err = s.Query(); err != nil {
+			return err
+		}
+		if st.State == svc.Stopped {
+			return nil
+		}
+	}
+	return fmt.Errorf("still running after %v", stopTimeout)
+}
+
+// handler runs paqet until the service manager asks it to stop.
+type handler struct {
+	path string
+}
+
+func (h *handler) Execute(args []string, req <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run.Main(ctx, h.path)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			// paqet ended without being asked to; let the recovery
+			// actions restart it.
+			flog.Flush(time.Second)
+			return false, 1
+		case r := <-req:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(stopTimeout.Milliseconds())}
+				cancel()
+				<-done
+				flog.Flush(time.Second)
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventWriter sends log lines to the event log at the severity of their
+// level tag.
+type eventWriter struct {
+	el *eventlog.Log
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	var err error
+	switch {
+	case strings.Contains(line, "[ERROR]"), strings.Contains(line, "[FATAL]"):
+		err = w.el.Error(1, line)
+	case strings.Contains(line, "[WARN]"):
+		err = w.el.Warning(1, line)
+	default:
+		err = w.el.Info(1, line)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
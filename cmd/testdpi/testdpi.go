@@ -0,0 +1,215 @@
+package testdpi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"paqet/cmd/version"
+	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/store"
+
+	"github.com/goccy/go-yaml"
+	"github.com/spf13/cobra"
+)
+
+var (
+	confPath string
+	duration time.Duration
+)
+
+func init() {
+	Cmd.Flags().StringVarP(&confPath, "config", "c", "config.yaml", "Path to the client configuration file.")
+	Cmd.Flags().DurationVarP(&duration, "duration", "d", 5*time.Second, "How long each variant must sustain the echo test.")
+}
+
+var Cmd = &cobra.Command{
+	Use:   "test-dpi",
+	Short: "Tries wire variants against the server and recommends one that gets through.",
+	Long: `The 'test-dpi' command dials the server from the client configuration once
+per variant of the settings that shape what the tunnel looks like on the
+wire: as configured, each TCP flag profile, pure ACK flags, smaller packets
+and decoy ACKs. Each variant must complete the hello handshake and then
+sustain an echo for --duration. It prints which variants got through and
+the config block of the first one that did, to paste into the client YAML.
+Only client-side settings are varied, so the server needs no change; it
+must run a version that supports bench.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := conf.ReadFile(confPath)
+		if err != nil {
+			log.Fatalf("Failed to read configuration: %v", err)
+		}
+		cfg, err := conf.Load(data)
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		if cfg.Role != "client" {
+			log.Fatalf("test-dpi command requires client configuration")
+		}
+		if duration < time.Second || duration > 5*time.Minute {
+			log.Fatalf("--duration must be between 1s and 5m")
+		}
+		flog.SetLevel(cfg.Log.Level)
+		protocol.Software = version.Version
+		run(data, cfg.Server.Addr.String())
+	},
+}
+
+// setting is one config value a variant changes, by YAML path.
+type setting struct {
+	path  string
+	value any
+}
+
+type variant struct {
+	name     string
+	settings []setting
+}
+
+// variants go from the configuration as written to larger changes, so
+// the first that works is the least intrusive.
+var variants = []variant{
+	{"as configured", nil},
+	{"profile data", []setting{{"network.tcp.profiles", []string{"data"}}}},
+	{"profile keepalive", []setting{{"network.tcp.profiles", []string{"keepalive"}}}},
+	{"profile download", []setting{{"network.tcp.profiles", []string{"download"}}}},
+	{"profile upload", []setting{{"network.tcp.profiles", []string{"upload"}}}},
+	{"pure ACK flags", []setting{
+		{"network.tcp.profiles", []string{}},
+		{"network.tcp.local_flag", []string{"A"}},
+		{"network.tcp.remote_flag", []string{"A"}},
+	}},
+	{"small packets", []setting{{"transport.kcp.mtu", 1000}}},
+	{"decoy ACKs", []setting{{"network.tcp.decoy_ack", 15}}},
+	{"keepalive, small packets", []setting{
+		{"network.tcp.profiles", []string{"keepalive"}},
+		{"transport.kcp.mtu", 1000},
+	}},
+}
+
+type result struct {
+	hello  time.Duration
+	rtts   []time.Duration
+	err    error
+	failed string // the stage that failed
+}
+
+func run(data []byte, server string) {
+	fmt.Printf("Testing %d variants against %s, %v of echo each...\n\n", len(variants), server, duration)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VARIANT\tHANDSHAKE\tECHO\tRESULT")
+	var best *variant
+	for i := range variants {
+		v := &variants[i]
+		r := try(data, v)
+		hs, echo := "-", "-"
+		if r.failed != "config" && r.failed != "start" {
+			hs = "no answer"
+			if r.failed != "handshake" {
+				hs = r.hello.Round(time.Millisecond).String()
+			}
+		}
+		if len(r.rtts) > 0 {
+			echo = fmt.Sprintf("%d, p50 %v", len(r.rtts), r.rtts[len(r.rtts)/2].Round(100*time.Microsecond))
+		}
+		verdict := "ok"
+		if r.err != nil {
+			verdict = fmt.Sprintf("failed at %s: %v", r.failed, r.err)
+		} else if best == nil {
+			best = v
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v.name, hs, echo, verdict)
+		w.Flush()
+	}
+	fmt.Println()
+
+	switch {
+	case best == nil:
+		fmt.Println("No variant got through. The server may be down or its port blocked outright; run `paqet doctor` to check the path.")
+		os.Exit(1)
+	case best.settings == nil:
+		fmt.Println("The configuration as written gets through; no change is needed.")
+	default:
+		block, err := yaml.Marshal(tree(best.settings))
+		if err != nil {
+			log.Fatalf("Failed to render config block: %v", err)
+		}
+		fmt.Printf("The configuration as written did not get through; %q did. Merge this into the client config:\n\n%s", best.name, block)
+	}
+}
+
+// try runs one variant on a client of its own, with its own port.
+func try(data []byte, v *variant) result {
+	cfg, err := apply(data, v.settings)
+	if err != nil {
+		return result{err: err, failed: "config"}
+	}
+	cfg.Network.Port = 0
+	st, _ := store.Open(&conf.Store{Backend: "memory"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := client.New(cfg, st)
+	if err != nil {
+		return result{err: err, failed: "start"}
+	}
+	start := time.Now()
+	if err := c.Start(ctx); err != nil {
+		return result{err: err, failed: "start"}
+	}
+	defer c.Close()
+	if err := c.Hello(); err != nil {
+		return result{err: err, failed: "handshake"}
+	}
+	r := result{hello: time.Since(start)}
+	r.rtts, r.err = c.Echo(ctx, duration)
+	if r.err != nil {
+		r.failed = "echo"
+	}
+	return r
+}
+
+// apply loads the configuration in data with settings changed.
+func apply(data []byte, settings []setting) (*conf.Conf, error) {
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for _, s := range settings {
+		set(doc, strings.Split(s.path, "."), s.value)
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return conf.Load(out)
+}
+
+func set(m map[string]any, path []string, value any) {
+	if len(path) == 1 {
+		m[path[0]] = value
+		return
+	}
+	next, ok := m[path[0]].(map[string]any)
+	if !ok {
+		next = make(map[string]any)
+		m[path[0]] = next
+	}
+	set(next, path[1:], value)
+}
+
+// tree nests settings into a YAML document.
+func tree(settings []setting) map[string]any {
+	doc := make(map[string]any)
+	for _, s := range settings {
+		set(doc, strings.Split(s.path, "."), s.value)
+	}
+	return doc
+}
@@ -0,0 +1,94 @@
+package validate
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"paqet/internal/conf"
+	"paqet/internal/socket"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	confPath string
+	quiet    bool
+)
+
+func init() {
+	Cmd.Flags().StringVarP(&confPath, "config", "c", "config.yaml", "Path to the configuration file.")
+	Cmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Only report whether the configuration is valid.")
+}
+
+var Cmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Checks a configuration and prints it fully resolved, without starting paqet.",
+	Long: `The 'validate' command loads the configuration with its includes and
+environment references, applies the defaults and validates every section,
+exiting 1 with the list of problems if any. It then resolves what paqet
+would use at startup: the interface, source addresses and gateway MAC, and
+prints them with the effective configuration, keys redacted. With
+network.interface set to auto, the printed configuration shows the
+interface and address picked, as run would pick them.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := conf.ReadFile(confPath)
+		if err != nil {
+			log.Fatalf("Failed to read configuration: %v", err)
+		}
+		cfg, err := conf.Load(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s is invalid: %v\n", confPath, err)
+			os.Exit(1)
+		}
+		if quiet {
+			fmt.Printf("%s is valid (%s)\n", confPath, cfg.Role)
+			return
+		}
+
+		fmt.Printf("%s is valid (%s).\n\nResolved:\n", confPath, cfg.Role)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		resolve(w, cfg)
+		w.Flush()
+		out, err := cfg.Redacted()
+		if err != nil {
+			log.Fatalf("Failed to render configuration: %v", err)
+		}
+		fmt.Printf("\nEffective configuration:\n\n%s", out)
+	},
+}
+
+// resolve prints what the network section comes down to on this host.
+func resolve(w *tabwriter.Writer, cfg *conf.Conf) {
+	for i, n := range cfg.Network.Listens() {
+		label := "interface"
+		if i > 0 {
+			label = fmt.Sprintf("listener %d", i)
+		}
+		fmt.Fprintf(w, "  %s\t%s (index %d, MAC %s, MTU %d)\n", label, n.Interface.Name, n.Interface.Index, n.Interface.HardwareAddr, n.Interface.MTU)
+		for _, a := range []struct {
+			family string
+			addr   conf.Addr
+			v6     bool
+		}{{"IPv4", n.IPv4, false}, {"IPv6", n.IPv6, true}} {
+			if a.addr.Addr == nil {
+				continue
+			}
+			fmt.Fprintf(w, "    %s source\t%s\n", a.family, a.addr.Addr)
+			if a.addr.Router != nil {
+				fmt.Fprintf(w, "    %s gateway MAC\t%s (configured)\n", a.family, a.addr.Router)
+			} else if mac, err := socket.GatewayMAC(n.Interface, a.v6, n.Fwmark); err != nil {
+				fmt.Fprintf(w, "    %s gateway MAC\tnot found: %v\n", a.family, err)
+			} else {
+				fmt.Fprintf(w, "    %s gateway MAC\t%s (discovered)\n", a.family, mac)
+			}
+		}
+	}
+	if cfg.Role == "client" {
+		fmt.Fprintf(w, "  server\t%s\n", cfg.Server.Addr)
+	} else {
+		fmt.Fprintf(w, "  listen\t%s\n", cfg.Listen.Addr)
+	}
+}
@@ -2,6 +2,7 @@ package version
 
 import (
 	"fmt"
+	"paqet/internal/tnet/kcp"
 	"runtime"
 
 	"github.com/spf13/cobra"
@@ -25,5 +26,8 @@ var Cmd = &cobra.Command{
 		fmt.Printf("Build Time: %s\n", BuildTime)
 		fmt.Printf("Go Version: %s\n", GoVersion)
 		fmt.Printf("Platform:   %s/%s\n", runtime.GOOS, runtime.GOARCH)
+		linked := kcp.Linked()
+		fmt.Printf("kcp-go:     %s\n", linked["github.com/xtaci/kcp-go/v5"])
+		fmt.Printf("smux:       %s\n", linked["github.com/xtaci/smux"])
 	},
 }
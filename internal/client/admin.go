@@ -0,0 +1,95 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"paqet/internal/pkg/admin"
+	"paqet/internal/tnet"
+	"paqet/internal/tnet/kcp"
+	"strconv"
+	"time"
+)
+
+// trackedStrm lists a stream on the admin endpoint while it is open.
+type trackedStrm struct {
+	tnet.Strm
+	st *admin.Stream
+}
+
+func track(strm tnet.Strm, proto, dest string) tnet.Strm {
+	st := admin.Track(proto, strm.RemoteAddr().String(), dest, strm)
+	if st == nil {
+		return strm
+	}
+	return &trackedStrm{Strm: strm, st: st}
+}
+
+func (s *trackedStrm) Read(b []byte) (int, error) {
+	n, err := s.Strm.Read(b)
+	s.st.CountDown(n)
+	return n, err
+}
+
+func (s *trackedStrm) Write(b []byte) (int, error) {
+	n, err := s.Strm.Write(b)
+	s.st.CountUp(n)
+	return n, err
+}
+
+func (s *trackedStrm) WriteTo(w io.Writer) (int64, error) {
+	return tnet.WriteTo(s.Strm, writerFunc(func(b []byte) (int, error) {
+		n, err := w.Write(b)
+		s.st.CountDown(n)
+		return n, err
+	}))
+}
+
+// writerFunc is an io.Writer that calls itself.
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
+
+func (s *trackedStrm) Close() error {
+	s.st.Untrack()
+	return s.Strm.Close()
+}
+
+// Conns lists the connections to the server, numbered from 1.
+func (c *Client) Conns() []admin.Conn {
+	var list []admin.Conn
+	for i, tc := range c.conns() {
+		conn, _ := tc.get()
+		if conn == nil || conn.IsClosed() {
+			continue
+		}
+		ac := admin.Conn{ID: strconv.Itoa(i + 1), Remote: conn.RemoteAddr().String()}
+		if c.cfg.Transport.Health.Interval > 0 {
+			state := "healthy"
+			if !tc.healthy.Load() {
+				state = "unhealthy"
+			}
+			ac.Health = fmt.Sprintf("%s (%s)", state, &tc.probe)
+		}
+		if k, ok := conn.(*kcp.Conn); ok {
+			ac.Streams = k.Session.NumStreams()
+			ac.RTT = (time.Duration(k.UDPSession.GetSRTT()) * time.Millisecond).String()
+		}
+		list = append(list, ac)
+	}
+	return list
+}
+
+// CloseConn closes the connection numbered id by Conns; it is redialed
+// when next used.
+func (c *Client) CloseConn(id string) error {
+	conns := c.conns()
+	i, err := strconv.Atoi(id)
+	if err != nil || i < 1 || i > len(conns) {
+		return fmt.Errorf("no connection %s", id)
+	}
+	conn, _ := conns[i-1].get()
+	if conn == nil || conn.IsClosed() {
+		return fmt.Errorf("connection %s is not up", id)
+	}
+	return conn.Close()
+}
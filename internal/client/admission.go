@@ -0,0 +1,177 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"paqet/internal/conf"
+	"paqet/internal/tnet"
+	"paqet/internal/tnet/kcp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBusy is returned for new streams turned away by
+// transport.admission, so a burst fails the excess at the edge instead
+// of queueing it in smux.
+var ErrBusy = errors.New("tunnel is busy")
+
+// Admission counters kept across the process.
+var (
+	admitRejected atomic.Uint64 // streams turned away
+	admitWaiting  atomic.Int64  // streams queued for a slot or a connection
+)
+
+// admission holds a stream open to the caps of transport.admission.
+type admission struct {
+	cfg   conf.Admission
+	slots chan struct{} // one per open in flight; nil without a cap
+
+	mu    sync.Mutex
+	ended chan struct{} // closed and replaced when a stream ends
+}
+
+func newAdmission(cfg conf.Admission) *admission {
+	a := &admission{cfg: cfg, ended: make(chan struct{})}
+	if cfg.Opens > 0 {
+		a.slots = make(chan struct{}, cfg.Opens)
+	}
+	return a
+}
+
+// deadline is how long a stream opened now may wait to be admitted.
+func (a *admission) deadline() time.Time {
+	if a.cfg.OnFull != "wait" {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(a.cfg.Wait) * time.Second)
+}
+
+// acquire takes a slot for one open, waiting until deadline for one
+// when all are taken. release gives it back.
+func (a *admission) acquire(deadline time.Time) error {
+	if a.slots == nil {
+		return nil
+	}
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if err := a.queue(deadline); err != nil {
+		return err
+	}
+	defer admitWaiting.Add(-1)
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		admitRejected.Add(1)
+		return fmt.Errorf("%w: %d streams opening, waited %ds", ErrBusy, a.cfg.Opens, a.cfg.Wait)
+	}
+}
+
+func (a *admission) release() {
+	if a.slots != nil {
+		<-a.slots
+	}
+}
+
+// queue joins the streams waiting, unless on_full rejects them or the
+// queue is full. The caller leaves it with admitWaiting.Add(-1).
+func (a *admission) queue(deadline time.Time) error {
+	if deadline.IsZero() || admitWaiting.Add(1) > int64(a.cfg.Queue) {
+		if !deadline.IsZero() {
+			admitWaiting.Add(-1)
+		}
+		admitRejected.Add(1)
+		return fmt.Errorf("%w: no room for another stream", ErrBusy)
+	}
+	return nil
+}
+
+// full reports whether conn carries admission.max_streams streams.
+func (a *admission) full(tc *timedConn) bool {
+	if a.cfg.MaxStreams == 0 {
+		return false
+	}
+	conn, _ := tc.get()
+	k, ok := conn.(*kcp.Conn)
+	return ok && k.Session.NumStreams() >= a.cfg.MaxStreams
+}
+
+// room returns the connection pick selects once it has room for
+// another stream. On a full tunnel it waits until deadline, picking
+// again each time one of the streams ends.
+func (a *admission) room(pick func() (*timedConn, error), deadline time.Time) (*timedConn, error) {
+	var timer *time.Timer
+	for {
+		// Taken before picking, so a stream ending in between still
+		// wakes the wait below.
+		ended := a.ending()
+		tc, err := pick()
+		if err != nil || !a.full(tc) {
+			if timer != nil {
+				timer.Stop()
+				admitWaiting.Add(-1)
+			}
+			return tc, err
+		}
+		if timer == nil {
+			if err := a.queue(deadline); err != nil {
+				return nil, err
+			}
+			timer = time.NewTimer(time.Until(deadline))
+		}
+		select {
+		case <-ended:
+		case <-timer.C:
+			admitWaiting.Add(-1)
+			admitRejected.Add(1)
+			return nil, fmt.Errorf("%w: no connection to use has room under max_streams %d, waited %ds", ErrBusy, a.cfg.MaxStreams, a.cfg.Wait)
+		}
+	}
+}
+
+// ending returns a channel closed when the next stream ends.
+func (a *admission) ending() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ended
+}
+
+func (a *admission) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	close(a.ended)
+	a.ended = make(chan struct{})
+}
+
+// track makes closing strm wake the streams room holds. Without
+// admission.max_streams nothing waits for that, and strm is returned
+// as it is.
+func (a *admission) track(strm tnet.Strm) tnet.Strm {
+	if a.cfg.MaxStreams == 0 {
+		return strm
+	}
+	return &admitStrm{Strm: strm, a: a}
+}
+
+type admitStrm struct {
+	tnet.Strm
+	a    *admission
+	once sync.Once
+}
+
+func (s *admitStrm) Close() error {
+	err := s.Strm.Close()
+	s.once.Do(s.a.end)
+	return err
+}
+
+func (s *admitStrm) WriteTo(w io.Writer) (int64, error) {
+	return tnet.WriteTo(s.Strm, w)
+}
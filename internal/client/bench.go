@@ -0,0 +1,250 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+const (
+	echoSize     = 32
+	echoInterval = 100 * time.Millisecond
+	idleEchoes   = 10
+)
+
+// BenchResult is what Bench measured.
+type BenchResult struct {
+	Up, Down    float64         // goodput in bytes per second
+	Idle        []time.Duration // echo round trips before the transfers, sorted
+	Loaded      []time.Duration // echo round trips during them, sorted
+	OutSegs     uint64          // KCP segments sent
+	RetransSegs uint64          // of which retransmissions
+}
+
+// Bench measures the tunnel against the server: echo round trips while
+// idle, then size bytes up and size bytes down, each split across
+// parallel streams while an echo stream keeps timing round trips. It
+// expects to be the only traffic of the process, as the retransmission
+// counts are process-wide.
+func (c *Client) Bench(ctx context.Context, size int64, parallel int) (*BenchResult, error) {
+	before := kcp.DefaultSnmp.Copy()
+	echo, err := c.benchStrm(protocol.BenchEcho, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer echo.Close()
+
+	res := &BenchResult{}
+	for i := 0; i < idleEchoes; i++ {
+		rtt, err := echoOnce(echo)
+		if err != nil {
+			return nil, fmt.Errorf("echo failed: %v", err)
+		}
+		res.Idle = append(res.Idle, rtt)
+		time.Sleep(echoInterval)
+	}
+
+	loadCtx, stopEcho := context.WithCancel(ctx)
+	loaded := make(chan []time.Duration, 1)
+	go func() { loaded <- echoLoop(loadCtx, echo) }()
+	res.Up, err = c.benchPhase(protocol.BenchUp, size, parallel)
+	if err == nil {
+		res.Down, err = c.benchPhase(protocol.BenchDown, size, parallel)
+	}
+	stopEcho()
+	res.Loaded = <-loaded
+	if err != nil {
+		return nil, err
+	}
+
+	after := kcp.DefaultSnmp.Copy()
+	res.OutSegs = after.OutSegs - before.OutSegs
+	res.RetransSegs = after.RetransSegs - before.RetransSegs
+	slices.Sort(res.Idle)
+	slices.Sort(res.Loaded)
+	return res, nil
+}
+
+// benchPhase moves size bytes in direction mode over parallel streams
+// and returns the goodput.
+func (c *Client) benchPhase(mode byte, size int64, parallel int) (float64, error) {
+	start := time.Now()
+	errs := make(chan error, parallel)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		n := size / int64(parallel)
+		if i == 0 {
+			n += size % int64(parallel)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.benchTransfer(mode, n)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return float64(size) / time.Since(start).Seconds(), nil
+}
+
+func (c *Client) benchTransfer(mode byte, n int64) error {
+	strm, err := c.benchStrm(mode, n)
+	if err != nil {
+		return err
+	}
+	defer strm.Close()
+	if mode == protocol.BenchDown {
+		if _, err := io.CopyN(io.Discard, strm, n); err != nil {
+			return fmt.Errorf("download failed: %v", err)
+		}
+		return nil
+	}
+	buf := make([]byte, 32*1024)
+	for sent := int64(0); sent < n; {
+		chunk := buf[:min(int64(len(buf)), n-sent)]
+		if _, err := strm.Write(chunk); err != nil {
+			return fmt.Errorf("upload failed: %v", err)
+		}
+		sent += int64(len(chunk))
+	}
+	var done protocol.Proto
+	if err := done.Read(strm); err != nil || done.Type != protocol.PSTATUS {
+		return fmt.Errorf("upload was not acknowledged: %v", err)
+	}
+	return nil
+}
+
+// benchStrm opens a stream on the next connection and asks the server
+// for a bench transfer.
+func (c *Client) benchStrm(mode byte, n int64) (tnet.Strm, error) {
+	if len(c.iter.Items) == 0 {
+		return nil, fmt.Errorf("client not started")
+	}
+	tc := c.iter.Next()
+	conn, _ := tc.get()
+	if conn == nil {
+		return nil, fmt.Errorf("connection not initialized")
+	}
+	if !tc.server().has(protocol.FeatBench) {
+		return nil, fmt.Errorf("server %s does not support bench; upgrade it", c.cfg.Server.Addr)
+	}
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return nil, err
+	}
+	p := protocol.Proto{Type: protocol.PBENCH, Mode: mode, Bytes: n}
+	if err := p.Write(strm); err != nil {
+		strm.Close()
+		return nil, err
+	}
+	strm.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var reply protocol.Proto
+	if err := reply.Read(strm); err != nil || reply.Type != protocol.PSTATUS {
+		strm.Close()
+		return nil, fmt.Errorf("server did not answer bench request: %v", err)
+	}
+	strm.SetReadDeadline(time.Time{})
+	if reply.Status != protocol.StatusOK {
+		strm.Close()
+		return nil, fmt.Errorf("server refused bench: %s", reply.Reason)
+	}
+	return strm, nil
+}
+
+// Hello waits for the hello exchange on the first connection and fails
+// when the server did not answer it.
+func (c *Client) Hello() error {
+	if len(c.iter.Items) == 0 {
+		return fmt.Errorf("client not started")
+	}
+	srv := c.iter.Items[0].server()
+	<-srv.done
+	if srv.features == 0 {
+		return fmt.Errorf("no hello from %s", c.cfg.Server.Addr)
+	}
+	return nil
+}
+
+// Echo times an echo every echoInterval for d and fails on the first
+// one that does not come back.
+func (c *Client) Echo(ctx context.Context, d time.Duration) ([]time.Duration, error) {
+	echo, err := c.benchStrm(protocol.BenchEcho, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer echo.Close()
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	context.AfterFunc(ctx, func() { echo.SetDeadline(time.Now()) })
+
+	var rtts []time.Duration
+	ticker := time.NewTicker(echoInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			slices.Sort(rtts)
+			return rtts, nil
+		case <-ticker.C:
+		}
+		rtt, err := echoOnce(echo)
+		if err != nil {
+			if ctx.Err() != nil {
+				slices.Sort(rtts)
+				return rtts, nil
+			}
+			return rtts, fmt.Errorf("echo %d failed: %v", len(rtts)+1, err)
+		}
+		rtts = append(rtts, rtt)
+	}
+}
+
+// Close closes the client's connections.
+func (c *Client) Close() {
+	for _, tc := range c.conns() {
+		tc.close()
+	}
+}
+
+func echoOnce(strm tnet.Strm) (time.Duration, error) {
+	var buf [echoSize]byte
+	start := time.Now()
+	if _, err := strm.Write(buf[:]); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(strm, buf[:]); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// echoLoop times an echo every echoInterval until ctx is done.
+func echoLoop(ctx context.Context, strm tnet.Strm) []time.Duration {
+	var rtts []time.Duration
+	ticker := time.NewTicker(echoInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return rtts
+		case <-ticker.C:
+		}
+		rtt, err := echoOnce(strm)
+		if err != nil {
+			return rtts
+		}
+		rtts = append(rtts, rtt)
+	}
+}
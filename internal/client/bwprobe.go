@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"paqet/internal/flog"
+	"paqet/internal/tnet/kcp"
+	"time"
+)
+
+const (
+	probeCount = 32
+	probeSize  = 1024
+)
+
+// runProbe periodically estimates downstream bandwidth over the first
+// connection with a PPROBE packet train, and sizes the receive window
+// of every connection to the bandwidth-delay product it gives, so a
+// fast path with a long RTT is not held back by transport.kcp.rcvwnd.
+func (c *Client) runProbe(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if len(c.iter.Items) == 0 {
+			continue
+		}
+		conn, _ := c.iter.Items[0].get()
+		k, ok := conn.(*kcp.Conn)
+		if !ok {
+			continue
+		}
+		bw, err := k.Bandwidth(probeCount, probeSize)
+		if err != nil {
+			flog.Debugf("bandwidth probe to %s failed: %v", c.cfg.Server.Addr, err)
+			continue
+		}
+		wnd := k.BDPWindow(bw)
+		flog.Debugf("estimated downstream bandwidth from %s: %.2f Mbit/s, receive window %d", c.cfg.Server.Addr, bw*8/1e6, wnd)
+		if c.rcvwnd.Swap(int32(wnd)) == int32(wnd) {
+			continue
+		}
+		for _, tc := range c.conns() {
+			conn, _ := tc.get()
+			if k, ok := conn.(*kcp.Conn); ok {
+				k.SetRcvWnd(wnd)
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"context"
+	"math/rand/v2"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/chaos"
+	"time"
+)
+
+// runChaos closes a random connection at chaos kill intervals, leaving
+// the health monitor to redial it.
+func (c *Client) runChaos(ctx context.Context) {
+	for {
+		wait := chaos.NextKill()
+		if wait == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		conns := c.conns()
+		i := rand.IntN(len(conns))
+		if conn, _ := conns[i].get(); conn != nil {
+			flog.Warnf("chaos: killing client connection %d", i+1)
+			conn.Close()
+		}
+	}
+}
@@ -2,41 +2,136 @@ package client
 
 import (
 	"context"
+	"net"
 	"paqet/internal/conf"
 	"paqet/internal/flog"
+	"paqet/internal/pkg/chaos"
+	"paqet/internal/pkg/class"
 	"paqet/internal/pkg/iterator"
+	"paqet/internal/store"
 	"paqet/internal/tnet"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Client struct {
 	cfg     *conf.Conf
 	iter    *iterator.Iterator[*timedConn]
 	udpPool *udpPool
+	cls     *class.Classifier
+	fast    *timedConn                     // reserved for interactive streams
+	bulk    *iterator.Iterator[*timedConn] // everything else when fast is set
+	marked  map[int]*timedConn             // dedicated connections by rule DSCP
+	store   store.Store
+	admit   *admission
+	mtu     atomic.Int32             // discovered path MTU, 0 keeps transport.kcp.mtu
+	rcvwnd  atomic.Int32             // receive window fitted to the probed bandwidth, 0 keeps transport.kcp.rcvwnd
+	tcp     atomic.Pointer[conf.TCP] // flags, replaced on reload
 }
 
-func New(cfg *conf.Conf) (*Client, error) {
+// Policy carries the per-rule options that decide where a stream goes.
+type Policy struct {
+	Class class.Class
+	DSCP  int // 0 uses transport.kcp.dscp
+	// Source is the real client of a TCP stream relayed to us with a
+	// PROXY protocol header, passed on for the server's own.
+	Source net.Addr
+}
+
+func New(cfg *conf.Conf, st store.Store) (*Client, error) {
 	c := &Client{
 		cfg:     cfg,
+		store:   st,
 		iter:    &iterator.Iterator[*timedConn]{},
 		udpPool: &udpPool{strms: make(map[uint64]tnet.Strm)},
+		marked:  make(map[int]*timedConn),
+		admit:   newAdmission(cfg.Transport.Admission),
 	}
+	if cc := cfg.Transport.Class; cc.Enabled {
+		c.cls = class.New(cc.Ports, cc.BulkBytes, cc.Weight)
+	}
+	c.tcp.Store(&cfg.Network.TCP)
 	return c, nil
 }
 
 func (c *Client) Start(ctx context.Context) error {
-	for i := 0; i < c.cfg.Transport.Conn; i++ {
-		tc, err := newTimedConn(ctx, c.cfg)
-		if err != nil {
-			flog.Errorf("failed to create connection %d: %v", i+1, err)
-			return err
+	if c.cfg.Transport.KCP.PMTUD {
+		c.startPMTU(ctx)
+	}
+	// Dial all connections at once, so startup takes one handshake
+	// rather than one per connection.
+	conns := make([]*timedConn, c.cfg.Transport.Conn)
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Go(func() { conns[i], errs[i] = newTimedConn(ctx, c.cfg, c.cls, 0, &c.mtu, &c.rcvwnd, &c.tcp) })
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		flog.Errorf("failed to create connection %d: %v", i+1, err)
+		for _, tc := range conns {
+			if tc != nil {
+				tc.close()
+			}
 		}
+		return err
+	}
+	for i, tc := range conns {
 		flog.Debugf("client connection %d created successfully", i+1)
 		c.iter.Items = append(c.iter.Items, tc)
+		if c.cfg.Transport.Health.Interval > 0 {
+			go tc.monitor(i + 1)
+		}
+		if c.cfg.Transport.Rotate > 0 {
+			go tc.rotate(i + 1)
+		}
+	}
+	if c.cfg.Transport.Class.Reserve && len(c.iter.Items) > 1 {
+		c.fast = c.iter.Items[0]
+		c.bulk = &iterator.Iterator[*timedConn]{Items: c.iter.Items[1:]}
+		flog.Infof("client connection 1 reserved for interactive streams")
+	}
+
+	// Packets of one KCP connection share a single DSCP, so forward rules
+	// with their own marking get a dedicated connection.
+	for _, ff := range c.cfg.Forward {
+		if ff.DSCP == 0 || ff.DSCP == c.cfg.Transport.KCP.DSCP || c.marked[ff.DSCP] != nil {
+			continue
+		}
+		tc, err := newTimedConn(ctx, c.cfg, c.cls, ff.DSCP, &c.mtu, &c.rcvwnd, &c.tcp)
+		if err != nil {
+			flog.Errorf("failed to create connection for DSCP %d: %v", ff.DSCP, err)
+			return err
+		}
+		flog.Debugf("client connection for DSCP %d created successfully", ff.DSCP)
+		c.marked[ff.DSCP] = tc
+		if c.cfg.Transport.Health.Interval > 0 {
+			go tc.monitor(len(c.iter.Items) + len(c.marked))
+		}
+		if c.cfg.Transport.Rotate > 0 {
+			go tc.rotate(len(c.iter.Items) + len(c.marked))
+		}
+	}
+
+	if c.cfg.Transport.Health.Interval > 0 {
+		go c.watchTunnel(ctx)
+	}
+
+	if chaos.Enabled() {
+		go c.runChaos(ctx)
+	}
+
+	if i := c.cfg.Transport.KCP.ProbeInterval; i > 0 {
+		go c.runProbe(ctx, time.Duration(i)*time.Second)
 	}
 
 	go func() {
 		<-ctx.Done()
-		for _, tc := range c.iter.Items {
+		for _, tc := range c.conns() {
 			tc.close()
 		}
 		flog.Infof("client shutdown complete")
@@ -53,3 +148,11 @@ func (c *Client) Start(ctx context.Context) error {
 	flog.Infof("Client started: IPv4:%s IPv6:%s -> %s (%d connections)", ipv4Addr, ipv6Addr, c.cfg.Server.Addr, len(c.iter.Items))
 	return nil
 }
+
+func (c *Client) conns() []*timedConn {
+	conns := append([]*timedConn{}, c.iter.Items...)
+	for _, tc := range c.marked {
+		conns = append(conns, tc)
+	}
+	return conns
+}
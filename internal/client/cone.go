@@ -0,0 +1,35 @@
+package client
+
+import (
+	"errors"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// ErrNoCone is returned by Cone when the server predates PCONE.
+var ErrNoCone = errors.New("server does not support full-cone UDP")
+
+// Cone opens a full-cone UDP stream. Both ways it carries wire.Datagram
+// frames, each addressed to or from any peer, all through one server
+// socket; the server ends it after listen.cone_idle without traffic.
+func (c *Client) Cone(pol Policy) (tnet.Strm, error) {
+	strm, srv, err := c.newStrm(&tnet.Addr{Host: "0.0.0.0"}, pol)
+	if err != nil {
+		flog.Debugf("failed to create stream for full-cone UDP: %v", err)
+		return nil, err
+	}
+	if !srv.has(protocol.FeatCone) {
+		strm.Close()
+		return nil, ErrNoCone
+	}
+	rs, _, err := request(strm, srv, protocol.Proto{Type: protocol.PCONE}, 0, false)
+	if err != nil {
+		flog.Debugf("failed to write full-cone UDP header on stream %d: %v", strm.SID(), err)
+		strm.Close()
+		return nil, err
+	}
+	strm = rs
+	flog.Debugf("full-cone UDP stream %d created", strm.SID())
+	return track(strm, "udp", "*"), nil
+}
@@ -1,26 +1,169 @@
 package client
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"paqet/internal/flog"
+	"paqet/internal/pkg/class"
+	"paqet/internal/pkg/hash"
+	"paqet/internal/pkg/iterator"
+	"paqet/internal/protocol"
 	"paqet/internal/tnet"
 	"time"
 )
 
 const maxRetries = 3
 
+// ErrDown is returned for new streams while every connection fails its
+// health checks, unless transport.health.on_down holds them.
+var ErrDown = errors.New("tunnel is down")
+
+// Down reports whether every connection is failing its health checks.
+// Without health checks the tunnel is never known to be down.
+func (c *Client) Down() bool {
+	if c.cfg.Transport.Health.Interval == 0 {
+		return false
+	}
+	for _, tc := range c.iter.Items {
+		if tc.healthy.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+// DownDirect reports whether new connections should skip the tunnel
+// because it is down and on_down is direct.
+func (c *Client) DownDirect() bool {
+	return c.cfg.Transport.Health.OnDown == "direct" && c.Down()
+}
+
+// up applies on_down while the tunnel is down: hold waits up to the
+// hold time for a connection to recover; otherwise the stream fails.
+func (c *Client) up() error {
+	if !c.Down() {
+		return nil
+	}
+	h := c.cfg.Transport.Health
+	if h.OnDown != "hold" {
+		return ErrDown
+	}
+	deadline := time.Now().Add(time.Duration(h.Hold) * time.Second)
+	for c.Down() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w after waiting %ds", ErrDown, h.Hold)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
 // newConn returns the next available connection using lock-free round-robin.
 // No mutex needed: iterator uses atomic counter, and connection health is
 // checked lazily. This eliminates the main bottleneck for 200+ concurrent users.
-func (c *Client) newConn() (tnet.Conn, error) {
-	tc := c.iter.Next()
-	if tc.conn == nil {
+//
+// Streams of a rule with its own DSCP use that rule's marked connection,
+// and with a reserved interactive connection, interactive streams go to it;
+// both only on the first attempt. Every other stream uses the rest.
+func (c *Client) newConn(addr *tnet.Addr, pol Policy, cl class.Class, attempt int) (*timedConn, error) {
+	pool := c.iter
+	if c.fast != nil {
+		pool = c.bulk
+	}
+
+	var tc *timedConn
+	switch {
+	case c.marked[pol.DSCP] != nil && attempt == 0:
+		tc = c.marked[pol.DSCP]
+	case c.fast != nil && cl == class.Interactive && attempt == 0:
+		tc = c.fast
+	case c.cfg.Transport.Affinity:
+		tc = pinned(pool.Items, addr, attempt, c.admit.full)
+	default:
+		tc = pick(pool, c.admit.full)
+	}
+	if conn, _ := tc.get(); conn == nil {
 		return nil, fmt.Errorf("connection not initialized")
 	}
-	return tc.conn, nil
+	return tc, nil
 }
 
-func (c *Client) newStrm() (tnet.Strm, error) {
+// pick takes the next connection in turn, unless a random other one is
+// usable when it is not, or scores less than half as much, so streams
+// avoid connections failing their pings or with a much longer RTT while
+// still spreading over the rest. Connections full reports at their
+// admission.max_streams are passed over while another has room.
+func pick(pool *iterator.Iterator[*timedConn], full func(*timedConn) bool) *timedConn {
+	a := pool.Next()
+	if len(pool.Items) == 1 {
+		return a
+	}
+	if full(a) {
+		for _, tc := range pool.Items {
+			if tc.usable() && !full(tc) {
+				a = tc
+				break
+			}
+		}
+	}
+	b := pool.Items[rand.IntN(len(pool.Items))]
+	if full(b) {
+		return a
+	}
+	switch ua, ub := a.usable(), b.usable(); {
+	case ua != ub:
+		if ub {
+			return b
+		}
+		return a
+	case b.probe.score()*2 < a.probe.score():
+		return b
+	}
+	return a
+}
+
+// pinned keys addr to a stable connection so consecutive streams to the
+// same target share one path. Dead and unhealthy connections are skipped
+// in order, then those full reports at their admission.max_streams, and
+// each retry moves one connection further along.
+func pinned(items []*timedConn, addr *tnet.Addr, attempt int, full func(*timedConn) bool) *timedConn {
+	n := len(items)
+	start := int(hash.Addr(addr.String())%uint64(n)) + attempt
+	for _, ok := range []func(*timedConn) bool{
+		func(tc *timedConn) bool { return tc.usable() && !full(tc) },
+		(*timedConn).usable,
+	} {
+		for i := 0; i < n; i++ {
+			if tc := items[(start+i)%n]; ok(tc) {
+				return tc
+			}
+		}
+	}
+	return items[start%n]
+}
+
+// newStrm opens a stream towards addr and returns it with the hello of
+// the connection it is on, which decides what the stream may use. When
+// traffic classification is enabled the stream is tracked so its
+// connection can be retuned; the policy class overrides the class
+// derived from the destination port. transport.admission bounds the
+// opens in flight and the streams of each connection.
+func (c *Client) newStrm(addr *tnet.Addr, pol Policy) (tnet.Strm, *serverHello, error) {
+	if err := c.up(); err != nil {
+		return nil, nil, err
+	}
+	cl := pol.Class
+	if cl == class.Auto && c.cls != nil {
+		cl = c.cls.ByPort(addr.Port)
+	}
+	deadline := c.admit.deadline()
+	if err := c.admit.acquire(deadline); err != nil {
+		return nil, nil, err
+	}
+	defer c.admit.release()
+
 	var lastErr error
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
@@ -30,19 +173,70 @@ func (c *Client) newStrm() (tnet.Strm, error) {
 			time.Sleep(backoff)
 		}
 
-		conn, err := c.newConn()
+		tc, err := c.admit.room(func() (*timedConn, error) { return c.newConn(addr, pol, cl, attempt) }, deadline)
+		if errors.Is(err, ErrBusy) {
+			return nil, nil, err
+		}
 		if err != nil {
 			lastErr = err
 			flog.Debugf("session creation failed (attempt %d/%d): %v", attempt+1, maxRetries, err)
 			continue
 		}
+		conn, tracker := tc.get()
+		srv := tc.server()
 		strm, err := conn.OpenStrm()
 		if err != nil {
 			lastErr = err
 			flog.Debugf("failed to open stream (attempt %d/%d): %v", attempt+1, maxRetries, err)
 			continue
 		}
-		return strm, nil
+		strm = c.admit.track(strm)
+		if tracker != nil {
+			cs := tracker.Wrap(strm, cl)
+			flog.Debugf("stream %d to %s classified as %s", strm.SID(), addr, cs.Class())
+			return cs, srv, nil
+		}
+		return strm, srv, nil
+	}
+	openFailures.Add(1)
+	return nil, nil, fmt.Errorf("failed to create stream after %d attempts: %w", maxRetries, lastErr)
+}
+
+// request writes the request p on strm, a stream on a connection to
+// srv. Ahead of it goes a POPTS naming the features of want that both
+// ends take, which the server follows for this stream alone; a server
+// without FeatOpts gets p by itself and the stream uses none of them.
+// p.Source, the client a PROXY protocol header named, goes in the POPTS
+// too.
+// Every stream asks for a PSTATUS, which the returned stream reads
+// before the relayed data. With early set the header waits for the
+// first write, as earlyStrm does. It returns the stream to relay
+// through and what it uses.
+func request(strm tnet.Strm, srv *serverHello, p protocol.Proto, want uint32, early bool) (tnet.Strm, uint32, error) {
+	var hdr bytes.Buffer
+	var uses uint32
+	if srv.has(protocol.FeatOpts) {
+		uses = srv.uses(want | protocol.FeatStatus)
+		o := protocol.Proto{Type: protocol.POPTS, Features: uses, Source: p.Source}
+		if err := o.Write(&hdr); err != nil {
+			return nil, 0, err
+		}
+	}
+	p.Compact = srv.has(protocol.FeatAddrV2)
+	if err := p.Write(&hdr); err != nil {
+		return nil, 0, err
+	}
+	if early {
+		strm = newEarlyStrm(strm, hdr.Bytes())
+	} else if _, err := strm.Write(hdr.Bytes()); err != nil {
+		return nil, 0, err
+	}
+	if uses&protocol.FeatStatus != 0 {
+		target := "*"
+		if p.Addr != nil {
+			target = p.Addr.String()
+		}
+		strm = &statusStrm{Strm: strm, addr: target}
 	}
-	return nil, fmt.Errorf("failed to create stream after %d attempts: %w", maxRetries, lastErr)
+	return strm, uses, nil
 }
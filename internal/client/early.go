@@ -0,0 +1,86 @@
+package client
+
+import (
+	"io"
+	"paqet/internal/tnet"
+	"sync"
+	"time"
+)
+
+// earlyWait is how long a new stream holds its header back for the
+// first payload bytes. Protocols where the server speaks first wait this
+// long before the header goes alone.
+const earlyWait = 10 * time.Millisecond
+
+// earlyStrm sends the request header of a new stream together with the
+// first write, so both leave in the same frames and the server has the
+// payload in hand when its dial completes, instead of a round trip later.
+type earlyStrm struct {
+	tnet.Strm
+	mu    sync.Mutex
+	hdr   []byte
+	err   error
+	sent  chan struct{}
+	timer *time.Timer
+}
+
+func newEarlyStrm(strm tnet.Strm, hdr []byte) *earlyStrm {
+	e := &earlyStrm{Strm: strm, hdr: hdr, sent: make(chan struct{})}
+	e.mu.Lock()
+	e.timer = time.AfterFunc(earlyWait, func() { e.send(nil) })
+	e.mu.Unlock()
+	return e
+}
+
+// send writes b, preceded by the header if it has not gone yet, and
+// returns how much of b was written.
+func (e *earlyStrm) send(b []byte) (int, error) {
+	e.mu.Lock()
+	if e.hdr == nil {
+		e.mu.Unlock()
+		if b == nil {
+			return 0, nil
+		}
+		return e.Strm.Write(b)
+	}
+	defer e.mu.Unlock()
+	e.timer.Stop()
+	hdr := len(e.hdr)
+	n, err := e.Strm.Write(append(e.hdr, b...))
+	if n < hdr {
+		e.err = err
+	}
+	e.hdr = nil
+	close(e.sent)
+	return max(n-hdr, 0), err
+}
+
+func (e *earlyStrm) Write(b []byte) (int, error) {
+	return e.send(b)
+}
+
+// Read waits for the header: nothing comes back before the server has it.
+func (e *earlyStrm) Read(b []byte) (int, error) {
+	<-e.sent
+	if e.err != nil {
+		return 0, e.err
+	}
+	return e.Strm.Read(b)
+}
+
+// WriteTo waits for the header like Read, then lets the stream below
+// write what the server sends straight to w.
+func (e *earlyStrm) WriteTo(w io.Writer) (int64, error) {
+	<-e.sent
+	if e.err != nil {
+		return 0, e.err
+	}
+	return tnet.WriteTo(e.Strm, w)
+}
+
+// Close still sends a header that never went, so the server sees the
+// request it would have before.
+func (e *earlyStrm) Close() error {
+	e.send(nil)
+	return e.Strm.Close()
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"fmt"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// Ext opens a stream on the next connection and sends p, a message of
+// a registered extension type. The caller owns the returned stream. A
+// server without a handler for the type answers with a PSTATUS.
+func (c *Client) Ext(p *protocol.Proto) (tnet.Strm, error) {
+	if !protocol.IsExt(p.Type) {
+		return nil, fmt.Errorf("type %#x is not an extension type", p.Type)
+	}
+	if len(c.iter.Items) == 0 {
+		return nil, fmt.Errorf("client not started")
+	}
+	conn, _ := c.iter.Next().get()
+	if conn == nil {
+		return nil, fmt.Errorf("connection not initialized")
+	}
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Write(strm); err != nil {
+		strm.Close()
+		return nil, err
+	}
+	return strm, nil
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"paqet/internal/flog"
+	"paqet/internal/tnet/kcp"
+	"time"
+)
+
+const (
+	pmtuFloor  = 576
+	pmtuBucket = "pmtu"
+	pmtuMaxAge = 24 * time.Hour
+)
+
+type pmtuEntry struct {
+	MTU int   `json:"mtu"`
+	At  int64 `json:"at"`
+}
+
+// startPMTU picks the KCP MTU before the first connection is dialed,
+// from the per-server cache when it is fresh and by probing otherwise.
+func (c *Client) startPMTU(ctx context.Context) {
+	k := c.cfg.Transport.KCP
+	key := c.cfg.Server.Addr.String()
+
+	maxAge := pmtuMaxAge
+	if k.PMTUDInterval > 0 {
+		maxAge = time.Duration(k.PMTUDInterval) * time.Second
+	}
+	var e pmtuEntry
+	if data, err := c.store.Get(pmtuBucket, key); err == nil && json.Unmarshal(data, &e) == nil {
+		if time.Since(time.Unix(e.At, 0)) < maxAge {
+			c.mtu.Store(int32(e.MTU))
+			flog.Infof("using cached path MTU %d for %s", e.MTU, key)
+		}
+	}
+	if c.mtu.Load() == 0 {
+		c.updatePMTU(ctx)
+	}
+	if k.PMTUDInterval > 0 {
+		go c.runPMTU(ctx, time.Duration(k.PMTUDInterval)*time.Second)
+	}
+}
+
+func (c *Client) runPMTU(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		prev := c.mtu.Load()
+		if c.updatePMTU(ctx) == prev {
+			continue
+		}
+		for _, tc := range c.conns() {
+			conn, _ := tc.get()
+			if k, ok := conn.(*kcp.Conn); ok {
+				k.SetMTU(int(c.mtu.Load()))
+			}
+		}
+	}
+}
+
+// updatePMTU probes the path, caches the result and returns the MTU in use.
+func (c *Client) updatePMTU(ctx context.Context) int32 {
+	key := c.cfg.Server.Addr.String()
+	mtu := c.discoverMTU(ctx)
+	if mtu == 0 {
+		flog.Warnf("path MTU discovery to %s failed, keeping KCP MTU %d", key, c.cfg.Transport.KCP.MTU)
+		return c.mtu.Load()
+	}
+	flog.Infof("path MTU to %s is %d (configured %d)", key, mtu, c.cfg.Transport.KCP.MTU)
+	c.mtu.Store(int32(mtu))
+	data, _ := json.Marshal(pmtuEntry{MTU: mtu, At: time.Now().Unix()})
+	if err := c.store.Put(pmtuBucket, key, data); err != nil {
+		flog.Debugf("failed to cache path MTU: %v", err)
+	}
+	return int32(mtu)
+}
+
+// discoverMTU binary-searches the largest KCP packet that reaches the
+// server, between pmtuFloor and what the interface can carry after the
+// crafted IP/TCP headers. With network.mimic set to a UDP protocol the
+// same bound holds, as SetMTU takes what the cover framing adds beyond
+// the TCP header off each probe. It returns 0 if even the floor fails,
+// e.g. when the server predates PMTU probes. A lost probe leaves an
+// oversized segment queued, so the probe connection is replaced after
+// each failure.
+func (c *Client) discoverMTU(ctx context.Context) int {
+	overhead := 20 + 32
+	if c.cfg.Server.Addr.IP.To4() == nil {
+		overhead = 40 + 32
+	}
+	lo, hi := pmtuFloor, min(c.cfg.Network.Interface.MTU-overhead, 1500)
+	if hi < lo {
+		return 0
+	}
+
+	pc := &timedConn{cfg: c.cfg, ctx: ctx}
+	var conn *kcp.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	probe := func(size int) bool {
+		if conn == nil {
+			tc, _, err := pc.createConn()
+			if err != nil {
+				flog.Debugf("failed to dial probe connection: %v", err)
+				return false
+			}
+			conn = tc.(*kcp.Conn)
+		}
+		if err := conn.Probe(size); err != nil {
+			flog.Debugf("path MTU probe of %d bytes failed: %v", size, err)
+			conn.Close()
+			conn = nil
+			return false
+		}
+		flog.Debugf("path MTU probe of %d bytes succeeded", size)
+		return true
+	}
+
+	if !probe(lo) {
+		return 0
+	}
+	for lo < hi && ctx.Err() == nil {
+		mid := (lo + hi + 1) / 2
+		if probe(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
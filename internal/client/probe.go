@@ -0,0 +1,63 @@
+package client
+
+import (
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// recheck is how soon a connection whose ping failed is pinged
+	// again, so a dead one is replaced after a few seconds rather than
+	// a few health intervals.
+	recheck = time.Second
+	// Redials of a connection that does not answer back off from
+	// redialMin to redialMax, each wait drawn from its upper half.
+	redialMin = time.Second
+	redialMax = 30 * time.Second
+)
+
+// probeStats is the ping history of a connection: the smoothed RTT of
+// the pings answered and which of the last 32 failed.
+type probeStats struct {
+	srtt    atomic.Int64  // nanoseconds, 0 before the first answer
+	history atomic.Uint32 // bit set per failed ping, newest lowest
+	streak  atomic.Int32  // consecutive failures
+}
+
+// ok records a ping answered after rtt. The RTT is smoothed like TCP's
+// SRTT, an eighth of each new sample.
+func (p *probeStats) ok(rtt time.Duration) {
+	p.history.Store(p.history.Load() << 1)
+	p.streak.Store(0)
+	if s := p.srtt.Load(); s != 0 {
+		rtt = time.Duration(s) + (rtt-time.Duration(s))/8
+	}
+	p.srtt.Store(int64(rtt))
+}
+
+func (p *probeStats) fail() {
+	p.history.Store(p.history.Load()<<1 | 1)
+	p.streak.Add(1)
+}
+
+// score ranks a connection for new streams, lower being better: the
+// smoothed RTT, doubled for each recent failure and multiplied while
+// pings are failing now.
+func (p *probeStats) score() time.Duration {
+	s := time.Duration(p.srtt.Load())
+	if s == 0 {
+		s = time.Millisecond
+	}
+	s <<= min(bits.OnesCount32(p.history.Load()), 8)
+	if p.streak.Load() > 0 {
+		s *= 16
+	}
+	return s
+}
+
+func (p *probeStats) String() string {
+	srtt := time.Duration(p.srtt.Load()).Round(100 * time.Microsecond)
+	return fmt.Sprintf("srtt %v, %d/32 failed", srtt, bits.OnesCount32(p.history.Load()))
+}
@@ -0,0 +1,29 @@
+package client
+
+import (
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/tnet/kcp"
+)
+
+// SetTCPF applies reloaded TCP flags: local flags to the packets of
+// every live connection, remote flags by asking the server again. With
+// profiles each connection picks one anew. Connections dialed afterwards
+// use both from the start.
+func (c *Client) SetTCPF(tcp *conf.TCP) {
+	c.tcp.Store(tcp)
+	for i, tc := range c.conns() {
+		conn, _ := tc.get()
+		if conn == nil || conn.IsClosed() {
+			continue
+		}
+		f := tcp.Pick()
+		if k, ok := conn.(*kcp.Conn); ok && k.PacketConn != nil {
+			k.PacketConn.SetTCPF(f.LF)
+		}
+		if err := tc.sendTCPF(conn, f.RF); err != nil {
+			flog.Warnf("failed to send reloaded TCP flags on connection %d: %v", i+1, err)
+		}
+	}
+	flog.Infof("TCP flags reloaded")
+}
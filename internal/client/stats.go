@@ -0,0 +1,70 @@
+package client
+
+import (
+	"paqet/internal/tnet/kcp"
+	"sync/atomic"
+	"time"
+)
+
+// Counters kept across all connections of the process.
+var (
+	openFailures atomic.Uint64 // streams that could not be opened
+	redials      atomic.Uint64 // connections replaced by the health monitor
+	rotations    atomic.Uint64 // connections replaced by transport.rotate
+)
+
+// Stats is a snapshot of the client's connections.
+type Stats struct {
+	Conns        int           // connections that are up
+	Streams      int           // streams open across them
+	RTT          time.Duration // mean smoothed KCP RTT of the connections that are up
+	PingRTT      time.Duration // mean smoothed RTT of their health pings, 0 before any answer
+	OpenFailures uint64
+	Redials      uint64
+	Rotations    uint64
+	Rejected     uint64 // streams turned away by transport.admission
+	Waiting      int64  // streams it holds for a slot or a connection
+}
+
+func (c *Client) Stats() Stats {
+	st := Stats{OpenFailures: openFailures.Load(), Redials: redials.Load(), Rotations: rotations.Load(), Rejected: admitRejected.Load(), Waiting: admitWaiting.Load()}
+	var rtt, ping time.Duration
+	var pinged int
+	for _, tc := range c.conns() {
+		conn, _ := tc.get()
+		if conn == nil || conn.IsClosed() {
+			continue
+		}
+		st.Conns++
+		if k, ok := conn.(*kcp.Conn); ok {
+			st.Streams += k.Session.NumStreams()
+			rtt += time.Duration(k.UDPSession.GetSRTT()) * time.Millisecond
+		}
+		if s := tc.probe.srtt.Load(); s != 0 {
+			ping += time.Duration(s)
+			pinged++
+		}
+	}
+	if st.Conns > 0 {
+		st.RTT = rtt / time.Duration(st.Conns)
+	}
+	if pinged > 0 {
+		st.PingRTT = ping / time.Duration(pinged)
+	}
+	return st
+}
+
+// KCPStats lists the KCP state of each connection that is up.
+func (c *Client) KCPStats() []kcp.Stats {
+	list := []kcp.Stats{}
+	for _, tc := range c.conns() {
+		conn, _ := tc.get()
+		if conn == nil || conn.IsClosed() {
+			continue
+		}
+		if k, ok := conn.(*kcp.Conn); ok {
+			list = append(list, k.Stats())
+		}
+	}
+	return list
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"sync"
+)
+
+// statusStrm consumes the PSTATUS the server sends ahead of the relayed
+// data, turning a refusal into a read error instead of a silent close.
+type statusStrm struct {
+	tnet.Strm
+	addr string
+	once sync.Once
+	err  error
+}
+
+func (s *statusStrm) Read(b []byte) (int, error) {
+	s.once.Do(s.readStatus)
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.Strm.Read(b)
+}
+
+func (s *statusStrm) WriteTo(w io.Writer) (int64, error) {
+	s.once.Do(s.readStatus)
+	if s.err != nil {
+		return 0, s.err
+	}
+	return tnet.WriteTo(s.Strm, w)
+}
+
+func (s *statusStrm) readStatus() {
+	var p protocol.Proto
+	if err := p.Read(s.Strm); err != nil {
+		s.err = err
+		return
+	}
+	if p.Type != protocol.PSTATUS {
+		s.err = fmt.Errorf("expected status from server, got type %d", p.Type)
+		return
+	}
+	switch p.Status {
+	case protocol.StatusOK:
+		return
+	case protocol.StatusDenied:
+		s.err = fmt.Errorf("server refused %s: %s", s.addr, p.Reason)
+		flog.Warnf("stream %d: %v", s.SID(), s.err)
+	case protocol.StatusAuth:
+		s.err = fmt.Errorf("server refused %s: %s (check user id and key)", s.addr, p.Reason)
+		flog.Warnf("stream %d: %v", s.SID(), s.err)
+	case protocol.StatusQuota:
+		s.err = fmt.Errorf("server refused %s: %s", s.addr, p.Reason)
+		flog.Warnf("stream %d: %v", s.SID(), s.err)
+	case protocol.StatusLimit:
+		s.err = fmt.Errorf("server rejected the stream to %s: %s", s.addr, p.Reason)
+		flog.Warnf("stream %d: %v", s.SID(), s.err)
+	default:
+		s.err = fmt.Errorf("server could not reach %s: %s", s.addr, p.Reason)
+		flog.Debugf("stream %d: %v", s.SID(), s.err)
+	}
+}
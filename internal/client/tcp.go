@@ -2,32 +2,39 @@ package client
 
 import (
 	"paqet/internal/flog"
+	"paqet/internal/pkg/compress"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
 )
 
-func (c *Client) TCP(addr string) (tnet.Strm, error) {
-	strm, err := c.newStrm()
+func (c *Client) TCP(addr string, pol Policy) (tnet.Strm, error) {
+	tAddr, err := tnet.NewAddr(addr)
 	if err != nil {
-		flog.Debugf("failed to create stream for TCP %s: %v", addr, err)
+		flog.Debugf("invalid TCP address %s: %v", addr, err)
 		return nil, err
 	}
 
-	tAddr, err := tnet.NewAddr(addr)
+	strm, srv, err := c.newStrm(tAddr, pol)
 	if err != nil {
-		flog.Debugf("invalid TCP address %s: %v", addr, err)
-		strm.Close()
+		flog.Debugf("failed to create stream for TCP %s: %v", addr, err)
 		return nil, err
 	}
 
 	p := protocol.Proto{Type: protocol.PTCP, Addr: tAddr}
-	err = p.Write(strm)
+	if pol.Source != nil {
+		p.Source = pol.Source.String()
+	}
+	rs, uses, err := request(strm, srv, p, protocol.CompressionFeature(c.cfg.Transport.Compress), true)
 	if err != nil {
-		flog.Debugf("failed to write TCP protocol header for %s on stream %d: %v", addr, strm.SID(), err)
+		flog.Debugf("failed to encode TCP protocol header for %s on stream %d: %v", addr, strm.SID(), err)
 		strm.Close()
 		return nil, err
 	}
+	strm = rs
+	if algo := protocol.Compression(uses); algo != "" {
+		strm = compress.NewStrm(strm, algo)
+	}
 
 	flog.Debugf("TCP stream %d created for %s", strm.SID(), addr)
-	return strm, nil
+	return track(strm, "tcp", addr), nil
 }
@@ -3,60 +3,474 @@ package client
 import (
 	"context"
 	"fmt"
+	"math/rand/v2"
 	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/chaos"
+	"paqet/internal/pkg/class"
 	"paqet/internal/protocol"
 	"paqet/internal/socket"
 	"paqet/internal/tnet"
 	"paqet/internal/tnet/kcp"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type timedConn struct {
-	cfg    *conf.Conf
-	conn   tnet.Conn
-	expire time.Time
-	ctx    context.Context
+	cfg     *conf.Conf
+	cls     *class.Classifier
+	dscp    int
+	mtu     *atomic.Int32
+	rcvwnd  *atomic.Int32
+	tcp     *atomic.Pointer[conf.TCP]
+	mu      sync.RWMutex
+	conn    tnet.Conn
+	tracker *class.Tracker
+	srv     *serverHello
+	expire  time.Time
+	ctx     context.Context
+	away    chan struct{} // the server asked to move off the connection
+	healthy atomic.Bool   // cleared after health.failures failed pings
+	probe   probeStats    // written by monitor only
 }
 
-func newTimedConn(ctx context.Context, cfg *conf.Conf) (*timedConn, error) {
-	var err error
-	tc := timedConn{cfg: cfg, ctx: ctx}
-	tc.conn, err = tc.createConn()
+func newTimedConn(ctx context.Context, cfg *conf.Conf, cls *class.Classifier, dscp int, mtu, rcvwnd *atomic.Int32, tcp *atomic.Pointer[conf.TCP]) (*timedConn, error) {
+	tc := timedConn{cfg: cfg, cls: cls, dscp: dscp, mtu: mtu, rcvwnd: rcvwnd, tcp: tcp, ctx: ctx, away: make(chan struct{}, 1)}
+	conn, srv, err := tc.createConn()
 	if err != nil {
 		return nil, err
 	}
+	tc.set(conn, srv)
+	tc.healthy.Store(true)
 
 	return &tc, nil
 }
 
-func (tc *timedConn) createConn() (tnet.Conn, error) {
+func (tc *timedConn) get() (tnet.Conn, *class.Tracker) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.conn, tc.tracker
+}
+
+// server returns what the server of the current connection advertised.
+func (tc *timedConn) server() *serverHello {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.srv
+}
+
+// set swaps in conn and returns the connection it replaced, with its
+// tracker, so that exactly one caller retires each connection.
+func (tc *timedConn) set(conn tnet.Conn, srv *serverHello) (tnet.Conn, *class.Tracker) {
+	var tracker *class.Tracker
+	if t, ok := conn.(class.Tuner); ok && tc.cls != nil {
+		tracker = tc.cls.Track(t)
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	prev, old := tc.conn, tc.tracker
+	tc.conn, tc.tracker, tc.srv = conn, tracker, srv
+	return prev, old
+}
+
+// usable reports whether new streams may go to tc: it is up and not
+// failing its health checks.
+func (tc *timedConn) usable() bool {
+	conn, _ := tc.get()
+	return conn != nil && !conn.IsClosed() && tc.healthy.Load()
+}
+
+// monitor pings the server every health interval, or every second while
+// pings fail, and replaces the connection after enough consecutive
+// failures, or at once when the server sends PGOAWAY. A session that
+// was rerouted to a server without its state (ECMP/anycast) never
+// answers, so it is redialed instead of hanging until the smux
+// keepalive expires. With kcp.dead_peer set, a session that heard
+// nothing from the server for that long is redialed without waiting for
+// pings to fail.
+func (tc *timedConn) monitor(id int) {
+	h := tc.cfg.Transport.Health
+	interval := time.Duration(h.Interval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var deadTick <-chan time.Time
+	deadPeer := time.Duration(tc.cfg.Transport.KCP.DeadPeer) * time.Second
+	if deadPeer > 0 {
+		t := time.NewTicker(max(deadPeer/8, 250*time.Millisecond))
+		defer t.Stop()
+		deadTick = t.C
+	}
+
+	failures := 0
+	for {
+		away, dead := false, false
+		select {
+		case <-tc.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-tc.away:
+			away = true
+		case <-deadTick:
+			conn, _ := tc.get()
+			s, ok := conn.(interface{ Silence() time.Duration })
+			if !ok || conn.IsClosed() || s.Silence() < deadPeer {
+				continue
+			}
+			flog.Infof("client connection %d heard nothing from the server for %v, redialing", id, s.Silence().Round(time.Second))
+			dead = true
+		}
+
+		conn, _ := tc.get()
+		if !away && !dead && !conn.IsClosed() {
+			err := chaos.ErrHealth
+			start := time.Now()
+			if !chaos.DropHealth() {
+				err = ping(conn, h.Pad)
+			}
+			if err == nil {
+				tc.probe.ok(time.Since(start))
+				if failures > 0 {
+					ticker.Reset(interval)
+				}
+				failures = 0
+				tc.healthy.Store(true)
+				continue
+			}
+			tc.probe.fail()
+			failures++
+			flog.Debugf("client connection %d health check failed (%d/%d): %v", id, failures, h.Failures, err)
+			if failures < h.Failures {
+				ticker.Reset(min(recheck, interval))
+				continue
+			}
+			ticker.Reset(interval)
+		}
+		if !away {
+			tc.healthy.Store(false)
+		}
+		if !tc.reconnect(id, away) {
+			return
+		}
+		failures = 0
+	}
+}
+
+// reconnect replaces the connection with a new session, retrying with
+// jittered exponential backoff until one is dialed and answers a ping,
+// so a client recovers within seconds of its server coming back. After
+// a PGOAWAY the new session is taken as it is and the old one is left to
+// its streams until the server goes; acceptStrms then closes it. It
+// returns false if the client shuts down first.
+func (tc *timedConn) reconnect(id int, away bool) bool {
+	pad := tc.cfg.Transport.Health.Pad
+	backoff := redialMin
+	for attempt := 1; ; attempt++ {
+		next, srv, err := tc.createConn()
+		if err != nil {
+			flog.Errorf("failed to redial client connection %d (attempt %d): %v", id, attempt, err)
+		} else {
+			prev, old := tc.set(next, srv)
+			if !away && prev != nil {
+				prev.Close()
+			}
+			if old != nil {
+				old.Close()
+			}
+			redials.Add(1)
+			flog.Infof("client connection %d redialed", id)
+			if away {
+				return true
+			}
+			// Check the new session at once, so held streams need not
+			// wait for the next tick.
+			start := time.Now()
+			if ping(next, pad) == nil {
+				tc.probe.ok(time.Since(start))
+				tc.healthy.Store(true)
+				return true
+			}
+			tc.probe.fail()
+			flog.Debugf("client connection %d does not answer after redial %d", id, attempt)
+		}
+
+		wait := backoff/2 + rand.N(backoff/2)
+		select {
+		case <-tc.ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, redialMax)
+	}
+}
+
+// rotate replaces the connection every transport.rotate seconds, give or
+// take a fifth, so a long-lived tunnel does not keep one source port and
+// KCP conversation. The new session says hello and authenticates like
+// any other before streams use it; the old one keeps its streams and is
+// closed when the last of them ends.
+func (tc *timedConn) rotate(id int) {
+	every := time.Duration(tc.cfg.Transport.Rotate) * time.Second
+	for {
+		timer := time.NewTimer(every - every/5 + rand.N(2*every/5))
+		select {
+		case <-tc.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		next, srv, err := tc.createConn()
+		if err != nil {
+			flog.Errorf("failed to rotate client connection %d: %v", id, err)
+			continue
+		}
+		prev, old := tc.set(next, srv)
+		if old != nil {
+			old.Close()
+		}
+		rotations.Add(1)
+		if c, ok := next.(interface{ Conv() uint32 }); ok {
+			flog.Infof("client connection %d rotated to conversation %08x", id, c.Conv())
+		} else {
+			flog.Infof("client connection %d rotated", id)
+		}
+		if prev != nil {
+			go tc.retire(prev)
+		}
+	}
+}
+
+// retireMax bounds how long a rotated connection is kept for streams
+// that never end, such as an idle SSH session.
+const retireMax = 10 * time.Minute
+
+// retire closes conn once it carries no more streams, after retireMax,
+// or when the client stops, whichever comes first.
+func (tc *timedConn) retire(conn tnet.Conn) {
+	k, ok := conn.(*kcp.Conn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	defer k.Close()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.NewTimer(retireMax)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-tc.ctx.Done():
+			return
+		case <-deadline.C:
+			if n := k.Session.NumStreams(); n > 0 {
+				flog.Infof("closing rotated connection with %d streams still open after %v", n, retireMax)
+			}
+			return
+		case <-ticker.C:
+			if k.IsClosed() || k.Session.NumStreams() == 0 {
+				return
+			}
+		}
+	}
+}
+
+// ping checks that the server answers on conn. With pad set it sends a
+// PMTU padded to a random size up to pad instead of a bare PPING, which
+// the server answers the same way.
+func ping(conn tnet.Conn, pad int) error {
+	if pad == 0 {
+		return conn.Ping(true)
+	}
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return fmt.Errorf("ping failed: %v", err)
+	}
+	defer strm.Close()
+	strm.SetDeadline(time.Now().Add(3 * time.Second))
+	p := protocol.Proto{Type: protocol.PMTU, Pad: rand.IntN(pad + 1)}
+	if err := p.Write(strm); err != nil {
+		return fmt.Errorf("ping write failed: %v", err)
+	}
+	if err := p.Read(strm); err != nil {
+		return fmt.Errorf("ping read failed: %v", err)
+	}
+	if p.Type != protocol.PPONG {
+		return fmt.Errorf("unexpected ping reply type %d", p.Type)
+	}
+	return nil
+}
+
+func (tc *timedConn) createConn() (tnet.Conn, *serverHello, error) {
 	netCfg := tc.cfg.Network
+	netCfg.TCP = tc.tcp.Load().Pick()
 	pConn, err := socket.New(tc.ctx, &netCfg)
 	if err != nil {
-		return nil, fmt.Errorf("could not create packet conn: %w", err)
+		return nil, nil, fmt.Errorf("could not create packet conn: %w", err)
 	}
 
-	conn, err := kcp.Dial(tc.cfg.Server.Addr, tc.cfg.Transport.KCP, pConn)
+	conn, err := kcp.Dial(tc.cfg.Server.PickAddr(), tc.cfg.Transport.KCP, pConn)
 	if err != nil {
 		pConn.Close()
-		return nil, err
+		return nil, nil, err
+	}
+	if tc.dscp != 0 {
+		pConn.SetDSCP(tc.dscp)
+	}
+	if tc.mtu != nil && tc.mtu.Load() != 0 {
+		conn.(*kcp.Conn).SetMTU(int(tc.mtu.Load()))
+	}
+	if tc.rcvwnd != nil && tc.rcvwnd.Load() != 0 {
+		conn.(*kcp.Conn).SetRcvWnd(int(tc.rcvwnd.Load()))
 	}
-	err = tc.sendTCPF(conn)
+	err = tc.sendTCPF(conn, netCfg.TCP.RF)
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return nil, nil, err
+	}
+	srv := &serverHello{done: make(chan struct{})}
+	go tc.hello(conn, srv)
+	go tc.acceptStrms(conn)
+	return conn, srv, nil
+}
+
+// acceptStrms answers the streams the server opens: a PGOAWAY when it
+// shuts down, or a registered extension type. After a PGOAWAY the
+// connection is redialed while its streams finish, so new ones go to a
+// new session. When the session ends, its packet conn is closed with it.
+func (tc *timedConn) acceptStrms(conn tnet.Conn) {
+	for {
+		strm, err := conn.AcceptStrm()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		strm.SetReadDeadline(time.Now().Add(10 * time.Second))
+		var p protocol.Proto
+		if err := p.Read(strm); err != nil {
+			strm.Close()
+			continue
+		}
+		strm.SetReadDeadline(time.Time{})
+		switch {
+		case p.Type == protocol.PGOAWAY:
+			strm.Close()
+			flog.Infof("server %s is shutting down, moving to a new connection", conn.RemoteAddr())
+			select {
+			case tc.away <- struct{}{}:
+			default:
+			}
+		case protocol.IsExt(p.Type) && protocol.Ext(p.Type) != nil:
+			go func() {
+				defer strm.Close()
+				if err := protocol.Ext(p.Type)(strm, &p); err != nil {
+					flog.Debugf("extension type %#x from %s failed: %v", p.Type, conn.RemoteAddr(), err)
+				}
+			}()
+		default:
+			strm.Close()
+		}
+	}
+}
+
+// serverHello is what the server answered to our PHELLO. Streams that
+// depend on a feature wait for done, so the server has recorded ours
+// before it sees them.
+type serverHello struct {
+	done     chan struct{}
+	features uint32
+}
+
+// has waits for the hello exchange and reports whether the server
+// advertised all of feats.
+func (h *serverHello) has(feats uint32) bool {
+	return h.uses(feats) == feats
+}
+
+// uses waits for the hello exchange and returns the bits of feats the
+// server advertised.
+func (h *serverHello) uses(feats uint32) uint32 {
+	if h == nil {
+		return 0
 	}
-	return conn, nil
+	<-h.done
+	return h.features & feats
 }
 
-func (tc *timedConn) sendTCPF(conn tnet.Conn) error {
+// hello advertises this build to the server and logs the server's. A
+// server older than PHELLO just closes the stream.
+func (tc *timedConn) hello(conn tnet.Conn, srv *serverHello) {
+	defer close(srv.done)
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return
+	}
+	defer strm.Close()
+
+	// Of the compression bits only the configured one is advertised, so
+	// the server's peer list shows what each client compresses with.
+	// Each stream still names its own in a POPTS.
+	feats := protocol.Features&^protocol.FeatCompress | protocol.CompressionFeature(tc.cfg.Transport.Compress)
+	p := protocol.Proto{Type: protocol.PHELLO, Version: protocol.Software, Features: feats}
+	if err := p.Write(strm); err != nil {
+		return
+	}
+	strm.SetDeadline(time.Now().Add(10 * time.Second))
+	var reply protocol.Proto
+	if err := reply.Read(strm); err != nil || reply.Type != protocol.PHELLO {
+		flog.Debugf("server %s did not answer hello; it predates version advertisement", conn.RemoteAddr())
+		return
+	}
+	srv.features = reply.Features
+	flog.Infof("server %s runs paqet %s (features: %s)", conn.RemoteAddr(), reply.Version, protocol.FeatureNames(reply.Features))
+	if tc.cfg.User != nil {
+		tc.auth(conn)
+	}
+}
+
+// auth proves to the server that the session belongs to the configured
+// user. Streams wait for it, so the server never sees them first.
+func (tc *timedConn) auth(conn tnet.Conn) {
+	c, ok := conn.(interface{ Conv() uint32 })
+	if !ok {
+		return
+	}
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		flog.Errorf("failed to authenticate to %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer strm.Close()
+
+	u := tc.cfg.User
+	now := time.Now().Unix()
+	p := protocol.Proto{Type: protocol.PAUTH, User: u.ID, Time: now, MAC: protocol.AuthMAC(u.Key, u.ID, c.Conv(), now)}
+	if err := p.Write(strm); err != nil {
+		flog.Errorf("failed to authenticate to %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	strm.SetDeadline(time.Now().Add(10 * time.Second))
+	var reply protocol.Proto
+	if err := reply.Read(strm); err != nil || reply.Type != protocol.PSTATUS {
+		flog.Errorf("server %s did not answer authentication as user %s", conn.RemoteAddr(), u.ID)
+		return
+	}
+	if reply.Status != protocol.StatusOK {
+		flog.Errorf("server %s rejected user %s: %s", conn.RemoteAddr(), u.ID, reply.Reason)
+		return
+	}
+	flog.Debugf("authenticated to %s as user %s", conn.RemoteAddr(), u.ID)
+}
+
+func (tc *timedConn) sendTCPF(conn tnet.Conn, rf []conf.TCPF) error {
 	strm, err := conn.OpenStrm()
 	if err != nil {
 		return err
 	}
 	defer strm.Close()
 
-	p := protocol.Proto{Type: protocol.PTCPF, TCPF: tc.cfg.Network.TCP.RF}
+	p := protocol.Proto{Type: protocol.PTCPF, TCPF: rf}
 	err = p.Write(strm)
 	if err != nil {
 		return err
@@ -65,7 +479,11 @@ func (tc *timedConn) sendTCPF(conn tnet.Conn) error {
 }
 
 func (tc *timedConn) close() {
-	if tc.conn != nil {
-		tc.conn.Close()
+	conn, tracker := tc.get()
+	if conn != nil {
+		conn.Close()
+	}
+	if tracker != nil {
+		tracker.Close()
 	}
 }
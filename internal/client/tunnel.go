@@ -0,0 +1,38 @@
+package client
+
+import (
+	"context"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/hooks"
+	"time"
+)
+
+// watchTunnel logs, and reports through the hooks, when every connection
+// starts failing its health checks and when one recovers.
+func (c *Client) watchTunnel(ctx context.Context) {
+	h := hooks.New(c.cfg.Hooks.Exec, c.cfg.Hooks.Webhook, time.Duration(c.cfg.Hooks.Timeout)*time.Second)
+	server := c.cfg.Server.Addr.String()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	var downSince time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		down := c.Down()
+		switch {
+		case down && downSince.IsZero():
+			downSince = time.Now()
+			flog.Warnf("tunnel to %s is down: every connection fails its health checks", server)
+			h.Fire(hooks.Event{Event: hooks.TunnelDown, Server: server, Time: downSince})
+		case !down && !downSince.IsZero():
+			d := time.Since(downSince)
+			downSince = time.Time{}
+			flog.Infof("tunnel to %s restored after %v", server, d.Round(time.Second))
+			h.Fire(hooks.Event{Event: hooks.TunnelRestored, Server: server, Time: time.Now(), DownFor: d.Seconds()})
+		}
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"paqet/internal/pkg/hash"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
+	"paqet/internal/wire"
+	"time"
 )
 
-func (c *Client) UDP(lAddr, tAddr string) (tnet.Strm, bool, uint64, error) {
+func (c *Client) UDP(lAddr, tAddr string, pol Policy) (tnet.Strm, bool, uint64, error) {
 	key := hash.AddrPair(lAddr, tAddr)
 	c.udpPool.mu.RLock()
 	if strm, exists := c.udpPool.strms[key]; exists {
@@ -17,26 +19,34 @@ func (c *Client) UDP(lAddr, tAddr string) (tnet.Strm, bool, uint64, error) {
 	}
 	c.udpPool.mu.RUnlock()
 
-	strm, err := c.newStrm()
+	taddr, err := tnet.NewAddr(tAddr)
 	if err != nil {
-		flog.Debugf("failed to create stream for UDP %s -> %s: %v", lAddr, tAddr, err)
+		flog.Debugf("invalid UDP address %s: %v", tAddr, err)
 		return nil, false, 0, err
 	}
 
-	taddr, err := tnet.NewAddr(tAddr)
+	strm, srv, err := c.newStrm(taddr, pol)
 	if err != nil {
-		flog.Debugf("invalid UDP address %s: %v", tAddr, err)
-		strm.Close()
+		flog.Debugf("failed to create stream for UDP %s -> %s: %v", lAddr, tAddr, err)
 		return nil, false, 0, err
 	}
+	framed := srv.has(protocol.FeatFramed)
 	p := protocol.Proto{Type: protocol.PUDP, Addr: taddr}
-	err = p.Write(strm)
+	if framed {
+		p.Type = protocol.PUDPF
+	}
+	rs, _, err := request(strm, srv, p, 0, false)
 	if err != nil {
 		flog.Debugf("failed to write UDP protocol header for %s -> %s on stream %d: %v", lAddr, tAddr, strm.SID(), err)
 		strm.Close()
 		return nil, false, 0, err
 	}
+	strm = rs
+	if framed {
+		strm = newFramedStrm(strm, time.Duration(c.cfg.Transport.UDPDelay)*time.Millisecond)
+	}
 
+	strm = track(strm, "udp", tAddr)
 	c.udpPool.mu.Lock()
 	c.udpPool.strms[key] = strm
 	c.udpPool.mu.Unlock()
@@ -48,3 +58,23 @@ func (c *Client) UDP(lAddr, tAddr string) (tnet.Strm, bool, uint64, error) {
 func (c *Client) CloseUDP(key uint64) error {
 	return c.udpPool.delete(key)
 }
+
+// framedStrm keeps datagram boundaries on a PUDPF stream: each Write
+// is one datagram and each Read returns one.
+type framedStrm struct {
+	tnet.Strm
+	r *wire.FrameReader
+	w *wire.FrameWriter
+}
+
+func newFramedStrm(strm tnet.Strm, delay time.Duration) *framedStrm {
+	return &framedStrm{Strm: strm, r: wire.NewFrameReader(strm), w: wire.NewFrameWriter(strm, delay)}
+}
+
+func (s *framedStrm) Read(b []byte) (int, error)  { return s.r.Read(b) }
+func (s *framedStrm) Write(b []byte) (int, error) { return s.w.Write(b) }
+
+func (s *framedStrm) Close() error {
+	s.w.Flush()
+	return s.Strm.Close()
+}
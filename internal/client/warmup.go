@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"paqet/internal/flog"
+	"time"
+)
+
+// warmupRetry is how often warmup pings a connection that has not
+// answered yet.
+const warmupRetry = 500 * time.Millisecond
+
+// WaitReady waits until a connection answers a ping through the server,
+// so listeners started afterwards do not fail their first streams on a
+// tunnel that is still coming up. It gives up after transport.warmup_timeout
+// and reports whether a connection answered.
+func (c *Client) WaitReady(ctx context.Context) bool {
+	conns := c.conns()
+	if len(conns) == 0 {
+		return false
+	}
+	timeout := time.Duration(c.cfg.Transport.Warmup) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+
+	ready := make(chan int, len(conns))
+	for i, tc := range conns {
+		go func() {
+			for ctx.Err() == nil {
+				conn, _ := tc.get()
+				if conn != nil && !conn.IsClosed() && ping(conn, c.cfg.Transport.Health.Pad) == nil {
+					tc.healthy.Store(true)
+					ready <- i + 1
+					return
+				}
+				select {
+				case <-ctx.Done():
+				case <-time.After(warmupRetry):
+				}
+			}
+		}()
+	}
+	select {
+	case id := <-ready:
+		flog.Infof("client connection %d ready after %v", id, time.Since(start).Round(time.Millisecond))
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
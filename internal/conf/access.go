@@ -0,0 +1,35 @@
+package conf
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Access writes a JSON line per relayed stream when it closes; an empty
+// Path disables it.
+type Access struct {
+	Path string `yaml:"path"`
+	// Destinations is how destinations are logged: full, hash (keyed by
+	// HashKey, or a key drawn at startup) or omit.
+	Destinations string `yaml:"destinations"`
+	HashKey      string `yaml:"hash_key"`
+}
+
+func (a *Access) setDefaults() {
+	if a.Destinations == "" {
+		a.Destinations = "full"
+	}
+}
+
+func (a *Access) validate() []error {
+	var errors []error
+
+	if !slices.Contains([]string{"full", "hash", "omit"}, a.Destinations) {
+		errors = append(errors, fmt.Errorf("access_log destinations must be one of: full, hash, omit"))
+	}
+	if a.HashKey != "" && a.Destinations != "hash" {
+		errors = append(errors, fmt.Errorf("access_log hash_key is only used with destinations: hash"))
+	}
+
+	return errors
+}
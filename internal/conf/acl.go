@@ -0,0 +1,179 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ACL restricts the destinations the server dials for clients. Rules
+// are checked in order and the first match decides; Default applies
+// when none matches. Unix socket targets are refused unless their path
+// is listed in Unix.
+type ACL struct {
+	Default string    `yaml:"default"`
+	Rules   []ACLRule `yaml:"rules"`
+	Unix    []string  `yaml:"unix"`
+}
+
+// ACLRule matches a destination by CIDR or domain suffix, port ranges
+// and protocol. An empty Match, Ports or Protocol matches anything.
+type ACLRule struct {
+	Action   string     `yaml:"action"`
+	Match    string     `yaml:"match"`
+	Ports    string     `yaml:"ports"`
+	Protocol string     `yaml:"protocol"`
+	CIDR     *net.IPNet `yaml:"-"`
+	ranges   [][2]int
+}
+
+func (a *ACL) setDefaults() {
+	if a.Default == "" {
+		a.Default = "allow"
+	}
+}
+
+func (a *ACL) validate() []error {
+	var errors []error
+
+	if a.Default != "allow" && a.Default != "deny" {
+		errors = append(errors, fmt.Errorf("acl default must be 'allow' or 'deny'"))
+	}
+	for _, path := range a.Unix {
+		if !filepath.IsAbs(path) {
+			errors = append(errors, fmt.Errorf("acl unix socket path '%s' must be absolute", path))
+		}
+	}
+	for i := range a.Rules {
+		r := &a.Rules[i]
+		if r.Action != "allow" && r.Action != "deny" {
+			errors = append(errors, fmt.Errorf("acl rule %d action must be 'allow' or 'deny'", i))
+		}
+		if r.Protocol != "" && r.Protocol != "tcp" && r.Protocol != "udp" {
+			errors = append(errors, fmt.Errorf("acl rule %d protocol must be 'tcp', 'udp' or empty", i))
+		}
+		if strings.Contains(r.Match, "/") {
+			_, cidr, err := net.ParseCIDR(r.Match)
+			if err != nil {
+				errors = append(errors, fmt.Errorf("acl rule %d: invalid CIDR '%s': %v", i, r.Match, err))
+			}
+			r.CIDR = cidr
+		} else if ip := net.ParseIP(r.Match); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			r.CIDR = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		r.Match = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(r.Match, "*."), "."))
+		ranges, err := parsePortRanges(r.Ports)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("acl rule %d: %v", i, err))
+		}
+		r.ranges = ranges
+	}
+
+	return errors
+}
+
+// Enabled reports whether the ACL can refuse anything.
+func (a *ACL) Enabled() bool {
+	return a.Default == "deny" || len(a.Rules) > 0
+}
+
+// Allow decides a dial to ip:port, requested as host over proto. host is
+// the name the client asked for, so domain rules see it even after it
+// resolved, while CIDR rules see the address actually dialed. It returns
+// the index of the deciding rule, or -1 for the default.
+func (a *ACL) Allow(proto, host string, ip net.IP, port int) (bool, int) {
+	allow, rule, _ := a.decide(proto, host, ip, port)
+	return allow, rule
+}
+
+// AllowUnix reports whether clients may reach the unix socket at path.
+func (a *ACL) AllowUnix(path string) bool {
+	path = filepath.Clean(path)
+	for _, p := range a.Unix {
+		if filepath.Clean(p) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuses reports whether a dial to host:port is denied whatever host
+// resolves to, so the server can refuse it without a lookup.
+func (a *ACL) Refuses(proto, host string, port int) (bool, int) {
+	allow, rule, decided := a.decide(proto, host, nil, port)
+	return decided && !allow, rule
+}
+
+// decide walks the rules. Without an ip it stops undecided at the first
+// CIDR rule that could match.
+func (a *ACL) decide(proto, host string, ip net.IP, port int) (allow bool, rule int, decided bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for i := range a.Rules {
+		r := &a.Rules[i]
+		if r.Protocol != "" && r.Protocol != proto {
+			continue
+		}
+		if !r.matchPort(port) {
+			continue
+		}
+		switch {
+		case r.CIDR != nil:
+			if ip == nil {
+				return false, i, false
+			}
+			if !r.CIDR.Contains(ip) {
+				continue
+			}
+		case r.Match != "" && r.Match != "*":
+			if host != r.Match && !strings.HasSuffix(host, "."+r.Match) {
+				continue
+			}
+		}
+		return r.Action == "allow", i, true
+	}
+	return a.Default == "allow", -1, true
+}
+
+func (r *ACLRule) matchPort(port int) bool {
+	if len(r.ranges) == 0 {
+		return true
+	}
+	for _, pr := range r.ranges {
+		if port >= pr[0] && port <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortRanges reads "22,80,8000-8100".
+func parsePortRanges(s string) ([][2]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var ranges [][2]int
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		a, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port '%s'", part)
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(hi); err != nil {
+				return nil, fmt.Errorf("invalid port '%s'", part)
+			}
+		}
+		if a < 1 || b > 65535 || a > b {
+			return nil, fmt.Errorf("invalid port range '%s'", part)
+		}
+		ranges = append(ranges, [2]int{a, b})
+	}
+	return ranges, nil
+}
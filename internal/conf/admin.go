@@ -0,0 +1,47 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Admin serves the control endpoint used by `paqet ctl` on Listen:
+// "unix:/path/to/socket" or a loopback host:port. Empty disables it.
+type Admin struct {
+	Listen string `yaml:"listen"`
+}
+
+func (a *Admin) setDefaults() {}
+
+func (a *Admin) validate() []error {
+	var errors []error
+
+	if a.Listen == "" {
+		return errors
+	}
+	if path, ok := strings.CutPrefix(a.Listen, "unix:"); ok {
+		if path == "" {
+			errors = append(errors, fmt.Errorf("admin listen 'unix:' needs a socket path"))
+		}
+		return errors
+	}
+	if err := loopback(a.Listen); err != nil {
+		errors = append(errors, fmt.Errorf("admin listen %v", err))
+	}
+
+	return errors
+}
+
+// loopback checks that addr is a host:port only this machine can reach,
+// for the endpoints that have no authentication.
+func loopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("'%s' must be host:port: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("'%s' must be a loopback address", addr)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// Admission bounds what a burst of new connections does to a client.
+// Opens caps the streams being opened at once and MaxStreams the streams
+// a connection carries; both are off at 0. OnFull is what a stream over
+// a cap does: reject fails it at once, wait queues it for up to Wait
+// seconds, with at most Queue streams waiting.
+type Admission struct {
+	Opens      int    `yaml:"opens"`
+	MaxStreams int    `yaml:"max_streams"`
+	OnFull     string `yaml:"on_full"`
+	Wait       int    `yaml:"wait"`
+	Queue      int    `yaml:"queue"`
+}
+
+func (a *Admission) setDefaults() {
+	if a.OnFull == "" {
+		a.OnFull = "reject"
+	}
+	if a.Wait == 0 {
+		a.Wait = 5
+	}
+	if a.Queue == 0 {
+		a.Queue = 1024
+	}
+}
+
+func (a *Admission) validate() []error {
+	var errors []error
+
+	if a.Opens < 0 || a.Opens > 65536 {
+		errors = append(errors, fmt.Errorf("admission opens must be between 0-65536"))
+	}
+	if a.MaxStreams < 0 || a.MaxStreams > 65536 {
+		errors = append(errors, fmt.Errorf("admission max_streams must be between 0-65536"))
+	}
+	if a.OnFull != "reject" && a.OnFull != "wait" {
+		errors = append(errors, fmt.Errorf("admission on_full must be 'reject' or 'wait'"))
+	}
+	if a.Wait < 1 || a.Wait > 300 {
+		errors = append(errors, fmt.Errorf("admission wait must be between 1-300 seconds"))
+	}
+	if a.Queue < 1 || a.Queue > 1<<20 {
+		errors = append(errors, fmt.Errorf("admission queue must be between 1-1048576"))
+	}
+
+	return errors
+}
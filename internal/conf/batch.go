@@ -0,0 +1,29 @@
+package conf
+
+import (
+	"fmt"
+)
+
+type Batch struct {
+	Size  int `yaml:"size"`
+	Delay int `yaml:"delay"`
+}
+
+func (b *Batch) setDefaults() {
+	if b.Size > 1 && b.Delay == 0 {
+		b.Delay = 200
+	}
+}
+
+func (b *Batch) validate() []error {
+	var errors []error
+
+	if b.Size < 0 || b.Size > 1024 {
+		errors = append(errors, fmt.Errorf("batch size must be between 0-1024 packets"))
+	}
+	if b.Delay < 0 || b.Delay > 10000 {
+		errors = append(errors, fmt.Errorf("batch delay must be between 0-10000 microseconds"))
+	}
+
+	return errors
+}
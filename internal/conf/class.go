@@ -0,0 +1,54 @@
+package conf
+
+import (
+	"fmt"
+	"slices"
+)
+
+type Class struct {
+	Enabled   bool  `yaml:"enabled"`
+	Ports     []int `yaml:"interactive_ports"`
+	BulkBytes int   `yaml:"bulk_bytes"`
+	Reserve   bool  `yaml:"reserve"`
+	Weight    int   `yaml:"weight"`
+}
+
+func (c *Class) setDefaults() {
+	// SSH, DNS, NTP, RDP, SIP and common game/VoIP ports.
+	if len(c.Ports) == 0 {
+		c.Ports = []int{22, 53, 123, 3389, 3478, 5060, 27015}
+	}
+	// Interactive streams rarely move more than a megabyte;
+	// anything past that is treated as a bulk transfer.
+	if c.BulkBytes == 0 {
+		c.BulkBytes = 1024 * 1024
+	}
+}
+
+func (c *Class) validate() []error {
+	var errors []error
+
+	for _, p := range c.Ports {
+		if p < 1 || p > 65535 {
+			errors = append(errors, fmt.Errorf("class interactive port %d must be between 1-65535", p))
+		}
+	}
+	if c.BulkBytes < 1024 {
+		errors = append(errors, fmt.Errorf("class bulk_bytes must be >= 1024 bytes"))
+	}
+	if c.Weight < 0 || c.Weight > 64 {
+		errors = append(errors, fmt.Errorf("class weight must be between 0-64"))
+	}
+	if c.Reserve && !c.Enabled {
+		errors = append(errors, fmt.Errorf("class reserve requires class to be enabled"))
+	}
+
+	return errors
+}
+
+func validatePriority(p string) error {
+	if !slices.Contains([]string{"", "interactive", "bulk"}, p) {
+		return fmt.Errorf("priority must be 'interactive' or 'bulk', got '%s'", p)
+	}
+	return nil
+}
@@ -2,7 +2,7 @@ package conf
 
 import (
 	"fmt"
-	"os"
+	"net"
 	"paqet/internal/flog"
 	"slices"
 	"strings"
@@ -19,14 +19,37 @@ type Conf struct {
 	Network   Network   `yaml:"network"`
 	Server    Server    `yaml:"server"`
 	Transport Transport `yaml:"transport"`
+	Store     Store     `yaml:"store"`
+	Flight    Flight    `yaml:"flight"`
+	Egress    Egress    `yaml:"egress"`
+	ACL       ACL       `yaml:"acl"`
+	Resolver  Resolver  `yaml:"resolver"`
+	Limit     Limit     `yaml:"limit"`
+	Users     []User    `yaml:"users"`
+	User      *User     `yaml:"user"`
+	Metrics   Metrics   `yaml:"metrics"`
+	Admin     Admin     `yaml:"admin"`
+	Debug     Debug     `yaml:"debug"`
+	IPFIX     IPFIX     `yaml:"ipfix"`
+	DNS       DNS       `yaml:"dns"`
+	Route     Route     `yaml:"route"`
+	Pool      Pool      `yaml:"pool"`
+	Proxy     Proxy     `yaml:"proxy_protocol"`
+	Access    Access    `yaml:"access_log"`
+	Hooks     Hooks     `yaml:"hooks"`
 }
 
 func LoadFromFile(path string) (*Conf, error) {
-	data, err := os.ReadFile(path)
+	data, err := ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	return Load(data)
+}
 
+// Load parses and validates a configuration held in memory, like
+// LoadFromFile, but without includes or environment references.
+func Load(data []byte) (*Conf, error) {
 	var conf Conf
 
 	if err := yaml.Unmarshal(data, &conf); err != nil {
@@ -58,14 +81,29 @@ func (c *Conf) setDefaults() {
 	c.Network.setDefaults(c.Role)
 	c.Server.setDefaults()
 	c.Transport.setDefaults(c.Role)
+	c.Store.setDefaults()
+	c.Flight.setDefaults()
+	c.Egress.setDefaults()
+	c.ACL.setDefaults()
+	c.Resolver.setDefaults()
+	c.Limit.setDefaults()
+	c.Metrics.setDefaults()
+	c.Admin.setDefaults()
+	c.Debug.setDefaults()
+	c.IPFIX.setDefaults()
+	c.Access.setDefaults()
+	c.DNS.setDefaults()
+	c.Route.setDefaults()
+	c.Pool.setDefaults()
+	c.Hooks.setDefaults()
 }
 
 func (c *Conf) validate() error {
 	var allErrors []error
 
 	allErrors = append(allErrors, c.Log.validate()...)
-	if c.Role == "client" && len(c.SOCKS5) == 0 && len(c.Forward) == 0 {
-		flog.Warnf("warning: client mode enabled but no SOCKS5 or forward configurations found")
+	if c.Role == "client" && len(c.SOCKS5) == 0 && len(c.Forward) == 0 && c.DNS.Listen_ == "" {
+		flog.Warnf("warning: client mode enabled but no SOCKS5, forward or dns configurations found")
 	}
 	for i := range c.SOCKS5 {
 		errs := c.SOCKS5[i].validate()
@@ -74,6 +112,9 @@ func (c *Conf) validate() error {
 		}
 	}
 
+	forwards, errs := expandForwards(c.Forward)
+	allErrors = append(allErrors, errs...)
+	c.Forward = forwards
 	for i := range c.Forward {
 		errs := c.Forward[i].validate()
 		for _, err := range errs {
@@ -81,21 +122,81 @@ func (c *Conf) validate() error {
 		}
 	}
 
+	if c.Network.Interface_ == "auto" {
+		port := "0" // random per connection on a client
+		if _, p, err := net.SplitHostPort(c.Listen.Addr_); err == nil && c.Role == "server" {
+			port = p
+		}
+		if err := c.Network.detect(port); err != nil {
+			allErrors = append(allErrors, err)
+		}
+	}
 	allErrors = append(allErrors, c.Network.validate()...)
 	allErrors = append(allErrors, c.Transport.validate()...)
+	if c.Transport.KCP != nil {
+		c.Transport.KCP.Cover = c.Network.Overhead()
+	}
+	for _, err := range c.Store.validate() {
+		allErrors = append(allErrors, fmt.Errorf("store %v", err))
+	}
+	allErrors = append(allErrors, c.Flight.validate()...)
+	allErrors = append(allErrors, c.Metrics.validate()...)
+	allErrors = append(allErrors, c.Admin.validate()...)
+	allErrors = append(allErrors, c.Debug.validate()...)
 	if c.Role == "server" {
 		allErrors = append(allErrors, c.Listen.validate()...)
+		c.Network.Ports = c.Listen.Ports
+		allErrors = append(allErrors, c.Egress.validate()...)
+		allErrors = append(allErrors, c.ACL.validate()...)
+		allErrors = append(allErrors, c.Resolver.validate()...)
+		allErrors = append(allErrors, c.Limit.validate()...)
+		allErrors = append(allErrors, c.IPFIX.validate()...)
+		allErrors = append(allErrors, c.Pool.validate()...)
+		allErrors = append(allErrors, c.Proxy.validate()...)
+		allErrors = append(allErrors, c.Access.validate()...)
+		seen := make(map[string]bool)
+		for i := range c.Users {
+			allErrors = append(allErrors, c.Users[i].validate()...)
+			if seen[c.Users[i].ID] {
+				allErrors = append(allErrors, fmt.Errorf("duplicate user id '%s'", c.Users[i].ID))
+			}
+			seen[c.Users[i].ID] = true
+		}
 	} else {
 		allErrors = append(allErrors, c.Server.validate()...)
-		if c.Server.Addr.IP.To4() != nil && c.Network.IPv4.Addr == nil {
+		for _, err := range c.DNS.validate() {
+			allErrors = append(allErrors, fmt.Errorf("dns %v", err))
+		}
+		allErrors = append(allErrors, c.Route.validate()...)
+		allErrors = append(allErrors, c.Hooks.validate()...)
+		if (c.Hooks.Exec != "" || c.Hooks.Webhook != "") && c.Transport.Health.Interval == 0 {
+			allErrors = append(allErrors, fmt.Errorf("hooks need a transport health interval to notice the tunnel going down"))
+		}
+		if c.User != nil {
+			allErrors = append(allErrors, c.User.validate()...)
+		}
+		if c.Server.Addr != nil && c.Server.Addr.IP.To4() != nil && c.Network.IPv4.Addr == nil {
 			allErrors = append(allErrors, fmt.Errorf("server address is IPv4, but the IPv4 interface is not configured"))
 		}
-		if c.Server.Addr.IP.To4() == nil && c.Network.IPv6.Addr == nil {
+		if c.Server.Addr != nil && c.Server.Addr.IP.To4() == nil && c.Network.IPv6.Addr == nil {
 			allErrors = append(allErrors, fmt.Errorf("server address is IPv6, but the IPv6 interface is not configured"))
 		}
+		if len(c.Network.Listeners) > 0 {
+			allErrors = append(allErrors, fmt.Errorf("network listeners are only used by a server"))
+		}
 		if c.Transport.Conn > 1 && c.Network.Port != 0 {
 			allErrors = append(allErrors, fmt.Errorf("only one connection is allowed when a client port is explicitly set"))
 		}
+		// A new session from the same address makes the server drop the
+		// old one, so rotation needs a fresh port per connection.
+		if c.Transport.Rotate > 0 && c.Network.Port != 0 {
+			allErrors = append(allErrors, fmt.Errorf("transport rotate is not allowed when a client port is explicitly set"))
+		}
+		// Probes after startup would come from the live connection's address
+		// and make the server replace that session.
+		if c.Transport.KCP != nil && c.Transport.KCP.PMTUDInterval > 0 && c.Network.Port != 0 {
+			allErrors = append(allErrors, fmt.Errorf("periodic path MTU discovery is not allowed when a client port is explicitly set"))
+		}
 	}
 	return writeErr(allErrors)
 }
@@ -0,0 +1,44 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// Debug serves net/http/pprof and paqet's runtime snapshots on
+// PprofListen, a loopback host:port; empty disables it. CaptureFile, when
+// set, mirrors every packet paqet sends and accepts into a pcapng file,
+// rotated at CaptureSize MiB with CaptureFiles kept.
+type Debug struct {
+	PprofListen    string `yaml:"pprof_listen"`
+	CaptureFile    string `yaml:"capture_file"`
+	CaptureSize    int    `yaml:"capture_size"`
+	CaptureFiles   int    `yaml:"capture_files"`
+	CaptureMarkers bool   `yaml:"capture_markers"`
+}
+
+func (d *Debug) setDefaults() {
+	if d.CaptureSize == 0 {
+		d.CaptureSize = 64
+	}
+	if d.CaptureFiles == 0 {
+		d.CaptureFiles = 3
+	}
+}
+
+func (d *Debug) validate() []error {
+	var errors []error
+
+	if d.PprofListen != "" {
+		if err := loopback(d.PprofListen); err != nil {
+			errors = append(errors, fmt.Errorf("debug pprof_listen %v", err))
+		}
+	}
+	if d.CaptureSize < 1 || d.CaptureSize > 4096 {
+		errors = append(errors, fmt.Errorf("debug capture_size must be between 1-4096 MiB"))
+	}
+	if d.CaptureFiles < 1 || d.CaptureFiles > 100 {
+		errors = append(errors, fmt.Errorf("debug capture_files must be between 1-100"))
+	}
+
+	return errors
+}
@@ -0,0 +1,63 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"paqet/internal/flog"
+)
+
+// detect resolves network.interface "auto" to the interface of the
+// default route and, when no address is set, fills in that interface's
+// address with port.
+func (n *Network) detect(port string) error {
+	iface, ip, err := defaultInterface()
+	if err != nil {
+		return fmt.Errorf("network interface auto: %v", err)
+	}
+	n.Interface_ = iface.Name
+	if n.IPv4.Addr_ == "" && n.IPv6.Addr_ == "" {
+		addr := net.JoinHostPort(ip.String(), port)
+		if ip.To4() != nil {
+			n.IPv4.Addr_ = addr
+		} else {
+			n.IPv6.Addr_ = addr
+		}
+	}
+	flog.Infof("network interface auto: using %s (%s), the default route", iface.Name, ip)
+	return nil
+}
+
+// defaultInterface finds the interface and address the host would send
+// to the internet from. Connecting a UDP socket only consults the
+// routing table; nothing is sent.
+func defaultInterface() (*net.Interface, net.IP, error) {
+	var local net.IP
+	for _, target := range []string{"192.0.2.1:9", "[2001:db8::1]:9"} {
+		c, err := net.Dial("udp", target)
+		if err != nil {
+			continue
+		}
+		local = c.LocalAddr().(*net.UDPAddr).IP
+		c.Close()
+		break
+	}
+	if local == nil {
+		return nil, nil, fmt.Errorf("no default route")
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(local) {
+				return &ifaces[i], local, nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("no interface has the default route's address %s", local)
+}
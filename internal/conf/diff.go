@@ -0,0 +1,39 @@
+package conf
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Changed lists the top-level sections, by YAML key, whose settings
+// differ between a and b. Sections are compared as written, defaults
+// applied, so derived state such as ciphers is never compared.
+func Changed(a, b *Conf) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		ya, erra := yaml.Marshal(va.Field(i).Interface())
+		yb, errb := yaml.Marshal(vb.Field(i).Interface())
+		if erra != nil || errb != nil || !bytes.Equal(ya, yb) {
+			changed = append(changed, strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0])
+		}
+	}
+	return changed
+}
+
+// CopySection sets the section of dst stored under the YAML key name to
+// that of src.
+func CopySection(dst, src *Conf, name string) {
+	vd, vs := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	t := vd.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0] == name {
+			vd.Field(i).Set(vs.Field(i))
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+)
+
+// DNS answers DNS queries on the client and forwards them through the
+// tunnel; an empty Listen disables it.
+type DNS struct {
+	Listen_  string       `yaml:"listen"`
+	Upstream string       `yaml:"upstream"`
+	Cache    int          `yaml:"cache"`
+	Listen   *net.UDPAddr `yaml:"-"`
+}
+
+func (d *DNS) setDefaults() {
+	if d.Upstream == "" {
+		d.Upstream = "1.1.1.1:53"
+	}
+	if d.Cache == 0 {
+		d.Cache = 4096
+	}
+}
+
+func (d *DNS) validate() []error {
+	var errors []error
+	if d.Listen_ == "" {
+		return nil
+	}
+
+	addr, err := validateAddr(d.Listen_, true)
+	if err != nil {
+		errors = append(errors, err)
+	}
+	d.Listen = addr
+
+	if _, _, err := net.SplitHostPort(d.Upstream); err != nil {
+		d.Upstream = net.JoinHostPort(d.Upstream, "53")
+	}
+	if d.Cache < 0 || d.Cache > 1<<20 {
+		errors = append(errors, fmt.Errorf("dns cache must be between 0-1048576 entries"))
+	}
+
+	return errors
+}
@@ -0,0 +1,87 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+var egressFamilies = []string{"auto", "prefer-v4", "prefer-v6", "v4-only", "v6-only", "happy-eyeballs"}
+
+// Egress sets which address family the server dials destinations over.
+type Egress struct {
+	Family    string           `yaml:"family"`
+	Fallback  int              `yaml:"fallback"`
+	Overrides []EgressOverride `yaml:"overrides"`
+	Fwmark    uint32           `yaml:"fwmark"` // linux
+}
+
+// EgressOverride applies its own family to destinations matching Match,
+// a domain (covering its subdomains) or a CIDR.
+type EgressOverride struct {
+	Match  string     `yaml:"match"`
+	Family string     `yaml:"family"`
+	CIDR   *net.IPNet `yaml:"-"`
+}
+
+func (e *Egress) setDefaults() {
+	if e.Family == "" {
+		e.Family = "auto"
+	}
+	if e.Fallback == 0 {
+		e.Fallback = 300
+	}
+}
+
+func (e *Egress) validate() []error {
+	var errors []error
+
+	if !slices.Contains(egressFamilies, e.Family) {
+		errors = append(errors, fmt.Errorf("egress family must be one of: %v", egressFamilies))
+	}
+	if e.Fallback < 10 || e.Fallback > 10000 {
+		errors = append(errors, fmt.Errorf("egress fallback must be between 10-10000 milliseconds"))
+	}
+	if e.Fwmark != 0 && runtime.GOOS != "linux" {
+		errors = append(errors, fmt.Errorf("egress fwmark is only supported on linux"))
+	}
+	for i := range e.Overrides {
+		o := &e.Overrides[i]
+		if o.Match == "" {
+			errors = append(errors, fmt.Errorf("egress override %d needs a match", i))
+		}
+		if !slices.Contains(egressFamilies, o.Family) {
+			errors = append(errors, fmt.Errorf("egress override %d family must be one of: %v", i, egressFamilies))
+		}
+		if strings.Contains(o.Match, "/") {
+			_, cidr, err := net.ParseCIDR(o.Match)
+			if err != nil {
+				errors = append(errors, fmt.Errorf("egress override %d: invalid CIDR '%s': %v", i, o.Match, err))
+			}
+			o.CIDR = cidr
+		}
+		o.Match = strings.ToLower(strings.TrimSuffix(o.Match, "."))
+	}
+
+	return errors
+}
+
+// FamilyFor returns the family for a destination host.
+func (e *Egress) FamilyFor(host string) string {
+	ip := net.ParseIP(host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, o := range e.Overrides {
+		if o.CIDR != nil {
+			if ip != nil && o.CIDR.Contains(ip) {
+				return o.Family
+			}
+			continue
+		}
+		if host == o.Match || strings.HasSuffix(host, "."+o.Match) {
+			return o.Family
+		}
+	}
+	return e.Family
+}
@@ -0,0 +1,26 @@
+package conf
+
+import (
+	"fmt"
+)
+
+type Flight struct {
+	Records int    `yaml:"records"`
+	Path    string `yaml:"path"`
+}
+
+func (f *Flight) setDefaults() {
+	if f.Records == 0 {
+		f.Records = 65536
+	}
+}
+
+func (f *Flight) validate() []error {
+	var errors []error
+
+	if f.Records < 1 || f.Records > 16*1024*1024 {
+		errors = append(errors, fmt.Errorf("flight records must be between 1-16777216"))
+	}
+
+	return errors
+}
@@ -1,32 +1,187 @@
 package conf
 
 import (
+	"fmt"
 	"net"
 	"paqet/internal/tnet"
+	"runtime"
+	"strconv"
+	"strings"
 )
 
+// maxForwardRange bounds the ports one forward rule may expand to.
+const maxForwardRange = 4096
+
 type Forward struct {
 	Listen_  string       `yaml:"listen"`
 	Target_  string       `yaml:"target"`
 	Protocol string       `yaml:"protocol"`
+	Priority string       `yaml:"priority"`
+	DSCP     int          `yaml:"dscp"`
+	Resolve  string       `yaml:"resolve"`
+	Resolver string       `yaml:"resolver"`
+	Proxy    bool         `yaml:"proxy_protocol"` // expect a PROXY protocol header (TCP)
+	BindIP   string       `yaml:"bind_ip"`        // source of what the rule sends outside the tunnel
+	Fwmark   uint32       `yaml:"fwmark"`         // linux
 	Listen   *net.UDPAddr `yaml:"-"`
 	Target   *tnet.Addr   `yaml:"-"`
+	Bind     net.IP       `yaml:"-"`
 }
 
-func (c *Forward) setDefaults() {}
+func (c *Forward) setDefaults() {
+	if c.Resolve == "" {
+		c.Resolve = "server"
+	}
+}
 func (c *Forward) validate() []error {
 	var errors []error
-	l, err := validateAddr(c.Listen_, true)
-	if err != nil {
-		errors = append(errors, err)
+	path, unix := strings.CutPrefix(c.Listen_, tnet.UnixPrefix)
+	if unix {
+		if path == "" {
+			errors = append(errors, fmt.Errorf("missing unix socket path in listen address"))
+		}
+	} else {
+		l, err := validateAddr(c.Listen_, true)
+		if err != nil {
+			errors = append(errors, err)
+		}
+		c.Listen = l
 	}
-	c.Listen = l
 
 	t, err := tnet.NewAddr(c.Target_)
 	if err != nil {
 		errors = append(errors, err)
 	}
 	c.Target = t
+	if (unix || strings.HasPrefix(c.Target_, tnet.UnixPrefix)) && c.Protocol != "tcp" {
+		errors = append(errors, fmt.Errorf("unix sockets are only supported for tcp forwards"))
+	}
+
+	if err := validatePriority(c.Priority); err != nil {
+		errors = append(errors, err)
+	}
+	if c.DSCP < 0 || c.DSCP > 63 {
+		errors = append(errors, fmt.Errorf("dscp must be between 0-63"))
+	}
+	errors = append(errors, validateResolve(c.Resolve, &c.Resolver)...)
+	if c.Proxy && c.Protocol != "tcp" {
+		errors = append(errors, fmt.Errorf("proxy_protocol is only supported for tcp forwards"))
+	}
+	c.Bind = nil
+	if c.BindIP != "" {
+		if c.Bind = net.ParseIP(c.BindIP); c.Bind == nil {
+			errors = append(errors, fmt.Errorf("bind_ip must be an IP address"))
+		}
+	}
+	if c.Fwmark != 0 && runtime.GOOS != "linux" {
+		errors = append(errors, fmt.Errorf("fwmark is only supported on linux"))
+	}
+
+	return errors
+}
+
+// ParseForward checks a rule added while running, as through the admin
+// endpoint, the way the config file's rules are: defaults are filled in
+// and a port range becomes one rule per port.
+func ParseForward(f Forward) ([]Forward, error) {
+	f.setDefaults()
+	if f.Protocol != "tcp" && f.Protocol != "udp" {
+		return nil, fmt.Errorf("protocol must be 'tcp' or 'udp'")
+	}
+	rules, errs := expandForwards([]Forward{f})
+	for i := range rules {
+		errs = append(errs, rules[i].validate()...)
+	}
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return rules, nil
+}
 
+// ListenAddr is the address the forwarder binds: host:port, or
+// "unix:/path" for a unix socket.
+func (c *Forward) ListenAddr() string {
+	if c.Listen == nil {
+		return c.Listen_
+	}
+	return c.Listen.String()
+}
+
+// expandForwards turns each rule listening on a port range ("a-b") into
+// one rule per port. Its target port is then a range of the same size,
+// one port for all of them, or "*" for the listen port; "*" also works
+// with a single listen port.
+func expandForwards(in []Forward) ([]Forward, []error) {
+	var out []Forward
+	var errors []error
+	for i, f := range in {
+		lhost, lport, err := net.SplitHostPort(f.Listen_)
+		if err != nil {
+			out = append(out, f)
+			continue
+		}
+		thost, tport, err := net.SplitHostPort(f.Target_)
+		if err != nil || !strings.Contains(lport, "-") && tport != "*" {
+			out = append(out, f)
+			continue
+		}
+		lfirst, llast, err := parsePortRange(lport)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("forward[%d] listen: %v", i, err))
+			continue
+		}
+		if llast-lfirst+1 > maxForwardRange {
+			errors = append(errors, fmt.Errorf("forward[%d] listen range is over %d ports", i, maxForwardRange))
+			continue
+		}
+		tfirst, tlast := lfirst, llast
+		if tport != "*" {
+			if tfirst, tlast, err = parsePortRange(tport); err != nil {
+				errors = append(errors, fmt.Errorf("forward[%d] target: %v", i, err))
+				continue
+			}
+			if tfirst != tlast && tlast-tfirst != llast-lfirst {
+				errors = append(errors, fmt.Errorf("forward[%d] target range must be one port or as long as the listen range", i))
+				continue
+			}
+		}
+		for p := lfirst; p <= llast; p++ {
+			r := f
+			r.Listen_ = net.JoinHostPort(lhost, strconv.Itoa(p))
+			tp := tfirst
+			if tfirst != tlast {
+				tp += p - lfirst
+			}
+			r.Target_ = net.JoinHostPort(thost, strconv.Itoa(tp))
+			out = append(out, r)
+		}
+	}
+	return out, errors
+}
+
+// parsePortRange parses "a-b" or a single port.
+func parsePortRange(s string) (int, int, error) {
+	ranges, err := parsePortRanges(s)
+	if err != nil || len(ranges) != 1 {
+		return 0, 0, fmt.Errorf("invalid port range '%s'", s)
+	}
+	return ranges[0][0], ranges[0][1], nil
+}
+
+// validateResolve checks where hostname destinations are resolved, and
+// adds the default port to a nameserver given without one.
+func validateResolve(resolve string, resolver *string) []error {
+	var errors []error
+	if resolve != "server" && resolve != "client" {
+		errors = append(errors, fmt.Errorf("resolve must be 'server' or 'client'"))
+	}
+	if *resolver != "" {
+		if _, _, err := net.SplitHostPort(*resolver); err != nil {
+			*resolver = net.JoinHostPort(*resolver, "53")
+		}
+		if host, _, _ := net.SplitHostPort(*resolver); net.ParseIP(host) == nil {
+			errors = append(errors, fmt.Errorf("resolver must be an IP address"))
+		}
+	}
 	return errors
 }
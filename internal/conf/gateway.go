@@ -0,0 +1,25 @@
+package conf
+
+import (
+	"fmt"
+)
+
+type Gateway struct {
+	Refresh int `yaml:"refresh"`
+}
+
+func (g *Gateway) setDefaults() {
+	if g.Refresh == 0 {
+		g.Refresh = 30
+	}
+}
+
+func (g *Gateway) validate() []error {
+	var errors []error
+
+	if g.Refresh < 1 || g.Refresh > 3600 {
+		errors = append(errors, fmt.Errorf("gateway refresh must be between 1-3600 seconds"))
+	}
+
+	return errors
+}
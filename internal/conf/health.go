@@ -0,0 +1,61 @@
+package conf
+
+import (
+	"fmt"
+)
+
+type Health struct {
+	Interval int `yaml:"interval"`
+	Failures int `yaml:"failures"`
+	Grace    int `yaml:"grace"`
+	// Pad is the most padding a client adds to each ping, in bytes. The
+	// size is drawn anew per ping, so pings have no constant size.
+	Pad int `yaml:"pad"`
+	// OnDown is what new streams do while every connection fails its
+	// pings: hold waits up to Hold seconds for one to recover, reject
+	// fails them at once, and direct connects without the tunnel.
+	OnDown string `yaml:"on_down"`
+	Hold   int    `yaml:"hold"`
+}
+
+func (h *Health) setDefaults() {
+	if h.Failures == 0 {
+		h.Failures = 2
+	}
+	if h.OnDown == "" {
+		h.OnDown = "hold"
+	}
+	if h.Hold == 0 {
+		h.Hold = 10
+	}
+}
+
+func (h *Health) validate() []error {
+	var errors []error
+
+	if h.Interval < 0 || h.Interval > 3600 {
+		errors = append(errors, fmt.Errorf("health interval must be between 0-3600 seconds"))
+	}
+	if h.Failures < 1 || h.Failures > 100 {
+		errors = append(errors, fmt.Errorf("health failures must be between 1-100"))
+	}
+	if h.Grace < 0 || h.Grace > 3600 {
+		errors = append(errors, fmt.Errorf("health grace must be between 0-3600 seconds"))
+	}
+	if h.Pad < 0 || h.Pad > 1200 {
+		errors = append(errors, fmt.Errorf("health pad must be between 0-1200 bytes"))
+	}
+	switch h.OnDown {
+	case "hold", "reject", "direct":
+		if h.OnDown != "hold" && h.Interval == 0 {
+			errors = append(errors, fmt.Errorf("health on_down '%s' needs a health interval", h.OnDown))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("health on_down must be 'hold', 'reject' or 'direct'"))
+	}
+	if h.Hold < 1 || h.Hold > 300 {
+		errors = append(errors, fmt.Errorf("health hold must be between 1-300 seconds"))
+	}
+
+	return errors
+}
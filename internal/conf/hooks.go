@@ -0,0 +1,41 @@
+package conf
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Hooks report the tunnel going down and coming back: Exec is run with
+// the event name as its last argument, and Webhook receives a JSON POST.
+// Either may be empty.
+type Hooks struct {
+	Exec    string `yaml:"exec"`
+	Webhook string `yaml:"webhook"`
+	Timeout int    `yaml:"timeout"`
+}
+
+func (h *Hooks) setDefaults() {
+	if h.Timeout == 0 {
+		h.Timeout = 10
+	}
+}
+
+func (h *Hooks) validate() []error {
+	var errors []error
+
+	if h.Exec != "" && len(strings.Fields(h.Exec)) == 0 {
+		errors = append(errors, fmt.Errorf("hooks exec must name a command"))
+	}
+	if h.Webhook != "" {
+		u, err := url.Parse(h.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errors = append(errors, fmt.Errorf("hooks webhook must be an http or https URL"))
+		}
+	}
+	if h.Timeout < 1 || h.Timeout > 300 {
+		errors = append(errors, fmt.Errorf("hooks timeout must be between 1-300 seconds"))
+	}
+
+	return errors
+}
@@ -0,0 +1,39 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+)
+
+// Idle bounds, in seconds, how long the server keeps relaying a stream
+// that carries nothing either way; -1 never ends one.
+type Idle struct {
+	TCP int `yaml:"tcp"`
+	UDP int `yaml:"udp"`
+}
+
+func (i *Idle) setDefaults() {
+	if i.TCP == 0 {
+		i.TCP = 7200
+	}
+	if i.UDP == 0 {
+		i.UDP = 180
+	}
+}
+
+func (i *Idle) validate() []error {
+	var errors []error
+
+	if i.TCP < -1 || i.TCP > 86400 {
+		errors = append(errors, fmt.Errorf("idle tcp must be -1 or between 1-86400 seconds"))
+	}
+	if i.UDP < -1 || i.UDP > 86400 {
+		errors = append(errors, fmt.Errorf("idle udp must be -1 or between 1-86400 seconds"))
+	}
+
+	return errors
+}
+
+// TCPTimeout and UDPTimeout return the bounds as durations, 0 for none.
+func (i *Idle) TCPTimeout() time.Duration { return max(time.Duration(i.TCP), 0) * time.Second }
+func (i *Idle) UDPTimeout() time.Duration { return max(time.Duration(i.UDP), 0) * time.Second }
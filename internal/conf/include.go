@@ -0,0 +1,202 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+// maxIncludeDepth bounds how deeply included files may include others.
+const maxIncludeDepth = 8
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ReadFile reads the configuration at path with its includes merged in
+// and environment references expanded, ready for Load.
+//
+// ${NAME} is replaced by the environment variable NAME, and ${NAME:-x}
+// by x when NAME is unset; an unset NAME without a default is an error.
+// References are expanded inside the values of the parsed file, so a
+// variable holding YAML syntax cannot add keys or change the structure;
+// a value that is a single reference takes the type of what it expands
+// to, as "port: ${PORT}" must stay a number. Comments are ignored.
+//
+// A top-level include, a file name or a list of them with globs allowed,
+// merges those files into the one naming them, resolved relative to its
+// directory: mappings are merged key by key, lists such as forward are
+// concatenated, and for any other value the including file wins.
+func ReadFile(path string) ([]byte, error) {
+	data, doc, err := readDoc(path, nil)
+	if err != nil || doc == nil {
+		return data, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// readDoc returns the contents of path and, only if it includes other
+// files or references the environment, the expanded and merged document.
+// stack holds the files including it.
+func readDoc(path string, stack []string) ([]byte, map[string]any, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if slices.Contains(stack, abs) {
+		return nil, nil, fmt.Errorf("%s includes itself", path)
+	}
+	if len(stack) > maxIncludeDepth {
+		return nil, nil, fmt.Errorf("includes nested deeper than %d files at %s", maxIncludeDepth, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// Load reports syntax errors with their line numbers.
+		return data, nil, nil
+	}
+	var missing []string
+	expanded := false
+	for k, v := range doc {
+		doc[k] = expandEnv(v, &expanded, &missing)
+	}
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("%s: environment variables not set: %v", path, missing)
+	}
+	if doc["include"] == nil {
+		if !expanded {
+			return data, nil, nil
+		}
+		return data, doc, nil
+	}
+	var patterns []string
+	switch inc := doc["include"].(type) {
+	case string:
+		patterns = []string{inc}
+	case []any:
+		for _, p := range inc {
+			s, ok := p.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: include must list file names", path)
+			}
+			patterns = append(patterns, s)
+		}
+	default:
+		return nil, nil, fmt.Errorf("%s: include must be a file name or a list of them", path)
+	}
+	delete(doc, "include")
+
+	stack = append(stack, abs)
+	dir := filepath.Dir(path)
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: include %q: %v", path, pattern, err)
+		}
+		if len(files) == 0 {
+			return nil, nil, fmt.Errorf("%s: include %q matches no file", path, pattern)
+		}
+		for _, f := range files { // Glob sorts them
+			sub, subDoc, err := readDoc(f, stack)
+			if err != nil {
+				return nil, nil, err
+			}
+			if subDoc == nil {
+				if err := yaml.Unmarshal(sub, &subDoc); err != nil {
+					return nil, nil, fmt.Errorf("%s: %v", f, err)
+				}
+			}
+			merge(doc, subDoc)
+		}
+	}
+	return data, doc, nil
+}
+
+// merge adds src to dst: mappings merge, lists append and dst keeps its
+// other values.
+func merge(dst, src map[string]any) {
+	for k, v := range src {
+		cur, ok := dst[k]
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		switch cur := cur.(type) {
+		case map[string]any:
+			if m, ok := v.(map[string]any); ok {
+				merge(cur, m)
+			}
+		case []any:
+			if l, ok := v.([]any); ok {
+				dst[k] = append(cur, l...)
+			}
+		}
+	}
+}
+
+// expandEnv replaces environment references in the strings of v, a
+// parsed YAML value, and returns the result. It sets expanded when it
+// finds any, and adds the variables it cannot resolve to missing.
+func expandEnv(v any, expanded *bool, missing *[]string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = expandEnv(e, expanded, missing)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = expandEnv(e, expanded, missing)
+		}
+	case string:
+		if !strings.Contains(v, "${") {
+			return v
+		}
+		*expanded = true
+		out := envRef.ReplaceAllStringFunc(v, func(ref string) string {
+			m := envRef.FindStringSubmatch(ref)
+			if e, ok := os.LookupEnv(m[1]); ok {
+				return e
+			}
+			if m[2] != "" {
+				return m[3]
+			}
+			*missing = append(*missing, m[1])
+			return ""
+		})
+		if loc := envRef.FindStringIndex(v); loc[0] == 0 && loc[1] == len(v) {
+			return scalar(out)
+		}
+		return out
+	}
+	return v
+}
+
+// scalar types s as a plain YAML scalar would be: a number or a boolean
+// if it reads as one and prints back the same, else the string itself,
+// so a secret such as 0123 keeps its digits.
+func scalar(s string) any {
+	if strings.ContainsAny(s, "\n\r") {
+		return s
+	}
+	var m map[string]any
+	if err := yaml.Unmarshal([]byte("v: "+s), &m); err != nil {
+		return s
+	}
+	switch v := m["v"].(type) {
+	case bool, int, int64, uint64, float64:
+		if fmt.Sprint(v) == s {
+			return v
+		}
+	}
+	return s
+}
@@ -0,0 +1,195 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+)
+
+// writeFiles creates files, name to contents, in a new directory and
+// returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readMap reads path with ReadFile and parses the result.
+func readMap(t *testing.T, path string) map[string]any {
+	t.Helper()
+	data, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("result does not parse: %v\n%s", err, data)
+	}
+	return doc
+}
+
+func TestIncludeMerge(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.yaml": `
+include: extra.yaml
+role: client
+log:
+  level: info
+forward:
+  - listen: "127.0.0.1:1"
+`,
+		"extra.yaml": `
+role: server
+log:
+  level: debug
+  debug_for: 60
+forward:
+  - listen: "127.0.0.1:2"
+`,
+	})
+	got := readMap(t, filepath.Join(dir, "main.yaml"))
+	want := map[string]any{
+		"role": "client",
+		"log":  map[string]any{"level": "info", "debug_for": uint64(60)},
+		"forward": []any{
+			map[string]any{"listen": "127.0.0.1:1"},
+			map[string]any{"listen": "127.0.0.1:2"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("merged to %v, want %v", got, want)
+	}
+}
+
+func TestIncludeGlob(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.yaml":       "include: [\"fwd/*.yaml\"]\nforward: []\n",
+		"fwd/b.yaml":      "forward: [{listen: b}]\n",
+		"fwd/a.yaml":      "forward: [{listen: a}]\n",
+		"fwd/c.txt":       "forward: [{listen: c}]\n",
+		"nested.yaml":     "include: sub/deeper.yaml\n",
+		"sub/deeper.yaml": "include: leaf.yaml\n",
+		"sub/leaf.yaml":   "role: server\n",
+		"none.yaml":       "include: missing/*.yaml\n",
+	})
+	got := readMap(t, filepath.Join(dir, "main.yaml"))["forward"]
+	want := []any{map[string]any{"listen": "a"}, map[string]any{"listen": "b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("forward is %v, want %v in file name order", got, want)
+	}
+
+	// Includes resolve against the directory of the file naming them.
+	if role := readMap(t, filepath.Join(dir, "nested.yaml"))["role"]; role != "server" {
+		t.Fatalf("nested include gave role %v", role)
+	}
+
+	if _, err := ReadFile(filepath.Join(dir, "none.yaml")); err == nil || !strings.Contains(err.Error(), "matches no file") {
+		t.Fatalf("include without a match gave %v", err)
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml":    "include: b.yaml\n",
+		"b.yaml":    "include: a.yaml\n",
+		"self.yaml": "include: self.yaml\n",
+	})
+	for _, name := range []string{"a.yaml", "self.yaml"} {
+		if _, err := ReadFile(filepath.Join(dir, name)); err == nil || !strings.Contains(err.Error(), "includes itself") {
+			t.Errorf("%s: got %v, want a cycle error", name, err)
+		}
+	}
+
+	files := map[string]string{}
+	for i := 0; i <= maxIncludeDepth+1; i++ {
+		files[filepath.Join(strings.Repeat("d/", i), "f.yaml")] = "include: d/f.yaml\n"
+	}
+	dir = writeFiles(t, files)
+	if _, err := ReadFile(filepath.Join(dir, "f.yaml")); err == nil || !strings.Contains(err.Error(), "nested deeper") {
+		t.Errorf("deep includes gave %v, want a depth error", err)
+	}
+}
+
+func TestIncludeEnv(t *testing.T) {
+	t.Setenv("PAQET_TEST_KEY", "s3cr3t")
+	t.Setenv("PAQET_TEST_HOST", "10.0.0.1")
+	t.Setenv("PAQET_TEST_PORT", "8443")
+	t.Setenv("PAQET_TEST_ON", "true")
+	t.Setenv("PAQET_TEST_EVIL", "x\nrole: server\nlog: {level: none}")
+	t.Setenv("PAQET_TEST_FLOW", "{level: none}")
+	t.Setenv("PAQET_TEST_DIGITS", "0123")
+
+	dir := writeFiles(t, map[string]string{
+		"main.yaml": `
+# ${PAQET_TEST_UNSET} in a comment is left alone
+role: client
+key: "${PAQET_TEST_KEY}"
+addr: ${PAQET_TEST_HOST}:${PAQET_TEST_PORT}
+port: ${PAQET_TEST_PORT}
+on: ${PAQET_TEST_ON}
+fallback: ${PAQET_TEST_UNSET:-plain}
+empty: ${PAQET_TEST_UNSET:-}
+evil: ${PAQET_TEST_EVIL}
+flow: ${PAQET_TEST_FLOW}
+list: [a, "${PAQET_TEST_KEY}"]
+digits: ${PAQET_TEST_DIGITS}
+`,
+		"missing.yaml": "role: client\nkey: ${PAQET_TEST_UNSET}\nother: ${PAQET_TEST_UNSET_TOO}\n",
+	})
+	got := readMap(t, filepath.Join(dir, "main.yaml"))
+	want := map[string]any{
+		"role":     "client",
+		"key":      "s3cr3t",
+		"addr":     "10.0.0.1:8443",
+		"port":     uint64(8443),
+		"on":       true,
+		"fallback": "plain",
+		"empty":    "",
+		"evil":     "x\nrole: server\nlog: {level: none}",
+		"flow":     "{level: none}",
+		"list":     []any{"a", "s3cr3t"},
+		"digits":   "0123",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expanded to %#v, want %#v", got, want)
+	}
+
+	_, err := ReadFile(filepath.Join(dir, "missing.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "PAQET_TEST_UNSET") || !strings.Contains(err.Error(), "PAQET_TEST_UNSET_TOO") {
+		t.Fatalf("unset variables gave %v, want both named", err)
+	}
+}
+
+// TestIncludeEnvTyped loads a value that is a single reference into a
+// typed field.
+func TestIncludeEnvTyped(t *testing.T) {
+	t.Setenv("PAQET_TEST_LEVEL", "debug")
+	t.Setenv("PAQET_TEST_SECONDS", "90")
+	dir := writeFiles(t, map[string]string{
+		"main.yaml": "log:\n  level: ${PAQET_TEST_LEVEL}\n  debug_for: ${PAQET_TEST_SECONDS}\n",
+	})
+	data, err := ReadFile(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c struct{ Log Log }
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		t.Fatalf("unmarshal: %v\n%s", err, data)
+	}
+	if c.Log.Level_ != "debug" || c.Log.DebugFor != 90 {
+		t.Fatalf("log is %+v", c.Log)
+	}
+}
@@ -0,0 +1,39 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+)
+
+// IPFIX exports relayed flows to a collector; an empty Collector
+// disables it.
+type IPFIX struct {
+	Collector string `yaml:"collector"`
+	Domain    int    `yaml:"domain"`
+	// Active is how often, in seconds, flows still running are reported.
+	Active int `yaml:"active_timeout"`
+}
+
+func (x *IPFIX) setDefaults() {
+	if x.Active == 0 {
+		x.Active = 60
+	}
+}
+
+func (x *IPFIX) validate() []error {
+	var errors []error
+
+	if x.Collector != "" {
+		if _, _, err := net.SplitHostPort(x.Collector); err != nil {
+			errors = append(errors, fmt.Errorf("ipfix collector '%s' must be host:port: %v", x.Collector, err))
+		}
+	}
+	if x.Domain < 0 || int64(x.Domain) > 0xffffffff {
+		errors = append(errors, fmt.Errorf("ipfix domain must be between 0-4294967295"))
+	}
+	if x.Active < 1 || x.Active > 3600 {
+		errors = append(errors, fmt.Errorf("ipfix active_timeout must be between 1-3600 seconds"))
+	}
+
+	return errors
+}
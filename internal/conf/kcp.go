@@ -1,6 +1,8 @@
 package conf
 
 import (
+	"crypto/cipher"
+	"crypto/fips140"
 	"fmt"
 	"slices"
 
@@ -15,8 +17,13 @@ type KCP struct {
 	NoCongestion int    `yaml:"nocongestion"`
 	WDelay       bool   `yaml:"wdelay"`
 	AckNoDelay   bool   `yaml:"acknodelay"`
+	DSCP         int    `yaml:"dscp"`
+
+	MTU           int  `yaml:"mtu"`
+	PMTUD         bool `yaml:"pmtud"`
+	PMTUDInterval int  `yaml:"pmtud_interval"`
+	ProbeInterval int  `yaml:"probe_interval"`
 
-	MTU    int `yaml:"mtu"`
 	Rcvwnd int `yaml:"rcvwnd"`
 	Sndwnd int `yaml:"sndwnd"`
 	Dshard int `yaml:"dshard"`
@@ -24,11 +31,20 @@ type KCP struct {
 
 	Block_ string `yaml:"block"`
 	Key    string `yaml:"key"`
+	FIPS   bool   `yaml:"fips"`
+	Obfs   bool   `yaml:"obfs"`
 
 	Smuxbuf   int `yaml:"smuxbuf"`
 	Streambuf int `yaml:"streambuf"`
 
-	Block kcp.BlockCrypt `yaml:"-"`
+	KeepAlive        int `yaml:"keepalive"`         // seconds between smux keepalives
+	KeepAliveTimeout int `yaml:"keepalive_timeout"` // seconds without one before a session closes
+	DeadPeer         int `yaml:"dead_peer"`         // client: seconds of silence before it redials
+
+	Block     kcp.BlockCrypt `yaml:"-"`
+	AEAD      cipher.AEAD    `yaml:"-"` // inside Block when it is an AEAD block
+	HeaderKey cipher.Block   `yaml:"-"`
+	Cover     int            `yaml:"-"` // network.mimic overhead, see Network.Overhead
 }
 
 func (k *KCP) setDefaults(role string) {
@@ -76,12 +92,21 @@ func (k *KCP) setDefaults(role string) {
 	if k.Streambuf == 0 {
 		k.Streambuf = 2 * 1024 * 1024
 	}
+
+	// 10s keeps control traffic low; 40s tolerates transient loss
+	// without disconnect flaps.
+	if k.KeepAlive == 0 {
+		k.KeepAlive = 10
+	}
+	if k.KeepAliveTimeout == 0 {
+		k.KeepAliveTimeout = 40
+	}
 }
 
 func (k *KCP) validate() []error {
 	var errors []error
 
-	validModes := []string{"normal", "fast", "fast2", "fast3", "stream", "1to1", "manual"}
+	validModes := []string{"normal", "fast", "fast2", "fast3", "stream", "1to1", "manual", "auto"}
 	if !slices.Contains(validModes, k.Mode) {
 		errors = append(errors, fmt.Errorf("KCP mode must be one of: %v", validModes))
 	}
@@ -90,6 +115,17 @@ func (k *KCP) validate() []error {
 		errors = append(errors, fmt.Errorf("KCP MTU must be between 50-1500 bytes"))
 	}
 
+	if k.PMTUDInterval < 0 {
+		errors = append(errors, fmt.Errorf("KCP pmtud_interval must be >= 0"))
+	}
+	if k.ProbeInterval < 0 {
+		errors = append(errors, fmt.Errorf("KCP probe_interval must be >= 0"))
+	}
+
+	if k.DSCP < 0 || k.DSCP > 63 {
+		errors = append(errors, fmt.Errorf("KCP dscp must be between 0-63"))
+	}
+
 	if k.Rcvwnd < 1 || k.Rcvwnd > 32768 {
 		errors = append(errors, fmt.Errorf("KCP rcvwnd must be between 1-32768"))
 	}
@@ -104,11 +140,29 @@ func (k *KCP) validate() []error {
 	if !slices.Contains([]string{"none", "null"}, k.Block_) && len(k.Key) == 0 {
 		errors = append(errors, fmt.Errorf("KCP encryption key is required"))
 	}
-	b, err := newBlock(k.Block_, k.Key)
+	if k.FIPS {
+		if k.Block_ != "aes-128-gcm" {
+			errors = append(errors, fmt.Errorf("KCP fips mode only allows block 'aes-128-gcm'"))
+		}
+		if k.Obfs {
+			errors = append(errors, fmt.Errorf("KCP fips mode does not allow obfs, whose header scrambling is not an approved service"))
+		}
+		if !fips140.Enabled() {
+			errors = append(errors, fmt.Errorf("KCP fips mode requires the Go FIPS 140-3 module: run with GODEBUG=fips140=on or build with GOFIPS140=latest"))
+		}
+	}
+	b, aead, err := newBlock(k.Block_, k.Key, k.FIPS)
 	if err != nil {
 		errors = append(errors, err)
 	}
-	k.Block = b
+	k.Block, k.AEAD = b, aead
+	if k.Obfs {
+		if len(k.Key) == 0 {
+			errors = append(errors, fmt.Errorf("KCP obfs requires a key"))
+		} else if k.HeaderKey, err = newHeaderKey(k.Key); err != nil {
+			errors = append(errors, err)
+		}
+	}
 
 	if k.Smuxbuf < 1024 {
 		errors = append(errors, fmt.Errorf("KCP smuxbuf must be >= 1024 bytes"))
@@ -117,5 +171,17 @@ func (k *KCP) validate() []error {
 		errors = append(errors, fmt.Errorf("KCP streambuf must be >= 1024 bytes"))
 	}
 
+	if k.KeepAlive < 1 || k.KeepAlive > 3600 {
+		errors = append(errors, fmt.Errorf("KCP keepalive must be between 1-3600 seconds"))
+	}
+	if k.KeepAliveTimeout < 2*k.KeepAlive || k.KeepAliveTimeout > 7200 {
+		errors = append(errors, fmt.Errorf("KCP keepalive_timeout must be at least twice keepalive and at most 7200 seconds"))
+	}
+	// A live peer sends at least a keepalive per interval, so anything
+	// shorter would redial healthy sessions.
+	if k.DeadPeer < 0 || k.DeadPeer > 0 && k.DeadPeer < 2*k.KeepAlive {
+		errors = append(errors, fmt.Errorf("KCP dead_peer must be 0 (off) or at least twice keepalive"))
+	}
+
 	return errors
 }
@@ -1,6 +1,9 @@
 package conf
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	fipspbkdf2 "crypto/pbkdf2"
 	"crypto/sha256"
 	"fmt"
 
@@ -9,14 +12,14 @@ import (
 )
 
 type blockCrypt struct {
-	keySize int // required key size; if 0, the entire key is used
-	build   func(key []byte) (kcp.BlockCrypt, error)
+	keySize int                                      // required key size; if 0, the entire key is used
+	build   func(key []byte) (kcp.BlockCrypt, error) // nil for the blocks of aeadCrypts
 }
 
 var blockCrypts = map[string]blockCrypt{
 	"aes":         {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
 	"aes-128":     {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
-	"aes-128-gcm": {16, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESGCMCrypt(key) }},
+	"aes-128-gcm": {16, nil},
 	"aes-192":     {24, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(key) }},
 	"salsa20":     {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewSalsa20BlockCrypt(key) }},
 	"blowfish":    {0, func(key []byte) (kcp.BlockCrypt, error) { return kcp.NewBlowfishBlockCrypt(key) }},
@@ -31,20 +34,68 @@ var blockCrypts = map[string]blockCrypt{
 	"null":        {0, func(key []byte) (kcp.BlockCrypt, error) { return nil, nil }},
 }
 
-func newBlock(block, key string) (kcp.BlockCrypt, error) {
-	dkey := pbkdf2.Key([]byte(key), []byte("paqet"), 100_000, 32, sha256.New)
+// aeadCrypts build the AEAD blocks, which kcp-go seals with directly.
+var aeadCrypts = map[string]func(key []byte) (cipher.AEAD, error){
+	"aes-128-gcm": newAESGCM,
+}
+
+// fipsSalt is the PBKDF2 salt in fips mode, as long as SP 800-132
+// requires. It is fixed, since both ends derive the same key without
+// exchanging anything, so the key itself must be a random secret.
+var fipsSalt = []byte("paqet-fips140-v1")
+
+// newAESGCM is AES-128-GCM with the nonce drawn inside the FIPS module,
+// the only way GCM is approved for encryption. kcp-go passes an empty
+// nonce to an AEAD of nonce size 0 and sends what Seal returns, so the
+// packet is the same random 12 byte nonce, ciphertext and tag that
+// kcp.NewAESGCMCrypt produces, and either end can use either.
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithRandomNonce(block)
+}
+
+// newBlock builds the block cipher keyed from key, and for an AEAD block
+// also returns the cipher.AEAD inside it. In fips mode the key is
+// derived by the FIPS module's PBKDF2 with fipsSalt; otherwise with the
+// short salt of every release before it, which the module refuses.
+func newBlock(block, key string, fips bool) (kcp.BlockCrypt, cipher.AEAD, error) {
+	var dkey []byte
+	if fips {
+		var err error
+		if dkey, err = fipspbkdf2.Key(sha256.New, key, fipsSalt, 100_000, 32); err != nil {
+			return nil, nil, fmt.Errorf("failed to derive the KCP key: %w", err)
+		}
+	} else {
+		dkey = pbkdf2.Key([]byte(key), []byte("paqet"), 100_000, 32, sha256.New)
+	}
 
 	if b, ok := blockCrypts[block]; ok {
 		bkey := dkey
 		if b.keySize > 0 && len(bkey) >= b.keySize {
 			bkey = bkey[:b.keySize]
 		}
+		if build := aeadCrypts[block]; build != nil {
+			aead, err := build(bkey)
+			if err != nil {
+				return nil, nil, err
+			}
+			return kcp.NewAEADCrypt(aead), aead, nil
+		}
 		block, err := b.build(bkey)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		return block, nil
+		return block, nil, nil
 	}
 
-	return nil, fmt.Errorf("unsupported block type: %s", block)
+	return nil, nil, fmt.Errorf("unsupported block type: %s", block)
+}
+
+// newHeaderKey derives the AES key that scrambles packet headers when
+// obfs is on, separately from the block cipher's.
+func newHeaderKey(key string) (cipher.Block, error) {
+	return aes.NewCipher(pbkdf2.Key([]byte(key), []byte("paqet-obfs"), 100_000, 16, sha256.New))
 }
@@ -0,0 +1,65 @@
+package conf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// sealer is how kcp-go uses an AEAD block.
+type sealer interface {
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+	NonceSize() int
+}
+
+// seal builds a packet of payload as kcp-go does: the nonce size in
+// random bytes, then the payload sealed after them.
+func seal(b sealer, payload []byte) []byte {
+	n := b.NonceSize()
+	buf := make([]byte, n+len(payload), 1500)
+	rand.Read(buf[:n])
+	copy(buf[n:], payload)
+	return b.Seal(buf[:n], buf[:n], buf[n:], nil)
+}
+
+// open reads a packet as kcp-go does.
+func open(b sealer, pkt []byte) ([]byte, error) {
+	n := b.NonceSize()
+	return b.Open(pkt[n:n], pkt[:n], pkt[n:], nil)
+}
+
+// TestAESGCMCompatible checks that a packet sealed with the random
+// nonce AEAD of fips mode opens with kcp-go's own AES-GCM and back, so
+// a fips end talks to one without.
+func TestAESGCMCompatible(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 16)
+	aead, err := newAESGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours := kcp.NewAEADCrypt(aead)
+	theirs, err := kcp.NewAESGCMCrypt(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("a kcp segment")
+	for _, dir := range []struct {
+		name     string
+		from, to sealer
+	}{
+		{"fips to kcp-go", ours.(sealer), theirs.(sealer)},
+		{"kcp-go to fips", theirs.(sealer), ours.(sealer)},
+	} {
+		pkt := seal(dir.from, payload)
+		if len(pkt) != 12+len(payload)+16 {
+			t.Fatalf("%s: packet of %d bytes, want nonce, payload and tag", dir.name, len(pkt))
+		}
+		got, err := open(dir.to, pkt)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Fatalf("%s: opened %q, %v", dir.name, got, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// Limit caps the throughput the server relays, in each direction, across
+// all clients and per client session. Rates are in kbit/s, bursts in
+// bytes; a zero rate is unlimited.
+type Limit struct {
+	Rate        int `yaml:"rate"`
+	Burst       int `yaml:"burst"`
+	ClientRate  int `yaml:"client_rate"`
+	ClientBurst int `yaml:"client_burst"`
+}
+
+func (l *Limit) setDefaults() {
+	if l.Rate > 0 && l.Burst == 0 {
+		l.Burst = defaultBurst(l.Rate)
+	}
+	if l.ClientRate > 0 && l.ClientBurst == 0 {
+		l.ClientBurst = defaultBurst(l.ClientRate)
+	}
+}
+
+// defaultBurst allows 100ms at full rate, and at least 64KB so a single
+// relay buffer never waits for more than it can hold.
+func defaultBurst(rate int) int {
+	return max(rate*1000/8/10, 65536)
+}
+
+func (l *Limit) validate() []error {
+	var errors []error
+
+	if l.Rate < 0 || l.ClientRate < 0 {
+		errors = append(errors, fmt.Errorf("limit rates must not be negative"))
+	}
+	if l.Burst < 0 || l.ClientBurst < 0 {
+		errors = append(errors, fmt.Errorf("limit bursts must not be negative"))
+	}
+
+	return errors
+}
@@ -2,10 +2,14 @@ package conf
 
 import (
 	"fmt"
+	"paqet/internal/flog"
 )
 
 type Log struct {
 	Level_ string `yaml:"level"`
+	// DebugFor is how long, in seconds, SIGUSR2 turns on debug logging
+	// before the level reverts.
+	DebugFor int `yaml:"debug_for"`
 
 	Level int `yaml:"-"`
 }
@@ -14,25 +18,20 @@ func (l *Log) setDefaults() {
 	if l.Level_ == "" {
 		l.Level_ = "none"
 	}
+	if l.DebugFor == 0 {
+		l.DebugFor = 600
+	}
 }
 
 func (l *Log) validate() []error {
 	var errors []error
-	switch l.Level_ {
-	case "none":
-		l.Level = -1
-	case "debug":
-		l.Level = 0
-	case "info":
-		l.Level = 1
-	case "warn":
-		l.Level = 2
-	case "error":
-		l.Level = 3
-	case "fatal":
-		l.Level = 4
-	default:
-		errors = append(errors, fmt.Errorf("invalid logging level '%s': must be one of none, debug, info, warn, error, fatal", l.Level_))
+	level, err := flog.ParseLevel(l.Level_)
+	if err != nil {
+		errors = append(errors, err)
+	}
+	l.Level = int(level)
+	if l.DebugFor < 1 || l.DebugFor > 86400 {
+		errors = append(errors, fmt.Errorf("log debug_for must be between 1-86400 seconds"))
 	}
 	return errors
 }
@@ -0,0 +1,25 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+)
+
+// Metrics serves Prometheus metrics on Listen; empty disables it.
+type Metrics struct {
+	Listen string `yaml:"listen"`
+}
+
+func (m *Metrics) setDefaults() {}
+
+func (m *Metrics) validate() []error {
+	var errors []error
+
+	if m.Listen != "" {
+		if _, _, err := net.SplitHostPort(m.Listen); err != nil {
+			errors = append(errors, fmt.Errorf("metrics listen '%s' must be host:port: %v", m.Listen, err))
+		}
+	}
+
+	return errors
+}
@@ -3,6 +3,7 @@ package conf
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"runtime"
 )
 
@@ -16,10 +17,30 @@ type Addr struct {
 type Network struct {
 	Interface_ string         `yaml:"interface"`
 	GUID       string         `yaml:"guid"`
+	Backend    string         `yaml:"backend"`
 	IPv4       Addr           `yaml:"ipv4"`
 	IPv6       Addr           `yaml:"ipv6"`
 	PCAP       PCAP           `yaml:"pcap"`
+	Batch      Batch          `yaml:"batch"`
+	Gateway    Gateway        `yaml:"gateway"`
 	TCP        TCP            `yaml:"tcp"`
+	Listeners  []Listener     `yaml:"listeners"`
+	Sources_   []string       `yaml:"allowed_sources"`
+	Fwmark     uint32         `yaml:"fwmark"` // linux
+	Mimic      string         `yaml:"mimic"`  // tcp, or the UDP protocol packets look like
+	Interface  *net.Interface `yaml:"-"`
+	Port       int            `yaml:"-"`
+	Ports      []PortRange    `yaml:"-"` // a server's ports besides Port
+	Sources    []netip.Prefix `yaml:"-"` // the only peers packets are taken from, if any
+}
+
+// Listener is one more address a server receives on, on its own
+// interface or IP; the rest of the network section applies to it too.
+type Listener struct {
+	Interface_ string         `yaml:"interface"`
+	GUID       string         `yaml:"guid"`
+	IPv4       Addr           `yaml:"ipv4"`
+	IPv6       Addr           `yaml:"ipv6"`
 	Interface  *net.Interface `yaml:"-"`
 	Port       int            `yaml:"-"`
 }
@@ -31,11 +52,79 @@ func (n *Network) setDefaults(role string) {
 	if n.PCAP.Sockbuf == 0 && n.TCP.PCAP.Sockbuf != 0 {
 		n.PCAP.Sockbuf = n.TCP.PCAP.Sockbuf
 	}
+	if n.Backend == "" {
+		n.Backend = "pcap"
+	}
+	if n.Mimic == "" {
+		n.Mimic = "tcp"
+	}
 	n.PCAP.setDefaults(role)
+	n.Batch.setDefaults()
+	n.Gateway.setDefaults()
 	n.TCP.setDefaults()
 }
 
 func (n *Network) validate() []error {
+	errors := n.validateIface()
+
+	if n.PCAP.Sockbuf != 0 && n.TCP.PCAP.Sockbuf != 0 && n.PCAP.Sockbuf != n.TCP.PCAP.Sockbuf {
+		errors = append(errors, fmt.Errorf("pcap.sockbuf configured in both network.pcap (%d) and network.tcp.pcap (%d); use only one", n.PCAP.Sockbuf, n.TCP.PCAP.Sockbuf))
+	}
+
+	errors = append(errors, n.PCAP.validate()...)
+	if n.PCAP.Workers > 1 && n.Backend != "afpacket" {
+		errors = append(errors, fmt.Errorf("pcap.workers > 1 needs the afpacket backend, which spreads packets across workers by kernel fanout"))
+	}
+	errors = append(errors, n.Batch.validate()...)
+	errors = append(errors, n.Gateway.validate()...)
+	errors = append(errors, n.TCP.validate()...)
+	if n.Fwmark != 0 {
+		switch {
+		case runtime.GOOS != "linux":
+			errors = append(errors, fmt.Errorf("network fwmark is only supported on linux"))
+		case n.Backend != "pcap" && n.Backend != "afpacket" && n.Backend != "xdp":
+			errors = append(errors, fmt.Errorf("network fwmark is not supported with the %s backend", n.Backend))
+		}
+	}
+	switch n.Mimic {
+	case "tcp", "wireguard", "dtls":
+	default:
+		errors = append(errors, fmt.Errorf("network mimic must be one of: tcp, wireguard, dtls"))
+	}
+
+	// Each source is a few instructions in the capture filter.
+	if len(n.Sources_) > 16 {
+		errors = append(errors, fmt.Errorf("at most 16 allowed_sources are allowed"))
+	}
+	n.Sources = nil
+	for _, s := range n.Sources_ {
+		p, err := netip.ParsePrefix(s)
+		if ip, err2 := netip.ParseAddr(s); err != nil && err2 == nil {
+			p, err = netip.PrefixFrom(ip, ip.BitLen()), nil
+		}
+		if err != nil {
+			errors = append(errors, fmt.Errorf("invalid allowed_sources entry '%s': want an IP or CIDR", s))
+			continue
+		}
+		n.Sources = append(n.Sources, p.Masked())
+	}
+
+	for i := range n.Listeners {
+		l := &n.Listeners[i]
+		c := *n
+		c.Interface_, c.GUID, c.IPv4, c.IPv6 = l.Interface_, l.GUID, l.IPv4, l.IPv6
+		for _, err := range c.validateIface() {
+			errors = append(errors, fmt.Errorf("network listener %d: %v", i+1, err))
+		}
+		l.Interface, l.IPv4, l.IPv6, l.Port = c.Interface, c.IPv4, c.IPv6, c.Port
+	}
+
+	return errors
+}
+
+// validateIface checks the interface and addresses, the part of the
+// section a listener has its own of.
+func (n *Network) validateIface() []error {
 	var errors []error
 
 	if n.Interface_ == "" {
@@ -50,8 +139,21 @@ func (n *Network) validate() []error {
 	}
 	n.Interface = lIface
 
-	if runtime.GOOS == "windows" && n.GUID == "" {
-		errors = append(errors, fmt.Errorf("guid is required on windows"))
+	if runtime.GOOS == "windows" && n.Backend == "pcap" && n.GUID == "" {
+		errors = append(errors, fmt.Errorf("guid is required on windows with the pcap backend"))
+	}
+	switch n.Backend {
+	case "pcap":
+	case "afpacket", "xdp":
+		if runtime.GOOS != "linux" {
+			errors = append(errors, fmt.Errorf("network backend '%s' is only available on linux", n.Backend))
+		}
+	case "windivert":
+		if runtime.GOOS != "windows" {
+			errors = append(errors, fmt.Errorf("network backend 'windivert' is only available on windows"))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("network backend must be one of: pcap, afpacket, xdp, windivert"))
 	}
 
 	ipv4Configured := n.IPv4.Addr_ != ""
@@ -78,16 +180,49 @@ func (n *Network) validate() []error {
 		n.Port = n.IPv6.Addr.Port
 	}
 
-	if n.PCAP.Sockbuf != 0 && n.TCP.PCAP.Sockbuf != 0 && n.PCAP.Sockbuf != n.TCP.PCAP.Sockbuf {
-		errors = append(errors, fmt.Errorf("pcap.sockbuf configured in both network.pcap (%d) and network.tcp.pcap (%d); use only one", n.PCAP.Sockbuf, n.TCP.PCAP.Sockbuf))
+	// WinDivert injects at the IP layer and never needs the MAC.
+	autoMAC := (ipv4Configured && n.IPv4.Router == nil) || (ipv6Configured && n.IPv6.Router == nil)
+	if autoMAC && runtime.GOOS != "linux" && n.Backend != "windivert" {
+		errors = append(errors, fmt.Errorf("router_mac discovery is only available on linux; set router_mac explicitly"))
 	}
 
-	errors = append(errors, n.PCAP.validate()...)
-	errors = append(errors, n.TCP.validate()...)
-
 	return errors
 }
 
+// UDP reports whether tunnel packets are carried in UDP, framed as the
+// protocol of mimic, instead of the default fake TCP.
+func (n *Network) UDP() bool {
+	return n.Mimic == "wireguard" || n.Mimic == "dtls"
+}
+
+// Overhead is how many bytes the UDP header and cover framing of mimic
+// take in a packet beyond the 32 byte fake TCP header the KCP MTU is
+// counted against: a WireGuard data message adds 16 bytes of header, a
+// 16 byte tag and up to 15 of padding, a DTLS record 13 bytes of header,
+// an 8 byte nonce and a 16 byte tag (see socket/cover.go).
+func (n *Network) Overhead() int {
+	switch n.Mimic {
+	case "wireguard":
+		return 8 + 16 + 16 + 15 - 32
+	case "dtls":
+		return 8 + 13 + 8 + 16 - 32
+	}
+	return 0
+}
+
+// Listens returns the network of each address a server receives on: n
+// itself, then one per listener.
+func (n *Network) Listens() []Network {
+	nets := []Network{*n}
+	for _, l := range n.Listeners {
+		c := *n
+		c.Interface_, c.GUID, c.IPv4, c.IPv6 = l.Interface_, l.GUID, l.IPv4, l.IPv6
+		c.Interface, c.Port = l.Interface, l.Port
+		nets = append(nets, c)
+	}
+	return nets
+}
+
 func (n *Addr) validate() []error {
 	var errors []error
 
@@ -97,8 +232,10 @@ func (n *Addr) validate() []error {
 	}
 	n.Addr = l
 
-	if n.RouterMac_ == "" {
-		errors = append(errors, fmt.Errorf("Router MAC address is required"))
+	// Empty or "auto" leaves Router nil: the gateway is looked up in
+	// the neighbour table and kept current at runtime.
+	if n.RouterMac_ == "" || n.RouterMac_ == "auto" {
+		return errors
 	}
 
 	hwAddr, err := net.ParseMAC(n.RouterMac_)
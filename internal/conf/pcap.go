@@ -7,6 +7,7 @@ import (
 
 type PCAP struct {
 	Sockbuf int `yaml:"sockbuf"`
+	Workers int `yaml:"workers"`
 }
 
 func (p *PCAP) setDefaults(role string) {
@@ -20,6 +21,9 @@ func (p *PCAP) setDefaults(role string) {
 			p.Sockbuf = 4 * 1024 * 1024
 		}
 	}
+	if p.Workers == 0 {
+		p.Workers = 1
+	}
 }
 
 func (p *PCAP) validate() []error {
@@ -33,6 +37,10 @@ func (p *PCAP) validate() []error {
 		errors = append(errors, fmt.Errorf("PCAP sockbuf too large (max 100MB)"))
 	}
 
+	if p.Workers < 1 || p.Workers > 64 {
+		errors = append(errors, fmt.Errorf("PCAP workers must be between 1-64"))
+	}
+
 	// Should be power of 2 for optimal performance, but not required
 	if p.Sockbuf&(p.Sockbuf-1) != 0 {
 		flog.Warnf("PCAP sockbuf (%d bytes) is not a power of 2 - consider using values like 4MB, 8MB, or 16MB for better performance", p.Sockbuf)
@@ -0,0 +1,32 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// Pool keeps spare TCP connections to destinations the server dials
+// often; Idle 0 disables it.
+type Pool struct {
+	// Idle is how long, in seconds, a spare connection waits to be used.
+	Idle int `yaml:"idle"`
+	Max  int `yaml:"max"`
+}
+
+func (p *Pool) setDefaults() {
+	if p.Max == 0 {
+		p.Max = 64
+	}
+}
+
+func (p *Pool) validate() []error {
+	var errors []error
+
+	if p.Idle < 0 || p.Idle > 300 {
+		errors = append(errors, fmt.Errorf("pool idle must be between 0-300 seconds"))
+	}
+	if p.Max < 1 || p.Max > 4096 {
+		errors = append(errors, fmt.Errorf("pool max must be between 1-4096 connections"))
+	}
+
+	return errors
+}
@@ -0,0 +1,83 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Proxy makes the server open TCP connections to matching
+// destinations with a PROXY protocol v2 header naming the client, so a
+// backend behind the server sees who connected. Targets are CIDRs, IPs
+// or domain suffixes; Ports optionally narrows them.
+type Proxy struct {
+	Targets []string `yaml:"targets"`
+	Ports   string   `yaml:"ports"`
+	cidrs   []*net.IPNet
+	domains []string
+	ranges  [][2]int
+}
+
+func (p *Proxy) validate() []error {
+	var errors []error
+
+	p.cidrs, p.domains = nil, nil
+	for _, t := range p.Targets {
+		if ip := net.ParseIP(t); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			p.cidrs = append(p.cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		if strings.Contains(t, "/") {
+			_, cidr, err := net.ParseCIDR(t)
+			if err != nil {
+				errors = append(errors, fmt.Errorf("proxy_protocol target '%s': %v", t, err))
+				continue
+			}
+			p.cidrs = append(p.cidrs, cidr)
+			continue
+		}
+		p.domains = append(p.domains, strings.ToLower(strings.TrimSuffix(t, ".")))
+	}
+	ranges, err := parsePortRanges(p.Ports)
+	if err != nil {
+		errors = append(errors, fmt.Errorf("proxy_protocol %v", err))
+	}
+	p.ranges = ranges
+
+	return errors
+}
+
+// Matches reports whether a connection to host (as the client named
+// it), dialed at ip and port, gets the header.
+func (p *Proxy) Matches(host string, ip net.IP, port int) bool {
+	if len(p.Targets) == 0 {
+		return false
+	}
+	if len(p.ranges) > 0 {
+		in := false
+		for _, r := range p.ranges {
+			if port >= r[0] && port <= r[1] {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	for _, c := range p.cidrs {
+		if ip != nil && c.Contains(ip) {
+			return true
+		}
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range p.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package conf
+
+import (
+	"github.com/goccy/go-yaml"
+)
+
+// Redacted renders the effective configuration, defaults included,
+// without keys and passwords.
+func (c *Conf) Redacted() ([]byte, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var tree any
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	redact(tree)
+	return yaml.Marshal(tree)
+}
+
+func redact(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if (k == "key" || k == "password" || k == "hash_key" || k == "webhook") && e != "" {
+				v[k] = "<redacted>"
+				continue
+			}
+			redact(e)
+		}
+	case []any:
+		for _, e := range v {
+			redact(e)
+		}
+	}
+}
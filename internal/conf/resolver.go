@@ -0,0 +1,52 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+)
+
+// Resolver controls how the server looks up hostname destinations.
+type Resolver struct {
+	Timeout     int      `yaml:"timeout"`
+	Attempts    int      `yaml:"attempts"`
+	Servers     []string `yaml:"servers"`
+	NegativeTTL int      `yaml:"negative_ttl"`
+}
+
+func (r *Resolver) setDefaults() {
+	if r.Timeout == 0 {
+		r.Timeout = 2000
+	}
+	if r.Attempts == 0 {
+		r.Attempts = 2
+	}
+	if r.NegativeTTL == 0 {
+		r.NegativeTTL = 10
+	}
+}
+
+func (r *Resolver) validate() []error {
+	var errors []error
+
+	if r.Timeout < 100 || r.Timeout > 30000 {
+		errors = append(errors, fmt.Errorf("resolver timeout must be between 100-30000 milliseconds"))
+	}
+	if r.Attempts < 1 || r.Attempts > 5 {
+		errors = append(errors, fmt.Errorf("resolver attempts must be between 1-5"))
+	}
+	if r.NegativeTTL < 1 || r.NegativeTTL > 3600 {
+		errors = append(errors, fmt.Errorf("resolver negative_ttl must be between 1-3600 seconds"))
+	}
+	for i, s := range r.Servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		host, _, _ := net.SplitHostPort(s)
+		if net.ParseIP(host) == nil {
+			errors = append(errors, fmt.Errorf("resolver server '%s' must be an IP address", r.Servers[i]))
+		}
+		r.Servers[i] = s
+	}
+
+	return errors
+}
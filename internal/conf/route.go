@@ -0,0 +1,185 @@
+package conf
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Route decides on the client whether a SOCKS5 destination goes through
+// the tunnel or is connected to directly. Rules are checked in order and
+// the first match decides; Default applies when none matches.
+type Route struct {
+	Default string      `yaml:"default"`
+	Rules   []RouteRule `yaml:"rules"`
+}
+
+// RouteRule matches a destination by CIDR, IP or domain suffix, given
+// in Match or one per line in File, and by port ranges. Hostnames are
+// never resolved to check a CIDR; only IP destinations match those.
+type RouteRule struct {
+	Action   string `yaml:"action"`
+	Match    string `yaml:"match"`
+	File     string `yaml:"file"`
+	Ports    string `yaml:"ports"`
+	domains  map[string]bool
+	prefixes []netip.Prefix
+	ranges   [][2]int
+}
+
+func (r *Route) setDefaults() {
+	if r.Default == "" {
+		r.Default = "tunnel"
+	}
+}
+
+func (r *Route) validate() []error {
+	var errors []error
+
+	if r.Default != "tunnel" && r.Default != "direct" {
+		errors = append(errors, fmt.Errorf("route default must be 'tunnel' or 'direct'"))
+	}
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if rule.Action != "tunnel" && rule.Action != "direct" {
+			errors = append(errors, fmt.Errorf("route rule %d action must be 'tunnel' or 'direct'", i))
+		}
+		if (rule.Match == "") == (rule.File == "") {
+			errors = append(errors, fmt.Errorf("route rule %d needs exactly one of match and file", i))
+		}
+		rule.domains = make(map[string]bool)
+		if rule.Match != "" {
+			if err := rule.add(rule.Match); err != nil {
+				errors = append(errors, fmt.Errorf("route rule %d: %v", i, err))
+			}
+		}
+		if rule.File != "" {
+			if err := rule.load(); err != nil {
+				errors = append(errors, fmt.Errorf("route rule %d: %v", i, err))
+			}
+		}
+		ranges, err := parsePortRanges(rule.Ports)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("route rule %d: %v", i, err))
+		}
+		rule.ranges = ranges
+	}
+
+	return errors
+}
+
+// add parses one match: a CIDR, an IP or a domain and its subdomains.
+func (r *RouteRule) add(m string) error {
+	if strings.Contains(m, "/") {
+		p, err := netip.ParsePrefix(m)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR '%s': %v", m, err)
+		}
+		r.prefixes = append(r.prefixes, p.Masked())
+		return nil
+	}
+	if ip, err := netip.ParseAddr(m); err == nil {
+		r.prefixes = append(r.prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+		return nil
+	}
+	r.domains[strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(m, "*."), "."))] = true
+	return nil
+}
+
+// load reads File: one match per line, blank lines and # comments ignored.
+func (r *RouteRule) load() error {
+	f, err := os.Open(r.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if err := r.add(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", r.File, n, err)
+		}
+	}
+	return sc.Err()
+}
+
+// Direct reports whether addr (host:port) is connected to directly.
+func (r *Route) Direct(addr string) bool {
+	if r == nil {
+		return false
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return r.Default == "direct"
+	}
+	port, _ := strconv.Atoi(p)
+	ip, ipErr := netip.ParseAddr(host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if !rule.matchPort(port) {
+			continue
+		}
+		if ipErr == nil && rule.matchIP(ip.Unmap()) || ipErr != nil && rule.matchDomain(host) {
+			return rule.Action == "direct"
+		}
+	}
+	return r.Default == "direct"
+}
+
+func (r *RouteRule) matchIP(ip netip.Addr) bool {
+	for _, p := range r.prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain checks host and each parent domain against the rule.
+func (r *RouteRule) matchDomain(host string) bool {
+	for {
+		if r.domains[host] {
+			return true
+		}
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return false
+		}
+		host = parent
+	}
+}
+
+func (r *RouteRule) matchPort(port int) bool {
+	if len(r.ranges) == 0 {
+		return true
+	}
+	for _, pr := range r.ranges {
+		if port >= pr[0] && port <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled reports whether anything can go direct.
+func (r *Route) Enabled() bool {
+	return r.Default == "direct" || len(r.Rules) > 0
+}
+
+// Key identifies the settings, so a reload can tell whether they changed.
+// Edits to a rule's file are not seen.
+func (r *Route) Key() string {
+	key := r.Default
+	for _, rule := range r.Rules {
+		key += fmt.Sprintf(" %s:%s:%s:%s", rule.Action, rule.Match, rule.File, rule.Ports)
+	}
+	return key
+}
@@ -1,15 +1,46 @@
 package conf
 
 import (
+	"fmt"
+	"math/rand/v2"
 	"net"
 )
 
 type Server struct {
-	Addr_ string       `yaml:"addr"`
-	Addr  *net.UDPAddr `yaml:"-"`
+	Addr_  string       `yaml:"addr"`
+	Ports_ []string     `yaml:"ports"`
+	Addr   *net.UDPAddr `yaml:"-"`
+	Ports  []PortRange  `yaml:"-"`
+
+	// Caps on what one client IP may hold open on the server; 0 is
+	// unlimited.
+	MaxConns            int `yaml:"max_conns"`
+	MaxStreamsPerConn   int `yaml:"max_streams_per_conn"`
+	MaxStreamsPerClient int `yaml:"max_streams_per_client"`
+
+	// New sessions accepted per second from one client IP and from all;
+	// 0 is unlimited. A client turned away ten times in a row is banned
+	// for Ban seconds, its packets dropped unread; 0 never bans.
+	AcceptRate   int `yaml:"accept_rate"`
+	AcceptGlobal int `yaml:"accept_global"`
+	Ban          int `yaml:"ban"`
+
+	// Drain is how long, in seconds, a server shutting down waits for
+	// relayed streams to finish before closing the sessions.
+	Drain int `yaml:"drain"`
+	// ConeIdle is how long, in seconds, a full-cone UDP mapping lasts
+	// without traffic.
+	ConeIdle int `yaml:"cone_idle"`
 }
 
-func (s *Server) setDefaults() {}
+func (s *Server) setDefaults() {
+	if s.Drain == 0 {
+		s.Drain = 10
+	}
+	if s.ConeIdle == 0 {
+		s.ConeIdle = 60
+	}
+}
 func (s *Server) validate() []error {
 	var errors []error
 	addr, err := validateAddr(s.Addr_, true)
@@ -18,6 +49,36 @@ func (s *Server) validate() []error {
 	}
 	s.Addr = addr
 
+	// Ranges are matched one by one in the capture filter.
+	if len(s.Ports_) > 16 {
+		errors = append(errors, fmt.Errorf("at most 16 ports or port ranges are allowed"))
+	}
+	s.Ports = nil
+	for _, p := range s.Ports_ {
+		lo, hi, err := parsePortRange(p)
+		if err != nil {
+			errors = append(errors, err)
+			continue
+		}
+		s.Ports = append(s.Ports, PortRange{Lo: lo, Hi: hi})
+	}
+
+	if s.MaxConns < 0 || s.MaxStreamsPerConn < 0 || s.MaxStreamsPerClient < 0 {
+		errors = append(errors, fmt.Errorf("max_conns and max_streams limits must not be negative"))
+	}
+	if s.AcceptRate < 0 || s.AcceptGlobal < 0 {
+		errors = append(errors, fmt.Errorf("accept_rate and accept_global must not be negative"))
+	}
+	if s.Ban < 0 || s.Ban > 86400 {
+		errors = append(errors, fmt.Errorf("ban must be between 0-86400 seconds"))
+	}
+	if s.Drain < 1 || s.Drain > 600 {
+		errors = append(errors, fmt.Errorf("drain must be between 1-600 seconds"))
+	}
+	if s.ConeIdle < 4 || s.ConeIdle > 3600 {
+		errors = append(errors, fmt.Errorf("cone_idle must be between 4-3600 seconds"))
+	}
+
 	// if s.Timeout < 1 || s.Timeout > 3600 {
 	// 	errors = append(errors, fmt.Errorf("server timeout must be between 1-3600 seconds"))
 	// }
@@ -27,3 +88,29 @@ func (s *Server) validate() []error {
 
 	return errors
 }
+
+// PortRange is the ports Lo to Hi, both included.
+type PortRange struct {
+	Lo, Hi int
+}
+
+// PickAddr returns the address to dial: Addr, or with a port drawn at
+// random from Addr's and those in Ports.
+func (s *Server) PickAddr() *net.UDPAddr {
+	n := 1
+	for _, r := range s.Ports {
+		n += r.Hi - r.Lo + 1
+	}
+	i := rand.IntN(n)
+	if i == 0 {
+		return s.Addr
+	}
+	i--
+	for _, r := range s.Ports {
+		if i <= r.Hi-r.Lo {
+			return &net.UDPAddr{IP: s.Addr.IP, Port: r.Lo + i, Zone: s.Addr.Zone}
+		}
+		i -= r.Hi - r.Lo + 1
+	}
+	return s.Addr
+}
@@ -1,17 +1,30 @@
 package conf
 
 import (
+	"fmt"
 	"net"
+	"runtime"
 )
 
 type SOCKS5 struct {
 	Listen_  string       `yaml:"listen"`
 	Username string       `yaml:"username"`
 	Password string       `yaml:"password"`
+	Priority string       `yaml:"priority"`
+	Resolve  string       `yaml:"resolve"`
+	Resolver string       `yaml:"resolver"`
+	Cone     bool         `yaml:"cone"`    // one full-cone UDP mapping per client
+	BindIP   string       `yaml:"bind_ip"` // source of direct connections and client lookups
+	Fwmark   uint32       `yaml:"fwmark"`  // linux
 	Listen   *net.UDPAddr `yaml:"-"`
+	Bind     net.IP       `yaml:"-"`
 }
 
-func (c *SOCKS5) setDefaults() {}
+func (c *SOCKS5) setDefaults() {
+	if c.Resolve == "" {
+		c.Resolve = "server"
+	}
+}
 func (c *SOCKS5) validate() []error {
 	var errors []error
 
@@ -20,5 +33,19 @@ func (c *SOCKS5) validate() []error {
 		errors = append(errors, err)
 	}
 	c.Listen = addr
+
+	if err := validatePriority(c.Priority); err != nil {
+		errors = append(errors, err)
+	}
+	errors = append(errors, validateResolve(c.Resolve, &c.Resolver)...)
+	c.Bind = nil
+	if c.BindIP != "" {
+		if c.Bind = net.ParseIP(c.BindIP); c.Bind == nil {
+			errors = append(errors, fmt.Errorf("socks5 bind_ip must be an IP address"))
+		}
+	}
+	if c.Fwmark != 0 && runtime.GOOS != "linux" {
+		errors = append(errors, fmt.Errorf("socks5 fwmark is only supported on linux"))
+	}
 	return errors
 }
@@ -0,0 +1,34 @@
+package conf
+
+import (
+	"fmt"
+	"slices"
+)
+
+type Store struct {
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path"`
+}
+
+func (s *Store) setDefaults() {
+	if s.Backend == "" {
+		s.Backend = "memory"
+	}
+	if s.Backend == "file" && s.Path == "" {
+		s.Path = "paqet-store"
+	}
+}
+
+func (s *Store) validate() []error {
+	var errors []error
+
+	switch {
+	case slices.Contains([]string{"memory", "file"}, s.Backend):
+	case slices.Contains([]string{"bolt", "sqlite"}, s.Backend):
+		errors = append(errors, fmt.Errorf("store backend '%s' is not compiled into this build; use 'file'", s.Backend))
+	default:
+		errors = append(errors, fmt.Errorf("store backend must be one of: memory, file"))
+	}
+
+	return errors
+}
@@ -2,14 +2,41 @@ package conf
 
 import (
 	"fmt"
+	"math/rand/v2"
+	"sort"
 )
 
 type TCP struct {
-	LF_ []string `yaml:"local_flag"`
-	RF_ []string `yaml:"remote_flag"`
-	PCAP PCAP    `yaml:"pcap"`
-	LF  []TCPF   `yaml:"-"`
-	RF  []TCPF   `yaml:"-"`
+	LF_      []string `yaml:"local_flag"`
+	RF_      []string `yaml:"remote_flag"`
+	Profiles []string `yaml:"profiles"`
+	Decoy    int      `yaml:"decoy_ack"` // seconds of quiet before a pure ACK to a peer, 0 = off
+	PCAP     PCAP     `yaml:"pcap"`
+	LF       []TCPF   `yaml:"-"`
+	RF       []TCPF   `yaml:"-"`
+
+	profiles []tcpProfile
+}
+
+// tcpProfile is a named pair of flag sequences, in place of local_flag
+// and remote_flag.
+type tcpProfile struct {
+	lf, rf []TCPF
+}
+
+// tcpProfiles are the built-in flag sequences, each shaped like a kind
+// of ordinary TCP traffic.
+var tcpProfiles = map[string][2][]string{
+	// Steady two-way data.
+	"data": {{"PA"}, {"PA"}},
+	// An HTTP keepalive connection: pushed requests and responses with
+	// pure ACKs between them.
+	"keepalive": {{"PA", "PA", "PA", "A"}, {"PA", "PA", "PA", "A"}},
+	// A download: full segments without PSH from the server, and the
+	// client mostly acknowledging.
+	"download": {{"A", "A", "PA"}, {"A", "A", "A", "PA"}},
+	// An upload, the other way round.
+	"upload": {{"A", "A", "A", "PA"}, {"A", "A", "PA"}},
 }
 
 type TCPF struct {
@@ -49,12 +76,55 @@ func (t *TCP) validate() []error {
 		}
 	}
 
+	t.profiles = nil
+	for _, name := range t.Profiles {
+		p, ok := tcpProfiles[name]
+		if !ok {
+			errors = append(errors, fmt.Errorf("unknown TCP flag profile '%s' (want one of %v)", name, profileNames()))
+			continue
+		}
+		var tp tcpProfile
+		for _, fStr := range p[0] {
+			f, _ := strTCPF(fStr)
+			tp.lf = append(tp.lf, f)
+		}
+		for _, fStr := range p[1] {
+			f, _ := strTCPF(fStr)
+			tp.rf = append(tp.rf, f)
+		}
+		t.profiles = append(t.profiles, tp)
+	}
+
+	if t.Decoy != 0 && (t.Decoy < 5 || t.Decoy > 3600) {
+		errors = append(errors, fmt.Errorf("decoy_ack must be between 5-3600 seconds, or 0 to disable"))
+	}
+
 	if len(t.LF) == 0 || len(t.RF) == 0 {
 		errors = append(errors, fmt.Errorf("at least one TCP flag combination required"))
 	}
 	return errors
 }
 
+// Pick returns the flags for one connection: t itself, or with the flags
+// of a profile chosen at random when profiles are set.
+func (t *TCP) Pick() TCP {
+	c := *t
+	if len(t.profiles) > 0 {
+		p := t.profiles[rand.IntN(len(t.profiles))]
+		c.LF, c.RF = p.lf, p.rf
+	}
+	return c
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(tcpProfiles))
+	for name := range tcpProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func strTCPF(fStr string) (TCPF, error) {
 	var f TCPF
 	for _, ch := range fStr {
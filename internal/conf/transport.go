@@ -2,15 +2,28 @@ package conf
 
 import (
 	"fmt"
+	"runtime"
 	"slices"
 )
 
 type Transport struct {
-	Protocol string `yaml:"protocol"`
-	Conn     int    `yaml:"conn"`
-	TCPBuf   int    `yaml:"tcpbuf"`
-	UDPBuf   int    `yaml:"udpbuf"`
-	KCP      *KCP   `yaml:"kcp"`
+	Protocol   string    `yaml:"protocol"`
+	Conn       int       `yaml:"conn"`
+	TCPBuf     int       `yaml:"tcpbuf"`
+	UDPBuf     int       `yaml:"udpbuf"`
+	BufClasses []int     `yaml:"buffer_classes"`
+	UDPDelay   int       `yaml:"udp_delay"`
+	Affinity   bool      `yaml:"affinity"`
+	CopyEngine string    `yaml:"copy_engine"`
+	Hibernate  int       `yaml:"hibernate"`
+	Compress   string    `yaml:"compression"`
+	Rotate     int       `yaml:"rotate"`
+	Warmup     int       `yaml:"warmup_timeout"`
+	KCP        *KCP      `yaml:"kcp"`
+	Class      Class     `yaml:"class"`
+	Health     Health    `yaml:"health"`
+	Idle       Idle      `yaml:"idle"`
+	Admission  Admission `yaml:"admission"`
 }
 
 func (t *Transport) setDefaults(role string) {
@@ -36,6 +49,27 @@ func (t *Transport) setDefaults(role string) {
 	if t.UDPBuf < 2*1024 {
 		t.UDPBuf = 2 * 1024
 	}
+	// Size classes besides tcpbuf and udpbuf: TCP copies start at the
+	// smallest and grow while reads fill them, so interactive streams
+	// hold a small buffer; tunnel packets take the one that fits.
+	if t.BufClasses == nil {
+		t.BufClasses = []int{512, 4096, 16384}
+	}
+
+	if t.CopyEngine == "" {
+		t.CopyEngine = "goroutine"
+	}
+	if t.Compress == "" {
+		t.Compress = "off"
+	}
+	if t.Warmup == 0 {
+		t.Warmup = 10
+	}
+
+	t.Class.setDefaults()
+	t.Health.setDefaults()
+	t.Idle.setDefaults()
+	t.Admission.setDefaults()
 
 	switch t.Protocol {
 	case "kcp":
@@ -54,9 +88,50 @@ func (t *Transport) validate() []error {
 		errors = append(errors, fmt.Errorf("transport protocol must be one of: %v", validProtocols))
 	}
 
+	if len(t.BufClasses) > 8 {
+		errors = append(errors, fmt.Errorf("buffer_classes takes at most 8 sizes"))
+	}
+	for _, size := range t.BufClasses {
+		if size < 256 || size > 1<<20 {
+			errors = append(errors, fmt.Errorf("buffer_classes sizes must be between 256-1048576 bytes"))
+			break
+		}
+	}
+
 	if t.Conn < 1 || t.Conn > 256 {
 		errors = append(errors, fmt.Errorf("KCP conn must be between 1-256 connections"))
 	}
+	switch t.CopyEngine {
+	case "goroutine":
+	case "event":
+		if runtime.GOOS != "linux" {
+			errors = append(errors, fmt.Errorf("copy_engine 'event' is only available on linux"))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("copy_engine must be 'goroutine' or 'event'"))
+	}
+	if t.UDPDelay < 0 || t.UDPDelay > 50 {
+		errors = append(errors, fmt.Errorf("udp_delay must be between 0-50 milliseconds"))
+	}
+	if t.Compress != "off" && t.Compress != "lz4" && t.Compress != "snappy" {
+		errors = append(errors, fmt.Errorf("compression must be 'off', 'lz4' or 'snappy'"))
+	}
+	if t.Rotate != 0 && (t.Rotate < 60 || t.Rotate > 86400) {
+		errors = append(errors, fmt.Errorf("rotate must be 0 or between 60-86400 seconds"))
+	}
+	if t.Warmup < 1 || t.Warmup > 300 {
+		errors = append(errors, fmt.Errorf("warmup_timeout must be between 1-300 seconds"))
+	}
+	if t.Hibernate < 0 || t.Hibernate > 3600 {
+		errors = append(errors, fmt.Errorf("hibernate must be between 0-3600 seconds"))
+	}
+	errors = append(errors, t.Class.validate()...)
+	errors = append(errors, t.Health.validate()...)
+	errors = append(errors, t.Idle.validate()...)
+	errors = append(errors, t.Admission.validate()...)
+	if t.Class.Reserve && t.Conn < 2 {
+		errors = append(errors, fmt.Errorf("class reserve requires at least 2 connections"))
+	}
 
 	switch t.Protocol {
 	case "kcp":
@@ -0,0 +1,39 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// User is one identity a server accepts sessions from. On a client only
+// ID and Key are used, to authenticate as that user.
+type User struct {
+	ID       string `yaml:"id"`
+	Key      string `yaml:"key"`
+	Rate     int    `yaml:"rate"`
+	MaxConns int    `yaml:"max_conns"`
+	Disabled bool   `yaml:"disabled"`
+
+	// Quotas in MiB relayed per calendar day and month (UTC), both
+	// directions together; 0 is unlimited.
+	DailyQuota   int64 `yaml:"daily_quota"`
+	MonthlyQuota int64 `yaml:"monthly_quota"`
+}
+
+func (u *User) validate() []error {
+	var errors []error
+
+	if u.ID == "" || len(u.ID) > 255 {
+		errors = append(errors, fmt.Errorf("user id must be 1-255 characters"))
+	}
+	if len(u.Key) < 16 {
+		errors = append(errors, fmt.Errorf("user %s key must be at least 16 characters", u.ID))
+	}
+	if u.Rate < 0 || u.MaxConns < 0 {
+		errors = append(errors, fmt.Errorf("user %s rate and max_conns must not be negative", u.ID))
+	}
+	if u.DailyQuota < 0 || u.MonthlyQuota < 0 {
+		errors = append(errors, fmt.Errorf("user %s daily_quota and monthly_quota must not be negative", u.ID))
+	}
+
+	return errors
+}
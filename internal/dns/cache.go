@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Bounds on how long an answer is cached. Negative answers without an
+// SOA to take the TTL from are kept for negativeTTL.
+const (
+	maxTTL      = time.Hour
+	negativeTTL = 30 * time.Second
+)
+
+type entry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// cache keeps answers by question. A nil cache stores nothing.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*entry
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, entries: make(map[string]*entry)}
+}
+
+func cacheKey(q dnsmessage.Question) string {
+	return strings.ToLower(q.Name.String()) + "/" + q.Type.String() + "/" + q.Class.String()
+}
+
+// get returns the cached answer for key as a response to query id, its
+// TTLs counted down by the time it spent in the cache.
+func (c *cache) get(key string, id uint16) []byte {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	e := c.entries[key]
+	if e != nil && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		e = nil
+	}
+	c.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+
+	msg := e.msg
+	msg.ID = id
+	age := uint32(time.Since(e.stored) / time.Second)
+	msg.Answers = aged(msg.Answers, age)
+	msg.Authorities = aged(msg.Authorities, age)
+	msg.Additionals = aged(msg.Additionals, age)
+	out, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// aged copies rrs with age taken off their TTLs, leaving OPT alone.
+func aged(rrs []dnsmessage.Resource, age uint32) []dnsmessage.Resource {
+	out := make([]dnsmessage.Resource, len(rrs))
+	copy(out, rrs)
+	for i := range out {
+		if out[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		out[i].Header.TTL -= min(age, out[i].Header.TTL)
+	}
+	return out
+}
+
+// put stores resp for key if it is a cacheable answer, for the smallest
+// TTL it carries.
+func (c *cache) put(key string, resp []byte) {
+	if c == nil {
+		return
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return
+	}
+	if msg.Truncated || (msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+	ttl := maxTTL
+	for _, rr := range msg.Answers {
+		ttl = min(ttl, time.Duration(rr.Header.TTL)*time.Second)
+	}
+	if len(msg.Answers) == 0 {
+		ttl = negativeTTL
+		for _, rr := range msg.Authorities {
+			if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+				ttl = min(time.Duration(rr.Header.TTL)*time.Second, time.Duration(soa.MinTTL)*time.Second)
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = &entry{msg: msg, stored: now, expires: now.Add(ttl)}
+}
+
+// evict drops the expired entries, or if none has expired, an arbitrary
+// one. c.mu must be held.
+func (c *cache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, k)
+	}
+}
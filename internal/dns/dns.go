@@ -0,0 +1,238 @@
+// Package dns answers DNS queries on the client, so the OS resolver can
+// point at paqet. Queries go through the tunnel to an upstream
+// nameserver over TCP, which the server relays like any other stream;
+// answers are cached for their TTL.
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"paqet/internal/client"
+	"paqet/internal/flog"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	queryTimeout = 5 * time.Second
+	maxMessage   = 65535
+	// maxPending bounds the UDP queries being answered at once; past it
+	// new ones are dropped, and the stub resolver asks again.
+	maxPending = 256
+)
+
+type DNS struct {
+	client   *client.Client
+	listen   string
+	upstream string
+	cache    *cache
+	wg       sync.WaitGroup
+}
+
+// New answers on listen (UDP and TCP) from upstream, caching up to
+// entries answers; 0 disables the cache.
+func New(c *client.Client, listen, upstream string, entries int) *DNS {
+	d := &DNS{client: c, listen: listen, upstream: upstream}
+	if entries > 0 {
+		d.cache = newCache(entries)
+	}
+	return d
+}
+
+func (d *DNS) Start(ctx context.Context) error {
+	pc, err := net.ListenPacket("udp", d.listen)
+	if err != nil {
+		return fmt.Errorf("failed to bind UDP socket on %s: %v", d.listen, err)
+	}
+	ln, err := net.Listen("tcp", d.listen)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to bind TCP socket on %s: %v", d.listen, err)
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		ln.Close()
+	}()
+	flog.Infof("DNS listening on %s -> %s", d.listen, d.upstream)
+
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		d.serveUDP(ctx, pc)
+	}()
+	go func() {
+		defer d.wg.Done()
+		d.serveTCP(ctx, ln)
+	}()
+	return nil
+}
+
+// Wait returns once the listener stopped after its context ended, so
+// its port can be bound again.
+func (d *DNS) Wait() { d.wg.Wait() }
+
+func (d *DNS) serveUDP(ctx context.Context, pc net.PacketConn) {
+	buf := make([]byte, maxMessage)
+	pending := make(chan struct{}, maxPending)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				flog.Errorf("DNS failed to read on %s: %v", d.listen, err)
+			}
+			return
+		}
+		select {
+		case pending <- struct{}{}:
+		default:
+			flog.Debugf("DNS dropped a query from %s: %d queries pending", addr, maxPending)
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-pending }()
+			resp, err := d.answer(query)
+			if err != nil {
+				flog.Debugf("DNS query from %s failed: %v", addr, err)
+				return
+			}
+			pc.WriteTo(truncate(resp), addr)
+		}()
+	}
+}
+
+func (d *DNS) serveTCP(ctx context.Context, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				flog.Errorf("DNS failed to accept on %s: %v", d.listen, err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+				query, err := readMsg(conn)
+				if err != nil {
+					return
+				}
+				resp, err := d.answer(query)
+				if err != nil {
+					flog.Debugf("DNS query from %s failed: %v", conn.RemoteAddr(), err)
+					return
+				}
+				if err := writeMsg(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer returns the response to query, from the cache or upstream.
+func (d *DNS) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %v", err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, fmt.Errorf("invalid question: %v", err)
+	}
+	key := cacheKey(q)
+	if resp := d.cache.get(key, hdr.ID); resp != nil {
+		return resp, nil
+	}
+	resp, err := d.exchange(query)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.put(key, resp)
+	return resp, nil
+}
+
+// exchange sends query upstream over a TCP stream through the tunnel.
+func (d *DNS) exchange(query []byte) ([]byte, error) {
+	strm, err := d.client.TCP(d.upstream, client.Policy{})
+	if err != nil {
+		return nil, err
+	}
+	defer strm.Close()
+	strm.SetDeadline(time.Now().Add(queryTimeout))
+	if err := writeMsg(strm, query); err != nil {
+		return nil, err
+	}
+	return readMsg(strm)
+}
+
+func readMsg(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeMsg(w io.Writer, msg []byte) error {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// truncate cuts a response too large for a plain UDP answer down to its
+// header and question with the TC bit set, so the resolver retries over
+// TCP. A query with EDNS0 is trusted to take what upstream sent.
+func truncate(resp []byte) []byte {
+	if len(resp) <= 512 {
+		return resp
+	}
+	var p dnsmessage.Parser
+	hdr, err := p.Start(resp)
+	if err != nil {
+		return resp
+	}
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return resp
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return resp
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return resp
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			break
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return resp
+		}
+		p.SkipAdditional()
+	}
+	hdr.Truncated = true
+	b := dnsmessage.NewBuilder(nil, hdr)
+	b.StartQuestions()
+	for _, q := range qs {
+		b.Question(q)
+	}
+	out, err := b.Finish()
+	if err != nil {
+		return resp
+	}
+	return out
+}
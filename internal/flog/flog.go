@@ -2,7 +2,11 @@ package flog
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,27 +22,99 @@ const (
 )
 
 var (
-	minLevel = Info
+	minLevel atomic.Int32
 	logCh    = make(chan string, 1024)
+	writer   sync.Once
+	// queued and written count the lines through logCh, for Flush.
+	queued, written atomic.Uint64
+	output          atomic.Pointer[io.Writer]
 )
 
 func init() {
-
+	minLevel.Store(int32(Info))
+	SetOutput(os.Stdout)
 }
 
+// SetOutput sends the log lines to w instead of stdout, such as a file or
+// the Windows event log when running as a service.
+func SetOutput(w io.Writer) { output.Store(&w) }
+
+// SetLevel may be called again at runtime to change the level. It
+// cancels a revert pending from SetLevelFor.
 func SetLevel(l int) {
-	minLevel = Level(l)
+	revertMu.Lock()
+	stopRevert()
+	revertMu.Unlock()
+	setLevel(l)
+}
+
+func setLevel(l int) {
+	minLevel.Store(int32(l))
 	if l != -1 {
-		go func() {
-			for msg := range logCh {
-				fmt.Fprint(os.Stdout, msg)
-			}
-		}()
+		writer.Do(func() {
+			go func() {
+				for msg := range logCh {
+					fmt.Fprint(*output.Load(), msg)
+					written.Add(1)
+				}
+			}()
+		})
 	}
 }
 
+var (
+	revertMu sync.Mutex
+	revert   *time.Timer
+	revertTo Level
+	revertAt time.Time
+)
+
+// SetLevelFor sets the level for d, then restores the level in force
+// before. Called again while a revert is pending, it restarts the wait
+// but still restores the original level.
+func SetLevelFor(l int, d time.Duration) {
+	revertMu.Lock()
+	defer revertMu.Unlock()
+	if revert == nil {
+		revertTo = GetLevel()
+	} else {
+		revert.Stop()
+	}
+	revertAt = time.Now().Add(d)
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		revertMu.Lock()
+		defer revertMu.Unlock()
+		if revert != t {
+			return
+		}
+		revert = nil
+		setLevel(int(revertTo))
+		logf(Info, "log level reverted to %s", strings.ToLower(revertTo.String()))
+	})
+	revert = t
+	setLevel(l)
+}
+
+// Reverting reports the level a pending SetLevelFor restores, and when.
+func Reverting() (Level, time.Time, bool) {
+	revertMu.Lock()
+	defer revertMu.Unlock()
+	return revertTo, revertAt, revert != nil
+}
+
+// stopRevert cancels a pending revert; revertMu must be held.
+func stopRevert() {
+	if revert != nil {
+		revert.Stop()
+		revert = nil
+	}
+}
+
+func GetLevel() Level { return Level(minLevel.Load()) }
+
 func logf(level Level, format string, args ...any) {
-	if level < minLevel || minLevel == None {
+	if min := GetLevel(); level < min || min == None {
 		return
 	}
 
@@ -56,6 +132,7 @@ func logf(level Level, format string, args ...any) {
 
 	select {
 	case logCh <- line:
+		queued.Add(1)
 	default:
 	}
 }
@@ -85,9 +162,40 @@ func Warnf(format string, args ...any)  { logf(Warn, format, args...) }
 func Errorf(format string, args ...any) { logf(Error, format, args...) }
 func Fatalf(format string, args ...any) {
 	logf(Fatal, format, args...)
-	// flush logs (optional: small sleep to let goroutine write)
-	time.Sleep(10 * time.Millisecond)
+	Flush(time.Second)
 	os.Exit(1)
 }
 
 func Close() { close(logCh) }
+
+// Flush waits up to timeout for the lines logged so far to be written.
+func Flush(timeout time.Duration) bool {
+	target := queued.Load()
+	deadline := time.Now().Add(timeout)
+	for written.Load() < target {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// ParseLevel maps a level name as written in the config to its Level.
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "none":
+		return None, nil
+	case "debug":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	case "warn":
+		return Warn, nil
+	case "error":
+		return Error, nil
+	case "fatal":
+		return Fatal, nil
+	}
+	return None, fmt.Errorf("invalid logging level '%s': must be one of none, debug, info, warn, error, fatal", s)
+}
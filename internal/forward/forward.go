@@ -3,55 +3,147 @@ package forward
 import (
 	"context"
 	"fmt"
+	"net"
 	"paqet/internal/client"
 	"paqet/internal/flog"
+	"paqet/internal/pkg/class"
+	"paqet/internal/pkg/fwmark"
+	"paqet/internal/pkg/resolve"
 	"sync"
+	"sync/atomic"
 )
 
 type Forward struct {
 	client     *client.Client
 	listenAddr string
 	targetAddr string
+	pol        client.Policy
+	res        *resolved
+	proxy      bool
+	bind       net.IP
+	mark       uint32
 	wg         sync.WaitGroup
+	active     atomic.Int64
+	// stop ends the listener alone, closing closed once it is;
+	// Start's context ends the rest.
+	stop   context.CancelFunc
+	closed chan struct{}
 }
 
-func New(client *client.Client, listenAddr, targetAddr string) (*Forward, error) {
+func New(c *client.Client, listenAddr, targetAddr string, prio class.Class, dscp int) (*Forward, error) {
 	return &Forward{
-		client:     client,
+		client:     c,
 		listenAddr: listenAddr,
 		targetAddr: targetAddr,
+		pol:        client.Policy{Class: prio, DSCP: dscp},
 	}, nil
 }
 
+// ResolveOnClient makes the forwarder look up a hostname target itself,
+// through server (host:port) or the system nameserver if empty, and send
+// the server the address instead. IP targets are left alone.
+func (f *Forward) ResolveOnClient(server string) {
+	host, port, err := net.SplitHostPort(f.targetAddr)
+	if err != nil || net.ParseIP(host) != nil {
+		return
+	}
+	r := resolve.New(server, func(network string) *net.Dialer { return fwmark.Dialer(network, f.bind, f.mark, 0) })
+	f.res = &resolved{host: host, port: port, r: r}
+}
+
+// AcceptProxy makes the TCP listener expect a PROXY protocol header
+// (v1 or v2) ahead of each connection, as another proxy in front of it
+// sends, and strip it before relaying.
+func (f *Forward) AcceptProxy() {
+	f.proxy = true
+}
+
+// Egress makes what the forwarder sends outside the tunnel, direct
+// connections while it is down and client-side lookups, leave from bind
+// if set and carry fwmark mark, so policy routing keeps it off a VPN
+// that routes everything.
+func (f *Forward) Egress(bind net.IP, mark uint32) {
+	f.bind, f.mark = bind, mark
+}
+
+// target is the address streams are opened to.
+func (f *Forward) target() string {
+	if f.res == nil {
+		return f.targetAddr
+	}
+	return f.res.target(f.targetAddr)
+}
+
 func (f *Forward) Start(ctx context.Context, protocol string) error {
 	flog.Debugf("starting %s forwarder: %s -> %s", protocol, f.listenAddr, f.targetAddr)
+	if f.res != nil {
+		go f.res.run(ctx)
+	}
+	lctx, stop := context.WithCancel(ctx)
+	var err error
 	switch protocol {
 	case "tcp":
-		return f.startTCP(ctx)
+		err = f.startTCP(ctx, lctx)
 	case "udp":
-		return f.startUDP(ctx)
+		err = f.startUDP(lctx)
 	default:
-		flog.Errorf("unsupported protocol: %s", protocol)
-		return fmt.Errorf("unsupported protocol: %s", protocol)
+		err = fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+	if err != nil {
+		stop()
+		flog.Errorf("%v", err)
+		return err
+	}
+	f.stop = stop
+	return nil
+}
+
+// Wait returns once the forwarder stopped after its context ended, so
+// its port can be bound again.
+func (f *Forward) Wait() { f.wg.Wait() }
+
+// Stop closes the listener of a started forwarder and returns once its
+// port is free. TCP connections being relayed go on until they finish
+// or the context given to Start ends; Wait then returns once they
+// drained. A UDP forwarder relays through its listening socket and
+// stops altogether.
+func (f *Forward) Stop() {
+	if f.stop == nil {
+		return
 	}
+	f.stop()
+	<-f.closed
 }
 
-func (f *Forward) startTCP(ctx context.Context) error {
+// Active is the number of connections, or UDP peers, being relayed.
+func (f *Forward) Active() int { return int(f.active.Load()) }
+
+func (f *Forward) startTCP(ctx, lctx context.Context) error {
+	listener, err := f.listenTCP()
+	if err != nil {
+		return err
+	}
+	f.closed = make(chan struct{})
 	f.wg.Add(1)
 	go func() {
 		defer f.wg.Done()
-		if err := f.listenTCP(ctx); err != nil {
-			flog.Debugf("TCP forwarder stopped with: %v", err)
-		}
+		defer close(f.closed)
+		f.serveTCP(ctx, lctx, listener)
 	}()
 	return nil
 }
 
 func (f *Forward) startUDP(ctx context.Context) error {
+	conn, err := f.listenUDP()
+	if err != nil {
+		return err
+	}
+	f.closed = make(chan struct{})
 	f.wg.Add(1)
 	go func() {
 		defer f.wg.Done()
-		f.listenUDP(ctx)
+		defer close(f.closed)
+		f.serveUDP(ctx, conn)
 	}()
 	return nil
 }
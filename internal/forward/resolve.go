@@ -0,0 +1,48 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/resolve"
+	"sync/atomic"
+	"time"
+)
+
+const retryTTL = 10 * time.Second
+
+// resolved keeps the address of a hostname target fresh on the client,
+// so the server dials an IP instead of asking its own, possibly
+// censored, resolver. Until the first answer the hostname is sent as is.
+type resolved struct {
+	host, port string
+	r          *resolve.Resolver
+	addr       atomic.Pointer[string]
+}
+
+func (r *resolved) target(fallback string) string {
+	if a := r.addr.Load(); a != nil {
+		return *a
+	}
+	return fallback
+}
+
+func (r *resolved) run(ctx context.Context) {
+	for {
+		ip, ttl, err := r.r.Lookup(ctx, r.host)
+		if err != nil {
+			flog.Warnf("failed to resolve forward target %s, retrying in %v: %v", r.host, retryTTL, err)
+			ttl = retryTTL
+		} else {
+			addr := net.JoinHostPort(ip.String(), r.port)
+			if old := r.addr.Swap(&addr); old == nil || *old != addr {
+				flog.Infof("forward target %s resolved to %s (ttl %v)", r.host, ip, ttl)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ttl):
+		}
+	}
+}
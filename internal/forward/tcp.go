@@ -1,31 +1,50 @@
 package forward
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"net"
+	"os"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/fwmark"
+	"paqet/internal/pkg/proxyproto"
+	"paqet/internal/tnet"
+	"strings"
+	"time"
 )
 
-func (f *Forward) listenTCP(ctx context.Context) error {
-	listener, err := net.Listen("tcp", f.listenAddr)
+func (f *Forward) listenTCP() (net.Listener, error) {
+	network, address := "tcp", f.listenAddr
+	if path, ok := strings.CutPrefix(f.listenAddr, tnet.UnixPrefix); ok {
+		network, address = "unix", path
+		os.Remove(path) // left behind by a process that did not exit cleanly
+	}
+	listener, err := net.Listen(network, address)
 	if err != nil {
-		flog.Errorf("failed to bind TCP socket on %s: %v", f.listenAddr, err)
-		return err
+		return nil, fmt.Errorf("failed to bind TCP socket on %s: %v", f.listenAddr, err)
 	}
+	flog.Infof("TCP forwarder listening on %s -> %s", f.listenAddr, f.targetAddr)
+	return listener, nil
+}
+
+// serveTCP accepts until lctx ends and relays each connection until ctx
+// does.
+func (f *Forward) serveTCP(ctx, lctx context.Context, listener net.Listener) {
 	defer listener.Close()
 	go func() {
-		<-ctx.Done()
+		<-lctx.Done()
 		listener.Close()
 	}()
-	flog.Infof("TCP forwarder listening on %s -> %s", f.listenAddr, f.targetAddr)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			select {
-			case <-ctx.Done():
-				return nil
+			case <-lctx.Done():
+				return
 			default:
 				flog.Errorf("failed to accept TCP connection on %s: %v", f.listenAddr, err)
 				continue
@@ -33,8 +52,10 @@ func (f *Forward) listenTCP(ctx context.Context) error {
 		}
 
 		f.wg.Add(1)
+		f.active.Add(1)
 		go func() {
 			defer f.wg.Done()
+			defer f.active.Add(-1)
 			defer conn.Close()
 			if err := f.handleTCPConn(ctx, conn); err != nil {
 				flog.Errorf("TCP connection %s -> %s closed with error: %v", conn.RemoteAddr(), f.targetAddr, err)
@@ -46,10 +67,31 @@ func (f *Forward) listenTCP(ctx context.Context) error {
 }
 
 func (f *Forward) handleTCPConn(ctx context.Context, conn net.Conn) error {
-	strm, err := f.client.TCP(f.targetAddr)
-	if err != nil {
-		flog.Errorf("failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), f.targetAddr, err)
-		return err
+	pol := f.pol
+	if f.proxy {
+		c, src, err := stripProxy(conn)
+		if err != nil {
+			return err
+		}
+		conn, pol.Source = c, src
+	}
+	var strm io.ReadWriteCloser
+	if f.client.DownDirect() {
+		d := fwmark.Dialer("tcp", f.bind, f.mark, 10*time.Second)
+		dc, err := d.DialContext(ctx, "tcp", f.targetAddr)
+		if err != nil {
+			flog.Errorf("tunnel is down and failed to connect directly for %s -> %s: %v", conn.RemoteAddr(), f.targetAddr, err)
+			return err
+		}
+		strm = dc
+		flog.Infof("tunnel is down, connected %s -> %s directly", conn.RemoteAddr(), f.targetAddr)
+	} else {
+		ts, err := f.client.TCP(f.target(), pol)
+		if err != nil {
+			flog.Errorf("failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), f.targetAddr, err)
+			return err
+		}
+		strm = ts
 	}
 	defer func() {
 		flog.Debugf("TCP stream closed for %s -> %s", conn.RemoteAddr(), f.targetAddr)
@@ -66,11 +108,10 @@ func (f *Forward) handleTCPConn(ctx context.Context, conn net.Conn) error {
 		copyCancel()
 		errCh <- err
 	}()
-	go func() {
-		err := buffer.CopyT(strm, conn)
+	buffer.GoCopyT(copyCtx, strm, conn, func(err error) {
 		copyCancel()
 		errCh <- err
-	}()
+	})
 
 	<-copyCtx.Done()
 	conn.Close()
@@ -82,3 +123,28 @@ func (f *Forward) handleTCPConn(ctx context.Context, conn net.Conn) error {
 
 	return nil
 }
+
+// stripProxy reads the PROXY protocol header conn starts with and
+// returns conn without it, and the source it names or nil.
+func stripProxy(conn net.Conn) (net.Conn, net.Addr, error) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	src, err := proxyproto.Read(br)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("PROXY protocol header from %s: %v", conn.RemoteAddr(), err)
+	}
+	if src != nil {
+		flog.Debugf("TCP connection %s is relayed for %s", conn.RemoteAddr(), src)
+	}
+	return &bufConn{Conn: conn, r: br}, src, nil
+}
+
+// bufConn is a conn whose reads go through r, which holds what was
+// read past the header.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) { return c.r.Read(b) }
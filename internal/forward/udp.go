@@ -2,6 +2,7 @@ package forward
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"paqet/internal/flog"
@@ -10,26 +11,26 @@ import (
 	"time"
 )
 
-func (f *Forward) listenUDP(ctx context.Context) {
+func (f *Forward) listenUDP() (*net.UDPConn, error) {
 	laddr, err := net.ResolveUDPAddr("udp", f.listenAddr)
 	if err != nil {
-		flog.Errorf("failed to resolve UDP listen address '%s': %v", f.listenAddr, err)
-		return
+		return nil, fmt.Errorf("failed to resolve UDP listen address '%s': %v", f.listenAddr, err)
 	}
-
 	conn, err := net.ListenUDP("udp", laddr)
 	if err != nil {
-		flog.Errorf("failed to bind UDP socket on %s: %v", laddr, err)
-		return
+		return nil, fmt.Errorf("failed to bind UDP socket on %s: %v", laddr, err)
 	}
+	flog.Infof("UDP forwarder listening on %s -> %s", laddr, f.targetAddr)
+	return conn, nil
+}
+
+func (f *Forward) serveUDP(ctx context.Context, conn *net.UDPConn) {
 	defer conn.Close()
 	go func() {
 		<-ctx.Done()
 		conn.Close()
 	}()
 
-	flog.Infof("UDP forwarder listening on %s -> %s", laddr, f.targetAddr)
-
 	for {
 		select {
 		case <-ctx.Done():
@@ -44,8 +45,8 @@ func (f *Forward) listenUDP(ctx context.Context) {
 }
 
 func (f *Forward) handleUDPPacket(ctx context.Context, conn *net.UDPConn) error {
-	bufp := buffer.UPool.Get().(*[]byte)
-	defer buffer.UPool.Put(bufp)
+	bufp := buffer.GetU()
+	defer buffer.Put(bufp)
 	buf := *bufp
 
 	n, caddr, err := conn.ReadFromUDP(buf)
@@ -56,7 +57,7 @@ func (f *Forward) handleUDPPacket(ctx context.Context, conn *net.UDPConn) error
 		return nil
 	}
 
-	strm, new, k, err := f.client.UDP(caddr.String(), f.targetAddr)
+	strm, new, k, err := f.client.UDP(caddr.String(), f.target(), f.pol)
 	if err != nil {
 		flog.Errorf("failed to establish UDP stream for %s -> %s: %v", caddr, f.targetAddr, err)
 		f.client.CloseUDP(k)
@@ -77,9 +78,11 @@ func (f *Forward) handleUDPPacket(ctx context.Context, conn *net.UDPConn) error
 }
 
 func (f *Forward) handleUDPStrm(ctx context.Context, k uint64, strm tnet.Strm, conn *net.UDPConn, caddr *net.UDPAddr) {
-	bufp := buffer.UPool.Get().(*[]byte)
+	f.active.Add(1)
+	bufp := buffer.GetU()
 	defer func() {
-		buffer.UPool.Put(bufp)
+		f.active.Add(-1)
+		buffer.Put(bufp)
 		flog.Debugf("UDP stream %d closed for %s -> %s", strm.SID(), caddr, f.targetAddr)
 		f.client.CloseUDP(k)
 	}()
@@ -0,0 +1,166 @@
+// Package accesslog writes one JSON line per relayed stream when it
+// closes: who opened it, where it went, how much it carried and why it
+// ended. Destinations can be hashed or left out, so a shared server can
+// keep what abuse handling needs without a browsing history.
+package accesslog
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"paqet/internal/flog"
+)
+
+// Entry is one line of the log.
+type Entry struct {
+	Time     time.Time `json:"time"` // when the stream closed
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Stream   int       `json:"stream"`
+	Proto    string    `json:"proto"`
+	Dest     string    `json:"dest,omitempty"`
+	Up       uint64    `json:"bytes_up"` // client towards destination
+	Down     uint64    `json:"bytes_down"`
+	Duration float64   `json:"duration"` // seconds
+	Reason   string    `json:"reason"`
+}
+
+// Logger appends entries to a file.
+type Logger struct {
+	path string
+	mode string
+	key  []byte
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// Open appends to path. mode is full, hash or omit for how destinations
+// are written; hash uses key, or a random one when it is empty, so the
+// hashes then only match within one run.
+func Open(path, mode, key string) (*Logger, error) {
+	f, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &Logger{path: path, mode: mode, key: []byte(key), w: f}
+	if mode == "hash" && key == "" {
+		l.key = make([]byte, 32)
+		rand.Read(l.key)
+	}
+	return l, nil
+}
+
+func openFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+}
+
+// Reopen switches to a new file at the path, for after a rotation moved
+// the old one away. Lines of streams closing meanwhile go to either.
+func (l *Logger) Reopen() error {
+	if l == nil {
+		return nil
+	}
+	f, err := openFile(l.path)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.w
+	l.w = f
+	l.mu.Unlock()
+	return old.Close()
+}
+
+// Counter reports the bytes a stream relayed, client towards
+// destination first.
+type Counter interface {
+	Bytes() (up, down uint64)
+}
+
+// Record is one stream being logged. Its methods accept a nil Record,
+// which is what Start returns without a logger.
+type Record struct {
+	entry  Entry
+	start  time.Time
+	counts Counter
+
+	once   sync.Once
+	reason string
+}
+
+// Start begins the record of stream sid from client to dest. The caller
+// must call End when the stream finishes.
+func (l *Logger) Start(client, user string, sid int, proto, dest string) *Record {
+	if l == nil {
+		return nil
+	}
+	r := &Record{entry: Entry{Client: client, User: user, Stream: sid, Proto: proto}, start: time.Now()}
+	switch l.mode {
+	case "full":
+		r.entry.Dest = dest
+	case "hash":
+		mac := hmac.New(sha256.New, l.key)
+		mac.Write([]byte(dest))
+		r.entry.Dest = hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+	return r
+}
+
+// Count takes the bytes of the line from c, which counts the stream's
+// relay already. Without it they are logged as zero.
+func (r *Record) Count(c Counter) {
+	if r != nil {
+		r.counts = c
+	}
+}
+
+// Closed notes why the stream ended. The first reason given is kept;
+// what happens to the other direction afterwards follows from it.
+func (r *Record) Closed(reason string) {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() { r.reason = reason })
+}
+
+// End writes the line of r.
+func (l *Logger) End(r *Record) {
+	if l == nil || r == nil {
+		return
+	}
+	r.Closed("closed")
+	e := r.entry
+	e.Time = time.Now()
+	if r.counts != nil {
+		e.Up, e.Down = r.counts.Bytes()
+	}
+	e.Duration = e.Time.Sub(r.start).Round(time.Millisecond).Seconds()
+	e.Reason = r.reason
+	line, err := json.Marshal(&e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		flog.Debugf("failed to write access log: %v", err)
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
@@ -0,0 +1,530 @@
+// Package admin serves a control endpoint for a running process: the
+// connections, streams and users it holds, closing them, a client's
+// forward rules, the effective config and the log level. It has no
+// authentication, so it only listens on a unix socket or a loopback
+// address.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"paqet/internal/flog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is one transport connection: a client session on the server, a
+// connection to the server on the client.
+type Conn struct {
+	ID      string `json:"id"`
+	Remote  string `json:"remote"`
+	Streams int    `json:"streams"`
+	User    string `json:"user,omitempty"`
+	Version string `json:"version,omitempty"`
+	RTT     string `json:"rtt,omitempty"`
+	Health  string `json:"health,omitempty"` // client only, with health checks
+}
+
+// StreamInfo is a snapshot of a relayed stream.
+type StreamInfo struct {
+	ID      uint64    `json:"id"`
+	Proto   string    `json:"proto"`
+	Peer    string    `json:"peer"`
+	Dest    string    `json:"dest"`
+	User    string    `json:"user,omitempty"`
+	Started time.Time `json:"started"`
+	Up      uint64    `json:"bytes_up"` // client towards destination
+	Down    uint64    `json:"bytes_down"`
+}
+
+// User is the use of one user a server accepts, in bytes. A quota of 0
+// is unlimited.
+type User struct {
+	ID           string `json:"id"`
+	Conns        int    `json:"conns"`
+	Up           uint64 `json:"bytes_up"` // since the server started
+	Down         uint64 `json:"bytes_down"`
+	Today        uint64 `json:"today"` // both directions, this UTC day
+	Month        uint64 `json:"month"`
+	DailyQuota   uint64 `json:"daily_quota"`
+	MonthlyQuota uint64 `json:"monthly_quota"`
+	Revoked      bool   `json:"revoked,omitempty"`
+}
+
+// Forward is a forward rule of a client. Rules added through the
+// endpoint have the source "admin", those of the config file "config".
+type Forward struct {
+	Listen   string `json:"listen"`
+	Target   string `json:"target"`
+	Protocol string `json:"protocol"`
+	Priority string `json:"priority,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Active   int    `json:"active"` // connections being relayed
+	Draining bool   `json:"draining,omitempty"`
+}
+
+// Stream is a relayed stream registered with Track.
+type Stream struct {
+	info     StreamInfo
+	up, down atomic.Uint64
+	c        io.Closer
+}
+
+var (
+	serving atomic.Bool
+
+	mu      sync.Mutex
+	nextID  uint64
+	streams = make(map[uint64]*Stream)
+
+	conns     func() []Conn
+	closeConn func(id string) error
+	users     func() []User
+	revoke    func(id string) error
+	config    func() ([]byte, error)
+	reload    func() string
+
+	forwards      func() []Forward
+	addForward    func(f Forward) error
+	removeForward func(protocol, listen string, drain time.Duration) error
+)
+
+// Track registers a stream to peer relayed to dest; c closes it. The
+// caller must call Untrack when the stream ends. Without an endpoint
+// nothing is tracked and Track returns nil, which the methods accept.
+func Track(proto, peer, dest string, c io.Closer) *Stream {
+	if !serving.Load() {
+		return nil
+	}
+	return Counted(proto, peer, dest, c)
+}
+
+// Counted is Track for a caller that reads the counts back with Bytes,
+// as the server's access log does. Without an endpoint the stream is
+// counted but not listed.
+func Counted(proto, peer, dest string, c io.Closer) *Stream {
+	s := &Stream{info: StreamInfo{Proto: proto, Peer: peer, Dest: dest, Started: time.Now()}, c: c}
+	if !serving.Load() {
+		return s
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	nextID++
+	s.info.ID = nextID
+	streams[s.info.ID] = s
+	return s
+}
+
+func (s *Stream) Untrack() {
+	if s == nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	delete(streams, s.info.ID)
+}
+
+// SetUser attributes the stream to the user its session authenticated
+// as.
+func (s *Stream) SetUser(user string) {
+	if s == nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	s.info.User = user
+}
+
+// Writers counts what is written through up and down.
+func (s *Stream) Writers(up, down io.Writer) (io.Writer, io.Writer) {
+	if s == nil {
+		return up, down
+	}
+	return &counter{up, &s.up}, &counter{down, &s.down}
+}
+
+// CountUp and CountDown add bytes relayed outside of Writers.
+func (s *Stream) CountUp(n int) {
+	if s != nil {
+		s.up.Add(uint64(n))
+	}
+}
+
+func (s *Stream) CountDown(n int) {
+	if s != nil {
+		s.down.Add(uint64(n))
+	}
+}
+
+// Bytes returns what was relayed so far, client towards destination
+// first.
+func (s *Stream) Bytes() (up, down uint64) {
+	if s == nil {
+		return 0, 0
+	}
+	return s.up.Load(), s.down.Load()
+}
+
+type counter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(uint64(n))
+	return n, err
+}
+
+// Streams lists the tracked streams, oldest first.
+func Streams() []StreamInfo {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]StreamInfo, 0, len(streams))
+	for _, s := range streams {
+		info := s.info
+		info.Up, info.Down = s.up.Load(), s.down.Load()
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CloseStream closes the tracked stream id.
+func CloseStream(id uint64) error {
+	mu.Lock()
+	s := streams[id]
+	mu.Unlock()
+	if s == nil {
+		return fmt.Errorf("no stream %d", id)
+	}
+	return s.c.Close()
+}
+
+// SetConns installs how the role lists and closes its connections.
+func SetConns(list func() []Conn, close func(id string) error) {
+	mu.Lock()
+	defer mu.Unlock()
+	conns, closeConn = list, close
+}
+
+// SetUsers installs how a server lists and revokes its users.
+func SetUsers(list func() []User, revokeUser func(id string) error) {
+	mu.Lock()
+	defer mu.Unlock()
+	users, revoke = list, revokeUser
+}
+
+// SetForwards installs how a client lists, adds and removes forward
+// rules. remove lets the connections of the rule finish for up to drain
+// before closing them.
+func SetForwards(list func() []Forward, add func(f Forward) error, remove func(protocol, listen string, drain time.Duration) error) {
+	mu.Lock()
+	defer mu.Unlock()
+	forwards, addForward, removeForward = list, add, remove
+}
+
+// SetConfig installs what /config reports, as YAML with secrets removed.
+func SetConfig(fn func() ([]byte, error)) {
+	mu.Lock()
+	defer mu.Unlock()
+	config = fn
+}
+
+// SetReload installs what /reload runs; it returns a summary.
+func SetReload(fn func() string) {
+	mu.Lock()
+	defer mu.Unlock()
+	reload = fn
+}
+
+// Listen opens addr: "unix:/path" or a loopback host:port.
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		os.Remove(path) // left behind by a process that did not exit cleanly
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve answers the control endpoint on addr in the background.
+func Serve(addr string) error {
+	ln, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	serving.Store(true)
+	go http.Serve(ln, Handler())
+	return nil
+}
+
+// Handler routes the control endpoint:
+//
+//	GET  /conns               connections
+//	POST /conns/close?id=     close a connection
+//	GET  /streams             relayed streams with byte counts
+//	POST /streams/close?id=   close a stream
+//	GET  /users               per-user byte counts and quotas
+//	POST /users/revoke?id=    refuse a user and close its sessions
+//	GET  /forwards            forward rules of a client
+//	POST /forwards/add        add the forward rule in the JSON body
+//	POST /forwards/remove?listen=&protocol=[&drain=]
+//	                          remove a forward rule, draining it
+//	GET  /config              effective configuration
+//	POST /reload              reload the config file
+//	GET  /log                 current log level
+//	POST /log?level=[&for=]   change the log level, for a duration
+//
+// As the endpoint has no authentication, a web page must not be able to
+// reach it through the browser of its user: requests carrying an Origin
+// header or Sec-Fetch-Site: cross-site are refused, as are those to a
+// Host other than a loopback one (DNS rebinding), and a POST must be
+// sent as application/json, which no form or simple request can.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /conns", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		list := conns
+		mu.Unlock()
+		out := []Conn{}
+		if list != nil {
+			out = append(out, list()...)
+		}
+		reply(w, out)
+	})
+	mux.HandleFunc("POST /conns/close", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		close := closeConn
+		mu.Unlock()
+		if close == nil {
+			fail(w, http.StatusServiceUnavailable, fmt.Errorf("not running"))
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if err := close(id); err != nil {
+			fail(w, http.StatusNotFound, err)
+			return
+		}
+		flog.Infof("admin: closed connection %s", id)
+		reply(w, "ok")
+	})
+	mux.HandleFunc("GET /streams", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, Streams())
+	})
+	mux.HandleFunc("POST /streams/close", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			fail(w, http.StatusBadRequest, fmt.Errorf("invalid stream id: %v", err))
+			return
+		}
+		if err := CloseStream(id); err != nil {
+			fail(w, http.StatusNotFound, err)
+			return
+		}
+		flog.Infof("admin: closed stream %d", id)
+		reply(w, "ok")
+	})
+	mux.HandleFunc("GET /users", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		list := users
+		mu.Unlock()
+		out := []User{}
+		if list != nil {
+			out = append(out, list()...)
+		}
+		reply(w, out)
+	})
+	mux.HandleFunc("POST /users/revoke", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fn := revoke
+		mu.Unlock()
+		if fn == nil {
+			fail(w, http.StatusServiceUnavailable, fmt.Errorf("not running"))
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if err := fn(id); err != nil {
+			fail(w, http.StatusNotFound, err)
+			return
+		}
+		flog.Infof("admin: revoked user %s", id)
+		reply(w, "ok")
+	})
+	mux.HandleFunc("GET /forwards", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		list := forwards
+		mu.Unlock()
+		out := []Forward{}
+		if list != nil {
+			out = append(out, list()...)
+		}
+		reply(w, out)
+	})
+	mux.HandleFunc("POST /forwards/add", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		add := addForward
+		mu.Unlock()
+		if add == nil {
+			fail(w, http.StatusServiceUnavailable, fmt.Errorf("not a running client"))
+			return
+		}
+		var f Forward
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&f); err != nil {
+			fail(w, http.StatusBadRequest, fmt.Errorf("invalid forward rule: %v", err))
+			return
+		}
+		f.Source, f.Active, f.Draining = "", 0, false
+		if err := add(f); err != nil {
+			fail(w, http.StatusBadRequest, err)
+			return
+		}
+		flog.Infof("admin: added %s forward %s -> %s", f.Protocol, f.Listen, f.Target)
+		reply(w, "ok")
+	})
+	mux.HandleFunc("POST /forwards/remove", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remove := removeForward
+		mu.Unlock()
+		if remove == nil {
+			fail(w, http.StatusServiceUnavailable, fmt.Errorf("not a running client"))
+			return
+		}
+		q := r.URL.Query()
+		var drain time.Duration
+		if s := q.Get("drain"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				fail(w, http.StatusBadRequest, fmt.Errorf("invalid duration '%s'", s))
+				return
+			}
+			drain = d
+		}
+		if err := remove(q.Get("protocol"), q.Get("listen"), drain); err != nil {
+			fail(w, http.StatusNotFound, err)
+			return
+		}
+		flog.Infof("admin: removed %s forward %s", q.Get("protocol"), q.Get("listen"))
+		reply(w, "ok")
+	})
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fn := config
+		mu.Unlock()
+		if fn == nil {
+			fail(w, http.StatusServiceUnavailable, fmt.Errorf("no configuration"))
+			return
+		}
+		data, err := fn()
+		if err != nil {
+			fail(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(data)
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fn := reload
+		mu.Unlock()
+		if fn == nil {
+			fail(w, http.StatusServiceUnavailable, fmt.Errorf("not running"))
+			return
+		}
+		reply(w, fn())
+	})
+	mux.HandleFunc("GET /log", func(w http.ResponseWriter, r *http.Request) {
+		level := strings.ToLower(flog.GetLevel().String())
+		if to, at, ok := flog.Reverting(); ok {
+			level += fmt.Sprintf(" (reverts to %s in %v)", strings.ToLower(to.String()), time.Until(at).Round(time.Second))
+		}
+		reply(w, level)
+	})
+	mux.HandleFunc("POST /log", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		level, err := flog.ParseLevel(q.Get("level"))
+		if err != nil {
+			fail(w, http.StatusBadRequest, err)
+			return
+		}
+		if q.Get("for") == "" {
+			flog.SetLevel(int(level))
+			flog.Infof("admin: log level set to %s", q.Get("level"))
+			reply(w, "ok")
+			return
+		}
+		d, err := time.ParseDuration(q.Get("for"))
+		if err != nil || d <= 0 {
+			fail(w, http.StatusBadRequest, fmt.Errorf("invalid duration '%s'", q.Get("for")))
+			return
+		}
+		flog.SetLevelFor(int(level), d)
+		flog.Infof("admin: log level set to %s for %v", q.Get("level"), d)
+		reply(w, "ok")
+	})
+	return guard(mux)
+}
+
+// guard refuses requests a browser may have sent on behalf of a web page;
+// see Handler.
+func guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") == "cross-site":
+			fail(w, http.StatusForbidden, fmt.Errorf("cross-site request refused"))
+			return
+		case !loopbackHost(r.Host):
+			fail(w, http.StatusForbidden, fmt.Errorf("host '%s' is not a loopback address", r.Host))
+			return
+		case r.Method == http.MethodPost && !isJSON(r.Header.Get("Content-Type")):
+			fail(w, http.StatusUnsupportedMediaType, fmt.Errorf("POST requires Content-Type: application/json"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loopbackHost reports whether host, with or without a port, names this
+// machine: localhost or a loopback address.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+func isJSON(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	return err == nil && t == "application/json"
+}
+
+func reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func fail(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -1,25 +1,128 @@
 package buffer
 
 import (
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	TPool sync.Pool
-	UPool sync.Pool
+	// classes are the pools buffers come from, smallest first.
+	classes []*Pool
+	// tcpMax is the largest buffer a TCP copy grows to, and udpSize
+	// the buffer a UDP copy reads each datagram into.
+	tcpMax  = 32 * 1024
+	udpSize = 16 * 1024
+
+	oversize atomic.Int64
+
+	eventEngine    bool
+	hibernateAfter time.Duration
 )
 
-func Initialize(tPool, uPool int) {
-	TPool = sync.Pool{
-		New: func() any {
-			b := make([]byte, tPool)
-			return &b
-		},
+// Pool is a sync.Pool of fixed-size buffers that counts its use.
+type Pool struct {
+	p         sync.Pool
+	size      int
+	gets      atomic.Int64
+	allocated atomic.Int64
+	inUse     atomic.Int64
+}
+
+// PoolStats is a snapshot of a Pool. A Get that finds the pool empty
+// allocates, so Allocated against Gets is the miss rate; the garbage
+// collector may free idle buffers in between.
+type PoolStats struct {
+	Size      int   `json:"size"`
+	InUse     int64 `json:"in_use"`
+	Gets      int64 `json:"gets"`
+	Allocated int64 `json:"allocated"`
+}
+
+func newPool(size int) *Pool {
+	p := &Pool{size: size}
+	p.p.New = func() any {
+		p.allocated.Add(1)
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// Get returns a *[]byte of the pool's size.
+func (p *Pool) Get() any {
+	p.gets.Add(1)
+	p.inUse.Add(1)
+	return p.p.Get()
+}
+
+func (p *Pool) Put(x any) {
+	p.inUse.Add(-1)
+	p.p.Put(x)
+}
+
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{Size: p.size, InUse: p.inUse.Load(), Gets: p.gets.Load(), Allocated: p.allocated.Load()}
+}
+
+// Get returns a buffer of the smallest class holding n bytes, its
+// length the class size. Larger requests are allocated to size and not
+// pooled.
+func Get(n int) *[]byte {
+	for _, p := range classes {
+		if p.size >= n {
+			return p.Get().(*[]byte)
+		}
 	}
-	UPool = sync.Pool{
-		New: func() any {
-			b := make([]byte, uPool)
-			return &b
-		},
+	oversize.Add(1)
+	b := make([]byte, n)
+	return &b
+}
+
+// Put returns b to the class it came from, whatever length it was
+// resliced to. Buffers of no class's capacity, such as the oversize ones
+// Get allocated, were never counted in use and are left to the garbage
+// collector.
+func Put(b *[]byte) {
+	for _, p := range classes {
+		if cap(*b) == p.size {
+			*b = (*b)[:p.size]
+			p.Put(b)
+			return
+		}
+	}
+}
+
+// GetU returns a buffer for one UDP datagram of up to transport.udpbuf
+// bytes.
+func GetU() *[]byte { return Get(udpSize) }
+
+// Stats returns a snapshot of each size class, smallest first.
+func Stats() []PoolStats {
+	stats := make([]PoolStats, len(classes))
+	for i, p := range classes {
+		stats[i] = p.Stats()
+	}
+	return stats
+}
+
+// Oversize returns how many buffers were larger than every class.
+func Oversize() int64 { return oversize.Load() }
+
+// Initialize sets up the size classes, with tcpbuf and udpbuf among
+// them, and selects the copy engine. A TCP copy whose source stays idle
+// for hibernate gives its buffer back until data arrives again; zero
+// keeps the buffer for the life of the copy.
+func Initialize(sizes []int, tcpBuf, udpBuf int, engine string, hibernate time.Duration) {
+	eventEngine = engine == "event"
+	hibernateAfter = hibernate
+	tcpMax, udpSize = tcpBuf, udpBuf
+
+	sizes = append(slices.Clone(sizes), tcpBuf, udpBuf)
+	slices.Sort(sizes)
+	classes = nil
+	for _, size := range slices.Compact(sizes) {
+		classes = append(classes, newPool(size))
 	}
 }
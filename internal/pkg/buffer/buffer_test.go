@@ -0,0 +1,31 @@
+package buffer
+
+import "testing"
+
+// TestPutInUse returns buffers of every kind and checks each class
+// counts only its own.
+func TestPutInUse(t *testing.T) {
+	Initialize([]int{512, 4096}, 16384, 16384, "", 0)
+	inUse := func() (n []int64) {
+		for _, st := range Stats() {
+			n = append(n, st.InUse)
+		}
+		return n
+	}
+
+	small, big := Get(100), Get(20000)
+	if got := inUse(); got[0] != 1 || got[1] != 0 || got[2] != 0 {
+		t.Fatalf("in use %v after one small and one oversize Get", got)
+	}
+	*small = (*small)[:10]
+	Put(small)
+	Put(big)
+	odd := make([]byte, 5000)
+	Put(&odd)
+	if got := inUse(); got[0] != 0 || got[1] != 0 || got[2] != 0 {
+		t.Fatalf("in use %v after putting them back and a foreign buffer", got)
+	}
+	if b := Get(100); len(*b) != 512 {
+		t.Fatalf("pooled buffer has length %d, want 512", len(*b))
+	}
+}
@@ -0,0 +1,214 @@
+package buffer
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// poller is the event copy engine: one epoll loop watches every idle
+// source and starts a short-lived goroutine to drain it once readable.
+// Registrations are one-shot, so at most one drain runs per source.
+type poller struct {
+	epfd    int
+	mu      sync.Mutex
+	watches map[int32]*watcher
+	next    int32
+}
+
+type watcher struct {
+	p        *poller
+	id       int32
+	ctx      context.Context
+	rc       syscall.RawConn
+	dst      io.Writer
+	done     func(error)
+	stop     func() bool
+	mu       sync.Mutex
+	draining bool
+	finished bool
+}
+
+var (
+	pollerOnce sync.Once
+	pollerInst *poller
+)
+
+func getPoller() *poller {
+	pollerOnce.Do(func() {
+		epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+		if err != nil {
+			return
+		}
+		pollerInst = &poller{epfd: epfd, watches: make(map[int32]*watcher)}
+		go pollerInst.loop()
+	})
+	return pollerInst
+}
+
+func watch(ctx context.Context, dst io.Writer, src net.Conn, done func(error)) bool {
+	p := getPoller()
+	sc, ok := src.(syscall.Conn)
+	if p == nil || !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	// Setup holds w.mu, so an early cancellation waits for it to finish.
+	w := &watcher{p: p, ctx: ctx, rc: rc, dst: dst, done: done}
+	w.mu.Lock()
+	w.stop = context.AfterFunc(ctx, func() { w.finish(ctx.Err(), true) })
+	p.mu.Lock()
+	p.next++
+	w.id = p.next
+	p.watches[w.id] = w
+	p.mu.Unlock()
+
+	if !w.ctl(unix.EPOLL_CTL_ADD) {
+		w.finished = true
+		w.mu.Unlock()
+		w.stop()
+		p.mu.Lock()
+		delete(p.watches, w.id)
+		p.mu.Unlock()
+		return false
+	}
+	w.mu.Unlock()
+	return true
+}
+
+// idleWatches counts the watched sources not being drained.
+func idleWatches() int64 {
+	if !eventEngine {
+		return 0
+	}
+	p := getPoller()
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	watches := make([]*watcher, 0, len(p.watches))
+	for _, w := range p.watches {
+		watches = append(watches, w)
+	}
+	p.mu.Unlock()
+	var n int64
+	for _, w := range watches {
+		w.mu.Lock()
+		if !w.draining && !w.finished {
+			n++
+		}
+		w.mu.Unlock()
+	}
+	return n
+}
+
+// ctl changes the registration while the descriptor is pinned, so a
+// concurrent Close cannot hand the number to another socket meanwhile.
+func (w *watcher) ctl(op int) bool {
+	var err error
+	ev := unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT, Fd: w.id}
+	cerr := w.rc.Control(func(fd uintptr) {
+		err = unix.EpollCtl(w.p.epfd, op, int(fd), &ev)
+	})
+	return cerr == nil && err == nil
+}
+
+func (p *poller) loop() {
+	events := make([]unix.EpollEvent, 128)
+	for {
+		n, err := unix.EpollWait(p.epfd, events, -1)
+		if err != nil && err != unix.EINTR {
+			return
+		}
+		for i := 0; i < n; i++ {
+			p.mu.Lock()
+			w := p.watches[events[i].Fd]
+			p.mu.Unlock()
+			if w == nil {
+				continue
+			}
+			w.mu.Lock()
+			if w.finished {
+				w.mu.Unlock()
+				continue
+			}
+			w.draining = true
+			w.mu.Unlock()
+			go w.drain()
+		}
+	}
+}
+
+// drain copies until the source would block, then rearms the watch and
+// returns the buffer to the pool.
+func (w *watcher) drain() {
+	var c copier
+	defer c.release()
+
+	for {
+		var n int
+		var rerr error
+		buf := c.buf()
+		err := w.rc.Read(func(fd uintptr) bool {
+			n, rerr = unix.Read(int(fd), buf)
+			return true
+		})
+		if err == nil {
+			err = rerr
+		}
+		switch {
+		case err == unix.EAGAIN:
+			w.mu.Lock()
+			w.draining = false
+			w.mu.Unlock()
+			// A cancellation seen while draining was left to us.
+			if w.ctx.Err() != nil {
+				w.finish(w.ctx.Err(), false)
+			} else if !w.ctl(unix.EPOLL_CTL_MOD) {
+				w.finish(net.ErrClosed, false)
+			}
+			return
+		case err != nil:
+			w.finish(err, false)
+			return
+		case n == 0:
+			w.finish(nil, false)
+			return
+		}
+		if _, err := w.dst.Write(buf[:n]); err != nil {
+			w.finish(err, false)
+			return
+		}
+		c.adapt(n)
+	}
+}
+
+// finish reports the result once. A cancellation that arrives during a
+// drain only marks the watch; the drain fails on the closed source and
+// reports then.
+func (w *watcher) finish(err error, cancelled bool) {
+	w.mu.Lock()
+	if w.finished || (cancelled && w.draining) {
+		w.mu.Unlock()
+		return
+	}
+	w.finished = true
+	w.mu.Unlock()
+
+	if !cancelled {
+		w.stop()
+	}
+	w.ctl(unix.EPOLL_CTL_DEL)
+	w.p.mu.Lock()
+	delete(w.p.watches, w.id)
+	w.p.mu.Unlock()
+	w.done(err)
+}
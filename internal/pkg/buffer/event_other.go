@@ -0,0 +1,15 @@
+//go:build !linux
+
+package buffer
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+func watch(ctx context.Context, dst io.Writer, src net.Conn, done func(error)) bool {
+	return false
+}
+
+func idleWatches() int64 { return 0 }
@@ -1,14 +1,237 @@
 package buffer
 
 import (
+	"context"
 	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// hibernated counts TCP copies waiting on an idle source without a
+// pooled buffer.
+var hibernated atomic.Int64
+
+// shrinkAfter is how many reads in a row must fit the class below before
+// a copy moves down to it.
+const shrinkAfter = 16
+
+// copier holds the buffer of a TCP copy and sizes it to the source:
+// a read that fills it moves up a class, up to tcpbuf, and a run of
+// reads that would fit the class below moves back down. Interactive
+// streams stay on small buffers while bulk ones read tcpbuf at a time.
+type copier struct {
+	bufp  *[]byte
+	small int // reads in a row that fit the class below
+}
+
+func (c *copier) buf() []byte {
+	if c.bufp == nil {
+		c.bufp = Get(min(firstClass(), tcpMax))
+	}
+	return *c.bufp
+}
+
+// adapt resizes the buffer after a read of n bytes into it.
+func (c *copier) adapt(n int) {
+	size := len(*c.bufp)
+	switch {
+	case n == size && size < tcpMax:
+		c.small = 0
+		if next := nextClass(size); next > size {
+			Put(c.bufp)
+			c.bufp = Get(min(next, tcpMax))
+		}
+	case n <= prevClass(size):
+		if c.small++; c.small >= shrinkAfter {
+			c.small = 0
+			Put(c.bufp)
+			c.bufp = Get(prevClass(size))
+		}
+	default:
+		c.small = 0
+	}
+}
+
+// release gives the buffer back; the next buf starts small again.
+func (c *copier) release() {
+	if c.bufp != nil {
+		Put(c.bufp)
+		c.bufp, c.small = nil, 0
+	}
+}
+
+func firstClass() int {
+	if len(classes) == 0 {
+		return tcpMax
+	}
+	return classes[0].size
+}
+
+// nextClass returns the size of the class above size, or size.
+func nextClass(size int) int {
+	for _, p := range classes {
+		if p.size > size {
+			return p.size
+		}
+	}
+	return size
+}
+
+// prevClass returns the size of the class below size, or 0.
+func prevClass(size int) int {
+	prev := 0
+	for _, p := range classes {
+		if p.size >= size {
+			break
+		}
+		prev = p.size
+	}
+	return prev
+}
+
+// CopyT copies src to dst until src ends, by the cheapest path the two
+// allow:
+//
+//   - between two TCP sockets on Linux, splice(2) moves the data inside
+//     the kernel without a user buffer;
+//   - a source that is not a socket but writes out buffers of its own,
+//     such as a smux stream, writes them to dst directly, saving a copy;
+//   - anything else is read into a pooled buffer that follows the
+//     traffic. It is read here rather than through io.Copy, as the net
+//     package's ReadFrom and WriteTo fallbacks allocate a fresh buffer
+//     for each copy.
 func CopyT(dst io.Writer, src io.Reader) error {
-	bufp := TPool.Get().(*[]byte)
-	defer TPool.Put(bufp)
-	buf := *bufp
+	if d, s, ok := spliceable(dst, src); ok {
+		return splice(d, s)
+	}
+	if wt, ok := src.(io.WriterTo); ok {
+		if _, sock := src.(syscall.Conn); !sock {
+			_, err := wt.WriteTo(dst)
+			return err
+		}
+	}
+	if c, ok := src.(net.Conn); ok && hibernateAfter > 0 {
+		return copyHibernating(dst, c)
+	}
+	var c copier
+	defer c.release()
+	for {
+		n, err := src.Read(c.buf())
+		if n > 0 {
+			if _, werr := dst.Write((*c.bufp)[:n]); werr != nil {
+				return werr
+			}
+			c.adapt(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// GoCopyT copies src to dst in the background like CopyT and calls done
+// with the result. With the event copy engine an idle src holds neither
+// a goroutine nor a buffer; ctx must be cancelled when the copy is no
+// longer wanted, as closing src alone does not wake the engine.
+func GoCopyT(ctx context.Context, dst io.Writer, src net.Conn, done func(error)) {
+	if _, _, ok := spliceable(dst, src); !ok && eventEngine && watch(ctx, dst, src, done) {
+		return
+	}
+	go func() { done(CopyT(dst, src)) }()
+}
 
-	_, err := io.CopyBuffer(dst, src, buf)
+// spliced counts TCP copies running in the kernel.
+var spliced atomic.Int64
+
+// spliceable returns dst and src as TCP sockets if the kernel can copy
+// between them.
+func spliceable(dst io.Writer, src io.Reader) (*net.TCPConn, *net.TCPConn, bool) {
+	if runtime.GOOS != "linux" {
+		return nil, nil, false
+	}
+	d, ok := dst.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	s, ok := src.(*net.TCPConn)
+	return d, s, ok
+}
+
+// splice copies src to dst through a kernel pipe. It holds no pooled
+// buffer while src is idle, so it needs neither hibernation nor the
+// event engine.
+func splice(dst, src *net.TCPConn) error {
+	spliced.Add(1)
+	defer spliced.Add(-1)
+	_, err := dst.ReadFrom(src)
 	return err
 }
+
+// Spliced returns how many TCP copies the kernel is doing.
+func Spliced() int64 { return spliced.Load() }
+
+// Hibernated returns how many TCP copies are waiting on an idle source
+// without a copy buffer: those hibernated by CopyT and those the event
+// engine watches.
+func Hibernated() int64 {
+	return hibernated.Load() + idleWatches()
+}
+
+// copyHibernating is CopyT for a source idle for long stretches. While
+// data flows it reads into a pooled buffer; once a read waits longer
+// than hibernateAfter the buffer goes back to the pool, and the copy
+// blocks on a small stack buffer until the source has data again.
+func copyHibernating(dst io.Writer, src net.Conn) error {
+	var small [512]byte
+	for {
+		err := copyActive(dst, src)
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return err
+		}
+
+		src.SetReadDeadline(time.Time{})
+		hibernated.Add(1)
+		n, err := src.Read(small[:])
+		hibernated.Add(-1)
+		if n > 0 {
+			if _, werr := dst.Write(small[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyActive copies until src ends, fails, or has nothing to read for
+// hibernateAfter, which it reports as a timeout error.
+func copyActive(dst io.Writer, src net.Conn) error {
+	var c copier
+	defer c.release()
+	for {
+		src.SetReadDeadline(time.Now().Add(hibernateAfter))
+		n, err := src.Read(c.buf())
+		if n > 0 {
+			if _, werr := dst.Write((*c.bufp)[:n]); werr != nil {
+				return werr
+			}
+			c.adapt(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -5,8 +5,8 @@ import (
 )
 
 func CopyU(dst io.Writer, src io.Reader) error {
-	bufp := UPool.Get().(*[]byte)
-	defer UPool.Put(bufp)
+	bufp := GetU()
+	defer Put(bufp)
 	buf := *bufp
 
 	_, err := io.CopyBuffer(dst, src, buf)
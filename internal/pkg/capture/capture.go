@@ -0,0 +1,181 @@
+// Package capture mirrors the packets paqet sends and accepts into a
+// pcapng file for bug reports, so nobody has to get a tcpdump filter
+// right. Frames are written as they are on the wire; payloads stay
+// encrypted. The file is rotated by size, keeping a few old ones.
+package capture
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// flushEvery bounds how much a crash loses of what was captured.
+const flushEvery = time.Second
+
+var (
+	outbound = pcapgo.NgEpbFlags{Direction: pcapgo.NgEpbFlagDirectionOutbound}
+	inbound  = pcapgo.NgEpbFlags{Direction: pcapgo.NgEpbFlagDirectionInbound}
+)
+
+// Writer appends packets to path, moving it to path.1, path.2 and so on
+// once it reaches size bytes.
+type Writer struct {
+	path    string
+	size    int64
+	files   int
+	markers bool
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *pcapgo.NgWriter
+	written int64
+	ifaces  map[layers.LinkType]int
+	flushed time.Time
+}
+
+// Open starts a capture at path. With markers, each packet carries a
+// comment naming its peer and where the tunnel payload sits in the
+// frame, for reading a capture without knowing the wire format.
+func Open(path string, size int64, files int, markers bool) (*Writer, error) {
+	w := &Writer{path: path, size: size, files: files, markers: markers}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open starts a new file at w.path. The caller holds mu, or owns w.
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w.written = 0
+	c := &counter{f: f, n: &w.written}
+	opts := pcapgo.NgWriterOptions{SectionInfo: pcapgo.NgSectionInfo{Application: "paqet", OS: runtime.GOOS}}
+	ng, err := pcapgo.NewNgWriterInterface(c, iface(layers.LinkTypeEthernet), opts)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.w, w.flushed = f, ng, time.Now()
+	w.ifaces = map[layers.LinkType]int{layers.LinkTypeEthernet: 0}
+	return nil
+}
+
+func iface(link layers.LinkType) pcapgo.NgInterface {
+	return pcapgo.NgInterface{Name: "paqet", LinkType: link, SnapLength: 0}
+}
+
+// rotate moves the full file aside, dropping the oldest, and starts a
+// new one. The caller holds mu.
+func (w *Writer) rotate() error {
+	w.w.Flush()
+	w.f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", w.path, w.files-1))
+	for i := w.files - 2; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if w.files > 1 {
+		os.Rename(w.path, w.path+".1")
+	}
+	return w.open()
+}
+
+func (w *Writer) write(link layers.LinkType, frame []byte, payload int, addr net.Addr, in bool) {
+	now := time.Now()
+	opts := pcapgo.NgPacketOptions{Flags: &outbound}
+	dir := "out to"
+	if in {
+		opts.Flags, dir = &inbound, "in from"
+	}
+	if w.markers {
+		opts.Comments = []string{fmt.Sprintf("%s %v, payload %d bytes at %d", dir, addr, len(frame)-payload, payload)}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.w == nil {
+		return
+	}
+	idx, ok := w.ifaces[link]
+	if !ok {
+		var err error
+		if idx, err = w.w.AddInterface(iface(link)); err != nil {
+			return
+		}
+		w.ifaces[link] = idx
+	}
+	ci := gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(frame), Length: len(frame), InterfaceIndex: idx}
+	if err := w.w.WritePacketWithOptions(ci, frame, opts); err != nil {
+		return
+	}
+	if now.Sub(w.flushed) >= flushEvery {
+		w.w.Flush()
+		w.flushed = now
+	}
+	if w.written >= w.size {
+		if err := w.rotate(); err != nil {
+			w.w = nil
+		}
+	}
+}
+
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.w == nil {
+		return nil
+	}
+	w.w.Flush()
+	w.w = nil
+	return w.f.Close()
+}
+
+// counter counts what reaches the file, buffered writes included once
+// flushed, to decide when to rotate.
+type counter struct {
+	f *os.File
+	n *int64
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.f.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+var def atomic.Pointer[Writer]
+
+// SetDefault makes w the writer used by Sent and Received.
+func SetDefault(w *Writer) { def.Store(w) }
+
+// Close stops the default writer, flushing what it holds.
+func Close() error { return def.Swap(nil).Close() }
+
+// Sent captures an Ethernet frame sent to addr whose tunnel payload
+// starts at offset payload.
+func Sent(frame []byte, payload int, addr net.Addr) {
+	if w := def.Load(); w != nil {
+		w.write(layers.LinkTypeEthernet, frame, payload, addr, false)
+	}
+}
+
+// Received captures a frame of link type link accepted from addr.
+func Received(link layers.LinkType, frame []byte, payload int, addr net.Addr) {
+	if w := def.Load(); w != nil {
+		w.write(link, frame, payload, addr, true)
+	}
+}
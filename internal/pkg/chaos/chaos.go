@@ -0,0 +1,152 @@
+// Package chaos injects faults for soak testing reconnection, stream
+// scheduling and resumption, and impairs the link (loss, duplication,
+// reordering, latency) to check KCP modes and FEC against a bad path.
+// It does nothing unless Enable is called, which only the hidden --chaos
+// flag of "paqet run" does, and each hook is then a single atomic load
+// when disabled.
+package chaos
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Faults sets how often each fault fires.
+type Faults struct {
+	Health  float64       // fraction of health checks failed without a ping
+	Open    time.Duration // upper bound of a random delay before stream opens
+	Kill    time.Duration // mean time between killed client connections
+	Corrupt float64       // fraction of received frames with one flipped byte
+
+	// Link impairments, applied to every packet sent.
+	Loss      float64       // fraction of packets dropped
+	Duplicate float64       // fraction of packets sent twice
+	Reorder   float64       // fraction of packets held back behind later ones
+	Delay     time.Duration // added latency
+	Jitter    time.Duration // upper bound of random latency on top of Delay
+	Seed      uint64        // seeds the link impairments; 0 picks one at random
+}
+
+var active atomic.Pointer[Faults]
+
+// ErrHealth is returned in place of a dropped health check.
+var ErrHealth = fmt.Errorf("chaos: health check dropped")
+
+// Parse reads a comma separated list such as
+// "health=0.2,open=500ms,kill=60s,corrupt=0.001" or
+// "loss=0.02,reorder=0.01,dup=0.005,delay=40ms,jitter=10ms,seed=1".
+func Parse(spec string) (*Faults, error) {
+	f := &Faults{}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("chaos fault %q is not key=value", kv)
+		}
+		var err error
+		switch k {
+		case "health":
+			f.Health, err = parseFraction(v)
+		case "corrupt":
+			f.Corrupt, err = parseFraction(v)
+		case "open":
+			f.Open, err = time.ParseDuration(v)
+		case "kill":
+			f.Kill, err = time.ParseDuration(v)
+		case "loss":
+			f.Loss, err = parseFraction(v)
+		case "dup":
+			f.Duplicate, err = parseFraction(v)
+		case "reorder":
+			f.Reorder, err = parseFraction(v)
+		case "delay":
+			f.Delay, err = time.ParseDuration(v)
+		case "jitter":
+			f.Jitter, err = time.ParseDuration(v)
+		case "seed":
+			f.Seed, err = strconv.ParseUint(v, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown chaos fault %q; use health, open, kill, corrupt, loss, dup, reorder, delay, jitter or seed", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chaos fault %s: %v", k, err)
+		}
+	}
+	if f.Open < 0 || f.Kill < 0 || f.Delay < 0 || f.Jitter < 0 {
+		return nil, fmt.Errorf("chaos durations must not be negative")
+	}
+	return f, nil
+}
+
+func parseFraction(v string) (float64, error) {
+	p, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("fraction must be between 0-1")
+	}
+	return p, nil
+}
+
+func (f *Faults) String() string {
+	s := fmt.Sprintf("health=%g,open=%s,kill=%s,corrupt=%g", f.Health, f.Open, f.Kill, f.Corrupt)
+	if f.Impairs() {
+		s += fmt.Sprintf(",loss=%g,dup=%g,reorder=%g,delay=%s,jitter=%s,seed=%d", f.Loss, f.Duplicate, f.Reorder, f.Delay, f.Jitter, f.Seed)
+	}
+	return s
+}
+
+// Impairs reports whether f sets any link impairment.
+func (f *Faults) Impairs() bool {
+	return f.Loss > 0 || f.Duplicate > 0 || f.Reorder > 0 || f.Delay > 0 || f.Jitter > 0
+}
+
+// Enable turns the faults on for the whole process.
+func Enable(f *Faults) { active.Store(f) }
+
+// Enabled reports whether any faults are active.
+func Enabled() bool { return active.Load() != nil }
+
+// Link returns the active faults when they impair the link, or nil.
+func Link() *Faults {
+	if f := active.Load(); f != nil && f.Impairs() {
+		return f
+	}
+	return nil
+}
+
+// DropHealth reports whether the next health check should fail.
+func DropHealth() bool {
+	f := active.Load()
+	return f != nil && f.Health > 0 && rand.Float64() < f.Health
+}
+
+// DelayOpen sleeps a random time up to the open delay.
+func DelayOpen() {
+	if f := active.Load(); f != nil && f.Open > 0 {
+		time.Sleep(rand.N(f.Open))
+	}
+}
+
+// Corrupt flips one random byte of b for the configured fraction of frames.
+func Corrupt(b []byte) {
+	f := active.Load()
+	if f == nil || f.Corrupt == 0 || len(b) == 0 || rand.Float64() >= f.Corrupt {
+		return
+	}
+	b[rand.IntN(len(b))] ^= byte(1 + rand.IntN(255))
+}
+
+// NextKill returns an exponentially distributed wait before the next
+// connection kill, or 0 when kills are off.
+func NextKill() time.Duration {
+	f := active.Load()
+	if f == nil || f.Kill == 0 {
+		return 0
+	}
+	return time.Duration(rand.ExpFloat64() * float64(f.Kill))
+}
@@ -0,0 +1,111 @@
+package class
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+type Class int32
+
+const (
+	Auto Class = iota - 1 // derived from the destination
+	Bulk
+	Interactive
+)
+
+// Parse maps a rule priority tag to a class. Untagged rules are Auto.
+func Parse(s string) Class {
+	switch s {
+	case "interactive":
+		return Interactive
+	case "bulk":
+		return Bulk
+	default:
+		return Auto
+	}
+}
+
+func (c Class) String() string {
+	switch c {
+	case Auto:
+		return "auto"
+	case Bulk:
+		return "bulk"
+	case Interactive:
+		return "interactive"
+	default:
+		return "unknown"
+	}
+}
+
+// Tuner is implemented by connections that can switch between an
+// interactive profile and their configured bulk profile.
+type Tuner interface {
+	Tune(interactive bool)
+}
+
+type Classifier struct {
+	ports     []int
+	bulkBytes int64
+	weight    int
+}
+
+// New creates a classifier. A non-zero weight puts a write scheduler in
+// front of every tracked connection.
+func New(ports []int, bulkBytes int, weight int) *Classifier {
+	return &Classifier{ports: ports, bulkBytes: int64(bulkBytes), weight: weight}
+}
+
+// ByPort returns the initial class of a stream towards port.
+func (c *Classifier) ByPort(port int) Class {
+	if slices.Contains(c.ports, port) {
+		return Interactive
+	}
+	return Bulk
+}
+
+// byPayload recognizes protocols from the first bytes a stream carries.
+func byPayload(b []byte) (Class, bool) {
+	if bytes.HasPrefix(b, []byte("SSH-")) {
+		return Interactive, true
+	}
+	return Bulk, false
+}
+
+// Tracker counts the live interactive streams of one connection and
+// retunes the connection whenever that count crosses zero.
+type Tracker struct {
+	cls   *Classifier
+	tuner Tuner
+	sched *Scheduler
+	live  atomic.Int32
+	mu    sync.Mutex
+	on    bool
+}
+
+func (c *Classifier) Track(t Tuner) *Tracker {
+	tr := &Tracker{cls: c, tuner: t}
+	if c.weight > 0 {
+		tr.sched = newScheduler(c.weight)
+	}
+	return tr
+}
+
+// Close stops the scheduler once the connection is gone.
+func (t *Tracker) Close() {
+	if t.sched != nil {
+		t.sched.close()
+	}
+}
+
+func (t *Tracker) add(d int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	on := t.live.Add(d) > 0
+	if on != t.on {
+		t.on = on
+		t.tuner.Tune(on)
+	}
+}
@@ -0,0 +1,81 @@
+package class
+
+import (
+	"time"
+)
+
+const (
+	quantum = 8192 // matches smux MaxFrameSize
+	lease   = 20 * time.Millisecond
+)
+
+// Scheduler orders the writes of one connection's streams before they
+// reach smux. Writes are granted one quantum at a time in weighted
+// round-robin: up to weight interactive quanta for every bulk quantum.
+// A grant is held until the write returns or the lease runs out, so a
+// stream stalled on flow control cannot hold up the others.
+type Scheduler struct {
+	q       [2]chan *Strm
+	weights [2]int
+	timer   *time.Timer
+	die     chan struct{}
+}
+
+func newScheduler(weight int) *Scheduler {
+	s := &Scheduler{
+		q:       [2]chan *Strm{make(chan *Strm, 64), make(chan *Strm, 64)},
+		weights: [2]int{Bulk: 1, Interactive: weight},
+		timer:   time.NewTimer(lease),
+		die:     make(chan struct{}),
+	}
+	s.timer.Stop()
+	go s.run()
+	return s
+}
+
+func (s *Scheduler) run() {
+	credit := s.weights
+	for {
+		var r *Strm
+		for c := Interactive; c >= Bulk && r == nil; c-- {
+			if credit[c] == 0 {
+				continue
+			}
+			select {
+			case r = <-s.q[c]:
+				credit[c]--
+			default:
+			}
+		}
+		if r == nil {
+			// Nothing with credit left is waiting: start a new round.
+			credit = s.weights
+			select {
+			case r = <-s.q[Interactive]:
+				credit[Interactive]--
+			case r = <-s.q[Bulk]:
+				credit[Bulk]--
+			case <-s.die:
+				return
+			}
+		}
+
+		select {
+		case <-r.done: // left over from a write that outlived its lease
+		default:
+		}
+		r.grant <- struct{}{}
+		s.timer.Reset(lease)
+		select {
+		case <-r.done:
+			s.timer.Stop()
+		case <-s.timer.C:
+		case <-s.die:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) close() {
+	close(s.die)
+}
@@ -0,0 +1,140 @@
+package class
+
+import (
+	"io"
+	"paqet/internal/tnet"
+	"sync"
+	"sync/atomic"
+)
+
+// Strm follows the class of a stream as it carries traffic: a recognized
+// first payload promotes it to interactive, and once it has moved more
+// than bulk_bytes it is demoted to bulk.
+type Strm struct {
+	tnet.Strm
+	t      *Tracker
+	cur    atomic.Int32
+	bytes  atomic.Int64
+	first  atomic.Bool
+	mu     sync.Mutex
+	closed bool
+	wmu    sync.Mutex
+	grant  chan struct{}
+	done   chan struct{}
+}
+
+func (t *Tracker) Wrap(strm tnet.Strm, c Class) *Strm {
+	s := &Strm{Strm: strm, t: t}
+	if t.sched != nil {
+		s.grant = make(chan struct{}, 1)
+		s.done = make(chan struct{}, 1)
+	}
+	s.set(c)
+	return s
+}
+
+func (s *Strm) Class() Class { return Class(s.cur.Load()) }
+
+func (s *Strm) Read(b []byte) (int, error) {
+	n, err := s.Strm.Read(b)
+	s.account(b[:n])
+	return n, err
+}
+
+// WriteTo keeps the io.WriterTo of the stream below, accounting for
+// what it writes to w as Read would.
+func (s *Strm) WriteTo(w io.Writer) (int64, error) {
+	return tnet.WriteTo(s.Strm, accountWriter{s, w})
+}
+
+type accountWriter struct {
+	s *Strm
+	w io.Writer
+}
+
+func (a accountWriter) Write(b []byte) (int, error) {
+	n, err := a.w.Write(b)
+	a.s.account(b[:n])
+	return n, err
+}
+
+func (s *Strm) Write(b []byte) (int, error) {
+	if s.t.sched == nil {
+		n, err := s.Strm.Write(b)
+		s.account(b[:n])
+		return n, err
+	}
+
+	// Queue one quantum at a time so the scheduler can interleave
+	// interactive writes between the chunks of a bulk transfer.
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	written := 0
+	for written < len(b) {
+		chunk := b[written:min(written+quantum, len(b))]
+		select {
+		case s.t.sched.q[s.Class()] <- s:
+		case <-s.t.sched.die:
+			return written, io.ErrClosedPipe
+		}
+		select {
+		case <-s.grant:
+		case <-s.t.sched.die:
+			return written, io.ErrClosedPipe
+		}
+		n, err := s.Strm.Write(chunk)
+		s.done <- struct{}{}
+		s.account(chunk[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (s *Strm) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		if s.Class() == Interactive {
+			s.t.add(-1)
+		}
+	}
+	s.mu.Unlock()
+	return s.Strm.Close()
+}
+
+func (s *Strm) account(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	total := s.bytes.Add(int64(len(b)))
+	if s.first.CompareAndSwap(false, true) {
+		if c, ok := byPayload(b); ok && total <= s.t.cls.bulkBytes {
+			s.set(c)
+		}
+	}
+	if total > s.t.cls.bulkBytes && s.Class() == Interactive {
+		s.set(Bulk)
+	}
+}
+
+func (s *Strm) set(c Class) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	prev := s.Class()
+	s.cur.Store(int32(c))
+	if prev == c {
+		// A fresh stream starts as bulk; only count it once it turns interactive.
+		return
+	}
+	if c == Interactive {
+		s.t.add(1)
+	} else {
+		s.t.add(-1)
+	}
+}
@@ -0,0 +1,220 @@
+// Package compress carries a byte stream as blocks compressed with LZ4
+// or Snappy. Each block is framed as
+//
+//	[1: kind][2: len][len: block]
+//
+// where kind says whether the block is compressed. Short writes, and
+// blocks that would not shrink, go as they are, so traffic that is
+// already compressed costs little more than the three header bytes.
+package compress
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	// maxBlock is the most a block decodes to; longer writes are split.
+	maxBlock = 32 * 1024
+	// minBlock is the shortest write worth compressing.
+	minBlock = 256
+	// After misses incompressible blocks in a row a Writer stops trying
+	// for the next skip blocks.
+	misses = 8
+	skip   = 64
+)
+
+// Block kinds.
+const (
+	kindRaw    = 0
+	kindPacked = 1
+)
+
+// Writer compresses each Write into one or more blocks. It is not safe
+// for concurrent use.
+type Writer struct {
+	w      io.Writer
+	algo   string
+	lz     lz4.Compressor
+	buf    []byte
+	missed int
+	skip   int
+}
+
+// NewWriter compresses onto w with algo, "lz4" or "snappy".
+func NewWriter(w io.Writer, algo string) *Writer {
+	size := maxBlock
+	if algo == "snappy" {
+		size = snappy.MaxEncodedLen(maxBlock)
+	}
+	return &Writer{w: w, algo: algo, buf: make([]byte, 3+size)}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		b := p[:min(len(p), maxBlock)]
+		if err := w.block(b); err != nil {
+			return n, err
+		}
+		n += len(b)
+		p = p[len(b):]
+	}
+	return n, nil
+}
+
+func (w *Writer) block(b []byte) error {
+	frame := w.buf[:3]
+	frame[0] = kindRaw
+	if len(b) >= minBlock && w.skip == 0 {
+		if packed := w.pack(b); packed > 0 {
+			frame, w.missed = w.buf[:3+packed], 0
+			frame[0] = kindPacked
+		} else if w.missed++; w.missed >= misses {
+			w.missed, w.skip = 0, skip
+		}
+	} else if w.skip > 0 {
+		w.skip--
+	}
+	if frame[0] == kindRaw {
+		frame = append(frame, b...)
+	}
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(frame)-3))
+	_, err := w.w.Write(frame)
+	return err
+}
+
+// pack compresses b after the frame header and returns its size, or 0
+// when the result would not be smaller than b.
+func (w *Writer) pack(b []byte) int {
+	dst := w.buf[3:]
+	switch w.algo {
+	case "lz4":
+		// Too small a buffer for an incompressible block makes the
+		// compressor give up early.
+		n, err := w.lz.CompressBlock(b, dst[:len(b)-1])
+		if err != nil {
+			return 0
+		}
+		return n
+	case "snappy":
+		if n := len(snappy.Encode(dst, b)); n < len(b) {
+			return n
+		}
+	}
+	return 0
+}
+
+// Reader decompresses the blocks a Writer produced.
+type Reader struct {
+	r    io.Reader
+	algo string
+	hdr  [3]byte
+	got  int // bytes of the current block read so far, header included
+	in   []byte
+	out  []byte
+	data []byte
+}
+
+// NewReader decompresses from r with algo, "lz4" or "snappy".
+func NewReader(r io.Reader, algo string) *Reader {
+	return &Reader{r: r, algo: algo, in: make([]byte, maxBlock), out: make([]byte, maxBlock)}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// WriteTo writes the decompressed stream to w until it ends, each block
+// straight out of the buffer it was decoded into.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for {
+		if len(r.data) > 0 {
+			n, err := w.Write(r.data)
+			total += int64(n)
+			r.data = r.data[n:]
+			if err != nil {
+				return total, err
+			}
+		}
+		if err := r.next(); err != nil {
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+}
+
+// next reads one block. A stream that ends between blocks is io.EOF.
+// When r fails mid-block, as on a read deadline, what was read is kept
+// and the next call carries on from there.
+func (r *Reader) next() error {
+	for r.got < 3 {
+		n, err := r.r.Read(r.hdr[r.got:])
+		r.got += n
+		if err != nil && r.got < 3 {
+			return unexpected(err, r.got)
+		}
+	}
+	n := int(binary.BigEndian.Uint16(r.hdr[1:]))
+	if n > maxBlock {
+		return fmt.Errorf("block too long: %d", n)
+	}
+	in := r.in[:n]
+	for r.got < 3+n {
+		m, err := r.r.Read(in[r.got-3:])
+		r.got += m
+		if err != nil && r.got < 3+n {
+			return unexpected(err, r.got)
+		}
+	}
+	r.got = 0
+	switch r.hdr[0] {
+	case kindRaw:
+		r.data = in
+		return nil
+	case kindPacked:
+	default:
+		return fmt.Errorf("unknown block kind %d", r.hdr[0])
+	}
+	switch r.algo {
+	case "lz4":
+		m, err := lz4.UncompressBlock(in, r.out)
+		if err != nil {
+			return fmt.Errorf("corrupt lz4 block: %v", err)
+		}
+		r.data = r.out[:m]
+	case "snappy":
+		if m, err := snappy.DecodedLen(in); err != nil || m > maxBlock {
+			return fmt.Errorf("corrupt snappy block")
+		}
+		out, err := snappy.Decode(r.out, in)
+		if err != nil {
+			return fmt.Errorf("corrupt snappy block: %v", err)
+		}
+		r.data = out
+	}
+	return nil
+}
+
+// unexpected turns an io.EOF after got bytes of a block into
+// io.ErrUnexpectedEOF.
+func unexpected(err error, got int) error {
+	if err == io.EOF && got > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
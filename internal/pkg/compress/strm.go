@@ -0,0 +1,25 @@
+package compress
+
+import (
+	"io"
+	"paqet/internal/tnet"
+)
+
+// Strm compresses what is relayed on a TCP stream with the algorithm
+// negotiated in the hello. What was written before it wraps the stream,
+// such as the request header, is not.
+type Strm struct {
+	tnet.Strm
+	r *Reader
+	w *Writer
+}
+
+func NewStrm(strm tnet.Strm, algo string) *Strm {
+	return &Strm{Strm: strm, r: NewReader(strm, algo), w: NewWriter(strm, algo)}
+}
+
+func (s *Strm) Read(b []byte) (int, error)  { return s.r.Read(b) }
+func (s *Strm) Write(b []byte) (int, error) { return s.w.Write(b) }
+
+// WriteTo writes each block out of the buffer it was decompressed into.
+func (s *Strm) WriteTo(w io.Writer) (int64, error) { return s.r.WriteTo(w) }
@@ -0,0 +1,157 @@
+// Package debug serves net/http/pprof and JSON snapshots of paqet's own
+// state for profiling a busy process. Like the admin endpoint it has no
+// authentication, so it only listens on a loopback address.
+package debug
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	mu        sync.Mutex
+	snapshots = map[string]func() any{}
+)
+
+func init() {
+	Register("goroutines", func() any { return Goroutines() })
+	Register("runtime", func() any { return runtimeStats() })
+}
+
+// Register adds a snapshot served as JSON on /debug/paqet/name.
+func Register(name string, fn func() any) {
+	mu.Lock()
+	defer mu.Unlock()
+	snapshots[name] = fn
+}
+
+// Serve answers the debug endpoint on addr in the background:
+//
+//	/debug/pprof/         net/http/pprof
+//	/debug/paqet/         names of the snapshots
+//	/debug/paqet/{name}   one snapshot
+func Serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/paqet/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		names := make([]string, 0, len(snapshots))
+		for name := range snapshots {
+			names = append(names, name)
+		}
+		mu.Unlock()
+		sort.Strings(names)
+		reply(w, names)
+	})
+	mux.HandleFunc("GET /debug/paqet/{name}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fn := snapshots[r.PathValue("name")]
+		mu.Unlock()
+		if fn == nil {
+			http.NotFound(w, r)
+			return
+		}
+		reply(w, fn())
+	})
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// Goroutines counts the goroutines by subsystem: the package of the
+// outermost paqet function on their stack, e.g. "internal/server", or
+// for goroutines of a library the package they were started in.
+func Goroutines() map[string]int {
+	var recs []runtime.StackRecord
+	n := runtime.NumGoroutine()
+	for {
+		recs = make([]runtime.StackRecord, n+n/4+16)
+		var ok bool
+		if n, ok = runtime.GoroutineProfile(recs); ok {
+			break
+		}
+	}
+	counts := make(map[string]int)
+	for _, r := range recs[:n] {
+		counts[subsystem(r.Stack())]++
+	}
+	return counts
+}
+
+func subsystem(pcs []uintptr) string {
+	var own, entry string
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		if pkg := funcPackage(f.Function); strings.HasPrefix(pkg, "paqet/") {
+			own = strings.TrimPrefix(pkg, "paqet/")
+		} else if pkg != "" && pkg != "runtime" {
+			entry = pkg
+		}
+		if !more {
+			break
+		}
+	}
+	switch {
+	case own != "":
+		return own
+	case entry != "":
+		return entry
+	}
+	return "runtime"
+}
+
+// funcPackage returns the import path of a function name such as
+// "paqet/internal/socket.(*RecvHandle).Read".
+func funcPackage(fn string) string {
+	slash := strings.LastIndexByte(fn, '/')
+	dot := strings.IndexByte(fn[slash+1:], '.')
+	if dot < 0 {
+		return ""
+	}
+	return fn[:slash+1+dot]
+}
+
+type runtimeSnapshot struct {
+	Goroutines int    `json:"goroutines"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	HeapAlloc  uint64 `json:"heap_alloc_bytes"`
+	HeapInuse  uint64 `json:"heap_inuse_bytes"`
+	Sys        uint64 `json:"sys_bytes"`
+	NumGC      uint32 `json:"num_gc"`
+	PauseTotal uint64 `json:"gc_pause_total_ns"`
+}
+
+func runtimeStats() runtimeSnapshot {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return runtimeSnapshot{
+		Goroutines: runtime.NumGoroutine(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		HeapAlloc:  m.HeapAlloc,
+		HeapInuse:  m.HeapInuse,
+		Sys:        m.Sys,
+		NumGC:      m.NumGC,
+		PauseTotal: m.PauseTotalNs,
+	}
+}
+
+func reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
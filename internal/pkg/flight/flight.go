@@ -0,0 +1,179 @@
+// Package flight keeps a bounded ring of recent packet metadata
+// (time, size, direction and an opaque flow id, never payloads) for
+// reconstructing stalls after the fact. A file-backed ring is a shared
+// memory mapping, so its contents survive a crash of the process.
+package flight
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	In  byte = 'I'
+	Out byte = 'O'
+
+	magic      = "PQFLIGHT"
+	headerSize = 64
+	recordSize = 32
+)
+
+// record is the on-disk layout, in the byte order of the writing host,
+// which the header names at offset 12 ('L' or 'B'). Seq 0 marks an
+// unused slot; a slot is valid once its Seq is written, which happens
+// last.
+type record struct {
+	Nanos int64
+	Flow  uint64
+	Size  uint32
+	Dir   byte
+	_     [3]byte
+	Seq   uint64
+}
+
+type Recorder struct {
+	mem     []byte
+	records []record
+	next    atomic.Uint64
+	unmap   func() error
+}
+
+var def atomic.Pointer[Recorder]
+
+// SetDefault makes r the recorder used by Record.
+func SetDefault(r *Recorder) { def.Store(r) }
+
+// Default returns the recorder set by SetDefault, or nil.
+func Default() *Recorder { return def.Load() }
+
+// Record adds a packet to the default recorder, if any.
+func Record(dir byte, size int, flow uint64) {
+	if r := def.Load(); r != nil {
+		r.Record(dir, size, flow)
+	}
+}
+
+// Open creates a ring of n records, mapped onto path when it is set.
+func Open(path string, n int) (*Recorder, error) {
+	size := headerSize + n*recordSize
+	r := &Recorder{}
+	if path == "" {
+		r.mem = make([]byte, size)
+	} else {
+		mem, unmap, err := mapFile(path, size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to map flight recorder file %s: %v", path, err)
+		}
+		r.mem, r.unmap = mem, unmap
+		clear(r.mem)
+	}
+	copy(r.mem, magic)
+	binary.LittleEndian.PutUint32(r.mem[8:], uint32(n))
+	r.mem[12] = nativeOrder()
+	r.records = unsafe.Slice((*record)(unsafe.Pointer(&r.mem[headerSize])), n)
+	return r, nil
+}
+
+func (r *Recorder) Record(dir byte, size int, flow uint64) {
+	seq := r.next.Add(1)
+	rec := &r.records[(seq-1)%uint64(len(r.records))]
+	atomic.StoreUint64(&rec.Seq, 0)
+	rec.Nanos = time.Now().UnixNano()
+	rec.Flow = flow
+	rec.Size = uint32(size)
+	rec.Dir = dir
+	atomic.StoreUint64(&rec.Seq, seq)
+}
+
+// Dump writes the ring, oldest first, as one line per packet.
+func (r *Recorder) Dump(w io.Writer) error {
+	return dump(w, r.records)
+}
+
+func (r *Recorder) Close() error {
+	def.CompareAndSwap(r, nil)
+	if r.unmap != nil {
+		return r.unmap()
+	}
+	return nil
+}
+
+// DumpFile decodes a ring file written by a (possibly crashed) process.
+func DumpFile(path string, w io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < headerSize || string(data[:8]) != magic {
+		return fmt.Errorf("%s is not a flight recorder file", path)
+	}
+	n := int(binary.LittleEndian.Uint32(data[8:]))
+	if len(data) < headerSize+n*recordSize {
+		return fmt.Errorf("%s is truncated", path)
+	}
+	// Decode field by field, so a file copied from a host of the other
+	// byte order still reads. Files from before the marker are native.
+	var order binary.ByteOrder = binary.NativeEndian
+	switch data[12] {
+	case 'L':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	}
+	records := make([]record, n)
+	for i := range records {
+		b := data[headerSize+i*recordSize:]
+		records[i] = record{
+			Nanos: int64(order.Uint64(b[0:])),
+			Flow:  order.Uint64(b[8:]),
+			Size:  order.Uint32(b[16:]),
+			Dir:   b[20],
+			Seq:   order.Uint64(b[24:]),
+		}
+	}
+	return dump(w, records)
+}
+
+func nativeOrder() byte {
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], 1)
+	if b[0] == 1 {
+		return 'L'
+	}
+	return 'B'
+}
+
+func dump(w io.Writer, records []record) error {
+	var recs []record
+	for i := range records {
+		// Skip slots rewritten while being copied.
+		seq := atomic.LoadUint64(&records[i].Seq)
+		rec := records[i]
+		if seq != 0 && atomic.LoadUint64(&records[i].Seq) == seq {
+			rec.Seq = seq
+			recs = append(recs, rec)
+		}
+	}
+	slices.SortFunc(recs, func(a, b record) int { return cmp.Compare(a.Seq, b.Seq) })
+
+	var prev int64
+	for _, rec := range recs {
+		gap := time.Duration(0)
+		if prev != 0 {
+			gap = time.Duration(rec.Nanos - prev)
+		}
+		prev = rec.Nanos
+		ts := time.Unix(0, rec.Nanos).Format("2006-01-02 15:04:05.000000")
+		if _, err := fmt.Fprintf(w, "%s %c %5d flow=%016x +%v\n", ts, rec.Dir, rec.Size, rec.Flow, gap); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package flight
+
+import "fmt"
+
+func mapFile(path string, size int) ([]byte, func() error, error) {
+	return nil, nil, fmt.Errorf("file-backed recording is not supported on this platform")
+}
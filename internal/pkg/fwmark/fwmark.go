@@ -0,0 +1,61 @@
+// Package fwmark sets the Linux firewall mark on paqet's own sockets, so
+// policy routing can send them out of the physical interface while a
+// VPN or TUN device holds the default route, instead of looping them
+// back into the tunnel they carry.
+package fwmark
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Control returns a net.Dialer Control that marks the socket with mark,
+// or nil for mark 0.
+func Control(mark uint32) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) { err = Set(int(fd), mark) }); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// SetOpened marks the AF_PACKET sockets open now that were not in
+// before, a PacketSockets taken earlier. It marks those of a library
+// such as libpcap that does not hand out its descriptor.
+func SetOpened(before map[int]bool, mark uint32) error {
+	n := 0
+	for fd := range PacketSockets() {
+		if before[fd] {
+			continue
+		}
+		if err := Set(fd, mark); err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("no new AF_PACKET socket to mark")
+	}
+	return nil
+}
+
+// Dialer connects over network, "tcp" or "udp", from bind if set, with
+// sockets marked with mark.
+func Dialer(network string, bind net.IP, mark uint32, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout, Control: Control(mark)}
+	if bind != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: bind}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: bind}
+		}
+	}
+	return d
+}
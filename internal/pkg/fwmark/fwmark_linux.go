@@ -0,0 +1,32 @@
+package fwmark
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set marks socket fd. It needs CAP_NET_ADMIN.
+func Set(fd int, mark uint32) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+}
+
+// PacketSockets returns the AF_PACKET sockets the process has open.
+func PacketSockets() map[int]bool {
+	fds := make(map[int]bool)
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return fds
+	}
+	for _, e := range entries {
+		fd, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if d, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN); err == nil && d == unix.AF_PACKET {
+			fds[fd] = true
+		}
+	}
+	return fds
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package fwmark
+
+import "fmt"
+
+func Set(fd int, mark uint32) error {
+	return fmt.Errorf("fwmark is only supported on linux")
+}
+
+func PacketSockets() map[int]bool { return nil }
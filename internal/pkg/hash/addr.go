@@ -0,0 +1,12 @@
+package hash
+
+import "hash/maphash"
+
+func Addr(addr string) uint64 {
+	h := hasherPool.Get().(*maphash.Hash)
+	defer hasherPool.Put(h)
+
+	h.Reset()
+	h.WriteString(addr)
+	return h.Sum64()
+}
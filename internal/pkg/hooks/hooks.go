@@ -0,0 +1,106 @@
+// Package hooks tells other software about tunnel events, such as a
+// monitoring script or a chat webhook, by running a command and POSTing
+// the event as JSON.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"paqet/internal/flog"
+)
+
+const (
+	TunnelDown     = "tunnel-down"
+	TunnelRestored = "tunnel-restored"
+)
+
+// Event is what a hook is told. The command gets it as its last
+// argument and in PAQET_* environment variables, the webhook as JSON.
+type Event struct {
+	Event   string    `json:"event"`
+	Server  string    `json:"server"`
+	Time    time.Time `json:"time"`
+	DownFor float64   `json:"down_for,omitempty"` // seconds, when restored
+}
+
+// Hooks runs the configured command and webhook for each event. A nil
+// Hooks does nothing.
+type Hooks struct {
+	exec    []string
+	webhook string
+	timeout time.Duration
+}
+
+// New returns the hooks for command, split at spaces, and webhook, or
+// nil when both are empty.
+func New(command, webhook string, timeout time.Duration) *Hooks {
+	if command == "" && webhook == "" {
+		return nil
+	}
+	return &Hooks{exec: strings.Fields(command), webhook: webhook, timeout: timeout}
+}
+
+// Fire reports e in the background; a failing hook is only logged.
+func (h *Hooks) Fire(e Event) {
+	if h == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+		if len(h.exec) > 0 {
+			if err := h.run(ctx, e); err != nil {
+				flog.Warnf("%s hook command failed: %v", e.Event, err)
+			}
+		}
+		if h.webhook != "" {
+			if err := h.post(ctx, e); err != nil {
+				flog.Warnf("%s webhook failed: %v", e.Event, err)
+			}
+		}
+	}()
+}
+
+func (h *Hooks) run(ctx context.Context, e Event) error {
+	cmd := exec.CommandContext(ctx, h.exec[0], append(h.exec[1:], e.Event)...)
+	cmd.Env = append(os.Environ(),
+		"PAQET_EVENT="+e.Event,
+		"PAQET_SERVER="+e.Server,
+		"PAQET_TIME="+e.Time.Format(time.RFC3339),
+		fmt.Sprintf("PAQET_DOWN_FOR=%.0f", e.DownFor),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return err
+}
+
+func (h *Hooks) post(ctx context.Context, e Event) error {
+	body, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", h.webhook, resp.Status)
+	}
+	return nil
+}
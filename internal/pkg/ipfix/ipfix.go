@@ -0,0 +1,287 @@
+// Package ipfix exports relayed flows to an IPFIX collector (RFC 7011)
+// over UDP, so NetFlow tooling can account for paqet traffic. Each flow
+// is reported as two unidirectional records, client to destination and
+// back, with delta counts: once per active timeout while it runs and
+// once when it ends.
+package ipfix
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"paqet/internal/flog"
+)
+
+// templateRefresh is how often the templates are resent; a collector
+// that restarts cannot decode records until it has them again.
+const templateRefresh = time.Minute
+
+// maxMessage keeps a message within one unfragmented UDP datagram.
+const maxMessage = 1400
+
+// Information elements (IANA "IPFIX Information Elements").
+const (
+	ieOctetDeltaCount    = 1
+	iePacketDeltaCount   = 2
+	ieProtocolIdentifier = 4
+	ieSourcePort         = 7
+	ieSourceIPv4         = 8
+	ieDestinationPort    = 11
+	ieDestinationIPv4    = 12
+	ieSourceIPv6         = 27
+	ieDestinationIPv6    = 28
+	ieFlowStartMillis    = 152
+	ieFlowEndMillis      = 153
+	ieUserName           = 371
+	varLen               = 0xffff
+)
+
+const (
+	templateSetID          = 2
+	firstTemplateID uint16 = 256
+)
+
+// Flow is one relayed stream. Its methods accept a nil Flow, which is
+// what Start returns without an exporter.
+type Flow struct {
+	user         string
+	client, dest netip.AddrPort
+	proto        uint8
+	start        time.Time
+
+	up, down, upPkts, downPkts atomic.Uint64
+	// What was reported so far, guarded by Exporter.mu.
+	sentUp, sentDown, sentUpPkts, sentDownPkts uint64
+}
+
+// Writers counts the bytes and writes through up and down. For UDP a
+// write is a datagram; for TCP it is one read from the other side,
+// which stands in for a packet count.
+func (f *Flow) Writers(up, down io.Writer) (io.Writer, io.Writer) {
+	if f == nil {
+		return up, down
+	}
+	return &counter{up, &f.up, &f.upPkts}, &counter{down, &f.down, &f.downPkts}
+}
+
+type counter struct {
+	w     io.Writer
+	n, pk *atomic.Uint64
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(uint64(n))
+	c.pk.Add(1)
+	return n, err
+}
+
+// Exporter sends flow records to one collector.
+type Exporter struct {
+	conn   net.Conn
+	domain uint32
+
+	mu        sync.Mutex
+	seq       uint32
+	templates time.Time // when they were last sent
+	flows     map[*Flow]struct{}
+}
+
+// New dials collector (host:port, UDP) and reports the flows still
+// running every active interval.
+func New(collector string, domain uint32, active time.Duration) (*Exporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exporter{conn: conn, domain: domain, flows: make(map[*Flow]struct{})}
+	go e.run(active)
+	return e, nil
+}
+
+// Start begins a flow from client to dest; proto is 6 for TCP or 17
+// for UDP. The caller must call End when it finishes.
+func (e *Exporter) Start(user string, client, dest net.Addr, proto uint8) *Flow {
+	if e == nil {
+		return nil
+	}
+	f := &Flow{user: user, client: addrPort(client), dest: addrPort(dest), proto: proto, start: time.Now()}
+	e.mu.Lock()
+	e.flows[f] = struct{}{}
+	e.mu.Unlock()
+	return f
+}
+
+// End reports what is left of f.
+func (e *Exporter) End(f *Flow) {
+	if e == nil || f == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.flows, f)
+	e.send([]*Flow{f}, time.Now())
+}
+
+func (e *Exporter) run(active time.Duration) {
+	ticker := time.NewTicker(active)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		e.mu.Lock()
+		flows := make([]*Flow, 0, len(e.flows))
+		for f := range e.flows {
+			flows = append(flows, f)
+		}
+		e.send(flows, now)
+		e.mu.Unlock()
+	}
+}
+
+// send reports the counts of flows since their last report, packing as
+// many records into each message as fit. e.mu must be held.
+func (e *Exporter) send(flows []*Flow, now time.Time) {
+	var sets [][]byte
+	for _, f := range flows {
+		up, down := f.up.Load(), f.down.Load()
+		upPkts, downPkts := f.upPkts.Load(), f.downPkts.Load()
+		if up > f.sentUp || upPkts > f.sentUpPkts {
+			sets = append(sets, record(f.client, f.dest, f.proto, f.user, up-f.sentUp, upPkts-f.sentUpPkts, f.start, now))
+		}
+		if down > f.sentDown || downPkts > f.sentDownPkts {
+			sets = append(sets, record(f.dest, f.client, f.proto, f.user, down-f.sentDown, downPkts-f.sentDownPkts, f.start, now))
+		}
+		f.sentUp, f.sentDown, f.sentUpPkts, f.sentDownPkts = up, down, upPkts, downPkts
+	}
+	if len(sets) == 0 {
+		return
+	}
+
+	var body [][]byte
+	if now.Sub(e.templates) >= templateRefresh {
+		body = append(body, templateSet())
+		e.templates = now
+	}
+	size, records := 0, uint32(0)
+	for _, set := range body {
+		size += len(set)
+	}
+	for _, set := range sets {
+		if size+len(set) > maxMessage-16 && len(body) > 0 {
+			e.write(body, records, now)
+			body, size, records = nil, 0, 0
+		}
+		body = append(body, set)
+		size += len(set)
+		records++
+	}
+	e.write(body, records, now)
+}
+
+// write sends one message of sets, records of which are data records.
+func (e *Exporter) write(sets [][]byte, records uint32, now time.Time) {
+	msg := make([]byte, 16, maxMessage)
+	for _, set := range sets {
+		msg = append(msg, set...)
+	}
+	binary.BigEndian.PutUint16(msg[0:], 10)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(msg[8:], e.seq)
+	binary.BigEndian.PutUint32(msg[12:], e.domain)
+	e.seq += records
+	if _, err := e.conn.Write(msg); err != nil {
+		flog.Debugf("ipfix: failed to export to %s: %v", e.conn.RemoteAddr(), err)
+	}
+}
+
+// templateID numbers the template for the address families of a record:
+// 256 IPv4 to IPv4, 257 IPv4 to IPv6, 258 IPv6 to IPv4, 259 IPv6 to IPv6.
+func templateID(src, dst bool) uint16 {
+	id := firstTemplateID
+	if src {
+		id += 2
+	}
+	if dst {
+		id++
+	}
+	return id
+}
+
+// templateSet describes the four templates. Every template has the same
+// fields; only the address elements differ.
+func templateSet() []byte {
+	set := []byte{0, templateSetID, 0, 0}
+	for _, v6 := range [][2]bool{{false, false}, {false, true}, {true, false}, {true, true}} {
+		srcIE, srcLen, dstIE, dstLen := uint16(ieSourceIPv4), uint16(4), uint16(ieDestinationIPv4), uint16(4)
+		if v6[0] {
+			srcIE, srcLen = ieSourceIPv6, 16
+		}
+		if v6[1] {
+			dstIE, dstLen = ieDestinationIPv6, 16
+		}
+		fields := [][2]uint16{
+			{srcIE, srcLen}, {ieSourcePort, 2},
+			{dstIE, dstLen}, {ieDestinationPort, 2},
+			{ieProtocolIdentifier, 1},
+			{ieOctetDeltaCount, 8}, {iePacketDeltaCount, 8},
+			{ieFlowStartMillis, 8}, {ieFlowEndMillis, 8},
+			{ieUserName, varLen},
+		}
+		set = binary.BigEndian.AppendUint16(set, templateID(v6[0], v6[1]))
+		set = binary.BigEndian.AppendUint16(set, uint16(len(fields)))
+		for _, f := range fields {
+			set = binary.BigEndian.AppendUint16(set, f[0])
+			set = binary.BigEndian.AppendUint16(set, f[1])
+		}
+	}
+	binary.BigEndian.PutUint16(set[2:], uint16(len(set)))
+	return set
+}
+
+// record is a data set holding one record from src to dst.
+func record(src, dst netip.AddrPort, proto uint8, user string, bytes, pkts uint64, start, end time.Time) []byte {
+	if len(user) > 254 {
+		user = user[:254]
+	}
+	set := make([]byte, 4, 64+len(user))
+	binary.BigEndian.PutUint16(set, templateID(!src.Addr().Is4(), !dst.Addr().Is4()))
+	set = append(set, src.Addr().AsSlice()...)
+	set = binary.BigEndian.AppendUint16(set, src.Port())
+	set = append(set, dst.Addr().AsSlice()...)
+	set = binary.BigEndian.AppendUint16(set, dst.Port())
+	set = append(set, proto)
+	set = binary.BigEndian.AppendUint64(set, bytes)
+	set = binary.BigEndian.AppendUint64(set, pkts)
+	set = binary.BigEndian.AppendUint64(set, uint64(start.UnixMilli()))
+	set = binary.BigEndian.AppendUint64(set, uint64(end.UnixMilli()))
+	set = append(set, byte(len(user)))
+	set = append(set, user...)
+	binary.BigEndian.PutUint16(set[2:], uint16(len(set)))
+	return set
+}
+
+// addrPort converts a TCP or UDP address, unmapping IPv4-in-IPv6 so the
+// record uses the IPv4 template. Anything else becomes the zero IPv4
+// address.
+func addrPort(a net.Addr) netip.AddrPort {
+	var ap netip.AddrPort
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	default:
+		if a != nil {
+			ap, _ = netip.ParseAddrPort(a.String())
+		}
+	}
+	if !ap.Addr().IsValid() {
+		return netip.AddrPortFrom(netip.IPv4Unspecified(), ap.Port())
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
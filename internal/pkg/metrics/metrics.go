@@ -0,0 +1,91 @@
+// Package metrics serves gauges and counters in the Prometheus text
+// format. Values are read from the subsystems that already keep them
+// when scraped, so nothing is counted twice.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sample is one value of a metric, with labels such as `direction="in"`.
+type Sample struct {
+	Labels string
+	Value  float64
+}
+
+type family struct {
+	name, help, typ string
+	collect         func() []Sample
+}
+
+var (
+	mu       sync.Mutex
+	families []family
+)
+
+// Gauge registers a metric whose value can go up and down.
+func Gauge(name, help string, fn func() float64) {
+	register(name, help, "gauge", func() []Sample { return []Sample{{Value: fn()}} })
+}
+
+// Counter registers a metric that only grows.
+func Counter(name, help string, fn func() float64) {
+	register(name, help, "counter", func() []Sample { return []Sample{{Value: fn()}} })
+}
+
+// Labeled registers a metric of type typ with one sample per label set.
+func Labeled(name, help, typ string, fn func() []Sample) {
+	register(name, help, typ, fn)
+}
+
+func register(name, help, typ string, fn func() []Sample) {
+	mu.Lock()
+	defer mu.Unlock()
+	families = append(families, family{name: name, help: help, typ: typ, collect: fn})
+}
+
+// Write renders every registered metric.
+func Write(w io.Writer) {
+	mu.Lock()
+	fams := append([]family(nil), families...)
+	mu.Unlock()
+	sort.Slice(fams, func(i, j int) bool { return fams[i].name < fams[j].name })
+
+	for _, f := range fams {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range f.collect() {
+			if s.Labels != "" {
+				fmt.Fprintf(w, "%s{%s} %v\n", f.name, s.Labels, s.Value)
+			} else {
+				fmt.Fprintf(w, "%s %v\n", f.name, s.Value)
+			}
+		}
+	}
+}
+
+// Label formats one label pair, escaping the value.
+func Label(name, value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return name + `="` + r.Replace(value) + `"`
+}
+
+// Serve answers /metrics on addr in the background.
+func Serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+	go http.Serve(ln, mux)
+	return nil
+}
@@ -0,0 +1,133 @@
+// Package proxyproto writes and reads the PROXY protocol header
+// (HAProxy, v1 and v2) that tells a backend the address a relayed
+// connection really came from.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Header returns the v2 header of a TCP connection from src to dst. The
+// source may be a UDP address, such as a client's KCP endpoint.
+// Addresses of other kinds, or of different families, give a LOCAL
+// header, which tells the backend to use the connection's own address.
+func Header(src, dst net.Addr) []byte {
+	b := append([]byte(nil), sigV2...)
+	s, sok := addrPort(src)
+	d, dok := addrPort(dst)
+	if !sok || !dok || s.Addr().Is4() != d.Addr().Is4() {
+		return append(b, 0x20, 0x00, 0, 0)
+	}
+	fam, n := byte(0x11), 12
+	if !s.Addr().Is4() {
+		fam, n = 0x21, 36
+	}
+	b = append(b, 0x21, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(n))
+	b = append(b, s.Addr().AsSlice()...)
+	b = append(b, d.Addr().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, s.Port())
+	return binary.BigEndian.AppendUint16(b, d.Port())
+}
+
+func addrPort(a net.Addr) (netip.AddrPort, bool) {
+	var ap netip.AddrPort
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	default:
+		return ap, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), ap.Addr().IsValid()
+}
+
+// Read consumes a v1 or v2 header from r and returns the source address
+// it names, or nil for a LOCAL or UNKNOWN one.
+func Read(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(sigV2))
+	if err == nil && bytes.Equal(peek, sigV2) {
+		return readV2(r)
+	}
+	if peek, err := r.Peek(6); err == nil && string(peek) == "PROXY " {
+		return readV1(r)
+	}
+	return nil, fmt.Errorf("no PROXY protocol header")
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0x0f == 0 {
+		return nil, nil // LOCAL
+	}
+	switch hdr[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short PROXY protocol v2 IPv4 address")
+		}
+		ip, _ := netip.AddrFromSlice(body[0:4])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:]))), nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short PROXY protocol v2 IPv6 address")
+		}
+		ip, _ := netip.AddrFromSlice(body[0:16])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:]))), nil
+	}
+	return nil, nil
+}
+
+// readV1 parses "PROXY TCP4 src dst sport dport\r\n", at most 107 bytes.
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	f := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(f) < 2 || !strings.HasSuffix(string(line), "\r\n") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header")
+	}
+	if f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header")
+	}
+	ip, err := netip.ParseAddr(f[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 source: %v", err)
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 source port: %v", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
@@ -0,0 +1,77 @@
+// Package ratelimit paces byte streams with token buckets.
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Bucket refills at a sustained rate up to burst bytes. A write larger
+// than the tokens left borrows from the future, and the writer sleeps
+// the debt off, so datagrams never have to be split.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns a bucket for rate bytes per second that starts full.
+func New(rate, burst int) *Bucket {
+	return &Bucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// SetRate retunes the bucket; writers already pacing by it follow.
+func (b *Bucket) SetRate(rate, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate, b.burst = float64(rate), float64(burst)
+	b.tokens = min(b.tokens, b.burst)
+}
+
+// reserve takes n tokens and returns how long to wait before using them.
+func (b *Bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type writer struct {
+	w       io.Writer
+	buckets []*Bucket
+}
+
+// Writer paces writes to w by every non-nil bucket. Without any it
+// returns w itself.
+func Writer(w io.Writer, buckets ...*Bucket) io.Writer {
+	lw := &writer{w: w}
+	for _, b := range buckets {
+		if b != nil {
+			lw.buckets = append(lw.buckets, b)
+		}
+	}
+	if len(lw.buckets) == 0 {
+		return w
+	}
+	return lw
+}
+
+func (lw *writer) Write(p []byte) (int, error) {
+	var wait time.Duration
+	for _, b := range lw.buckets {
+		wait = max(wait, b.reserve(len(p)))
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return lw.w.Write(p)
+}
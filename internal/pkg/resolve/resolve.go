@@ -0,0 +1,212 @@
+// Package resolve looks up hostnames on the client, for forward rules
+// and SOCKS5 listeners with resolve: client. It asks a nameserver
+// directly, so answers come with their TTLs.
+package resolve
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Bounds on how long an answer is kept. Without TTLs (no nameserver to
+// ask directly) the default applies.
+const (
+	MinTTL     = 5 * time.Second
+	MaxTTL     = time.Hour
+	DefaultTTL = time.Minute
+)
+
+// maxEntries bounds the cache of Resolve; a SOCKS5 client may ask for
+// any number of names.
+const maxEntries = 4096
+
+// Resolver looks up names through one nameserver.
+type Resolver struct {
+	server string
+	dialer func(network string) *net.Dialer
+
+	mu    sync.Mutex
+	cache map[string]entry
+}
+
+type entry struct {
+	ip    netip.Addr
+	until time.Time
+}
+
+// New returns a resolver asking server (host:port), or the first
+// nameserver of /etc/resolv.conf if empty. Queries are sent from the
+// dialer's socket, so they can leave from a bind address and carry a
+// fwmark.
+func New(server string, dialer func(network string) *net.Dialer) *Resolver {
+	return &Resolver{server: server, dialer: dialer, cache: make(map[string]entry)}
+}
+
+// Lookup asks for host's addresses, preferring IPv4 which most servers
+// can reach, and returns one with the TTL of its answer.
+func (r *Resolver) Lookup(ctx context.Context, host string) (netip.Addr, time.Duration, error) {
+	server := r.server
+	if server == "" {
+		server = systemNameserver()
+	}
+	if server == "" {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return netip.Addr{}, 0, err
+		}
+		return pickAddr(ips), DefaultTTL, nil
+	}
+
+	var errs []error
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		ips, ttl, err := query(ctx, r.dialer("udp"), server, host, t)
+		if err == nil && len(ips) > 0 {
+			return pickAddr(ips), min(max(ttl, MinTTL), MaxTTL), nil
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return netip.Addr{}, 0, errs[0]
+	}
+	return netip.Addr{}, 0, fmt.Errorf("no addresses for %s", host)
+}
+
+// Resolve is Lookup through a cache that keeps each answer for its TTL.
+func (r *Resolver) Resolve(ctx context.Context, host string) (netip.Addr, error) {
+	now := time.Now()
+	r.mu.Lock()
+	e, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && now.Before(e.until) {
+		return e.ip, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	ip, ttl, err := r.Lookup(ctx, host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= maxEntries {
+		for h, e := range r.cache {
+			if !now.Before(e.until) {
+				delete(r.cache, h)
+			}
+		}
+		// Still full of live answers: drop any, map order is random.
+		for h := range r.cache {
+			if len(r.cache) < maxEntries {
+				break
+			}
+			delete(r.cache, h)
+		}
+	}
+	r.cache[host] = entry{ip: ip, until: now.Add(ttl)}
+	return ip, nil
+}
+
+func pickAddr(ips []netip.Addr) netip.Addr {
+	for _, ip := range ips {
+		if ip.Unmap().Is4() {
+			return ip.Unmap()
+		}
+	}
+	return ips[0]
+}
+
+// query asks server for the records of type t, returning the addresses
+// and the smallest TTL along the answer (CNAMEs included).
+func query(ctx context.Context, d *net.Dialer, server, host string, t dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}
+	req, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(buf[:n]); err != nil || resp.ID != id || !resp.Response {
+			continue
+		}
+		if resp.RCode == dnsmessage.RCodeNameError {
+			return nil, 0, fmt.Errorf("lookup %s: no such host", host)
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess {
+			return nil, 0, fmt.Errorf("lookup %s: %v", host, resp.RCode)
+		}
+		var ips []netip.Addr
+		ttl := MaxTTL
+		for _, a := range resp.Answers {
+			ttl = min(ttl, time.Duration(a.Header.TTL)*time.Second)
+			switch b := a.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, netip.AddrFrom4(b.A))
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, netip.AddrFrom16(b.AAAA))
+			}
+		}
+		return ips, ttl, nil
+	}
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf, or
+// "" where there is none (Windows).
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip, err := netip.ParseAddr(fields[1]); err == nil {
+				return net.JoinHostPort(ip.String(), "53")
+			}
+		}
+	}
+	return ""
+}
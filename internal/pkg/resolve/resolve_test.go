@@ -0,0 +1,95 @@
+package resolve
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// nameserver answers every A query on a local UDP port with 192.0.2.1
+// and ttl, counting the queries.
+func nameserver(t *testing.T, ttl uint32, queries *atomic.Int32) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req dnsmessage.Message
+			if req.Unpack(buf[:n]) != nil || len(req.Questions) != 1 {
+				continue
+			}
+			q := req.Questions[0]
+			resp := dnsmessage.Message{Header: dnsmessage.Header{ID: req.ID, Response: true}, Questions: req.Questions}
+			if q.Type == dnsmessage.TypeA {
+				queries.Add(1)
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: ttl},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+				}}
+			}
+			out, _ := resp.Pack()
+			pc.WriteTo(out, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func dialer(string) *net.Dialer { return &net.Dialer{} }
+
+func TestResolveTTL(t *testing.T) {
+	var queries atomic.Int32
+	r := New(nameserver(t, 1, &queries), dialer)
+	want := netip.MustParseAddr("192.0.2.1")
+	for range 3 {
+		ip, err := r.Resolve(context.Background(), "example.com")
+		if err != nil || ip != want {
+			t.Fatalf("resolved to %v, %v, want %v", ip, err, want)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("%d queries for a cached name, want 1", n)
+	}
+
+	// A TTL under MinTTL is raised to it; once past, the name is asked
+	// again.
+	r.mu.Lock()
+	until := r.cache["example.com"].until
+	r.cache["example.com"] = entry{ip: want, until: time.Now().Add(-time.Second)}
+	r.mu.Unlock()
+	if d := time.Until(until); d < MinTTL-time.Second || d > MinTTL {
+		t.Fatalf("kept for %v, want MinTTL", d)
+	}
+	if _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("%d queries after the answer expired, want 2", n)
+	}
+}
+
+func TestResolveBounded(t *testing.T) {
+	var queries atomic.Int32
+	r := New(nameserver(t, 300, &queries), dialer)
+	for i := range maxEntries + 10 {
+		if _, err := r.Resolve(context.Background(), "host"+strconv.Itoa(i)+".example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(r.cache); n > maxEntries {
+		t.Fatalf("cache holds %d names, want at most %d", n, maxEntries)
+	}
+}
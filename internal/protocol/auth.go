@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"paqet/internal/wire"
+)
+
+// AuthMACSize is the length of the MAC in a PAUTH.
+const AuthMACSize = wire.MACSize
+
+// AuthMAC proves knowledge of a user's key for one KCP session at time t
+// (unix seconds). Binding the conversation id keeps a captured PAUTH
+// from authenticating any other session.
+func AuthMAC(key, user string, conv uint32, t int64) []byte {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write([]byte("paqet-auth\x00"))
+	m.Write([]byte(user))
+	var buf [12]byte
+	binary.BigEndian.PutUint32(buf[:4], conv)
+	binary.BigEndian.PutUint64(buf[4:], uint64(t))
+	m.Write(buf[:])
+	return m.Sum(nil)
+}
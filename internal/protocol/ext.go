@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"fmt"
+	"paqet/internal/tnet"
+	"sync"
+)
+
+// The extension range holds message types that forks and operators
+// define for themselves; stock builds never assign them. Their bodies
+// are opaque and length-prefixed (wire.Ext), so a peer without a
+// handler reads past one and refuses it with a PSTATUS instead of
+// failing the stream.
+const (
+	PExtFirst PType = 0xe0
+	PExtLast  PType = 0xff
+)
+
+// IsExt reports whether t is in the extension range.
+func IsExt(t PType) bool { return t >= PExtFirst && t <= PExtLast }
+
+// ExtHandler answers an extension message p on the stream it arrived
+// on. The stream is closed when it returns.
+type ExtHandler func(strm tnet.Strm, p *Proto) error
+
+var (
+	extMu       sync.RWMutex
+	extHandlers = make(map[PType]ExtHandler)
+)
+
+// RegisterExt installs h for extension type t, typically from an init
+// function. The server calls it for streams that start with t, the
+// client for streams the server opens with t.
+func RegisterExt(t PType, h ExtHandler) error {
+	if !IsExt(t) {
+		return fmt.Errorf("type %#x is outside the extension range %#x-%#x", t, PExtFirst, PExtLast)
+	}
+	extMu.Lock()
+	defer extMu.Unlock()
+	if _, ok := extHandlers[t]; ok {
+		return fmt.Errorf("extension type %#x is already registered", t)
+	}
+	extHandlers[t] = h
+	return nil
+}
+
+// Ext returns the handler registered for t, or nil.
+func Ext(t PType) ExtHandler {
+	extMu.RLock()
+	defer extMu.RUnlock()
+	return extHandlers[t]
+}
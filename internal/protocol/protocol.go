@@ -1,11 +1,12 @@
 package protocol
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
 	"paqet/internal/conf"
 	"paqet/internal/tnet"
+	"paqet/internal/wire"
+	"strings"
 )
 
 type PType = byte
@@ -16,118 +17,265 @@ const (
 	PTCPF PType = 0x03
 	PTCP  PType = 0x04
 	PUDP  PType = 0x05
+	PMTU  PType = 0x06
+
+	PPROBE    PType = 0x07
+	PPROBEACK PType = 0x08
+
+	PHELLO  PType = 0x09
+	PSTATUS PType = 0x0a
+	PAUTH   PType = 0x0b
+	PBENCH  PType = 0x0c
+	PGOAWAY PType = 0x0d
+	PCONE   PType = 0x0e
+	PUDPF   PType = 0x0f
+	POPTS   PType = 0x10
+)
+
+// Status codes of a PSTATUS.
+const (
+	StatusOK     byte = 0
+	StatusDenied byte = 1 // refused by the server's ACL
+	StatusFailed byte = 2 // the server could not reach the destination
+	StatusLimit  byte = 3 // over the server's connection or stream caps
+	StatusAuth   byte = 4 // the session is not authenticated as a user
+	StatusQuota  byte = 5 // the user has used up its daily or monthly quota
+)
+
+// Directions of a PBENCH. For BenchUp the server reads Bytes and then
+// sends a PSTATUS; for BenchDown it sends Bytes; for BenchEcho it
+// echoes what it reads until the stream closes.
+const (
+	BenchUp   byte = 0
+	BenchDown byte = 1
+	BenchEcho byte = 2
+)
+
+// MaxBenchBytes bounds the transfer a PBENCH may ask for.
+const MaxBenchBytes = 1 << 30
+
+// MaxProbeCount bounds the packet train a PPROBE may ask for.
+const MaxProbeCount = 1024
+
+// Feature bits advertised in PHELLO.
+const (
+	FeatPMTU   uint32 = 1 << 0  // answers PMTU padding probes
+	FeatProbe  uint32 = 1 << 1  // answers PPROBE bandwidth trains
+	FeatStatus uint32 = 1 << 2  // reports the outcome of PTCP/PUDP with PSTATUS
+	FeatBench  uint32 = 1 << 3  // answers PBENCH
+	FeatGoAway uint32 = 1 << 4  // accepts a PGOAWAY on a stream the server opens
+	FeatCone   uint32 = 1 << 5  // relays full-cone UDP after a PCONE
+	FeatFramed uint32 = 1 << 6  // relays UDP framed as wire.FrameWriter does after a PUDPF
+	FeatAddrV2 uint32 = 1 << 7  // decodes the compact address layout of package wire
+	FeatLZ4    uint32 = 1 << 8  // compresses TCP streams with LZ4 (package compress)
+	FeatSnappy uint32 = 1 << 9  // compresses TCP streams with Snappy
+	FeatOpts   uint32 = 1 << 10 // takes a POPTS ahead of a PTCP, PUDP, PUDPF or PCONE
 )
 
+// Features is the set this build supports.
+const Features = FeatPMTU | FeatProbe | FeatStatus | FeatBench | FeatGoAway | FeatCone | FeatFramed | FeatAddrV2 | FeatLZ4 | FeatSnappy | FeatOpts
+
+// FeatCompress is every compression bit.
+const FeatCompress = FeatLZ4 | FeatSnappy
+
+// compressions maps the compression bits to their algorithm. A client
+// advertises at most the one it wants; a server advertises all it has.
+var compressions = []struct {
+	bit  uint32
+	algo string
+}{{FeatLZ4, "lz4"}, {FeatSnappy, "snappy"}}
+
+// Compression is the algorithm whose bit is in f, "" for none.
+func Compression(f uint32) string {
+	for _, c := range compressions {
+		if f&c.bit != 0 {
+			return c.algo
+		}
+	}
+	return ""
+}
+
+// CompressionFeature is the bit of algo, 0 for "off" or an unknown one.
+func CompressionFeature(algo string) uint32 {
+	for _, c := range compressions {
+		if c.algo == algo {
+			return c.bit
+		}
+	}
+	return 0
+}
+
+// Software is the version a PHELLO advertises; cmd/run sets it.
+var Software = "unknown"
+
+// FeatureNames lists the known bits of f, and any unknown ones in hex.
+func FeatureNames(f uint32) string {
+	var names []string
+	for _, n := range []struct {
+		bit  uint32
+		name string
+	}{{FeatPMTU, "pmtu"}, {FeatProbe, "probe"}, {FeatStatus, "status"}, {FeatBench, "bench"}, {FeatGoAway, "goaway"}, {FeatCone, "cone"}, {FeatFramed, "framed"}, {FeatAddrV2, "addrv2"}, {FeatLZ4, "lz4"}, {FeatSnappy, "snappy"}, {FeatOpts, "opts"}} {
+		if f&n.bit != 0 {
+			names = append(names, n.name)
+			f &^= n.bit
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("%#x", f))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
 type Proto struct {
 	Type PType
 	Addr *tnet.Addr
 	TCPF []conf.TCPF
+	Pad  int
+	// Count is the number of PPROBEACK messages requested by a PPROBE.
+	Count int
+	// Version and Features describe the sender of a PHELLO. Features of
+	// a POPTS, and of the request it precedes once the server has read
+	// both, are what that stream uses: compression by FeatLZ4 or
+	// FeatSnappy, and a PSTATUS ahead of the relayed data by FeatStatus.
+	Version  string
+	Features uint32
+	// Source is the "ip:port" a POPTS names as the real client of the
+	// stream, when it reached the client through a PROXY protocol hop.
+	Source string
+	// Status and Reason are the outcome of a PTCP/PUDP request.
+	Status byte
+	Reason string
+	// User, Time and MAC authenticate a session in a PAUTH.
+	User string
+	Time int64
+	MAC  []byte
+	// Mode and Bytes describe the transfer a PBENCH asks for.
+	Mode  byte
+	Bytes int64
+	// Ext is the opaque body of a type in the extension range.
+	Ext []byte
+	// Compact encodes Addr in the compact layout, for peers with
+	// FeatAddrV2; Read sets it when the peer used it.
+	Compact bool
 }
 
-// Read performs efficient binary decoding instead of gob.
-// Wire format:
-//
-//	[1 byte: Type]
-//	[2 bytes: addr len (big-endian), N bytes: addr string]  (if Type == PTCP or PUDP)
-//	[1 byte: TCPF count, N bytes: TCPF flags]                (if Type == PTCPF)
+// body is the wire layout of the message after its type byte, nil for
+// types without one.
+func (p *Proto) body() (wire.Message, error) {
+	switch p.Type {
+	case PTCP, PUDP, PUDPF:
+		m := &wire.Addr{Compact: p.Compact}
+		if p.Addr != nil {
+			m.Addr = p.Addr.String()
+		}
+		return m, nil
+	case PTCPF:
+		m := &wire.Flags{Flags: make([]uint16, len(p.TCPF))}
+		for i, f := range p.TCPF {
+			m.Flags[i] = encodeTCPF(f)
+		}
+		return m, nil
+	case PMTU, PPROBEACK:
+		return &wire.Pad{Len: p.Pad}, nil
+	case PPROBE:
+		return &wire.Probe{Count: p.Count, Pad: p.Pad}, nil
+	case PHELLO:
+		return &wire.Hello{Version: p.Version, Features: p.Features}, nil
+	case POPTS:
+		return &wire.Opts{Features: p.Features, Source: p.Source}, nil
+	case PSTATUS:
+		return &wire.Status{Code: p.Status, Reason: p.Reason}, nil
+	case PAUTH:
+		return &wire.Auth{User: p.User, Time: p.Time, MAC: p.MAC}, nil
+	case PBENCH:
+		return &wire.Bench{Mode: p.Mode, Bytes: uint64(p.Bytes)}, nil
+	case PPING, PPONG, PGOAWAY, PCONE:
+		return nil, nil
+	}
+	if IsExt(p.Type) {
+		return &wire.Ext{Data: p.Ext}, nil
+	}
+	if p.Type == 0x2f {
+		return nil, fmt.Errorf("legacy gob protocol detected (type 47): upgrade client/server to same version")
+	}
+	return nil, fmt.Errorf("unknown protocol type: %d", p.Type)
+}
+
+// Read decodes one message: a type byte followed by the body laid out
+// in package wire.
 func (p *Proto) Read(r io.Reader) error {
 	var typeBuf [1]byte
 	if _, err := io.ReadFull(r, typeBuf[:]); err != nil {
 		return err
 	}
 	p.Type = typeBuf[0]
+	m, err := p.body()
+	if err != nil || m == nil {
+		return err
+	}
+	if err := m.Decode(r); err != nil {
+		return err
+	}
 
-	switch p.Type {
-	case PTCP, PUDP:
-		// Read addr length (2 bytes) + addr string
-		var lenBuf [2]byte
-		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
-			return err
-		}
-		addrLen := binary.BigEndian.Uint16(lenBuf[:])
-		if addrLen > 512 {
-			return fmt.Errorf("address too long: %d", addrLen)
-		}
-		addrBuf := make([]byte, addrLen)
-		if _, err := io.ReadFull(r, addrBuf); err != nil {
-			return err
-		}
-		addr, err := tnet.NewAddr(string(addrBuf))
+	switch m := m.(type) {
+	case *wire.Addr:
+		addr, err := tnet.NewAddr(m.Addr)
 		if err != nil {
 			return err
 		}
-		p.Addr = addr
-
-	case PTCPF:
-		// Read TCPF count (1 byte) + flags
-		var countBuf [1]byte
-		if _, err := io.ReadFull(r, countBuf[:]); err != nil {
-			return err
-		}
-		count := int(countBuf[0])
-		if count > 64 {
-			return fmt.Errorf("too many TCPF entries: %d", count)
+		p.Addr, p.Compact = addr, m.Compact
+	case *wire.Flags:
+		p.TCPF = make([]conf.TCPF, len(m.Flags))
+		for i, f := range m.Flags {
+			p.TCPF[i] = decodeTCPF(f)
 		}
-		p.TCPF = make([]conf.TCPF, count)
-		for i := 0; i < count; i++ {
-			var flagBuf [2]byte
-			if _, err := io.ReadFull(r, flagBuf[:]); err != nil {
-				return err
-			}
-			flags := binary.BigEndian.Uint16(flagBuf[:])
-			p.TCPF[i] = decodeTCPF(flags)
+	case *wire.Pad:
+		p.Pad = m.Len
+	case *wire.Probe:
+		p.Count, p.Pad = m.Count, m.Pad
+		if p.Count > MaxProbeCount {
+			return fmt.Errorf("probe train too long: %d", p.Count)
 		}
-
-	case PPING, PPONG:
-		// No additional data
-	default:
-		if p.Type == 0x2f {
-			return fmt.Errorf("legacy gob protocol detected (type 47): upgrade client/server to same version")
+	case *wire.Hello:
+		p.Version, p.Features = m.Version, m.Features
+	case *wire.Opts:
+		p.Features, p.Source = m.Features, m.Source
+	case *wire.Status:
+		p.Status, p.Reason = m.Code, m.Reason
+	case *wire.Auth:
+		p.User, p.Time, p.MAC = m.User, m.Time, m.MAC
+	case *wire.Bench:
+		if m.Bytes > MaxBenchBytes {
+			return fmt.Errorf("bench transfer too large: %d", m.Bytes)
 		}
-		return fmt.Errorf("unknown protocol type: %d", p.Type)
+		p.Mode, p.Bytes = m.Mode, int64(m.Bytes)
+	case *wire.Ext:
+		p.Ext = m.Data
 	}
 	return nil
 }
 
-// Write performs efficient binary encoding instead of gob.
+// Write encodes the message in one write, so it is never split across
+// stream frames.
 func (p *Proto) Write(w io.Writer) error {
-	if _, err := w.Write([]byte{p.Type}); err != nil {
+	if (p.Type == PTCP || p.Type == PUDP || p.Type == PUDPF) && p.Addr == nil {
+		return fmt.Errorf("address is required for TCP/UDP")
+	}
+	m, err := p.body()
+	if err != nil {
 		return err
 	}
-
-	switch p.Type {
-	case PTCP, PUDP:
-		if p.Addr == nil {
-			return fmt.Errorf("address is required for TCP/UDP")
-		}
-		addrStr := p.Addr.String()
-		var lenBuf [2]byte
-		binary.BigEndian.PutUint16(lenBuf[:], uint16(len(addrStr)))
-		if _, err := w.Write(lenBuf[:]); err != nil {
-			return err
-		}
-		if _, err := w.Write([]byte(addrStr)); err != nil {
+	buf := []byte{p.Type}
+	if m != nil {
+		if buf, err = m.Append(buf); err != nil {
 			return err
 		}
-
-	case PTCPF:
-		count := len(p.TCPF)
-		if _, err := w.Write([]byte{byte(count)}); err != nil {
-			return err
-		}
-		for _, f := range p.TCPF {
-			var flagBuf [2]byte
-			binary.BigEndian.PutUint16(flagBuf[:], encodeTCPF(f))
-			if _, err := w.Write(flagBuf[:]); err != nil {
-				return err
-			}
-		}
-
-	case PPING, PPONG:
-		// No additional data
 	}
-
-	return nil
+	_, err = w.Write(buf)
+	return err
 }
 
 func encodeTCPF(f conf.TCPF) uint16 {
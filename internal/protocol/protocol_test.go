@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTruncated checks that every vector cut short fails rather than
+// decodes.
+func TestTruncated(t *testing.T) {
+	for _, v := range Vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			want, err := hex.DecodeString(strings.ReplaceAll(v.Wire, " ", ""))
+			if err != nil {
+				t.Fatalf("bad hex: %v", err)
+			}
+			for i := 0; i < len(want); i++ {
+				var p Proto
+				if err := p.Read(bytes.NewReader(want[:i])); err == nil {
+					t.Errorf("decoding %d of %d bytes succeeded", i, len(want))
+				}
+			}
+		})
+	}
+}
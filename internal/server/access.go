@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"paqet/internal/pkg/accesslog"
+	"paqet/internal/pkg/admin"
+)
+
+// track lists a stream with the admin endpoint and, with the access log
+// on, makes rec take its byte counts from it.
+func (s *Server) track(rec *accesslog.Record, proto, peer, dest string, c io.Closer) *admin.Stream {
+	if s.access == nil {
+		return admin.Track(proto, peer, dest, c)
+	}
+	st := admin.Counted(proto, peer, dest, c)
+	rec.Count(st)
+	return st
+}
+
+// dialReason is the access log reason of a stream whose destination
+// could not be dialed.
+func dialReason(err error) string {
+	var denied *aclError
+	if errors.As(err, &denied) {
+		return "denied"
+	}
+	return "dial failed: " + err.Error()
+}
+
+// closeReason is the access log reason of a relay whose side stopped
+// with err.
+func closeReason(side string, err error) string {
+	if err == nil || errors.Is(err, io.EOF) {
+		return side + " closed"
+	}
+	return side + " error: " + err.Error()
+}
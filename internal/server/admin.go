@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"paqet/internal/pkg/admin"
+	"paqet/internal/tnet/kcp"
+	"sort"
+	"time"
+)
+
+// Conns lists the client sessions, identified by remote address.
+func (s *Server) Conns() []admin.Conn {
+	var list []admin.Conn
+	s.sessions.Range(func(k, v any) bool {
+		addr, sess := k.(string), v.(*session)
+		ac := admin.Conn{ID: addr, Remote: addr, Version: s.peers.info(addr).Version}
+		if st := s.users.get(addr); st != nil {
+			ac.User = st.cfg.ID
+		}
+		if k, ok := sess.conn.(*kcp.Conn); ok {
+			ac.Streams = k.Session.NumStreams()
+			ac.RTT = (time.Duration(k.UDPSession.GetSRTT()) * time.Millisecond).String()
+		}
+		list = append(list, ac)
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CloseConn drops the session from the remote address id.
+func (s *Server) CloseConn(id string) error {
+	v, ok := s.sessions.Load(id)
+	if !ok {
+		return fmt.Errorf("no session from %s", id)
+	}
+	return v.(*session).conn.Close()
+}
+
+// Users lists the configured users with their byte counts and quotas.
+func (s *Server) Users() []admin.User {
+	var list []admin.User
+	for id, st := range s.UserStats() {
+		cfg := s.users.byID[id].cfg
+		list = append(list, admin.User{
+			ID: id, Conns: st.Conns, Up: st.BytesUp, Down: st.BytesDown, Today: st.Today, Month: st.Month,
+			DailyQuota: uint64(cfg.DailyQuota) * mib, MonthlyQuota: uint64(cfg.MonthlyQuota) * mib, Revoked: st.Revoked,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/socket"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// banStrikes is how many sessions in a row a client may have turned
+	// away before it is banned.
+	banStrikes = 10
+	// Sources unseen for admitIdle are forgotten, unless banned; past
+	// maxAdmit tracked sources the idle ones are swept at once.
+	admitIdle = time.Minute
+	maxAdmit  = 65536
+)
+
+type source struct {
+	tokens  float64
+	last    time.Time
+	strikes int
+	banned  time.Time // until
+}
+
+// admission throttles new sessions per client IP and overall, and bans
+// clients that keep coming back over their rate.
+type admission struct {
+	mu      sync.Mutex
+	cfg     conf.Server
+	global  float64 // tokens
+	last    time.Time
+	sources map[netip.Addr]*source
+	swept   time.Time
+
+	bans     atomic.Int64 // sources banned now
+	rejected atomic.Int64
+	banned   atomic.Int64 // bans so far
+}
+
+func newAdmission(cfg *conf.Server) *admission {
+	a := &admission{cfg: *cfg, last: time.Now(), sources: make(map[netip.Addr]*source)}
+	a.global = float64(burst(cfg.AcceptGlobal))
+	return a
+}
+
+// burst lets a client open its connections at once, and reconnect
+// them all after a network change.
+func burst(rate int) int {
+	return max(2*rate, 4)
+}
+
+// update applies new rates to sessions accepted afterwards.
+func (a *admission) update(cfg *conf.Server) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cfg = *cfg
+}
+
+func addrKey(addr net.Addr) netip.Addr {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		ip, _ := netip.AddrFromSlice(u.IP)
+		return ip.Unmap()
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap.Addr().Unmap()
+}
+
+// admit reports whether a new session from addr may go ahead.
+func (a *admission) admit(addr net.Addr) bool {
+	ip := addrKey(addr)
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cfg := &a.cfg
+	if cfg.AcceptRate == 0 && cfg.AcceptGlobal == 0 {
+		return true
+	}
+	a.sweep(now)
+	src := a.sources[ip]
+	if src == nil {
+		src = &source{tokens: float64(burst(cfg.AcceptRate)), last: now}
+		a.sources[ip] = src
+	}
+	if now.Before(src.banned) {
+		a.rejected.Add(1)
+		return false
+	}
+	ok := true
+	if cfg.AcceptRate > 0 {
+		src.tokens = min(float64(burst(cfg.AcceptRate)), src.tokens+now.Sub(src.last).Seconds()*float64(cfg.AcceptRate))
+		ok = src.tokens >= 1
+	}
+	src.last = now
+	if ok && cfg.AcceptGlobal > 0 {
+		a.global = min(float64(burst(cfg.AcceptGlobal)), a.global+now.Sub(a.last).Seconds()*float64(cfg.AcceptGlobal))
+		a.last = now
+		if a.global < 1 {
+			// Over the global budget is nobody's fault in particular;
+			// it counts no strike.
+			a.rejected.Add(1)
+			return false
+		}
+		a.global--
+	}
+	if ok {
+		if cfg.AcceptRate > 0 {
+			src.tokens--
+		}
+		src.strikes = 0
+		return true
+	}
+	a.rejected.Add(1)
+	if src.strikes++; cfg.Ban > 0 && src.strikes >= banStrikes {
+		src.strikes = 0
+		if src.banned.IsZero() {
+			a.bans.Add(1)
+		}
+		src.banned = now.Add(time.Duration(cfg.Ban) * time.Second)
+		a.banned.Add(1)
+		flog.Warnf("banned %s for %ds after %d sessions over accept_rate in a row", ip, cfg.Ban, banStrikes)
+	}
+	return false
+}
+
+// sweep forgets idle sources, at most every admitIdle unless there are
+// too many. Called with mu held.
+func (a *admission) sweep(now time.Time) {
+	if now.Sub(a.swept) < admitIdle && len(a.sources) < maxAdmit {
+		return
+	}
+	a.swept = now
+	for ip, src := range a.sources {
+		if now.Sub(src.last) < admitIdle {
+			continue
+		}
+		if !src.banned.IsZero() {
+			if now.Before(src.banned) {
+				continue
+			}
+			a.bans.Add(-1)
+		}
+		delete(a.sources, ip)
+	}
+}
+
+// isBanned reports whether packets from addr are to be dropped.
+func (a *admission) isBanned(addr net.Addr) bool {
+	if a.bans.Load() == 0 {
+		return false
+	}
+	ip := addrKey(addr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	src := a.sources[ip]
+	return src != nil && time.Now().Before(src.banned)
+}
+
+// guard drops the packets of banned clients before KCP sees them, so
+// they cannot start sessions.
+type guard struct {
+	socket.Conn
+	a *admission
+}
+
+func (g *guard) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := g.Conn.ReadFrom(p)
+		if err != nil || !g.a.isBanned(addr) {
+			return n, addr, err
+		}
+	}
+}
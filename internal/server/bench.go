@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/admin"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// handleBench serves `paqet bench`: it sinks, sends or echoes test data
+// on strm. The transfer is paced and counted like a relay of the client.
+func (s *Server) handleBench(strm tnet.Strm, p *protocol.Proto) error {
+	peer := strm.RemoteAddr().String()
+	if p.Mode > protocol.BenchEcho {
+		s.reportStatus(strm, p, fmt.Errorf("unknown bench mode %d", p.Mode))
+		return nil
+	}
+	flog.Debugf("accepted bench stream %d from %s (mode %d, %d bytes)", strm.SID(), peer, p.Mode, p.Bytes)
+	s.reportStatus(strm, p, nil)
+
+	up, down := s.limits.wrap(peer, io.Discard, strm)
+	up, down = s.users.wrap(peer, up, down)
+	st := admin.Track("bench", peer, "-", strm)
+	defer st.Untrack()
+	st.SetUser(s.users.name(peer))
+	up, down = st.Writers(up, down)
+
+	var err error
+	switch p.Mode {
+	case protocol.BenchUp:
+		if _, err = io.CopyN(up, strm, p.Bytes); err == nil {
+			done := protocol.Proto{Type: protocol.PSTATUS, Status: protocol.StatusOK}
+			err = done.Write(strm)
+		}
+	case protocol.BenchDown:
+		_, err = io.CopyN(down, zeros{}, p.Bytes)
+	case protocol.BenchEcho:
+		err = buffer.CopyT(down, strm)
+	}
+	if err != nil {
+		flog.Debugf("bench stream %d from %s ended: %v", strm.SID(), peer, err)
+	}
+	return nil
+}
+
+// zeros is an endless reader of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/class"
+	"paqet/internal/tnet"
+	"sync"
+)
+
+// limitError rejects a stream over one of the server's caps.
+type limitError struct{ reason string }
+
+func (e *limitError) Error() string { return e.reason }
+
+// session is the per-connection state streams are handled with.
+type session struct {
+	conn    tnet.Conn
+	tracker *class.Tracker
+	client  string // remote IP the caps are counted against
+	streams int    // guarded by caps.mu
+	over    error  // set when the connection itself is over max_conns
+}
+
+type clientUse struct {
+	conns, streams int
+}
+
+// caps counts the connections and streams each client IP holds, so one
+// client cannot open thousands of smux streams.
+type caps struct {
+	mu      sync.Mutex
+	cfg     conf.Server
+	clients map[string]*clientUse
+}
+
+func newCaps(cfg *conf.Server) *caps {
+	return &caps{cfg: *cfg, clients: make(map[string]*clientUse)}
+}
+
+// update applies new caps to connections and streams opened afterwards.
+func (c *caps) update(cfg *conf.Server) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = *cfg
+}
+
+func clientIP(addr net.Addr) string {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return u.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// openConn registers a connection from addr. Past max_conns the session
+// is still returned, with over set, so its streams can be told why.
+func (c *caps) openConn(addr net.Addr) *session {
+	sess := &session{client: clientIP(addr)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u := c.clients[sess.client]
+	if u == nil {
+		u = &clientUse{}
+		c.clients[sess.client] = u
+	}
+	if c.cfg.MaxConns > 0 && u.conns >= c.cfg.MaxConns {
+		sess.over = &limitError{fmt.Sprintf("too many connections from %s (max_conns %d)", sess.client, c.cfg.MaxConns)}
+		return sess
+	}
+	u.conns++
+	return sess
+}
+
+func (c *caps) closeConn(sess *session) {
+	if sess.over != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if u := c.clients[sess.client]; u != nil {
+		u.conns--
+		if u.conns == 0 && u.streams == 0 {
+			delete(c.clients, sess.client)
+		}
+	}
+}
+
+// openStream admits a relayed stream on sess, or says which cap it hit.
+func (c *caps) openStream(sess *session) error {
+	if sess.over != nil {
+		return sess.over
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u := c.clients[sess.client]
+	if max := c.cfg.MaxStreamsPerConn; max > 0 && sess.streams >= max {
+		return &limitError{fmt.Sprintf("too many streams on this connection (max_streams_per_conn %d)", max)}
+	}
+	if max := c.cfg.MaxStreamsPerClient; max > 0 && u.streams >= max {
+		return &limitError{fmt.Sprintf("too many streams from %s (max_streams_per_client %d)", sess.client, max)}
+	}
+	sess.streams++
+	u.streams++
+	return nil
+}
+
+func (c *caps) closeStream(sess *session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sess.streams--
+	if u := c.clients[sess.client]; u != nil {
+		u.streams--
+		if u.conns == 0 && u.streams == 0 {
+			delete(c.clients, sess.client)
+		}
+	}
+}
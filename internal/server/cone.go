@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"paqet/internal/flog"
+	"paqet/internal/pkg/fwmark"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"paqet/internal/wire"
+)
+
+// maxConeTargets bounds the destinations a full-cone flow keeps
+// resolved; past it the cache starts over.
+const maxConeTargets = 256
+
+// handleCone relays full-cone UDP for one client flow. Unlike PUDP the
+// socket is not connected: datagrams from the stream go to whatever
+// destination each one names, and a datagram from any peer comes back
+// with its source, so STUN and peer-to-peer protocols see one mapping
+// for every peer. The flow ends after listen.cone_idle without traffic
+// either way.
+func (s *Server) handleCone(ctx context.Context, strm tnet.Strm, p *protocol.Proto) error {
+	client := strm.RemoteAddr().String()
+	rec := s.access.Start(client, s.users.name(client), strm.SID(), "udp", "*")
+	defer s.access.End(rec)
+	lc := net.ListenConfig{Control: fwmark.Control(s.egress.Load().Fwmark)}
+	l, err := lc.ListenPacket(ctx, "udp", ":0")
+	s.reportStatus(strm, p, err)
+	if err != nil {
+		rec.Closed(closeReason("server", err))
+		flog.Errorf("failed to bind full-cone UDP socket for stream %d: %v", strm.SID(), err)
+		return err
+	}
+	pc := l.(*net.UDPConn)
+	flog.Infof("accepted full-cone UDP stream %d: %s via %s", strm.SID(), strm.RemoteAddr(), pc.LocalAddr())
+	defer func() {
+		pc.Close()
+		flog.Debugf("closed full-cone UDP socket %s for stream %d", pc.LocalAddr(), strm.SID())
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	idle := time.Duration(s.cfg.Listen.ConeIdle) * time.Second
+	go func() {
+		ticker := time.NewTicker(idle / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+			case now := <-ticker.C:
+				if now.Sub(time.Unix(0, last.Load())) < idle {
+					continue
+				}
+				rec.Closed("idle")
+				flog.Debugf("full-cone UDP stream %d idle for %v", strm.SID(), idle)
+			}
+			pc.Close()
+			strm.Close()
+			return
+		}
+	}()
+
+	send := &coneSend{pc: pc}
+	up, down := s.limits.wrap(client, send, strm)
+	up, down = s.users.wrap(client, up, down)
+	st := s.track(rec, "udp", client, "*", strm)
+	defer st.Untrack()
+	st.SetUser(s.users.name(client))
+	up, down = st.Writers(up, down)
+	fl := s.flows.Start(s.users.name(client), strm.RemoteAddr(), nil, 17)
+	defer s.flows.End(fl)
+	up, down = fl.Writers(up, down)
+
+	go func() {
+		defer cancel()
+		s.coneDown(pc, down, &last)
+	}()
+	s.coneUp(ctx, strm, send, up, &last)
+	rec.Closed("client closed")
+	return nil
+}
+
+// coneUp sends the datagrams read from strm to their destinations. A
+// destination that does not resolve or that the ACL refuses is dropped
+// on its own; the flow goes on.
+func (s *Server) coneUp(ctx context.Context, strm tnet.Strm, send *coneSend, up io.Writer, last *atomic.Int64) {
+	targets := make(map[string]netip.AddrPort)
+	var d wire.Datagram
+	for {
+		if err := d.Decode(strm); err != nil {
+			return
+		}
+		last.Store(time.Now().UnixNano())
+		to, ok := targets[d.Addr]
+		if !ok {
+			var err error
+			if to, err = s.coneTarget(ctx, d.Addr); err != nil {
+				flog.Debugf("full-cone UDP stream %d: dropping datagram to %s: %v", strm.SID(), d.Addr, err)
+				continue
+			}
+			if len(targets) >= maxConeTargets {
+				clear(targets)
+			}
+			targets[d.Addr] = to
+		}
+		send.to = to
+		if _, err := up.Write(d.Data); err != nil {
+			flog.Debugf("full-cone UDP stream %d: failed to send to %s: %v", strm.SID(), to, err)
+		}
+	}
+}
+
+// coneDown frames every datagram the socket receives, from any peer,
+// back onto the stream.
+func (s *Server) coneDown(pc *net.UDPConn, down io.Writer, last *atomic.Int64) {
+	buf := make([]byte, 65535)
+	var frame []byte
+	for {
+		n, from, err := pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		last.Store(time.Now().UnixNano())
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		frame, _ = (&wire.Datagram{Addr: from.String(), Data: buf[:n]}).Append(frame[:0])
+		if _, err := down.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// coneTarget resolves addr under the ACL and egress family, as dial
+// does for a connected stream.
+func (s *Server) coneTarget(ctx context.Context, addr string) (netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	acl := s.acl.Load()
+	if acl.Enabled() {
+		if denied, rule := acl.Refuses("udp", host, int(port)); denied {
+			return netip.AddrPort{}, &aclError{addr: addr, rule: rule}
+		}
+	}
+	ips, err := s.resolver.lookup(ctx, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	fam := s.egress.Load().FamilyFor(host)
+	ip := ips[0]
+	switch fam {
+	case "v4-only", "prefer-v4":
+		ip = pick(ips, true, ip)
+	case "v6-only", "prefer-v6", "happy-eyeballs":
+		ip = pick(ips, false, ip)
+	}
+	if fam == "v4-only" && !ip.Is4() || fam == "v6-only" && ip.Is4() {
+		return netip.AddrPort{}, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	if acl.Enabled() {
+		if ok, rule := acl.Allow("udp", host, ip.AsSlice(), int(port)); !ok {
+			return netip.AddrPort{}, &aclError{addr: addr, rule: rule}
+		}
+	}
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
+
+// pick returns the first of ips in the family asked for, or def.
+func pick(ips []netip.Addr, v4 bool, def netip.Addr) netip.Addr {
+	for _, ip := range ips {
+		if ip.Is4() == v4 {
+			return ip
+		}
+	}
+	return def
+}
+
+// coneSend writes each datagram to the destination of the one last
+// read, so the relay's writers can wrap it like a connected socket.
+type coneSend struct {
+	pc *net.UDPConn
+	to netip.AddrPort
+}
+
+func (c *coneSend) Write(b []byte) (int, error) {
+	return c.pc.WriteToUDPAddrPort(b, c.to)
+}
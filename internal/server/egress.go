@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"paqet/internal/pkg/fwmark"
+	"paqet/internal/tnet"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// dial connects to addr over the address family the egress policy picks
+// for its host. Exits with broken IPv6 would otherwise stall each dial
+// until the OS gives up on v6.
+func (s *Server) dial(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	if path, ok := strings.CutPrefix(addr, tnet.UnixPrefix); ok {
+		return s.dialUnix(ctx, network, addr, path, timeout)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	eg := s.egress.Load()
+	mark := fwmark.Control(eg.Fwmark)
+	dialer := &net.Dialer{Timeout: timeout, Control: mark}
+	if acl := s.acl.Load(); acl.Enabled() {
+		p, _ := strconv.Atoi(port)
+		if denied, rule := acl.Refuses(network, host, p); denied {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: &aclError{addr: addr, rule: rule}}
+		}
+		// Checked again on the address actually dialed, so a name that
+		// resolves into a denied range is caught too.
+		dialer.Control = func(nw, address string, c syscall.RawConn) error {
+			ipStr, portStr, _ := net.SplitHostPort(address)
+			port, _ := strconv.Atoi(portStr)
+			if ok, rule := acl.Allow(network, host, net.ParseIP(ipStr), port); !ok {
+				return &aclError{addr: address, rule: rule}
+			}
+			if mark != nil {
+				return mark(nw, address, c)
+			}
+			return nil
+		}
+	}
+
+	// The lookup has its own timeout and retries; timeout covers the
+	// connect alone.
+	ips, err := s.resolver.lookup(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	var v4, v6 []netip.Addr
+	for _, ip := range ips {
+		if ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	pn, _ := strconv.ParseUint(port, 10, 16)
+	t := target{network: network, host: host, port: uint16(pn)}
+	delay := time.Duration(eg.Fallback) * time.Millisecond
+
+	family := eg.FamilyFor(host)
+	first, second := v4, v6
+	switch family {
+	case "v4-only":
+		return t.dialSerial(ctx, dialer, v4)
+	case "v6-only":
+		return t.dialSerial(ctx, dialer, v6)
+	case "prefer-v6", "happy-eyeballs":
+		first, second = v6, v4
+	case "auto":
+		// As the standard dialer does: the family of the first answer
+		// leads and the other joins after 300ms.
+		delay = 300 * time.Millisecond
+		if ips[0].Is6() {
+			first, second = v6, v4
+		}
+	}
+	if len(v4) == 0 || len(v6) == 0 {
+		return t.race(ctx, dialer, first, second, delay)
+	}
+	// The family that won last time for this host leads, so a broken
+	// one costs the fallback delay once per familyTTL, not every dial.
+	if v6Won, ok := s.families.get(host); ok && v6Won != first[0].Is6() {
+		first, second = second, first
+	}
+	conn, err := t.race(ctx, dialer, first, second, delay)
+	if err == nil && network == "tcp" {
+		s.families.put(host, conn.RemoteAddr().(*net.TCPAddr).IP.To4() == nil)
+	}
+	return conn, err
+}
+
+// familyTTL is how long the family that won a race for a host is kept.
+const familyTTL = 10 * time.Minute
+
+// maxFamilies bounds the hosts families remembers.
+const maxFamilies = 4096
+
+// families remembers which address family connected first per dual-stack
+// host.
+type families struct {
+	mu    sync.Mutex
+	hosts map[string]familyEntry
+}
+
+type familyEntry struct {
+	v6    bool
+	until time.Time
+}
+
+func newFamilies() *families {
+	return &families{hosts: make(map[string]familyEntry)}
+}
+
+func (f *families) get(host string) (v6 bool, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.hosts[host]
+	if !ok || time.Now().After(e.until) {
+		return false, false
+	}
+	return e.v6, true
+}
+
+func (f *families) put(host string, v6 bool) {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.hosts[host]; !ok && len(f.hosts) >= maxFamilies {
+		for k, e := range f.hosts {
+			if now.After(e.until) || len(f.hosts) >= maxFamilies {
+				delete(f.hosts, k)
+			}
+		}
+	}
+	f.hosts[host] = familyEntry{v6: v6, until: now.Add(familyTTL)}
+}
+
+// dialUnix connects to a unix socket the ACL lists. Stream sockets only:
+// datagram relaying has no unix counterpart.
+func (s *Server) dialUnix(ctx context.Context, network, addr, path string, timeout time.Duration) (net.Conn, error) {
+	if network != "tcp" || !s.acl.Load().AllowUnix(path) {
+		return nil, &net.OpError{Op: "dial", Net: "unix", Err: &aclError{addr: addr, rule: -1}}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "unix", path)
+}
+
+// aclError reports a destination refused by the ACL.
+type aclError struct {
+	addr string
+	rule int
+}
+
+func (e *aclError) Error() string {
+	if e.rule < 0 {
+		return fmt.Sprintf("%s denied by acl default", e.addr)
+	}
+	return fmt.Sprintf("%s denied by acl rule %d", e.addr, e.rule)
+}
+
+// target is a destination whose addresses are already resolved.
+type target struct {
+	network string
+	host    string
+	port    uint16
+}
+
+// minDialTimeout keeps one address from being left a useless sliver of
+// the timeout when a name has many.
+const minDialTimeout = 2 * time.Second
+
+// dialSerial tries ips in order, splitting the dialer's timeout between
+// them.
+func (t target) dialSerial(ctx context.Context, dialer *net.Dialer, ips []netip.Addr) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: t.network, Err: &net.AddrError{Err: "no suitable address found", Addr: t.host}}
+	}
+	deadline := time.Now().Add(dialer.Timeout)
+	var firstErr error
+	for i, ip := range ips {
+		d := *dialer
+		d.Timeout = time.Until(deadline) / time.Duration(len(ips)-i)
+		if d.Timeout < minDialTimeout {
+			d.Timeout = min(minDialTimeout, time.Until(deadline))
+		}
+		conn, err := d.DialContext(ctx, t.network, netip.AddrPortFrom(ip, t.port).String())
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil || time.Until(deadline) <= 0 {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// race dials the first family and, if it has not connected within
+// delay or fails sooner, the second one alongside (RFC 8305). The first
+// connection to succeed wins. A UDP dial does not touch the network, so
+// it just takes the first family that has an address.
+func (t target) race(ctx context.Context, dialer *net.Dialer, first, second []netip.Addr, delay time.Duration) (net.Conn, error) {
+	if t.network == "udp" {
+		if len(first) == 0 {
+			first = second
+		}
+		return t.dialSerial(ctx, dialer, first)
+	}
+	if len(first) == 0 || len(second) == 0 {
+		return t.dialSerial(ctx, dialer, append(first, second...))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	start := func(ips []netip.Addr) {
+		go func() {
+			conn, err := t.dialSerial(ctx, dialer, ips)
+			results <- result{conn, err}
+		}()
+	}
+
+	start(first)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	fallback := timer.C
+	pending := 1
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-fallback:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if fallback == nil {
+				continue
+			}
+		}
+		fallback = nil
+		start(second)
+		pending++
+	}
+	return nil, firstErr
+}
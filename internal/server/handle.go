@@ -3,13 +3,56 @@ package server
 import (
 	"context"
 	"fmt"
+	"net"
+	"time"
 
 	"paqet/internal/flog"
+	"paqet/internal/pkg/class"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
 )
 
+// overLinger is how long a session over max_conns is kept to answer its
+// streams with the reason before it is dropped.
+const overLinger = 10 * time.Second
+
 func (s *Server) handleConn(ctx context.Context, conn tnet.Conn) {
+	sess := s.caps.openConn(conn.RemoteAddr())
+	sess.conn = conn
+	defer s.caps.closeConn(sess)
+	if t, ok := conn.(class.Tuner); ok && s.cls != nil {
+		sess.tracker = s.cls.Track(t)
+		defer sess.tracker.Close()
+	}
+	// A fresh client session opens its first stream right away. A session
+	// that starts mid-flow (rerouted here by ECMP/anycast from another node)
+	// never delivers one, so drop it instead of holding it open.
+	addr := conn.RemoteAddr().String()
+	s.sessions.Store(addr, sess)
+	defer s.sessions.CompareAndDelete(addr, sess)
+	s.peers.add(addr)
+	defer s.peers.remove(addr)
+	defer s.users.remove(addr)
+	s.limits.add(addr)
+	defer s.limits.remove(addr)
+
+	grace := s.cfg.Transport.Health.Grace
+	if grace > 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(grace) * time.Second))
+	}
+	if s.users.required() {
+		// Lifted by handleAuth; a session that never authenticates is
+		// dropped, which also covers sessions rerouted mid-flow.
+		conn.SetDeadline(time.Now().Add(authTimeout))
+		grace = 0
+	}
+	if sess.over != nil {
+		// Linger long enough to tell the client why, then drop it.
+		flog.Warnf("rejecting session from %s: %v", addr, sess.over)
+		conn.SetDeadline(time.Now().Add(overLinger))
+		grace = 0
+	}
+	first := true
 	for {
 		select {
 		case <-ctx.Done():
@@ -19,14 +62,31 @@ func (s *Server) handleConn(ctx context.Context, conn tnet.Conn) {
 		}
 		strm, err := conn.AcceptStrm()
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && first && grace > 0 {
+				flog.Infof("rejecting session from %s: no stream within %ds, likely started on another node", conn.RemoteAddr(), grace)
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && s.users.required() && s.users.get(addr) == nil {
+				flog.Infof("dropping session from %s: not authenticated within %v", conn.RemoteAddr(), authTimeout)
+				return
+			}
+			if s.stopping.Load() {
+				return // closed by shutdown
+			}
 			flog.Errorf("failed to accept stream on %s: %v", conn.RemoteAddr(), err)
 			return
 		}
+		if first && grace > 0 {
+			conn.SetDeadline(time.Time{})
+		}
+		first = false
 		s.wg.Add(1)
+		s.strmCount.Add(1)
 		go func() {
 			defer s.wg.Done()
+			defer s.strmCount.Add(-1)
 			defer strm.Close()
-			if err := s.handleStrm(ctx, strm); err != nil {
+			if err := s.handleStrm(ctx, strm, sess); err != nil {
 				flog.Errorf("stream %d from %s closed with error: %v", strm.SID(), strm.RemoteAddr(), err)
 			} else {
 				flog.Debugf("stream %d from %s closed", strm.SID(), strm.RemoteAddr())
@@ -35,28 +95,113 @@ func (s *Server) handleConn(ctx context.Context, conn tnet.Conn) {
 	}
 }
 
-func (s *Server) handleStrm(ctx context.Context, strm tnet.Strm) error {
+func (s *Server) handleStrm(ctx context.Context, strm tnet.Strm, sess *session) error {
 	var p protocol.Proto
 	err := p.Read(strm)
 	if err != nil {
 		flog.Errorf("failed to read protocol message from stream %d: %v", strm.SID(), err)
 		return err
 	}
+	if p.Type == protocol.POPTS {
+		// What the request that follows uses, and who it is for, for
+		// this stream alone.
+		uses, src := p.Features&protocol.Features, p.Source
+		p = protocol.Proto{}
+		if err := p.Read(strm); err != nil {
+			flog.Errorf("failed to read request after options on stream %d: %v", strm.SID(), err)
+			return err
+		}
+		p.Features, p.Source = uses, src
+	}
 
 	switch p.Type {
-	case protocol.PPING:
+	case protocol.PPING, protocol.PMTU:
 		return s.handlePing(strm)
+	case protocol.PPROBE:
+		return s.handleProbe(strm, &p)
+	case protocol.PHELLO:
+		return s.handleHello(strm, &p)
+	case protocol.PAUTH:
+		return s.handleAuth(strm, &p, sess)
 	case protocol.PTCPF:
 		if len(p.TCPF) != 0 {
 			s.pConn.SetClientTCPF(strm.RemoteAddr(), p.TCPF)
 		}
 		return nil
-	case protocol.PTCP:
-		return s.handleTCPProtocol(ctx, strm, &p)
-	case protocol.PUDP:
+	case protocol.PBENCH:
+		if err := s.admit(sess, strm); err != nil {
+			flog.Warnf("rejecting bench stream %d from %s: %v", strm.SID(), strm.RemoteAddr(), err)
+			s.reportStatus(strm, &p, err)
+			return nil
+		}
+		defer s.caps.closeStream(sess)
+		return s.handleBench(strm, &p)
+	case protocol.PTCP, protocol.PUDP, protocol.PUDPF:
+		if err := s.admit(sess, strm); err != nil {
+			flog.Warnf("rejecting stream %d from %s to %s: %v", strm.SID(), strm.RemoteAddr(), p.Addr, err)
+			s.reportStatus(strm, &p, err)
+			return nil
+		}
+		defer s.caps.closeStream(sess)
+		if sess.tracker != nil {
+			cs := sess.tracker.Wrap(strm, s.cls.ByPort(p.Addr.Port))
+			defer cs.Close()
+			strm = cs
+		}
+		if p.Type == protocol.PTCP {
+			return s.handleTCPProtocol(ctx, strm, &p)
+		}
 		return s.handleUDPProtocol(ctx, strm, &p)
+	case protocol.PCONE:
+		if err := s.admit(sess, strm); err != nil {
+			flog.Warnf("rejecting full-cone UDP stream %d from %s: %v", strm.SID(), strm.RemoteAddr(), err)
+			s.reportStatus(strm, &p, err)
+			return nil
+		}
+		defer s.caps.closeStream(sess)
+		return s.handleCone(ctx, strm, &p)
 	default:
+		if protocol.IsExt(p.Type) {
+			return s.handleExt(strm, &p)
+		}
 		flog.Errorf("unknown protocol type %d on stream %d", p.Type, strm.SID())
 		return fmt.Errorf("unknown protocol type: %d", p.Type)
 	}
 }
+
+// handleExt passes an extension message to its registered handler. One
+// without a handler is refused, so the client learns this server lacks
+// the extension instead of waiting on the stream.
+func (s *Server) handleExt(strm tnet.Strm, p *protocol.Proto) error {
+	if s.users.required() && s.users.get(strm.RemoteAddr().String()) == nil {
+		s.reportStatus(strm, p, &authError{"session is not authenticated as a user"})
+		return nil
+	}
+	h := protocol.Ext(p.Type)
+	if h == nil {
+		flog.Debugf("no handler for extension type %#x on stream %d from %s", p.Type, strm.SID(), strm.RemoteAddr())
+		s.reportStatus(strm, p, fmt.Errorf("unsupported extension type %#x", p.Type))
+		return nil
+	}
+	return h(strm, p)
+}
+
+// admit checks that a stream carrying traffic may open: its session is
+// authenticated when users are required, its user is within its quotas,
+// and it is within the stream caps. An admitted stream must be released
+// with caps.closeStream.
+func (s *Server) admit(sess *session, strm tnet.Strm) error {
+	if s.stopping.Load() {
+		return fmt.Errorf("server is shutting down")
+	}
+	if s.users.required() {
+		st := s.users.get(strm.RemoteAddr().String())
+		if st == nil {
+			return &authError{"session is not authenticated as a user"}
+		}
+		if err := st.overQuota(); err != nil {
+			return err
+		}
+	}
+	return s.caps.openStream(sess)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"paqet/internal/flog"
+	"paqet/internal/pkg/accesslog"
+	"paqet/internal/tnet"
+)
+
+// watchIdle ends a relay once d passes without a write either way, by
+// closing strm and dst, and returns up and down wrapped to note the
+// traffic. The relay's own deadlines are left alone, so hibernation
+// keeps working. With d of 0 the relay is not watched.
+func (s *Server) watchIdle(ctx context.Context, d time.Duration, strm tnet.Strm, dst io.Closer, rec *accesslog.Record, up, down io.Writer) (io.Writer, io.Writer) {
+	if d == 0 {
+		return up, down
+	}
+	a := &activity{}
+	a.touch()
+	go func() {
+		ticker := time.NewTicker(min(d/4, time.Minute))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if a.since() < d {
+					continue
+				}
+				s.idled.Add(1)
+				rec.Closed("idle")
+				flog.Debugf("stream %d from %s idle for %v, closing it", strm.SID(), strm.RemoteAddr(), d)
+				dst.Close()
+				strm.Close()
+				return
+			}
+		}
+	}()
+	return &activeWriter{up, a}, &activeWriter{down, a}
+}
+
+// activity is when a relay last moved data, in Unix nanoseconds.
+type activity struct {
+	last atomic.Int64
+}
+
+func (a *activity) touch()               { a.last.Store(time.Now().UnixNano()) }
+func (a *activity) since() time.Duration { return time.Since(time.Unix(0, a.last.Load())) }
+
+type activeWriter struct {
+	w io.Writer
+	a *activity
+}
+
+func (w *activeWriter) Write(p []byte) (int, error) {
+	w.a.touch()
+	return w.w.Write(p)
+}
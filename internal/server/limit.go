@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/ratelimit"
+	"sync"
+)
+
+// limits holds the token buckets of the relay: one pair shared by every
+// client and one pair per client session, each pair split by direction.
+type limits struct {
+	mu       sync.Mutex
+	cfg      *conf.Limit
+	up, down *ratelimit.Bucket
+	clients  map[string]*clientLimit
+}
+
+type clientLimit struct {
+	up, down *ratelimit.Bucket
+}
+
+func newLimits(cfg *conf.Limit) *limits {
+	l := &limits{cfg: cfg, clients: make(map[string]*clientLimit)}
+	l.up = retune(nil, cfg.Rate, cfg.Burst)
+	l.down = retune(nil, cfg.Rate, cfg.Burst)
+	return l
+}
+
+func kbitToBytes(kbit int) int { return kbit * 1000 / 8 }
+
+// add registers the session at addr, with buckets when clients are
+// limited.
+func (l *limits) add(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clients[addr] = &clientLimit{
+		up:   retune(nil, l.cfg.ClientRate, l.cfg.ClientBurst),
+		down: retune(nil, l.cfg.ClientRate, l.cfg.ClientBurst),
+	}
+}
+
+func (l *limits) remove(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, addr)
+}
+
+// wrap paces a relay for the session at addr: up carries client data to
+// the destination, down the replies back.
+func (l *limits) wrap(addr string, up, down io.Writer) (io.Writer, io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.clients[addr]
+	if c == nil {
+		c = &clientLimit{}
+	}
+	return ratelimit.Writer(up, l.up, c.up), ratelimit.Writer(down, l.down, c.down)
+}
+
+// update applies new limits. Relays already paced by a bucket follow a
+// changed rate at once; a limit turned on or off applies to relays
+// started afterwards.
+func (l *limits) update(cfg *conf.Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+	l.up = retune(l.up, cfg.Rate, cfg.Burst)
+	l.down = retune(l.down, cfg.Rate, cfg.Burst)
+	for _, c := range l.clients {
+		c.up = retune(c.up, cfg.ClientRate, cfg.ClientBurst)
+		c.down = retune(c.down, cfg.ClientRate, cfg.ClientBurst)
+	}
+}
+
+func retune(b *ratelimit.Bucket, kbit, burst int) *ratelimit.Bucket {
+	switch {
+	case kbit == 0:
+		return nil
+	case b == nil:
+		return ratelimit.New(kbitToBytes(kbit), burst)
+	}
+	b.SetRate(kbitToBytes(kbit), burst)
+	return b
+}
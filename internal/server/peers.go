@@ -0,0 +1,80 @@
+package server
+
+import (
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"sync"
+)
+
+// PeerInfo is what a client advertised in its PHELLO. Clients too old
+// to send one are counted under Version "unknown".
+type PeerInfo struct {
+	Version  string
+	Features uint32
+}
+
+// peers tracks the advertised build of every connected session, so an
+// operator can tell when all clients support a feature before making it
+// mandatory.
+type peers struct {
+	mu sync.Mutex
+	m  map[string]PeerInfo
+}
+
+func (p *peers) add(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.m == nil {
+		p.m = make(map[string]PeerInfo)
+	}
+	p.m[addr] = PeerInfo{Version: "unknown"}
+}
+
+func (p *peers) remove(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.m, addr)
+}
+
+func (p *peers) hello(addr string, info PeerInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.m[addr]; ok {
+		p.m[addr] = info
+	}
+}
+
+func (p *peers) info(addr string) PeerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.m[addr]
+}
+
+// features returns what the session at addr advertised.
+func (p *peers) features(addr string) uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.m[addr].Features
+}
+
+// PeerVersions counts the connected sessions by advertised version and
+// feature set.
+func (s *Server) PeerVersions() map[PeerInfo]int {
+	s.peers.mu.Lock()
+	defer s.peers.mu.Unlock()
+	counts := make(map[PeerInfo]int)
+	for _, info := range s.peers.m {
+		counts[info]++
+	}
+	return counts
+}
+
+// handleHello records the client's build and answers with ours.
+func (s *Server) handleHello(strm tnet.Strm, p *protocol.Proto) error {
+	addr := strm.RemoteAddr().String()
+	s.peers.hello(addr, PeerInfo{Version: p.Version, Features: p.Features})
+	flog.Infof("client %s runs paqet %s (features: %s)", addr, p.Version, protocol.FeatureNames(p.Features))
+	reply := protocol.Proto{Type: protocol.PHELLO, Version: protocol.Software, Features: protocol.Features}
+	return reply.Write(strm)
+}
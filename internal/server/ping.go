@@ -16,3 +16,17 @@ func (s *Server) handlePing(strm tnet.Strm) error {
 	flog.Debugf("sent pong on stream %d", strm.SID())
 	return nil
 }
+
+// handleProbe answers a bandwidth probe with a back-to-back train of
+// padded messages; the client times their arrival.
+func (s *Server) handleProbe(strm tnet.Strm, p *protocol.Proto) error {
+	flog.Debugf("accepted bandwidth probe (%d x %d bytes) on stream %d from %s", p.Count, p.Pad, strm.SID(), strm.RemoteAddr())
+	ack := protocol.Proto{Type: protocol.PPROBEACK, Pad: p.Pad}
+	for i := 0; i < p.Count; i++ {
+		if err := ack.Write(strm); err != nil {
+			flog.Debugf("bandwidth probe on stream %d aborted after %d messages: %v", strm.SID(), i, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+)
+
+// pool keeps a fresh TCP connection ready for destinations streams went
+// to within the idle time, so the next stream to one skips the
+// handshake. A connection serves one stream only: TCP has no request
+// boundaries, so one that relayed a stream cannot be handed to another.
+// Its methods accept a nil pool, which is what the server has without
+// pool.idle.
+type pool struct {
+	idle time.Duration
+	max  int
+
+	mu      sync.Mutex
+	spares  map[string][]spare
+	n       int
+	recent  map[string]time.Time // last stream per address
+	filling map[string]bool
+}
+
+type spare struct {
+	conn  net.Conn
+	until time.Time
+}
+
+func newPool(cfg *conf.Pool) *pool {
+	if cfg.Idle == 0 {
+		return nil
+	}
+	p := &pool{
+		idle:    time.Duration(cfg.Idle) * time.Second,
+		max:     cfg.Max,
+		spares:  make(map[string][]spare),
+		recent:  make(map[string]time.Time),
+		filling: make(map[string]bool),
+	}
+	return p
+}
+
+// start expires spares until ctx ends. The pool is made with the server,
+// before it has a context, so reloads can flush it from the start.
+func (p *pool) start(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	go p.expire(ctx)
+}
+
+// get returns a spare connection to addr that the destination has not
+// closed, or nil.
+func (p *pool) get(addr string) net.Conn {
+	if p == nil {
+		return nil
+	}
+	for {
+		p.mu.Lock()
+		ss := p.spares[addr]
+		if len(ss) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		s := ss[len(ss)-1]
+		p.spares[addr] = ss[:len(ss)-1]
+		p.n--
+		p.mu.Unlock()
+		if time.Now().Before(s.until) {
+			if conn := alive(s.conn); conn != nil {
+				return conn
+			}
+		}
+		s.conn.Close()
+	}
+}
+
+// used records a stream to addr and, if another went there within the
+// idle time, dials a spare for the next one in the background.
+func (p *pool) used(addr string, dial func() (net.Conn, error)) {
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	last, ok := p.recent[addr]
+	p.recent[addr] = now
+	if !ok || now.Sub(last) > p.idle || len(p.spares[addr]) > 0 || p.filling[addr] || p.n >= p.max {
+		p.mu.Unlock()
+		return
+	}
+	p.filling[addr] = true
+	p.mu.Unlock()
+
+	go func() {
+		conn, err := dial()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.filling, addr)
+		if err != nil {
+			flog.Debugf("failed to dial spare connection to %s: %v", addr, err)
+			return
+		}
+		if p.n >= p.max {
+			conn.Close()
+			return
+		}
+		p.spares[addr] = append(p.spares[addr], spare{conn: conn, until: time.Now().Add(p.idle)})
+		p.n++
+	}()
+}
+
+// flush closes every spare, so none outlives the policy it was dialed
+// under.
+func (p *pool) flush() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, ss := range p.spares {
+		for _, s := range ss {
+			s.conn.Close()
+		}
+		delete(p.spares, addr)
+	}
+	p.n = 0
+}
+
+// expire closes spares left unused for the idle time and forgets
+// addresses no stream went to since.
+func (p *pool) expire(ctx context.Context) {
+	ticker := time.NewTicker(p.idle / 2)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		p.mu.Lock()
+		for addr, ss := range p.spares {
+			kept := ss[:0]
+			for _, s := range ss {
+				if now.After(s.until) {
+					s.conn.Close()
+					p.n--
+				} else {
+					kept = append(kept, s)
+				}
+			}
+			if len(kept) == 0 {
+				delete(p.spares, addr)
+			} else {
+				p.spares[addr] = kept
+			}
+		}
+		for addr, t := range p.recent {
+			if now.Sub(t) > p.idle {
+				delete(p.recent, addr)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// alive checks that the destination has not closed conn while it was
+// idle. Anything it sent meanwhile, such as a banner, is kept for the
+// stream.
+func alive(conn net.Conn) net.Conn {
+	var b [512]byte
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return &primed{Conn: conn, pre: append([]byte(nil), b[:n]...)}
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return conn
+	}
+	return nil
+}
+
+// primed is a conn that returns pre before what it reads next.
+type primed struct {
+	net.Conn
+	pre []byte
+}
+
+func (c *primed) Read(b []byte) (int, error) {
+	if len(c.pre) > 0 {
+		n := copy(b, c.pre)
+		c.pre = c.pre[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// drain writes what c read ahead to w and returns the conn underneath,
+// so a relay reads the socket itself and the copy engine can watch or
+// splice it.
+func (c *primed) drain(w io.Writer) (net.Conn, error) {
+	_, err := w.Write(c.pre)
+	c.pre = nil
+	return c.Conn, err
+}
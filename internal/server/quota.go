@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"paqet/internal/flog"
+	"paqet/internal/store"
+	"sync"
+	"time"
+)
+
+const (
+	usageBucket = "usage"
+	// usageFlush is how often the usage of active users is saved, which
+	// bounds what a crash forgets.
+	usageFlush = time.Minute
+	mib        = 1 << 20
+)
+
+// quotaError rejects a stream of a user over its daily or monthly quota.
+type quotaError struct{ reason string }
+
+func (e *quotaError) Error() string { return e.reason }
+
+// usage is what a user relayed, both directions together, in the
+// current UTC day and month. It is kept in the store so quotas survive
+// restarts.
+type usage struct {
+	mu         sync.Mutex
+	Day        string `json:"day"` // 2006-01-02
+	DayBytes   uint64 `json:"day_bytes"`
+	Month      string `json:"month"` // 2006-01
+	MonthBytes uint64 `json:"month_bytes"`
+	dirty      bool
+
+	// nextDay and nextMonth are when Day and Month end; roll does
+	// nothing before then, keeping the write path off time.Format.
+	nextDay, nextMonth time.Time
+}
+
+// roll starts a new period once the day or month of now differs. The
+// caller holds mu.
+func (u *usage) roll(now time.Time) {
+	if now.Before(u.nextDay) && now.Before(u.nextMonth) {
+		return
+	}
+	now = now.UTC()
+	y, m, d := now.Date()
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayBytes, u.dirty = day, 0, true
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes, u.dirty = month, 0, true
+	}
+	u.nextDay = time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+	u.nextMonth = time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (u *usage) add(n int) {
+	if n <= 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.roll(time.Now())
+	u.DayBytes += uint64(n)
+	u.MonthBytes += uint64(n)
+	u.dirty = true
+}
+
+// current returns the bytes used today and this month.
+func (u *usage) current() (day, month uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.roll(time.Now())
+	return u.DayBytes, u.MonthBytes
+}
+
+// overQuota reports why st may not open more streams, or nil.
+func (st *userState) overQuota() error {
+	day, month := st.usage.current()
+	if q := st.cfg.DailyQuota; q > 0 && day >= uint64(q)*mib {
+		return &quotaError{fmt.Sprintf("daily quota of %d MiB for user %q used up", q, st.cfg.ID)}
+	}
+	if q := st.cfg.MonthlyQuota; q > 0 && month >= uint64(q)*mib {
+		return &quotaError{fmt.Sprintf("monthly quota of %d MiB for user %q used up", q, st.cfg.ID)}
+	}
+	return nil
+}
+
+// loadUsage restores the usage saved by an earlier run; a period that
+// has since ended starts from zero.
+func (u *users) loadUsage(st store.Store) {
+	saved, err := st.List(usageBucket)
+	if err != nil {
+		flog.Warnf("failed to load user usage: %v", err)
+		return
+	}
+	for id, data := range saved {
+		us := u.byID[id]
+		if us == nil {
+			continue
+		}
+		us.usage.mu.Lock()
+		if err := json.Unmarshal(data, &us.usage); err != nil {
+			flog.Warnf("ignoring saved usage of user %s: %v", id, err)
+		}
+		us.usage.nextDay, us.usage.nextMonth = time.Time{}, time.Time{}
+		us.usage.roll(time.Now())
+		us.usage.mu.Unlock()
+	}
+}
+
+// saveUsage writes the usage of every user that changed since the last
+// save.
+func (u *users) saveUsage(st store.Store) {
+	for id, us := range u.byID {
+		us.usage.mu.Lock()
+		if !us.usage.dirty {
+			us.usage.mu.Unlock()
+			continue
+		}
+		data, err := json.Marshal(&us.usage)
+		us.usage.dirty = false
+		us.usage.mu.Unlock()
+		if err != nil {
+			continue
+		}
+		if err := st.Put(usageBucket, id, data); err != nil {
+			flog.Warnf("failed to save usage of user %s: %v", id, err)
+		}
+	}
+}
+
+// runUsage saves user usage every usageFlush until ctx ends.
+func (s *Server) runUsage(ctx context.Context) {
+	ticker := time.NewTicker(usageFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.users.saveUsage(s.store)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+)
+
+// The setters below apply parts of a reloaded configuration without
+// dropping sessions. Streams already relaying keep the destination they
+// were allowed to reach.
+
+// SetACL applies a new destination ACL to streams opened afterwards.
+func (s *Server) SetACL(acl *conf.ACL) {
+	s.acl.Store(acl)
+	s.pool.flush()
+	flog.Infof("ACL reloaded: %d rules, default %s", len(acl.Rules), acl.Default)
+}
+
+// SetEgress applies a new address family policy to dials made afterwards.
+func (s *Server) SetEgress(eg *conf.Egress) {
+	s.egress.Store(eg)
+	s.pool.flush()
+	flog.Infof("egress policy reloaded")
+}
+
+// SetLimit retunes the relay bandwidth limits.
+func (s *Server) SetLimit(l *conf.Limit) {
+	s.limits.update(l)
+	flog.Infof("bandwidth limits reloaded")
+}
+
+// SetCaps applies new connection and stream caps.
+func (s *Server) SetCaps(l *conf.Server) {
+	s.caps.update(l)
+	s.accepts.update(l)
+	flog.Infof("connection and stream caps reloaded")
+}
+
+// ReopenLogs opens the access log file again, for after logrotate moved
+// it away.
+func (s *Server) ReopenLogs() {
+	if err := s.access.Reopen(); err != nil {
+		flog.Errorf("failed to reopen access log: %v", err)
+	}
+}
+
+// SetTCPF changes the TCP flags of packets to clients that did not ask
+// for their own.
+func (s *Server) SetTCPF(f []conf.TCPF) {
+	if s.pConn != nil {
+		s.pConn.SetTCPF(f)
+		flog.Infof("TCP flags reloaded")
+	}
+}
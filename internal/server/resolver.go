@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/fwmark"
+)
+
+// ResolverStats summarises the lookups of hostname destinations.
+type ResolverStats struct {
+	Lookups      uint64        // lookups that reached a resolver
+	Failures     uint64        // lookups that failed every attempt
+	Retries      uint64        // attempts after the first
+	NegativeHits uint64        // answered from the negative cache
+	AvgLatency   time.Duration // mean time to resolve, retries included
+	MaxLatency   time.Duration
+}
+
+// resolver looks up destinations with a bounded time per attempt, moves
+// on to the next configured server after a failure, and remembers names
+// that do not exist for a while.
+type resolver struct {
+	cfg     *conf.Resolver
+	servers []*net.Resolver
+
+	mu  sync.Mutex
+	neg map[string]negEntry
+
+	lookups, failures, retries, negHits atomic.Uint64
+	total, max                          atomic.Int64
+}
+
+type negEntry struct {
+	err     error
+	expires time.Time
+}
+
+// maxNegative bounds the negative cache; it is cleared when full.
+const maxNegative = 4096
+
+// newResolver asks the servers of cfg, with sockets carrying the
+// egress fwmark of the moment.
+func newResolver(cfg *conf.Resolver, egress *atomic.Pointer[conf.Egress]) *resolver {
+	r := &resolver{cfg: cfg, neg: make(map[string]negEntry)}
+	for _, addr := range cfg.Servers {
+		r.servers = append(r.servers, &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{Control: fwmark.Control(egress.Load().Fwmark)}
+				return d.DialContext(ctx, network, addr)
+			},
+		})
+	}
+	if len(r.servers) == 0 {
+		r.servers = []*net.Resolver{net.DefaultResolver}
+	}
+	return r
+}
+
+// lookup returns the addresses of host, which may be an IP literal.
+func (r *resolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+	key := strings.ToLower(host)
+	if err := r.negative(key); err != nil {
+		r.negHits.Add(1)
+		return nil, err
+	}
+
+	r.lookups.Add(1)
+	start := time.Now()
+	var err error
+	for i := 0; i < r.cfg.Attempts; i++ {
+		if i > 0 {
+			r.retries.Add(1)
+			flog.Debugf("retrying lookup of %s (%d/%d) after: %v", host, i+1, r.cfg.Attempts, err)
+		}
+		var ips []netip.Addr
+		actx, cancel := context.WithTimeout(ctx, time.Duration(r.cfg.Timeout)*time.Millisecond)
+		ips, err = r.servers[i%len(r.servers)].LookupNetIP(actx, "ip", host)
+		cancel()
+		if err == nil && len(ips) > 0 {
+			r.observe(host, time.Since(start))
+			for j := range ips {
+				ips[j] = ips[j].Unmap()
+			}
+			return ips, nil
+		}
+		if err == nil {
+			err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			r.remember(key, err)
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	r.observe(host, time.Since(start))
+	r.failures.Add(1)
+	return nil, err
+}
+
+func (r *resolver) negative(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.neg[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(r.neg, key)
+		return nil
+	}
+	return e.err
+}
+
+func (r *resolver) remember(key string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.neg) >= maxNegative {
+		clear(r.neg)
+	}
+	r.neg[key] = negEntry{err: err, expires: time.Now().Add(time.Duration(r.cfg.NegativeTTL) * time.Second)}
+}
+
+func (r *resolver) observe(host string, d time.Duration) {
+	r.total.Add(int64(d))
+	for {
+		m := r.max.Load()
+		if int64(d) <= m || r.max.CompareAndSwap(m, int64(d)) {
+			break
+		}
+	}
+	if d > time.Second {
+		flog.Debugf("slow lookup of %s: %v", host, d)
+	}
+}
+
+// ResolverStats reports the lookups made for hostname destinations.
+func (s *Server) ResolverStats() ResolverStats {
+	r := s.resolver
+	st := ResolverStats{
+		Lookups:      r.lookups.Load(),
+		Failures:     r.failures.Load(),
+		Retries:      r.retries.Load(),
+		NegativeHits: r.negHits.Load(),
+		MaxLatency:   time.Duration(r.max.Load()),
+	}
+	if st.Lookups > 0 {
+		st.AvgLatency = time.Duration(r.total.Load() / int64(st.Lookups))
+	}
+	return st
+}
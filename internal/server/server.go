@@ -8,69 +8,131 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"paqet/internal/conf"
 	"paqet/internal/flog"
+	"paqet/internal/pkg/accesslog"
+	"paqet/internal/pkg/class"
+	"paqet/internal/pkg/ipfix"
 	"paqet/internal/socket"
+	"paqet/internal/store"
 	"paqet/internal/tnet"
 	"paqet/internal/tnet/kcp"
 )
 
 type Server struct {
-	cfg      *conf.Conf
-	pConn    *socket.PacketConn
-	wg       sync.WaitGroup
+	cfg       *conf.Conf
+	store     store.Store
+	pConn     socket.Conn
+	wg        sync.WaitGroup
 	connCount atomic.Int64 // Track active connections for monitoring
+	strmCount atomic.Int64
+	stopping  atomic.Bool
+	idled     atomic.Int64 // relays ended by transport.idle
+	cls       *class.Classifier
+	peers     peers
+	resolver  *resolver
+	limits    *limits
+	caps      *caps
+	accepts   *admission
+	users     *users
+	sessions  sync.Map // remote addr -> *session
+	flows     *ipfix.Exporter
+	access    *accesslog.Logger
+	acl       atomic.Pointer[conf.ACL]
+	egress    atomic.Pointer[conf.Egress]
+	families  *families
+	pool      *pool
 }
 
-func New(cfg *conf.Conf) (*Server, error) {
+func New(cfg *conf.Conf, st store.Store) (*Server, error) {
 	s := &Server{
-		cfg: cfg,
+		cfg:      cfg,
+		store:    st,
+		limits:   newLimits(&cfg.Limit),
+		caps:     newCaps(&cfg.Listen),
+		accepts:  newAdmission(&cfg.Listen),
+		users:    newUsers(cfg.Users),
+		families: newFamilies(),
+		pool:     newPool(&cfg.Pool),
 	}
+	s.resolver = newResolver(&cfg.Resolver, &s.egress)
+	if cc := cfg.Transport.Class; cc.Enabled {
+		s.cls = class.New(cc.Ports, cc.BulkBytes, cc.Weight)
+	}
+	if x := cfg.IPFIX; x.Collector != "" {
+		e, err := ipfix.New(x.Collector, uint32(x.Domain), time.Duration(x.Active)*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("could not reach IPFIX collector: %w", err)
+		}
+		s.flows = e
+	}
+	if a := cfg.Access; a.Path != "" {
+		l, err := accesslog.Open(a.Path, a.Destinations, a.HashKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not open access log: %w", err)
+		}
+		s.access = l
+	}
+	s.users.loadUsage(st)
+	s.acl.Store(&cfg.ACL)
+	s.egress.Store(&cfg.Egress)
 
 	return s, nil
 }
 
-func (s *Server) Start() error {
+// Start runs the server until SIGINT, SIGTERM or stop closes, then shuts
+// it down.
+func (s *Server) Start(stop <-chan struct{}) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sig
-		flog.Infof("Shutdown signal received, initiating graceful shutdown...")
-		cancel()
-	}()
 
-	pConn, err := socket.New(ctx, &s.cfg.Network)
+	// The packet conn outlives ctx: shutdown closes it only once the
+	// sessions on it are gone.
+	pConn, err := openConn(&s.cfg.Network)
 	if err != nil {
 		return fmt.Errorf("could not create raw packet conn: %w", err)
 	}
 	s.pConn = pConn
 
-	listener, err := kcp.Listen(s.cfg.Transport.KCP, pConn)
+	listener, err := kcp.Listen(s.cfg.Transport.KCP, &guard{Conn: pConn, a: s.accepts})
 	if err != nil {
+		pConn.Close()
 		return fmt.Errorf("could not start KCP listener: %w", err)
 	}
-	defer listener.Close()
-	flog.Infof("Server started - listening for packets on :%d", s.cfg.Listen.Addr.Port)
+	for _, l := range s.cfg.Network.Listeners {
+		flog.Infof("Also listening on %s (IPv4:%s IPv6:%s)", l.Interface.Name, l.IPv4.Addr, l.IPv6.Addr)
+	}
+	if len(s.cfg.Listen.Ports_) > 0 {
+		flog.Infof("Server started - listening for packets on :%d and ports %v", s.cfg.Listen.Addr.Port, s.cfg.Listen.Ports_)
+	} else {
+		flog.Infof("Server started - listening for packets on :%d", s.cfg.Listen.Addr.Port)
+	}
 
+	s.pool.start(ctx)
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
 		s.listen(ctx, listener)
 	}()
+	if s.users.required() {
+		go s.runUsage(ctx)
+	}
 
-	s.wg.Wait()
-	flog.Infof("Server shutdown completed")
+	select {
+	case <-sig:
+	case <-stop:
+	}
+	flog.Infof("Shutdown signal received, initiating graceful shutdown...")
+	s.shutdown(cancel, listener.(*kcp.Listener))
 	return nil
 }
 
 func (s *Server) listen(ctx context.Context, listener tnet.Listener) {
-	go func() {
-		<-ctx.Done()
-		listener.Close()
-	}()
+	var backoff time.Duration
 	for {
 		select {
 		case <-ctx.Done():
@@ -79,7 +141,23 @@ func (s *Server) listen(ctx context.Context, listener tnet.Listener) {
 		}
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.stopping.Load() {
+				return
+			}
+			// Back off so a failing listener does not spin and flood the log.
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
 			flog.Errorf("failed to accept connection: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+		if !s.accepts.admit(conn.RemoteAddr()) {
+			flog.Debugf("turned away new connection from %s: over the accept rate", conn.RemoteAddr())
+			conn.Close()
 			continue
 		}
 		flog.Infof("accepted new connection from %s (local: %s) [active: %d]", conn.RemoteAddr(), conn.LocalAddr(), s.connCount.Add(1))
@@ -95,3 +173,60 @@ func (s *Server) listen(ctx context.Context, listener tnet.Listener) {
 		}()
 	}
 }
+
+// Stats is a snapshot of the server's sessions.
+type Stats struct {
+	Conns   int64
+	Streams int64
+	Idled   int64
+	// Sessions turned away by the accept rates, and client IPs banned.
+	Rejected int64
+	Bans     int64
+}
+
+func (s *Server) Stats() Stats {
+	return Stats{
+		Conns:    s.connCount.Load(),
+		Streams:  s.strmCount.Load(),
+		Idled:    s.idled.Load(),
+		Rejected: s.accepts.rejected.Load(),
+		Bans:     s.accepts.banned.Load(),
+	}
+}
+
+// KCPStats lists the KCP state of each client session.
+func (s *Server) KCPStats() []kcp.Stats {
+	list := []kcp.Stats{}
+	s.sessions.Range(func(_, v any) bool {
+		if k, ok := v.(*session).conn.(*kcp.Conn); ok {
+			list = append(list, k.Stats())
+		}
+		return true
+	})
+	return list
+}
+
+// openConn opens a packet conn for each listen address of cfg, joined
+// into a group when there is more than one.
+func openConn(cfg *conf.Network) (socket.Conn, error) {
+	tcp := cfg.TCP.Pick()
+	nets := cfg.Listens()
+	if len(nets) == 1 {
+		nets[0].TCP = tcp
+		pConn, err := socket.New(context.Background(), &nets[0])
+		if err != nil {
+			return nil, err
+		}
+		return pConn, nil
+	}
+	cfgs := make([]*conf.Network, len(nets))
+	for i := range nets {
+		nets[i].TCP = tcp
+		cfgs[i] = &nets[i]
+	}
+	group, err := socket.NewGroup(context.Background(), cfgs)
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
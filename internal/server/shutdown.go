@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet/kcp"
+)
+
+// Bounds of the shutdown stages besides the drain, which is listen.drain.
+// A stage that runs out logs what it left behind and the next one starts.
+const (
+	notifyTimeout = 2 * time.Second
+	closeTimeout  = 5 * time.Second
+	flushTimeout  = 2 * time.Second
+)
+
+// shutdown stops the server in stages, each bounded, so that a client
+// or destination that hangs cannot keep the totals from being logged:
+//
+//  1. stop accepting sessions, and refuse new streams on existing ones
+//  2. send PGOAWAY to the clients that support it, so they redial
+//  3. drain: wait up to listen.drain for relayed streams to finish
+//  4. close the KCP sessions, ending the streams still open
+//  5. close the packet conn
+//  6. save per-user usage, close the access log, log the resolver and
+//     per-user totals and flush the log
+func (s *Server) shutdown(cancel context.CancelFunc, listener *kcp.Listener) {
+	start := time.Now()
+	s.stopping.Store(true)
+	listener.Stop()
+	flog.Infof("shutdown 1/6: stopped accepting sessions")
+
+	sent, ok := s.goAway()
+	if ok {
+		flog.Infof("shutdown 2/6: notified %d clients", sent)
+	} else {
+		flog.Warnf("shutdown 2/6: notified %d clients, gave up on the rest after %v", sent, notifyTimeout)
+	}
+
+	drain := time.Duration(s.cfg.Listen.Drain) * time.Second
+	if left := s.drain(drain); left == 0 {
+		flog.Infof("shutdown 3/6: all streams finished")
+	} else {
+		flog.Warnf("shutdown 3/6: %d streams still open after %v, closing them", left, drain)
+	}
+
+	cancel()
+	s.pool.flush()
+	s.sessions.Range(func(_, v any) bool {
+		v.(*session).conn.Close()
+		return true
+	})
+	if wait(&s.wg, closeTimeout) {
+		flog.Infof("shutdown 4/6: closed KCP sessions")
+	} else {
+		flog.Warnf("shutdown 4/6: %d sessions and %d streams did not exit within %v", s.connCount.Load(), s.strmCount.Load(), closeTimeout)
+	}
+
+	listener.Close()
+	flog.Infof("shutdown 5/6: closed packet conn")
+
+	if st := s.ResolverStats(); st.Lookups > 0 {
+		flog.Infof("resolver: %d lookups, %d failed, %d retries, %d negative cache hits, avg %v, max %v",
+			st.Lookups, st.Failures, st.Retries, st.NegativeHits, st.AvgLatency.Round(time.Millisecond), st.MaxLatency.Round(time.Millisecond))
+	}
+	s.users.saveUsage(s.store)
+	s.access.Close()
+	for id, st := range s.UserStats() {
+		flog.Infof("user %s: %d bytes up, %d bytes down, %d today, %d this month", id, st.BytesUp, st.BytesDown, st.Today, st.Month)
+	}
+	flog.Infof("shutdown 6/6: server shutdown completed in %v", time.Since(start).Round(time.Millisecond))
+	flog.Flush(flushTimeout)
+}
+
+// goAway tells each client that advertised FeatGoAway to move its
+// streams to a new session. It reports how many were told and whether
+// all were within notifyTimeout.
+func (s *Server) goAway() (int, bool) {
+	var wg sync.WaitGroup
+	var sent atomic.Int32
+	s.sessions.Range(func(k, v any) bool {
+		if s.peers.features(k.(string))&protocol.FeatGoAway == 0 {
+			return true
+		}
+		conn := v.(*session).conn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			strm, err := conn.OpenStrm()
+			if err != nil {
+				return
+			}
+			defer strm.Close()
+			strm.SetDeadline(time.Now().Add(notifyTimeout))
+			p := protocol.Proto{Type: protocol.PGOAWAY}
+			if p.Write(strm) == nil {
+				sent.Add(1)
+			}
+		}()
+		return true
+	})
+	ok := wait(&wg, notifyTimeout)
+	return int(sent.Load()), ok
+}
+
+// drain waits up to d for the relayed streams to finish and returns how
+// many are still open.
+func (s *Server) drain(d time.Duration) int64 {
+	deadline := time.Now().Add(d)
+	for {
+		n := s.strmCount.Load()
+		if n == 0 || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// wait waits up to d for wg and reports whether it finished.
+func wait(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"errors"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// reportStatus tells the client how its request req went. A relay
+// request gets a PSTATUS only if its POPTS asked for one, as the client
+// reads none before the relayed data otherwise; a PBENCH or extension
+// message is always answered.
+func (s *Server) reportStatus(strm tnet.Strm, req *protocol.Proto, err error) {
+	switch req.Type {
+	case protocol.PTCP, protocol.PUDP, protocol.PUDPF, protocol.PCONE:
+		if req.Features&protocol.FeatStatus == 0 {
+			return
+		}
+	}
+	p := protocol.Proto{Type: protocol.PSTATUS, Status: protocol.StatusOK}
+	var denied *aclError
+	var limit *limitError
+	var auth *authError
+	var quota *quotaError
+	switch {
+	case err == nil:
+	case errors.As(err, &denied):
+		p.Status, p.Reason = protocol.StatusDenied, "destination not allowed"
+	case errors.As(err, &limit):
+		p.Status, p.Reason = protocol.StatusLimit, limit.reason
+	case errors.As(err, &auth):
+		p.Status, p.Reason = protocol.StatusAuth, auth.reason
+	case errors.As(err, &quota):
+		p.Status, p.Reason = protocol.StatusQuota, quota.reason
+	default:
+		p.Status, p.Reason = protocol.StatusFailed, err.Error()
+	}
+	p.Write(strm)
+}
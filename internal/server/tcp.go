@@ -2,23 +2,45 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"net/netip"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/compress"
+	"paqet/internal/pkg/proxyproto"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
+	"strconv"
 	"time"
 )
 
 func (s *Server) handleTCPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto) error {
 	flog.Infof("accepted TCP stream %d: %s -> %s", strm.SID(), strm.RemoteAddr(), p.Addr.String())
-	return s.handleTCP(ctx, strm, p.Addr.String())
+	return s.handleTCP(ctx, strm, p)
 }
 
-func (s *Server) handleTCP(ctx context.Context, strm tnet.Strm, addr string) error {
-	dialer := &net.Dialer{Timeout: 5 * time.Second}
-	conn, err := dialer.DialContext(ctx, "tcp", addr)
+func (s *Server) handleTCP(ctx context.Context, strm tnet.Strm, p *protocol.Proto) error {
+	addr := p.Addr.String()
+	peer := strm.RemoteAddr().String()
+	rec := s.access.Start(peer, s.users.name(peer), strm.SID(), "tcp", addr)
+	defer s.access.End(rec)
+	conn := s.pool.get(addr)
+	var err error
+	if conn == nil {
+		conn, err = s.dial(ctx, "tcp", addr, 5*time.Second)
+	} else {
+		flog.Debugf("using spare TCP connection to %s for stream %d", addr, strm.SID())
+	}
+	s.reportStatus(strm, p, err)
 	if err != nil {
+		rec.Closed(dialReason(err))
+		var denied *aclError
+		if errors.As(err, &denied) {
+			flog.Warnf("TCP stream %d from %s: %v", strm.SID(), strm.RemoteAddr(), err)
+			return nil
+		}
 		flog.Errorf("failed to establish TCP connection to %s for stream %d: %v", addr, strm.SID(), err)
 		return err
 	}
@@ -27,26 +49,56 @@ func (s *Server) handleTCP(ctx context.Context, strm tnet.Strm, addr string) err
 		flog.Debugf("closed TCP connection %s for stream %d", addr, strm.SID())
 	}()
 	flog.Debugf("TCP connection established to %s for stream %d", addr, strm.SID())
+	if err := s.proxyHeader(conn, strm, p); err != nil {
+		flog.Errorf("failed to send PROXY protocol header to %s for stream %d: %v", addr, strm.SID(), err)
+		return err
+	}
+	s.pool.used(addr, func() (net.Conn, error) {
+		return s.dial(context.Background(), "tcp", addr, 5*time.Second)
+	})
+	if algo := protocol.Compression(p.Features); algo != "" {
+		strm = compress.NewStrm(strm, algo)
+	}
 
 	// Use context cancellation to properly tear down both directions
 	// when one side closes. Prevents goroutine leaks.
 	copyCtx, copyCancel := context.WithCancel(ctx)
 	defer copyCancel()
 
+	up, down := s.limits.wrap(strm.RemoteAddr().String(), conn, strm)
+	up, down = s.users.wrap(strm.RemoteAddr().String(), up, down)
+	st := s.track(rec, "tcp", strm.RemoteAddr().String(), addr, strm)
+	defer st.Untrack()
+	st.SetUser(s.users.name(strm.RemoteAddr().String()))
+	up, down = st.Writers(up, down)
+	fl := s.flows.Start(s.users.name(strm.RemoteAddr().String()), strm.RemoteAddr(), conn.RemoteAddr(), 6)
+	defer s.flows.End(fl)
+	up, down = fl.Writers(up, down)
+	up, down = s.watchIdle(copyCtx, s.cfg.Transport.Idle.TCPTimeout(), strm, conn, rec, up, down)
+	if p, ok := conn.(*primed); ok {
+		if conn, err = p.drain(down); err != nil {
+			rec.Closed(closeReason("client", err))
+			return nil
+		}
+	}
 	errChan := make(chan error, 2)
 	go func() {
-		err := buffer.CopyT(conn, strm)
+		err := buffer.CopyT(up, strm)
+		rec.Closed(closeReason("client", err))
 		copyCancel() // Signal the other direction to stop
 		errChan <- err
 	}()
-	go func() {
-		err := buffer.CopyT(strm, conn)
+	buffer.GoCopyT(copyCtx, down, conn, func(err error) {
+		rec.Closed(closeReason("destination", err))
 		copyCancel() // Signal the other direction to stop
 		errChan <- err
-	}()
+	})
 
 	// Wait for context cancellation (either copy finished or parent cancelled)
 	<-copyCtx.Done()
+	if ctx.Err() != nil {
+		rec.Closed("shutdown")
+	}
 
 	// Close connections to unblock any stuck reads
 	conn.Close()
@@ -63,3 +115,28 @@ func (s *Server) handleTCP(ctx context.Context, strm tnet.Strm, addr string) err
 	}
 	return nil
 }
+
+// proxyHeader opens conn with a PROXY protocol header naming the client
+// when proxy_protocol matches its destination: the source the request
+// carries, or else the client's own address.
+func (s *Server) proxyHeader(conn net.Conn, strm tnet.Strm, p *protocol.Proto) error {
+	host, portStr, _ := net.SplitHostPort(p.Addr.String())
+	port, _ := strconv.Atoi(portStr)
+	var ip net.IP
+	if ta, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = ta.IP
+	}
+	if !s.cfg.Proxy.Matches(host, ip, port) {
+		return nil
+	}
+	src := strm.RemoteAddr()
+	if p.Source != "" {
+		ap, err := netip.ParseAddrPort(p.Source)
+		if err != nil {
+			return fmt.Errorf("bad source %q: %v", p.Source, err)
+		}
+		src = net.TCPAddrFromAddrPort(ap)
+	}
+	_, err := conn.Write(proxyproto.Header(src, conn.RemoteAddr()))
+	return err
+}
@@ -2,23 +2,38 @@ package server
 
 import (
 	"context"
-	"net"
+	"errors"
+	"io"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
+	"paqet/internal/wire"
 	"time"
 )
 
 func (s *Server) handleUDPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto) error {
 	flog.Infof("accepted UDP stream %d: %s -> %s", strm.SID(), strm.RemoteAddr(), p.Addr.String())
-	return s.handleUDP(ctx, strm, p.Addr.String())
+	return s.handleUDP(ctx, strm, p)
 }
 
-func (s *Server) handleUDP(ctx context.Context, strm tnet.Strm, addr string) error {
-	dialer := &net.Dialer{Timeout: 8 * time.Second}
-	conn, err := dialer.DialContext(ctx, "udp", addr)
+// handleUDP relays datagrams between strm and the destination of p. A
+// PUDPF stream carries them framed as wire.FrameWriter does; otherwise
+// each stream read and write is taken to be one datagram.
+func (s *Server) handleUDP(ctx context.Context, strm tnet.Strm, p *protocol.Proto) error {
+	addr, framed := p.Addr.String(), p.Type == protocol.PUDPF
+	peer := strm.RemoteAddr().String()
+	rec := s.access.Start(peer, s.users.name(peer), strm.SID(), "udp", addr)
+	defer s.access.End(rec)
+	conn, err := s.dial(ctx, "udp", addr, 8*time.Second)
+	s.reportStatus(strm, p, err)
 	if err != nil {
+		rec.Closed(dialReason(err))
+		var denied *aclError
+		if errors.As(err, &denied) {
+			flog.Warnf("UDP stream %d from %s: %v", strm.SID(), strm.RemoteAddr(), err)
+			return nil
+		}
 		flog.Errorf("failed to establish UDP connection to %s for stream %d: %v", addr, strm.SID(), err)
 		return err
 	}
@@ -31,20 +46,48 @@ func (s *Server) handleUDP(ctx context.Context, strm tnet.Strm, addr string) err
 	copyCtx, copyCancel := context.WithCancel(ctx)
 	defer copyCancel()
 
+	var src io.Reader = strm
+	var dst io.Writer = strm
+	var fw *wire.FrameWriter
+	if framed {
+		src = wire.NewFrameReader(strm)
+		fw = wire.NewFrameWriter(strm, time.Duration(s.cfg.Transport.UDPDelay)*time.Millisecond)
+		dst = fw
+	}
+	up, down := s.limits.wrap(strm.RemoteAddr().String(), conn, dst)
+	up, down = s.users.wrap(strm.RemoteAddr().String(), up, down)
+	st := s.track(rec, "udp", strm.RemoteAddr().String(), addr, strm)
+	defer st.Untrack()
+	st.SetUser(s.users.name(strm.RemoteAddr().String()))
+	up, down = st.Writers(up, down)
+	fl := s.flows.Start(s.users.name(strm.RemoteAddr().String()), strm.RemoteAddr(), conn.RemoteAddr(), 17)
+	defer s.flows.End(fl)
+	up, down = fl.Writers(up, down)
+	up, down = s.watchIdle(copyCtx, s.cfg.Transport.Idle.UDPTimeout(), strm, conn, rec, up, down)
 	errChan := make(chan error, 2)
 	go func() {
-		err := buffer.CopyU(conn, strm)
+		err := buffer.CopyU(up, src)
+		rec.Closed(closeReason("client", err))
 		copyCancel()
 		errChan <- err
 	}()
 	go func() {
-		err := buffer.CopyU(strm, conn)
+		err := buffer.CopyU(down, conn)
+		rec.Closed(closeReason("destination", err))
 		copyCancel()
 		errChan <- err
 	}()
 
 	<-copyCtx.Done()
+	if ctx.Err() != nil {
+		rec.Closed("shutdown")
+	}
 	conn.Close()
+	if fw != nil {
+		// The last datagrams from the destination may still be waiting
+		// out transport.udp_delay.
+		fw.Flush()
+	}
 	strm.Close()
 
 	for i := 0; i < 2; i++ {
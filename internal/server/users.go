@@ -0,0 +1,239 @@
+package server
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"io"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/ratelimit"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// authWindow is how far the time in a PAUTH may be from ours.
+	authWindow = 2 * time.Minute
+	// authTimeout is how long a session has to authenticate when the
+	// server has users.
+	authTimeout = 10 * time.Second
+)
+
+// authError rejects a stream or PAUTH of a session without a valid user.
+type authError struct{ reason string }
+
+func (e *authError) Error() string { return e.reason }
+
+// UserStats is the current and total use of one user.
+type UserStats struct {
+	Conns     int
+	BytesUp   uint64 // relayed from the user's clients to destinations
+	BytesDown uint64
+	Revoked   bool
+	// Bytes relayed in the current UTC day and month, both directions,
+	// counted against the quotas.
+	Today, Month uint64
+}
+
+type userState struct {
+	cfg                *conf.User
+	up, down           *ratelimit.Bucket
+	bytesUp, bytesDown atomic.Uint64
+	revoked            atomic.Bool
+	usage              usage
+}
+
+// users attributes sessions to the configured users. Sessions are keyed
+// by remote address, like peers and limits.
+type users struct {
+	byID map[string]*userState
+
+	mu       sync.Mutex
+	sessions map[string]*userSession
+	seen     map[string]time.Time // recently accepted MACs, against replay
+}
+
+type userSession struct {
+	user *userState
+	conn tnet.Conn
+}
+
+func newUsers(cfg []conf.User) *users {
+	u := &users{
+		byID:     make(map[string]*userState),
+		sessions: make(map[string]*userSession),
+		seen:     make(map[string]time.Time),
+	}
+	for i := range cfg {
+		st := &userState{cfg: &cfg[i]}
+		if rate := cfg[i].Rate; rate > 0 {
+			burst := max(kbitToBytes(rate)/10, 65536)
+			st.up = ratelimit.New(kbitToBytes(rate), burst)
+			st.down = ratelimit.New(kbitToBytes(rate), burst)
+		}
+		u.byID[cfg[i].ID] = st
+	}
+	return u
+}
+
+// required reports whether sessions must authenticate.
+func (u *users) required() bool { return len(u.byID) > 0 }
+
+func (u *users) get(addr string) *userState {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if s := u.sessions[addr]; s != nil {
+		return s.user
+	}
+	return nil
+}
+
+// name returns the user the session at addr authenticated as, or "".
+func (u *users) name(addr string) string {
+	if st := u.get(addr); st != nil {
+		return st.cfg.ID
+	}
+	return ""
+}
+
+func (u *users) remove(addr string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.sessions, addr)
+}
+
+// authenticate checks a PAUTH for the session conn and attributes it.
+func (u *users) authenticate(conn tnet.Conn, p *protocol.Proto) (*userState, error) {
+	st := u.byID[p.User]
+	if st == nil || st.cfg.Disabled || st.revoked.Load() {
+		return nil, &authError{fmt.Sprintf("unknown or disabled user %q", p.User)}
+	}
+	if d := time.Since(time.Unix(p.Time, 0)); d > authWindow || d < -authWindow {
+		return nil, &authError{fmt.Sprintf("clock off by %v, more than %v", d.Round(time.Second), authWindow)}
+	}
+	c, ok := conn.(interface{ Conv() uint32 })
+	if !ok {
+		return nil, &authError{"connection cannot be authenticated"}
+	}
+	if !hmac.Equal(p.MAC, protocol.AuthMAC(st.cfg.Key, p.User, c.Conv(), p.Time)) {
+		return nil, &authError{fmt.Sprintf("bad key for user %q", p.User)}
+	}
+
+	addr := conn.RemoteAddr().String()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	for mac, t := range u.seen {
+		if now.Sub(t) > 2*authWindow {
+			delete(u.seen, mac)
+		}
+	}
+	if _, ok := u.seen[string(p.MAC)]; ok {
+		return nil, &authError{"replayed authentication"}
+	}
+	if max := st.cfg.MaxConns; max > 0 {
+		n := 0
+		for a, s := range u.sessions {
+			if s.user == st && a != addr {
+				n++
+			}
+		}
+		if n >= max {
+			return nil, &limitError{fmt.Sprintf("too many connections for user %q (max_conns %d)", p.User, max)}
+		}
+	}
+	u.seen[string(p.MAC)] = now
+	u.sessions[addr] = &userSession{user: st, conn: conn}
+	return st, nil
+}
+
+// wrap counts and paces a relay for the user of the session at addr.
+func (u *users) wrap(addr string, up, down io.Writer) (io.Writer, io.Writer) {
+	st := u.get(addr)
+	if st == nil {
+		return up, down
+	}
+	return &countWriter{ratelimit.Writer(up, st.up), &st.bytesUp, &st.usage}, &countWriter{ratelimit.Writer(down, st.down), &st.bytesDown, &st.usage}
+}
+
+type countWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+	u *usage
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(uint64(n))
+	c.u.add(n)
+	return n, err
+}
+
+// handleAuth attributes the session to the user a PAUTH proves, and
+// lifts the deadline it has to do so.
+func (s *Server) handleAuth(strm tnet.Strm, p *protocol.Proto, sess *session) error {
+	conn := sess.conn
+	reply := protocol.Proto{Type: protocol.PSTATUS, Status: protocol.StatusOK}
+	if sess.over != nil {
+		// Keep the linger deadline; the session is on its way out.
+		reply.Status, reply.Reason = protocol.StatusLimit, sess.over.Error()
+		return reply.Write(strm)
+	}
+	if s.users.required() {
+		st, err := s.users.authenticate(conn, p)
+		if err != nil {
+			flog.Warnf("session from %s failed to authenticate: %v", conn.RemoteAddr(), err)
+			reply.Status, reply.Reason = protocol.StatusAuth, err.Error()
+			if _, ok := err.(*limitError); ok {
+				reply.Status = protocol.StatusLimit
+			}
+			return reply.Write(strm)
+		}
+		conn.SetDeadline(time.Time{})
+		flog.Infof("session from %s authenticated as user %s", conn.RemoteAddr(), st.cfg.ID)
+	}
+	return reply.Write(strm)
+}
+
+// UserStats reports the use of every configured user.
+func (s *Server) UserStats() map[string]UserStats {
+	stats := make(map[string]UserStats)
+	for id, st := range s.users.byID {
+		today, month := st.usage.current()
+		stats[id] = UserStats{BytesUp: st.bytesUp.Load(), BytesDown: st.bytesDown.Load(), Revoked: st.revoked.Load(), Today: today, Month: month}
+	}
+	s.users.mu.Lock()
+	defer s.users.mu.Unlock()
+	for _, us := range s.users.sessions {
+		st := stats[us.user.cfg.ID]
+		st.Conns++
+		stats[us.user.cfg.ID] = st
+	}
+	return stats
+}
+
+// Revoke refuses the user from now on and closes its sessions.
+func (s *Server) Revoke(id string) error {
+	st := s.users.byID[id]
+	if st == nil {
+		return fmt.Errorf("unknown user %q", id)
+	}
+	st.revoked.Store(true)
+	s.users.mu.Lock()
+	var conns []tnet.Conn
+	for addr, us := range s.users.sessions {
+		if us.user == st {
+			conns = append(conns, us.conn)
+			delete(s.users.sessions, addr)
+		}
+	}
+	s.users.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	flog.Infof("user %s revoked, %d sessions closed", id, len(conns))
+	return nil
+}
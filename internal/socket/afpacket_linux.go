@@ -0,0 +1,258 @@
+package socket
+
+import (
+	"fmt"
+	"os"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/fwmark"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/gopacket/gopacket"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	afBlockSize = 256 * 1024
+	afFrameSize = 2048
+	afRetireTov = 1 // ms before a partly filled block is handed to userspace
+	afPollMs    = 100
+)
+
+// afPacketHandle is a native Linux capture/injection handle: receive uses
+// an mmap'd TPACKET_V3 ring joined to a hash fanout group, send writes
+// straight to the socket. Packets returned by ReadPacketData point into
+// the ring and are only valid until the next call.
+type afPacketHandle struct {
+	fd     int
+	ring   []byte
+	blocks int
+	cur    int // block being consumed
+	pkt    int // packets left in cur
+	off    uint32
+	held   bool // cur belongs to userspace
+	mu     sync.Mutex
+	closed atomic.Bool
+}
+
+func htons(v uint16) uint16 { return v<<8 | v>>8 }
+
+func newAFPacketHandle(cfg *conf.Network, dir direction) (rawHandle, error) {
+	proto := htons(unix.ETH_P_ALL)
+	if dir == dirOut {
+		proto = 0 // send only: bind without receiving anything
+	}
+	packetOpen.Lock()
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		packetOpen.Unlock()
+		return nil, fmt.Errorf("failed to open AF_PACKET socket: %v", err)
+	}
+	h := &afPacketHandle{fd: fd}
+
+	// Sent frames skip routing but keep the mark for tc and nftables
+	// egress rules. The xdp backend sends through this handle too.
+	if cfg.Fwmark != 0 && dir == dirOut {
+		if err := fwmark.Set(fd, cfg.Fwmark); err != nil {
+			packetOpen.Unlock()
+			h.Close()
+			return nil, fmt.Errorf("failed to set fwmark on AF_PACKET socket: %v", err)
+		}
+	}
+	packetOpen.Unlock()
+
+	if dir == dirIn {
+		if err := h.setupRx(cfg); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+
+	sa := &unix.SockaddrLinklayer{Protocol: proto, Ifindex: cfg.Interface.Index}
+	if err := unix.Bind(fd, sa); err != nil {
+		h.Close()
+		return nil, fmt.Errorf("failed to bind AF_PACKET socket to %s: %v", cfg.Interface.Name, err)
+	}
+
+	if dir == dirIn {
+		// Fanout has to be joined after bind. Sockets on the same port
+		// share the group, so load is spread by flow hash. The group
+		// ignores the socket's PACKET_IGNORE_OUTGOING and needs its own
+		// flag, which older kernels reject.
+		group := cfg.Port & 0xffff
+		mode := unix.PACKET_FANOUT_HASH | unix.PACKET_FANOUT_FLAG_DEFRAG
+		err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, group|(mode|unix.PACKET_FANOUT_FLAG_IGNORE_OUTGOING)<<16)
+		if err == unix.EINVAL {
+			err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, group|mode<<16)
+		}
+		if err != nil {
+			h.Close()
+			return nil, fmt.Errorf("failed to join AF_PACKET fanout group %d: %v", group, err)
+		}
+	}
+	return h, nil
+}
+
+func (h *afPacketHandle) setupRx(cfg *conf.Network) error {
+	// Kernels before 4.20 lack this option; outgoing frames then fail
+	// the dst port filter anyway, except for traffic to ourselves.
+	_ = unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_IGNORE_OUTGOING, 1)
+
+	prog, err := bpf.Assemble(dstPortFilter(cfg))
+	if err != nil {
+		return fmt.Errorf("failed to assemble BPF filter: %v", err)
+	}
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: (*unix.SockFilter)(unsafe.Pointer(&prog[0]))}
+	if err := unix.SetsockoptSockFprog(h.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog); err != nil {
+		return fmt.Errorf("failed to attach BPF filter: %v", err)
+	}
+
+	if err := unix.SetsockoptInt(h.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return fmt.Errorf("failed to select TPACKET_V3: %v", err)
+	}
+	h.blocks = max(cfg.PCAP.Sockbuf/afBlockSize, 2)
+	req := unix.TpacketReq3{
+		Block_size:     afBlockSize,
+		Block_nr:       uint32(h.blocks),
+		Frame_size:     afFrameSize,
+		Frame_nr:       uint32(afBlockSize / afFrameSize * h.blocks),
+		Retire_blk_tov: afRetireTov,
+	}
+	if err := unix.SetsockoptTpacketReq3(h.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return fmt.Errorf("failed to set up %d byte RX ring: %v", afBlockSize*h.blocks, err)
+	}
+	h.ring, err = unix.Mmap(h.fd, 0, afBlockSize*h.blocks, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_LOCKED)
+	if err != nil {
+		return fmt.Errorf("failed to map RX ring: %v", err)
+	}
+	return nil
+}
+
+func (h *afPacketHandle) block(i int) *unix.TpacketHdrV1 {
+	desc := (*unix.TpacketBlockDesc)(unsafe.Pointer(&h.ring[i*afBlockSize]))
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&desc.Hdr[0]))
+}
+
+func (h *afPacketHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for {
+		if h.closed.Load() {
+			return nil, gopacket.CaptureInfo{}, os.ErrClosed
+		}
+		if h.pkt > 0 {
+			base := h.cur*afBlockSize + int(h.off)
+			hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&h.ring[base]))
+			h.off += hdr.Next_offset
+			h.pkt--
+			start := base + int(hdr.Mac)
+			data := h.ring[start : start+int(hdr.Snaplen)]
+			ci := gopacket.CaptureInfo{
+				Timestamp:     time.Unix(int64(hdr.Sec), int64(hdr.Nsec)),
+				CaptureLength: int(hdr.Snaplen),
+				Length:        int(hdr.Len),
+			}
+			return data, ci, nil
+		}
+
+		if h.held {
+			// The previous packet has been consumed by the caller.
+			h.giveBack()
+		}
+
+		b := h.block(h.cur)
+		if atomic.LoadUint32(&b.Block_status)&unix.TP_STATUS_USER == 0 {
+			fds := []unix.PollFd{{Fd: int32(h.fd), Events: unix.POLLIN | unix.POLLERR}}
+			if _, err := unix.Poll(fds, afPollMs); err != nil && err != unix.EINTR {
+				return nil, gopacket.CaptureInfo{}, fmt.Errorf("poll failed: %v", err)
+			}
+			// The interface went down or away; poll would not block again.
+			if fds[0].Revents&unix.POLLERR != 0 {
+				if e, _ := unix.GetsockoptInt(h.fd, unix.SOL_SOCKET, unix.SO_ERROR); e != 0 {
+					return nil, gopacket.CaptureInfo{}, fmt.Errorf("capture failed: %v", unix.Errno(e))
+				}
+			}
+			continue
+		}
+		h.held = true
+		h.pkt = int(b.Num_pkts)
+		h.off = b.Offset_to_first_pkt
+	}
+}
+
+// Release hands the block of the last packet back to the kernel once
+// every packet in it has been read, rather than at the next read.
+func (h *afPacketHandle) Release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.held && h.pkt == 0 && !h.closed.Load() {
+		h.giveBack()
+	}
+}
+
+// giveBack returns the current block to the kernel. The caller holds mu.
+func (h *afPacketHandle) giveBack() {
+	atomic.StoreUint32(&h.block(h.cur).Block_status, unix.TP_STATUS_KERNEL)
+	h.held = false
+	h.cur = (h.cur + 1) % h.blocks
+}
+
+func (h *afPacketHandle) WritePacketData(data []byte) error {
+	if h.closed.Load() {
+		return os.ErrClosed
+	}
+	_, err := unix.Write(h.fd, data)
+	return err
+}
+
+// mmsghdr is struct mmsghdr, which x/sys/unix does not define.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// WritePacketBatch sends pkts with as few sendmmsg calls as the kernel
+// allows.
+func (h *afPacketHandle) WritePacketBatch(pkts [][]byte) error {
+	if h.closed.Load() {
+		return os.ErrClosed
+	}
+	iov := make([]unix.Iovec, len(pkts))
+	msgs := make([]mmsghdr, len(pkts))
+	for i := 0; i < len(pkts); i++ {
+		iov[i].Base = &pkts[i][0]
+		iov[i].SetLen(len(pkts[i]))
+		msgs[i].hdr.Iov = &iov[i]
+		msgs[i].hdr.SetIovlen(1)
+	}
+	for sent := 0; sent < len(msgs); {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(h.fd), uintptr(unsafe.Pointer(&msgs[sent])), uintptr(len(msgs)-sent), 0, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		sent += int(n)
+	}
+	return nil
+}
+
+// Close waits for a pending read, which wakes up within one poll
+// interval, before unmapping the ring.
+func (h *afPacketHandle) Close() {
+	if h.closed.Swap(true) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ring != nil {
+		unix.Munmap(h.ring)
+		h.ring = nil
+	}
+	unix.Close(h.fd)
+}
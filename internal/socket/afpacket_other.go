@@ -0,0 +1,16 @@
+//go:build !linux
+
+package socket
+
+import (
+	"fmt"
+	"paqet/internal/conf"
+)
+
+func newAFPacketHandle(cfg *conf.Network, dir direction) (rawHandle, error) {
+	return nil, fmt.Errorf("afpacket backend is only available on linux")
+}
+
+func newXDPHandle(cfg *conf.Network, dir direction) (rawHandle, error) {
+	return nil, fmt.Errorf("xdp backend is only available on linux")
+}
@@ -0,0 +1,86 @@
+package socket
+
+import (
+	"sync"
+	"time"
+)
+
+// batchWriter is implemented by handles that can send several frames
+// with one system call.
+type batchWriter interface {
+	WritePacketBatch(pkts [][]byte) error
+}
+
+// batcher coalesces frames written within delay of each other and hands
+// them to the handle together, at most size at a time. Send errors are
+// reported by the next write.
+type batcher struct {
+	handle  rawHandle
+	size    int
+	delay   time.Duration
+	pending [][]byte
+	free    [][]byte
+	timer   *time.Timer
+	armed   bool
+	err     error
+	mu      sync.Mutex
+}
+
+func newBatcher(handle rawHandle, size int, delay time.Duration) *batcher {
+	b := &batcher{handle: handle, size: size, delay: delay}
+	b.timer = time.AfterFunc(time.Hour, b.flush)
+	b.timer.Stop()
+	return b
+}
+
+func (b *batcher) write(frame []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var buf []byte
+	if n := len(b.free); n > 0 {
+		buf, b.free = b.free[n-1], b.free[:n-1]
+	}
+	b.pending = append(b.pending, append(buf[:0], frame...))
+
+	if len(b.pending) >= b.size {
+		b.flushLocked()
+	} else if !b.armed {
+		b.armed = true
+		b.timer.Reset(b.delay)
+	}
+	err := b.err
+	b.err = nil
+	return err
+}
+
+func (b *batcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *batcher) flushLocked() {
+	if b.armed {
+		b.timer.Stop()
+		b.armed = false
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+	if bw, ok := b.handle.(batchWriter); ok {
+		if err := bw.WritePacketBatch(b.pending); err != nil {
+			sendErrs[classifySend(err)].Add(1)
+			b.err = err
+		}
+	} else {
+		for _, p := range b.pending {
+			if err := writeRetry(b.handle, p); err != nil {
+				b.err = err
+			}
+		}
+	}
+	b.free = append(b.free, b.pending...)
+	clear(b.pending)
+	b.pending = b.pending[:0]
+}
@@ -0,0 +1,416 @@
+package socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/hash"
+	"sync"
+	"time"
+)
+
+// cover frames tunnel payloads as the UDP protocol of network.mimic, so
+// a flow shows the message types, sizes and handshake cadence of a
+// WireGuard tunnel or a DTLS 1.2 session to whatever reads its headers.
+// None of the cover protocol's cryptography is real: keys, MACs and
+// tags are random bytes, and the payload inside is what the transport's
+// own encryption made of it.
+type cover struct {
+	kind string
+
+	mu    sync.Mutex
+	peers map[uint64]*coverPeer
+	swept time.Time
+}
+
+// coverPeer is the session with one peer.
+type coverPeer struct {
+	initiator bool      // we sent first, so we run the handshakes
+	local     uint32    // WireGuard: our session index
+	remote    uint32    // WireGuard: the peer's, once it answered
+	seq       uint64    // WireGuard data counter, DTLS epoch 1 record number
+	started   time.Time // when the last handshake completed
+	tried     time.Time // when we last started one
+	seen      time.Time
+	held      [][]byte // payloads waiting for the first handshake
+}
+
+const (
+	// WireGuard starts a new handshake every two minutes while a session
+	// carries data and retries an unanswered one after five seconds.
+	wgRekey = 2 * time.Minute
+	wgRetry = 5 * time.Second
+	// DTLS retransmits an unanswered flight after a second.
+	dtlsRetry = time.Second
+	// coverIdle is how long a quiet peer's session is kept.
+	coverIdle = 10 * time.Minute
+	// coverHold is how many payloads wait for the first handshake of a
+	// session; KCP resends any beyond it.
+	coverHold = 16
+
+	wgInitiation = 1
+	wgResponse   = 2
+	wgData       = 4
+
+	dtlsChangeCipherSpec = 20
+	dtlsHandshake        = 22
+	dtlsApplicationData  = 23
+
+	// TLS_PSK_WITH_AES_128_GCM_SHA256, as CoAP and other DTLS users
+	// without certificates negotiate it.
+	dtlsSuite = 0x00a8
+)
+
+var zeros [16]byte
+
+func newCover(cfg *conf.Network) *cover {
+	if !cfg.UDP() {
+		return nil
+	}
+	return &cover{
+		kind:  cfg.Mimic,
+		peers: make(map[uint64]*coverPeer),
+	}
+}
+
+// peer returns the session with addr, starting one if there is none.
+// The caller holds mu.
+func (c *cover) peer(addr *net.UDPAddr, initiator bool, now time.Time) *coverPeer {
+	key := hash.IPAddr(addr.IP, uint16(addr.Port))
+	p := c.peers[key]
+	if p == nil {
+		p = &coverPeer{initiator: initiator, local: rand.Uint32(), seq: 1}
+		c.peers[key] = p
+	}
+	p.seen = now
+	if now.Sub(c.swept) > coverIdle {
+		c.swept = now
+		for k, q := range c.peers {
+			if now.Sub(q.seen) > coverIdle {
+				delete(c.peers, k)
+			}
+		}
+	}
+	return p
+}
+
+// write sends payload to addr framed as the cover protocol, preceded by
+// a handshake when one is due. Until the peer has answered the first
+// handshake, a data message could not be real, as WireGuard would have
+// no receiver index for it and DTLS no epoch 1, so payloads are held
+// instead and sent once read sees the answer.
+func (c *cover) write(send sender, payload []byte, addr *net.UDPAddr) error {
+	hs, data := buffer.Get(snapLen), buffer.Get(snapLen)
+	defer buffer.Put(hs)
+	defer buffer.Put(data)
+
+	now := time.Now()
+	c.mu.Lock()
+	p := c.peer(addr, true, now)
+	*hs, *data = (*hs)[:0], (*data)[:0]
+	if c.kind == "wireguard" {
+		if p.initiator && (p.started.IsZero() || now.Sub(p.started) > wgRekey) && now.Sub(p.tried) > wgRetry {
+			p.tried = now
+			*hs = wgInitiationMsg(*hs, p)
+		}
+	} else if p.initiator && p.started.IsZero() && now.Sub(p.tried) > dtlsRetry {
+		p.tried = now
+		*hs = dtlsClientHello(*hs)
+	}
+	switch {
+	case p.initiator && p.started.IsZero():
+		if payload != nil && len(p.held) < coverHold {
+			p.held = append(p.held, append([]byte(nil), payload...))
+		}
+	case c.kind == "wireguard":
+		*data = wgDataMsg(*data, p, payload)
+	default:
+		*data = dtlsAppData(*data, p, payload)
+	}
+	c.mu.Unlock()
+
+	if len(*hs) > 0 {
+		if err := send.Write(*hs, addr); err != nil {
+			return err
+		}
+	}
+	if len(*data) == 0 {
+		return nil
+	}
+	return send.Write(*data, addr)
+}
+
+// keepalive sends addr what the cover protocol sends an idle peer: an
+// empty WireGuard data message, or an empty DTLS record.
+func (c *cover) keepalive(send sender, addr *net.UDPAddr) error {
+	return c.write(send, nil, addr)
+}
+
+// read returns the tunnel payload of b from addr, or nil for handshakes,
+// keepalives and anything else, answering handshakes through send.
+func (c *cover) read(send sender, b []byte, addr net.Addr) []byte {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	reply := buffer.Get(snapLen)
+	defer buffer.Put(reply)
+	*reply = (*reply)[:0]
+
+	now := time.Now()
+	c.mu.Lock()
+	p := c.peer(ua, false, now)
+	var payload []byte
+	if c.kind == "wireguard" {
+		payload, *reply = c.wgRead(*reply, p, b, now)
+	} else {
+		payload, *reply = c.dtlsRead(*reply, p, b, now)
+	}
+	var held [][]byte
+	if !p.started.IsZero() {
+		held, p.held = p.held, nil
+	}
+	c.mu.Unlock()
+
+	if len(*reply) > 0 {
+		if err := send.Write(*reply, ua); err != nil {
+			flog.Debugf("failed to answer %s handshake from %s: %v", c.kind, ua, err)
+		}
+	}
+	for _, h := range held {
+		if err := c.write(send, h, ua); err != nil {
+			flog.Debugf("failed to send held payload to %s: %v", ua, err)
+			break
+		}
+	}
+	return payload
+}
+
+func appendRandom(b []byte, n int) []byte {
+	for ; n >= 8; n -= 8 {
+		b = binary.LittleEndian.AppendUint64(b, rand.Uint64())
+	}
+	for ; n > 0; n-- {
+		b = append(b, byte(rand.Uint32()))
+	}
+	return b
+}
+
+// wgInitiationMsg is a handshake initiation: index, ephemeral key,
+// encrypted static key and timestamp, mac1, and a mac2 only set under
+// load. 148 bytes.
+func wgInitiationMsg(b []byte, p *coverPeer) []byte {
+	p.local = rand.Uint32()
+	b = append(b, wgInitiation, 0, 0, 0)
+	b = binary.LittleEndian.AppendUint32(b, p.local)
+	b = appendRandom(b, 32+48+28+16)
+	return append(b, zeros[:16]...)
+}
+
+// wgResponseMsg answers an initiation: both indexes, ephemeral key,
+// encrypted nothing, mac1 and mac2. 92 bytes.
+func wgResponseMsg(b []byte, p *coverPeer) []byte {
+	b = append(b, wgResponse, 0, 0, 0)
+	b = binary.LittleEndian.AppendUint32(b, p.local)
+	b = binary.LittleEndian.AppendUint32(b, p.remote)
+	b = appendRandom(b, 32+16+16)
+	return append(b, zeros[:16]...)
+}
+
+// wgDataMsg carries payload as a transport data message: the receiver's
+// index, a counter, then the payload padded to 16 bytes and a 16 byte
+// tag. The last tag byte holds the padding in its low bits.
+func wgDataMsg(b []byte, p *coverPeer, payload []byte) []byte {
+	pad := -len(payload) & 15
+	b = append(b, wgData, 0, 0, 0)
+	b = binary.LittleEndian.AppendUint32(b, p.remote)
+	b = binary.LittleEndian.AppendUint64(b, p.seq)
+	p.seq++
+	b = append(b, payload...)
+	b = append(b, zeros[:pad]...)
+	b = appendRandom(b, 16)
+	b[len(b)-1] = b[len(b)-1]&0xf0 | byte(pad)
+	return b
+}
+
+func (c *cover) wgRead(reply []byte, p *coverPeer, b []byte, now time.Time) ([]byte, []byte) {
+	if len(b) < 32 || b[1]|b[2]|b[3] != 0 {
+		return nil, reply
+	}
+	switch {
+	case b[0] == wgInitiation && len(b) == 148:
+		p.initiator = false
+		p.remote = binary.LittleEndian.Uint32(b[4:8])
+		p.local = rand.Uint32()
+		p.seq, p.started = 0, now
+		return nil, wgResponseMsg(reply, p)
+	case b[0] == wgResponse && len(b) == 92:
+		if p.initiator && binary.LittleEndian.Uint32(b[8:12]) == p.local {
+			p.remote = binary.LittleEndian.Uint32(b[4:8])
+			p.seq, p.started = 0, now
+		}
+	case b[0] == wgData && (len(b)-16)%16 == 0:
+		n := len(b) - 32 - int(b[len(b)-1]&0x0f)
+		if n > 0 {
+			return b[16 : 16+n], reply
+		}
+	}
+	return nil, reply
+}
+
+// dtlsRecord starts a record; dtlsEnd fills in its length.
+func dtlsRecord(b []byte, typ byte, epoch uint16, seq uint64) []byte {
+	b = append(b, typ, 0xfe, 0xfd)
+	b = binary.BigEndian.AppendUint16(b, epoch)
+	b = append(b, byte(seq>>40), byte(seq>>32), byte(seq>>24), byte(seq>>16), byte(seq>>8), byte(seq))
+	return append(b, 0, 0)
+}
+
+func dtlsEnd(b []byte, start int) []byte {
+	binary.BigEndian.PutUint16(b[start+11:], uint16(len(b)-start-13))
+	return b
+}
+
+// dtlsMessage appends a handshake message, unfragmented, in a record of
+// its own.
+func dtlsMessage(b []byte, typ byte, recSeq uint64, msgSeq uint16, body []byte) []byte {
+	start := len(b)
+	b = dtlsRecord(b, dtlsHandshake, 0, recSeq)
+	n := len(body)
+	b = append(b, typ, byte(n>>16), byte(n>>8), byte(n))
+	b = binary.BigEndian.AppendUint16(b, msgSeq)
+	b = append(b, 0, 0, 0, byte(n>>16), byte(n>>8), byte(n))
+	b = append(b, body...)
+	return dtlsEnd(b, start)
+}
+
+// dtlsHelloExtensions are extended_master_secret and an empty
+// renegotiation_info.
+var dtlsHelloExtensions = []byte{0x00, 0x09, 0x00, 0x17, 0x00, 0x00, 0xff, 0x01, 0x00, 0x01, 0x00}
+
+// dtlsClientHello is the first flight of a PSK handshake, skipping the
+// optional cookie exchange.
+func dtlsClientHello(b []byte) []byte {
+	body := []byte{0xfe, 0xfd}
+	body = appendRandom(body, 32)
+	body = append(body, 0, 0)       // session id, cookie
+	body = append(body, 0x00, 0x06) // cipher suites
+	body = append(body, 0xc0, 0xa8, 0x00, 0xa8, 0x00, 0xa9)
+	body = append(body, 0x01, 0x00) // null compression
+	body = append(body, dtlsHelloExtensions...)
+	return dtlsMessage(b, 1, 0, 0, body)
+}
+
+// dtlsServerFlight answers a ClientHello: ServerHello and
+// ServerHelloDone.
+func dtlsServerFlight(b []byte) []byte {
+	body := []byte{0xfe, 0xfd}
+	body = appendRandom(body, 32)
+	body = append(body, 32)
+	body = appendRandom(body, 32)
+	body = binary.BigEndian.AppendUint16(body, dtlsSuite)
+	body = append(body, 0x00)
+	body = append(body, dtlsHelloExtensions...)
+	b = dtlsMessage(b, 2, 0, 0, body)
+	return dtlsMessage(b, 14, 1, 1, nil)
+}
+
+// dtlsFinish is the last flight of either side: the client's starts
+// with its PSK identity, then both change cipher spec and send an
+// encrypted Finished as the first record of epoch 1.
+func dtlsFinish(b []byte, client bool) []byte {
+	seq := uint64(2)
+	if client {
+		identity := fmt.Appendf(nil, "%016x", rand.Uint64())
+		body := binary.BigEndian.AppendUint16(nil, uint16(len(identity)))
+		b = dtlsMessage(b, 16, 1, 1, append(body, identity...))
+	}
+	start := len(b)
+	b = dtlsRecord(b, dtlsChangeCipherSpec, 0, seq)
+	b = dtlsEnd(append(b, 1), start)
+	start = len(b)
+	b = dtlsRecord(b, dtlsHandshake, 1, 0)
+	b = appendRandom(b, 8+12+12+16) // nonce, Finished, tag
+	return dtlsEnd(b, start)
+}
+
+// dtlsAppData carries payload in an application data record of epoch 1:
+// the explicit nonce, the payload and a 16 byte tag.
+func dtlsAppData(b []byte, p *coverPeer, payload []byte) []byte {
+	start := len(b)
+	b = dtlsRecord(b, dtlsApplicationData, 1, p.seq)
+	b = binary.BigEndian.AppendUint64(b, p.seq)
+	p.seq++
+	b = append(b, payload...)
+	b = appendRandom(b, 16)
+	return dtlsEnd(b, start)
+}
+
+func (c *cover) dtlsRead(reply []byte, p *coverPeer, b []byte, now time.Time) ([]byte, []byte) {
+	for len(b) >= 13 {
+		if b[1] != 0xfe || b[2] != 0xfd {
+			return nil, reply
+		}
+		typ, epoch := b[0], binary.BigEndian.Uint16(b[3:5])
+		n := int(binary.BigEndian.Uint16(b[11:13]))
+		if len(b) < 13+n {
+			return nil, reply
+		}
+		body := b[13 : 13+n]
+		b = b[13+n:]
+		switch {
+		case typ == dtlsApplicationData && epoch == 1:
+			if n > 24 {
+				return body[8 : n-16], reply
+			}
+			return nil, reply
+		case typ == dtlsHandshake && epoch == 0 && n >= 12 && body[0] == 1:
+			// A ClientHello, perhaps again after a lost answer.
+			p.initiator = false
+			reply = dtlsServerFlight(reply)
+		case typ == dtlsHandshake && epoch == 0 && n >= 12 && body[0] == 2:
+			if p.initiator && p.started.IsZero() {
+				p.started = now
+				reply = dtlsFinish(reply, true)
+			}
+		case typ == dtlsChangeCipherSpec && !p.initiator:
+			p.started = now
+			reply = dtlsFinish(reply, false)
+		}
+	}
+	return nil, reply
+}
+
+// maxHeld caps the ports holdPorts binds for a large network.ports.
+const maxHeld = 1024
+
+// holdPorts binds plain UDP sockets to the ports paqet receives on, so
+// the kernel, which sees the cover traffic too, does not answer it with
+// ICMP port unreachable. Nothing reads them; their buffers fill and the
+// kernel drops the rest quietly.
+func holdPorts(cfg *conf.Network) []*net.UDPConn {
+	if !cfg.UDP() {
+		return nil
+	}
+	ports := []int{cfg.Port}
+	for _, r := range cfg.Ports {
+		for p := r.Lo; p <= r.Hi && len(ports) < maxHeld; p++ {
+			ports = append(ports, p)
+		}
+	}
+	var held []*net.UDPConn
+	for _, p := range ports {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: p})
+		if err != nil {
+			flog.Warnf("failed to hold UDP port %d, the kernel may answer peers with ICMP port unreachable: %v", p, err)
+			continue
+		}
+		conn.SetReadBuffer(1)
+		held = append(held, conn)
+	}
+	return held
+}
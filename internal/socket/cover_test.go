@@ -0,0 +1,145 @@
+package socket
+
+import (
+	"bytes"
+	"net"
+	"paqet/internal/conf"
+	"testing"
+)
+
+// sent is a sender that keeps what is written to it.
+type sent struct {
+	packets [][]byte
+}
+
+func (s *sent) Write(payload []byte, _ *net.UDPAddr) error {
+	s.packets = append(s.packets, append([]byte(nil), payload...))
+	return nil
+}
+
+func (s *sent) ack(*net.UDPAddr) error              { return nil }
+func (s *sent) setDSCP(int)                         {}
+func (s *sent) setClientTCPF(net.Addr, []conf.TCPF) {}
+func (s *sent) setTCPF([]conf.TCPF)                 {}
+func (s *sent) inherit(sender)                      {}
+func (s *sent) Close()                              {}
+
+// take returns the packets written so far and forgets them.
+func (s *sent) take() [][]byte {
+	p := s.packets
+	s.packets = nil
+	return p
+}
+
+var (
+	coverClient = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	coverServer = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+)
+
+// deliver reads each packet on c as from addr and returns the payloads
+// that came out.
+func deliver(c *cover, send sender, packets [][]byte, addr net.Addr) [][]byte {
+	var out [][]byte
+	for _, p := range packets {
+		if payload := c.read(send, p, addr); payload != nil {
+			out = append(out, append([]byte(nil), payload...))
+		}
+	}
+	return out
+}
+
+// TestCoverHandshake runs the first handshake of each mimic between two
+// covers: the client holds its payloads until the server answers, then
+// sends them framed, and the server reads them back unchanged.
+func TestCoverHandshake(t *testing.T) {
+	for _, kind := range []string{"wireguard", "dtls"} {
+		t.Run(kind, func(t *testing.T) {
+			client := newCover(&conf.Network{Mimic: kind})
+			server := newCover(&conf.Network{Mimic: kind})
+			var cs, ss sent
+
+			want := [][]byte{[]byte("first"), bytes.Repeat([]byte{7}, 1200)}
+			for _, p := range want {
+				if err := client.write(&cs, p, coverServer); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hello := cs.take()
+			if len(hello) != 1 {
+				t.Fatalf("client sent %d packets before the handshake, want the hello only", len(hello))
+			}
+			if got := deliver(server, &ss, hello, coverClient); got != nil {
+				t.Fatalf("server read payload %q from the hello", got)
+			}
+			answer := ss.take()
+			if len(answer) != 1 {
+				t.Fatalf("server sent %d answers to the hello, want 1", len(answer))
+			}
+
+			// The client sends its finishing flight, if the protocol has
+			// one, and then the held payloads.
+			if got := deliver(client, &cs, answer, coverServer); got != nil {
+				t.Fatalf("client read payload %q from the answer", got)
+			}
+			got := deliver(server, &ss, cs.take(), coverClient)
+			if len(got) != len(want) {
+				t.Fatalf("server read %d payloads, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if !bytes.Equal(got[i], want[i]) {
+					t.Fatalf("payload %d is %x, want %x", i, got[i], want[i])
+				}
+			}
+
+			// Once both sides have a session, each way carries data at once.
+			if err := server.write(&ss, []byte("reply"), coverClient); err != nil {
+				t.Fatal(err)
+			}
+			if got := deliver(client, &cs, ss.take(), coverServer); len(got) != 1 || string(got[0]) != "reply" {
+				t.Fatalf("client read %q, want the reply", got)
+			}
+		})
+	}
+}
+
+// TestCoverFraming frames payloads of every length around the padding
+// and tag boundaries and reads them back.
+func TestCoverFraming(t *testing.T) {
+	for _, kind := range []string{"wireguard", "dtls"} {
+		t.Run(kind, func(t *testing.T) {
+			c := newCover(&conf.Network{Mimic: kind})
+			p := &coverPeer{remote: 1, seq: 1}
+			for n := 1; n <= 64; n++ {
+				payload := bytes.Repeat([]byte{byte(n)}, n)
+				var b, got []byte
+				if kind == "wireguard" {
+					b = wgDataMsg(nil, p, payload)
+					if len(b)%16 != 0 {
+						t.Fatalf("%d byte payload framed in %d bytes, not padded to 16", n, len(b))
+					}
+					got, _ = c.wgRead(nil, &coverPeer{}, b, p.started)
+				} else {
+					b = dtlsAppData(nil, p, payload)
+					got, _ = c.dtlsRead(nil, &coverPeer{}, b, p.started)
+				}
+				if !bytes.Equal(got, payload) {
+					t.Fatalf("%d byte payload read back as %x", n, got)
+				}
+			}
+
+			// An empty message is a keepalive and carries nothing.
+			var b []byte
+			if kind == "wireguard" {
+				b = wgDataMsg(nil, p, nil)
+				if got, _ := c.wgRead(nil, &coverPeer{}, b, p.started); got != nil {
+					t.Fatalf("keepalive read as %x", got)
+				}
+			} else {
+				b = dtlsAppData(nil, p, nil)
+				if got, _ := c.dtlsRead(nil, &coverPeer{}, b, p.started); got != nil {
+					t.Fatalf("keepalive read as %x", got)
+				}
+			}
+		})
+	}
+}
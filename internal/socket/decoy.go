@@ -0,0 +1,112 @@
+package socket
+
+import (
+	"net"
+	"paqet/internal/pkg/hash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stateful middleboxes forget a flow that stays quiet too long and drop
+// the burst that follows it. With decoy_ack set, each peer we sent to
+// in the last decoyTTL gets a pure ACK whenever it has heard nothing
+// from us for the interval, as an idle TCP connection's keepalive would.
+// Under network.mimic it gets the cover protocol's keepalive instead.
+const decoyTTL = 10 * time.Minute
+
+// Pure ACKs sent to keep flows alive.
+var decoyAcks atomic.Uint64
+
+type decoys struct {
+	every time.Duration
+	mu    sync.RWMutex
+	peers map[uint64]*decoyPeer
+}
+
+type decoyPeer struct {
+	addr net.UDPAddr
+	sent atomic.Int64 // unix nanoseconds of the last packet, decoys included
+	data atomic.Int64 // unix nanoseconds of the last packet with payload
+}
+
+func newDecoys(every time.Duration) *decoys {
+	if every <= 0 {
+		return nil
+	}
+	return &decoys{every: every, peers: make(map[uint64]*decoyPeer)}
+}
+
+// seen notes a packet sent to addr. It is nil-safe.
+func (d *decoys) seen(addr *net.UDPAddr) {
+	if d == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	key := hash.IPAddr(addr.IP, uint16(addr.Port))
+	d.mu.RLock()
+	p := d.peers[key]
+	d.mu.RUnlock()
+	if p == nil {
+		d.mu.Lock()
+		if p = d.peers[key]; p == nil {
+			p = &decoyPeer{addr: net.UDPAddr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port}}
+			d.peers[key] = p
+		}
+		d.mu.Unlock()
+	}
+	p.sent.Store(now)
+	p.data.Store(now)
+}
+
+// due returns the peers quiet for the interval, and forgets those that
+// have had no payload for decoyTTL.
+func (d *decoys) due(now time.Time) []*decoyPeer {
+	quiet := now.Add(-d.every).UnixNano()
+	gone := now.Add(-decoyTTL).UnixNano()
+	var due []*decoyPeer
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k, p := range d.peers {
+		if p.data.Load() < gone {
+			delete(d.peers, k)
+			continue
+		}
+		if p.sent.Load() < quiet {
+			due = append(due, p)
+		}
+	}
+	return due
+}
+
+// keepalive sends the due decoy ACKs until c is closed.
+func (c *PacketConn) keepalive() {
+	t := time.NewTicker(c.decoys.every / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case now := <-t.C:
+			for _, p := range c.decoys.due(now) {
+				send := c.io.Load().send
+				var err error
+				if c.cover != nil {
+					err = c.cover.keepalive(send, &p.addr)
+				} else {
+					err = send.ack(&p.addr)
+				}
+				if err != nil {
+					continue
+				}
+				p.sent.Store(now.UnixNano())
+				decoyAcks.Add(1)
+			}
+		}
+	}
+}
+
+// DecoyAcks returns how many pure ACKs were sent to keep flows alive.
+func DecoyAcks() uint64 {
+	return decoyAcks.Load()
+}
@@ -0,0 +1,209 @@
+package socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"paqet/internal/conf"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// bpfAsm builds a classic BPF program with jumps to named labels; an
+// empty label is the next instruction.
+type bpfAsm struct {
+	insns  []bpf.Instruction
+	labels map[string]int
+	fixups map[int][2]string
+}
+
+func (a *bpfAsm) emit(i bpf.Instruction) { a.insns = append(a.insns, i) }
+
+func (a *bpfAsm) label(name string) { a.labels[name] = len(a.insns) }
+
+func (a *bpfAsm) jump(cond bpf.JumpTest, val uint32, t, f string) {
+	a.fixups[len(a.insns)] = [2]string{t, f}
+	a.emit(bpf.JumpIf{Cond: cond, Val: val})
+}
+
+func (a *bpfAsm) goTo(to string) {
+	a.fixups[len(a.insns)] = [2]string{to}
+	a.emit(bpf.Jump{})
+}
+
+func (a *bpfAsm) resolve() []bpf.Instruction {
+	skip := func(pc int, to string) int {
+		if to == "" {
+			return 0
+		}
+		return a.labels[to] - pc - 1
+	}
+	for pc, to := range a.fixups {
+		switch i := a.insns[pc].(type) {
+		case bpf.JumpIf:
+			t, f := skip(pc, to[0]), skip(pc, to[1])
+			if t > 255 || f > 255 {
+				panic("bpf jump out of range") // the number of sources and ports is capped
+			}
+			i.SkipTrue, i.SkipFalse = uint8(t), uint8(f)
+			a.insns[pc] = i
+		case bpf.Jump:
+			a.insns[pc] = bpf.Jump{Skip: uint32(skip(pc, to[0]))}
+		}
+	}
+	return a.insns
+}
+
+// dstPortFilter is the classic BPF equivalent of "tcp and dst port
+// <port>", or udp with a mimicked protocol, for untagged IPv4/IPv6
+// Ethernet frames, with a server's extra ports matched as well, and only
+// from the allowed sources when there are any. VLAN, QinQ and PPPoE
+// session frames are passed whole, since their headers move the offsets;
+// RecvHandle checks the port and source for those.
+func dstPortFilter(cfg *conf.Network) []bpf.Instruction {
+	a := &bpfAsm{labels: map[string]int{}, fixups: map[int][2]string{}}
+	proto, _ := l4(cfg)
+	var v4, v6 []netip.Prefix
+	for _, p := range cfg.Sources {
+		if p.Addr().Is4() {
+			v4 = append(v4, p)
+		} else {
+			v6 = append(v6, p)
+		}
+	}
+
+	a.emit(bpf.LoadAbsolute{Off: 12, Size: 2})
+	a.jump(bpf.JumpEqual, 0x0800, "", "notv4")
+	// IPv4: protocol, first fragment, allowed source, port after the
+	// variable header
+	a.emit(bpf.LoadAbsolute{Off: 23, Size: 1})
+	a.jump(bpf.JumpEqual, uint32(proto), "", "drop4")
+	a.emit(bpf.LoadAbsolute{Off: 20, Size: 2})
+	a.jump(bpf.JumpBitsSet, 0x1fff, "drop4", "")
+	if len(cfg.Sources) > 0 {
+		for _, p := range v4 {
+			a.emit(bpf.LoadAbsolute{Off: 26, Size: 4})
+			a.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask32(p.Bits())})
+			a.jump(bpf.JumpEqual, binary.BigEndian.Uint32(p.Addr().AsSlice()), "port4", "")
+		}
+		a.goTo("drop4")
+	}
+	a.label("port4")
+	a.emit(bpf.LoadMemShift{Off: 14})
+	a.emit(bpf.LoadIndirect{Off: 16, Size: 2})
+	a.goTo("port")
+	a.label("drop4")
+	a.emit(bpf.RetConstant{Val: 0})
+
+	a.label("notv4")
+	a.jump(bpf.JumpEqual, 0x86dd, "ipv6", "")
+	// 802.1Q, 802.1ad, legacy QinQ and PPPoE session
+	a.jump(bpf.JumpEqual, 0x8100, "tagged", "")
+	a.jump(bpf.JumpEqual, 0x88a8, "tagged", "")
+	a.jump(bpf.JumpEqual, 0x9100, "tagged", "")
+	a.jump(bpf.JumpEqual, 0x8864, "", "drop6")
+	a.label("tagged")
+	a.emit(bpf.RetConstant{Val: snapLen})
+
+	// IPv6: next header the protocol, no extension headers, allowed
+	// source
+	a.label("ipv6")
+	a.emit(bpf.LoadAbsolute{Off: 20, Size: 1})
+	a.jump(bpf.JumpEqual, uint32(proto), "", "drop6")
+	if len(cfg.Sources) > 0 {
+		for i, p := range v6 {
+			next := fmt.Sprintf("src6_%d", i)
+			addr := p.Addr().As16()
+			for w := 0; w*32 < p.Bits(); w++ {
+				a.emit(bpf.LoadAbsolute{Off: 22 + uint32(w)*4, Size: 4})
+				a.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask32(min(p.Bits()-w*32, 32))})
+				a.jump(bpf.JumpEqual, binary.BigEndian.Uint32(addr[w*4:]), "", next)
+			}
+			a.goTo("port6")
+			a.label(next)
+		}
+		a.goTo("drop6")
+	}
+	a.label("port6")
+	a.emit(bpf.LoadAbsolute{Off: 56, Size: 2})
+	a.goTo("port")
+	a.label("drop6")
+	a.emit(bpf.RetConstant{Val: 0})
+
+	// Destination port in A
+	a.label("port")
+	a.jump(bpf.JumpEqual, uint32(cfg.Port), "accept", "")
+	for i, r := range cfg.Ports {
+		if r.Lo == r.Hi {
+			a.jump(bpf.JumpEqual, uint32(r.Lo), "accept", "")
+			continue
+		}
+		next := fmt.Sprintf("range%d", i)
+		a.jump(bpf.JumpGreaterOrEqual, uint32(r.Lo), "", next)
+		a.jump(bpf.JumpLessOrEqual, uint32(r.Hi), "accept", "")
+		a.label(next)
+	}
+	a.emit(bpf.RetConstant{Val: 0})
+	a.label("accept")
+	a.emit(bpf.RetConstant{Val: snapLen})
+	return a.resolve()
+}
+
+// mask32 is a netmask of bits ones.
+func mask32(bits int) uint32 {
+	return ^uint32(0) << (32 - bits)
+}
+
+// portExpr renders port and ports in the syntax of a libpcap filter
+// ("dst port 443 or dst portrange 50000-50010") or, with divert set, of
+// a WinDivert one, whose fields name the protocol proto.
+func portExpr(port int, ports []conf.PortRange, divert bool, proto string) string {
+	all := append([]conf.PortRange{{Lo: port, Hi: port}}, ports...)
+	terms := make([]string, len(all))
+	for i, r := range all {
+		switch {
+		case divert && r.Lo == r.Hi:
+			terms[i] = fmt.Sprintf("%s.DstPort == %d", proto, r.Lo)
+		case divert:
+			terms[i] = fmt.Sprintf("(%s.DstPort >= %d and %s.DstPort <= %d)", proto, r.Lo, proto, r.Hi)
+		case r.Lo == r.Hi:
+			terms[i] = fmt.Sprintf("dst port %d", r.Lo)
+		default:
+			terms[i] = fmt.Sprintf("dst portrange %d-%d", r.Lo, r.Hi)
+		}
+	}
+	return "(" + strings.Join(terms, " or ") + ")"
+}
+
+// srcExpr renders sources like portExpr, or returns "" when any source
+// is allowed.
+func srcExpr(sources []netip.Prefix, divert bool) string {
+	if len(sources) == 0 {
+		return ""
+	}
+	terms := make([]string, len(sources))
+	for i, p := range sources {
+		switch {
+		case divert:
+			field := "ip.SrcAddr"
+			if p.Addr().Is6() {
+				field = "ipv6.SrcAddr"
+			}
+			terms[i] = fmt.Sprintf("(%s >= %s and %s <= %s)", field, p.Addr(), field, lastAddr(p))
+		default:
+			terms[i] = "src net " + p.String()
+		}
+	}
+	return "(" + strings.Join(terms, " or ") + ")"
+}
+
+// lastAddr is the highest address in p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
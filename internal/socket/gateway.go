@@ -0,0 +1,133 @@
+package socket
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// gateway holds the next-hop MAC of one address family. A configured
+// router_mac is fixed; otherwise the MAC comes from the kernel neighbour
+// table, so a router replaced behind the same IP (VRRP failover) is
+// picked up without a restart.
+type gateway struct {
+	family string
+	v6     bool
+	auto   bool
+	mark   uint32 // of the socket that refreshes the neighbour entry
+	mac    atomic.Pointer[net.HardwareAddr]
+}
+
+func (g *gateway) get() net.HardwareAddr {
+	if p := g.mac.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+func (g *gateway) resolve(iface *net.Interface) error {
+	mac, err := lookupGateway(iface, g.v6, g.mark)
+	if err != nil {
+		return fmt.Errorf("failed to discover %s gateway MAC on %s: %v", g.family, iface.Name, err)
+	}
+	if old := g.get(); old != nil && !bytes.Equal(old, mac) {
+		flog.Infof("%s gateway MAC changed from %s to %s", g.family, old, mac)
+	}
+	g.mac.Store(&mac)
+	return nil
+}
+
+// GatewayMAC discovers the MAC of the default gateway on iface, as the
+// handles do when router_mac is not set, with network.fwmark mark.
+func GatewayMAC(iface *net.Interface, v6 bool, mark uint32) (net.HardwareAddr, error) {
+	return lookupGateway(iface, v6, mark)
+}
+
+// gateways refreshes the discovered MACs on an interval, and early when
+// a send fails.
+type gateways struct {
+	iface   *net.Interface
+	v4, v6  gateway
+	refresh time.Duration
+	kick    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newGateways(cfg *conf.Network) (*gateways, error) {
+	g := &gateways{
+		iface:   cfg.Interface,
+		v4:      gateway{family: "IPv4", mark: cfg.Fwmark},
+		v6:      gateway{family: "IPv6", v6: true, mark: cfg.Fwmark},
+		refresh: time.Duration(cfg.Gateway.Refresh) * time.Second,
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	var auto bool
+	for _, f := range []struct {
+		gw   *gateway
+		addr *conf.Addr
+	}{{&g.v4, &cfg.IPv4}, {&g.v6, &cfg.IPv6}} {
+		if f.addr.Addr == nil {
+			continue
+		}
+		mac := f.addr.Router
+		if mac == nil && cfg.Backend == "windivert" {
+			// Injected below the Ethernet header; any MAC will do.
+			mac = make(net.HardwareAddr, 6)
+		}
+		if mac != nil {
+			f.gw.mac.Store(&mac)
+			continue
+		}
+		f.gw.auto = true
+		if err := f.gw.resolve(g.iface); err != nil {
+			return nil, fmt.Errorf("%v; set router_mac to configure it statically", err)
+		}
+		flog.Infof("%s gateway MAC on %s is %s", f.gw.family, g.iface.Name, f.gw.get())
+		auto = true
+	}
+	if auto {
+		go g.loop()
+	}
+	return g, nil
+}
+
+func (g *gateways) loop() {
+	ticker := time.NewTicker(g.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+		case <-g.kick:
+		}
+		for _, gw := range []*gateway{&g.v4, &g.v6} {
+			if !gw.auto {
+				continue
+			}
+			// Keep sending to the last known MAC until a lookup succeeds.
+			if err := gw.resolve(g.iface); err != nil {
+				flog.Warnf("%v", err)
+			}
+		}
+	}
+}
+
+// stale asks for an early refresh; it never blocks the send path.
+func (g *gateways) stale() {
+	select {
+	case g.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (g *gateways) close() {
+	g.once.Do(func() { close(g.done) })
+}
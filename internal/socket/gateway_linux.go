@@ -0,0 +1,154 @@
+package socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"paqet/internal/pkg/fwmark"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// lookupGateway finds the default gateway of iface in the main routing
+// table and returns its MAC from the neighbour table. An entry that is
+// missing or not confirmed is refreshed by sending the gateway a UDP
+// datagram, which makes the kernel run ARP or NDP for it; the datagram
+// is tied to iface and carries mark, so a VPN route cannot take it.
+func lookupGateway(iface *net.Interface, v6 bool, mark uint32) (net.HardwareAddr, error) {
+	family := unix.AF_INET
+	if v6 {
+		family = unix.AF_INET6
+	}
+	gw, err := defaultRoute(iface.Index, family)
+	if err != nil {
+		return nil, err
+	}
+
+	var last net.HardwareAddr
+	for i := 0; i < 5; i++ {
+		mac, state, err := neighbour(iface.Index, family, gw)
+		if err != nil {
+			return nil, err
+		}
+		if mac != nil && state&(unix.NUD_REACHABLE|unix.NUD_PERMANENT|unix.NUD_NOARP) != 0 {
+			return mac, nil
+		}
+		if mac != nil && state&(unix.NUD_INCOMPLETE|unix.NUD_FAILED) == 0 {
+			last = mac
+		}
+		poke(iface, gw, mark)
+		time.Sleep(200 * time.Millisecond)
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, fmt.Errorf("gateway %s did not answer ARP/NDP", gw)
+}
+
+func defaultRoute(ifindex, family int) (net.IP, error) {
+	tab, err := syscall.NetlinkRIB(unix.RTM_GETROUTE, family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes: %v", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routes: %v", err)
+	}
+
+	var gw net.IP
+	var best uint32
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWROUTE || len(m.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		rt := (*unix.RtMsg)(unsafe.Pointer(&m.Data[0]))
+		if rt.Dst_len != 0 || rt.Table != unix.RT_TABLE_MAIN {
+			continue
+		}
+		attrs := rtAttrs(m.Data[unix.SizeofRtMsg:])
+		oif, via := attrs[unix.RTA_OIF], attrs[unix.RTA_GATEWAY]
+		if len(oif) != 4 || int(binary.NativeEndian.Uint32(oif)) != ifindex || via == nil {
+			continue
+		}
+		var metric uint32
+		if p := attrs[unix.RTA_PRIORITY]; len(p) == 4 {
+			metric = binary.NativeEndian.Uint32(p)
+		}
+		if gw == nil || metric < best {
+			gw, best = net.IP(append([]byte(nil), via...)), metric
+		}
+	}
+	if gw == nil {
+		return nil, fmt.Errorf("no default route via a gateway on interface %d", ifindex)
+	}
+	return gw, nil
+}
+
+func neighbour(ifindex, family int, ip net.IP) (net.HardwareAddr, uint16, error) {
+	tab, err := syscall.NetlinkRIB(unix.RTM_GETNEIGH, family)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read neighbours: %v", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse neighbours: %v", err)
+	}
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWNEIGH || len(m.Data) < unix.SizeofNdMsg {
+			continue
+		}
+		nd := (*unix.NdMsg)(unsafe.Pointer(&m.Data[0]))
+		if int(nd.Ifindex) != ifindex {
+			continue
+		}
+		attrs := rtAttrs(m.Data[unix.SizeofNdMsg:])
+		if !ip.Equal(net.IP(attrs[unix.NDA_DST])) {
+			continue
+		}
+		if ll := attrs[unix.NDA_LLADDR]; len(ll) == 6 {
+			return net.HardwareAddr(append([]byte(nil), ll...)), nd.State, nil
+		}
+		return nil, nd.State, nil
+	}
+	return nil, 0, nil
+}
+
+// poke sends one byte to the discard port so the kernel resolves or
+// reconfirms the gateway.
+func poke(iface *net.Interface, ip net.IP, mark uint32) {
+	addr := &net.UDPAddr{IP: ip, Port: 9}
+	if ip.IsLinkLocalUnicast() {
+		addr.Zone = iface.Name
+	}
+	d := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		c.Control(func(fd uintptr) {
+			unix.BindToDevice(int(fd), iface.Name)
+			if mark != 0 {
+				fwmark.Set(int(fd), mark)
+			}
+		})
+		return nil
+	}}
+	conn, err := d.Dial("udp", addr.String())
+	if err != nil {
+		return
+	}
+	conn.Write([]byte{0})
+	conn.Close()
+}
+
+func rtAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < unix.SizeofRtAttr || l > len(b) {
+			break
+		}
+		attrs[binary.NativeEndian.Uint16(b[2:4])] = b[unix.SizeofRtAttr:l]
+		b = b[min((l+3)&^3, len(b)):]
+	}
+	return attrs
+}
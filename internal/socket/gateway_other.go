@@ -0,0 +1,13 @@
+//go:build !linux
+
+package socket
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func lookupGateway(iface *net.Interface, v6 bool, mark uint32) (net.HardwareAddr, error) {
+	return nil, fmt.Errorf("gateway discovery is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,210 @@
+package socket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/hash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is what a server listens on: one PacketConn, or a Group of them.
+type Conn interface {
+	net.PacketConn
+	SetDSCP(dscp int) error
+	SetClientTCPF(addr net.Addr, f []conf.TCPF)
+	SetTCPF(f []conf.TCPF)
+}
+
+// Group joins the PacketConns of several listen addresses, each with its
+// own interface and handles, into one Conn. Packets are read from all of
+// them; replies to a client leave from the one it was last heard on, as
+// it drops packets from any other address. A member that cannot be
+// read any more fails the Group's reads with its error.
+type Group struct {
+	conns []*PacketConn
+	queue chan *packet
+
+	failOnce sync.Once
+	err      error
+	failed   chan struct{} // closed once err is set
+
+	mu    sync.RWMutex
+	peers map[uint64]int // client to index in conns
+
+	readDeadline atomic.Value
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewGroup opens a PacketConn for each of cfgs.
+func NewGroup(ctx context.Context, cfgs []*conf.Network) (*Group, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	g := &Group{
+		queue:  make(chan *packet, 1024),
+		peers:  make(map[uint64]int),
+		failed: make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, cfg := range cfgs {
+		c, err := New(ctx, cfg)
+		if err != nil {
+			g.Close()
+			return nil, fmt.Errorf("listener on %s: %w", cfg.Interface.Name, err)
+		}
+		g.conns = append(g.conns, c)
+	}
+	for i, c := range g.conns {
+		go g.run(i, c, cfgs[i].Interface.Name)
+	}
+	return g, nil
+}
+
+func (g *Group) run(i int, c *PacketConn, name string) {
+	for {
+		bufp := buffer.Get(snapLen)
+		n, addr, err := c.ReadFrom(*bufp)
+		if err != nil {
+			buffer.Put(bufp)
+			if g.ctx.Err() == nil {
+				flog.Errorf("listener on %s stopped reading: %v", name, err)
+				g.fail(fmt.Errorf("listener on %s: %w", name, err))
+			}
+			return
+		}
+		p := &packet{bufp: bufp, buf: (*bufp)[:n], addr: addr}
+		g.seen(addr, i)
+		select {
+		case g.queue <- p:
+		case <-g.ctx.Done():
+			p.release()
+			return
+		}
+	}
+}
+
+// fail makes reads return err, unless another member failed first.
+func (g *Group) fail(err error) {
+	g.failOnce.Do(func() {
+		g.err = err
+		close(g.failed)
+	})
+}
+
+// seen notes that addr was heard on conns[i].
+func (g *Group) seen(addr net.Addr, i int) {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	key := hash.IPAddr(a.IP, uint16(a.Port))
+	g.mu.RLock()
+	cur, ok := g.peers[key]
+	g.mu.RUnlock()
+	if ok && cur == i {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !ok && len(g.peers) >= maxClientTCPF {
+		for k := range g.peers {
+			delete(g.peers, k)
+			break
+		}
+	}
+	g.peers[key] = i
+}
+
+func (g *Group) ReadFrom(data []byte) (int, net.Addr, error) {
+	var deadline <-chan time.Time
+	if d, ok := g.readDeadline.Load().(time.Time); ok && !d.IsZero() {
+		timer := time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	select {
+	case <-g.ctx.Done():
+		return 0, nil, g.ctx.Err()
+	case <-deadline:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-g.failed:
+		return 0, nil, g.err
+	case p := <-g.queue:
+		n, addr := copy(data, p.buf), p.addr
+		p.release()
+		return n, addr, nil
+	}
+}
+
+// WriteTo sends from the conn addr was last heard on, or the first.
+func (g *Group) WriteTo(data []byte, addr net.Addr) (int, error) {
+	i := 0
+	if a, ok := addr.(*net.UDPAddr); ok {
+		g.mu.RLock()
+		i = g.peers[hash.IPAddr(a.IP, uint16(a.Port))]
+		g.mu.RUnlock()
+	}
+	return g.conns[i].WriteTo(data, addr)
+}
+
+func (g *Group) Close() error {
+	g.cancel()
+	for _, c := range g.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (g *Group) LocalAddr() net.Addr {
+	return nil
+}
+
+func (g *Group) SetDeadline(t time.Time) error {
+	g.readDeadline.Store(t)
+	for _, c := range g.conns {
+		c.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (g *Group) SetReadDeadline(t time.Time) error {
+	g.readDeadline.Store(t)
+	return nil
+}
+
+func (g *Group) SetWriteDeadline(t time.Time) error {
+	for _, c := range g.conns {
+		c.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (g *Group) SetDSCP(dscp int) error {
+	for _, c := range g.conns {
+		if err := c.SetDSCP(dscp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Group) SetClientTCPF(addr net.Addr, f []conf.TCPF) {
+	for _, c := range g.conns {
+		c.SetClientTCPF(addr, f)
+	}
+}
+
+// SetTCPF replaces the flags of packets to peers without their own.
+func (g *Group) SetTCPF(f []conf.TCPF) {
+	for _, c := range g.conns {
+		c.SetTCPF(f)
+	}
+}
@@ -1,53 +1,80 @@
 package socket
 
 import (
-	"fmt"
+	"net"
 	"paqet/internal/conf"
-	"runtime"
+	"sync"
 
-	"github.com/gopacket/gopacket/pcap"
+	"github.com/gopacket/gopacket"
 )
 
-func newHandle(cfg *conf.Network) (*pcap.Handle, error) {
-	// On Windows, use the GUID field to construct the NPF device name
-	// On other platforms, use the interface name directly
-	ifaceName := cfg.Interface.Name
-	if runtime.GOOS == "windows" {
-		ifaceName = cfg.GUID
-	}
+// rawHandle captures and injects Ethernet frames on the configured
+// interface. A frame returned by ReadPacketData is leased from the
+// handle's own buffer, so no backend allocates per packet: the reader
+// copies what it keeps and then calls Release, which lets a ring or UMEM
+// backend hand the slot back to the kernel at once. The next
+// ReadPacketData releases a frame the reader did not.
+type rawHandle interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	Release()
+	WritePacketData(data []byte) error
+	Close()
+}
 
-	inactive, err := pcap.NewInactiveHandle(ifaceName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create inactive pcap handle for %s: %v", cfg.Interface.Name, err)
-	}
-	defer inactive.CleanUp()
+type direction int
 
-	if err = inactive.SetBufferSize(cfg.PCAP.Sockbuf); err != nil {
-		return nil, fmt.Errorf("failed to set pcap buffer size to %d: %v", cfg.PCAP.Sockbuf, err)
-	}
+const (
+	dirIn  direction = iota // receive: inbound TCP, or UDP, to the local port
+	dirOut                  // send only
+)
 
-	// SnapLen 4096 is sufficient for tunnel payloads (KCP MTU ~1350 + headers).
-	// 65536 wastes memory copying full jumbo frames we never need.
-	if err = inactive.SetSnapLen(4096); err != nil {
-		return nil, fmt.Errorf("failed to set pcap snap length: %v", err)
-	}
-	// Promiscuous mode is NOT needed: BPF filter already selects our port.
-	// Disabling it avoids capturing and processing irrelevant traffic,
-	// which is a major CPU saver on busy servers.
-	if err = inactive.SetPromisc(false); err != nil {
-		return nil, fmt.Errorf("failed to disable promiscuous mode: %v", err)
-	}
-	if err = inactive.SetTimeout(pcap.BlockForever); err != nil {
-		return nil, fmt.Errorf("failed to set pcap timeout: %v", err)
-	}
-	if err = inactive.SetImmediateMode(true); err != nil {
-		return nil, fmt.Errorf("failed to enable immediate mode: %v", err)
+// packetOpen is held while a handle opens an AF_PACKET socket and sets
+// its network.fwmark, so the pcap backend, which finds its socket by
+// looking at those open before and after, marks its own only.
+var packetOpen sync.Mutex
+
+// snapLen 4096 is sufficient for tunnel payloads (KCP MTU ~1350 + headers).
+// 65536 wastes memory copying full jumbo frames we never need.
+const snapLen = 4096
+
+// l4 is the IP protocol tunnel packets travel in, by number and name.
+func l4(cfg *conf.Network) (uint8, string) {
+	if cfg.UDP() {
+		return 17, "udp"
 	}
+	return 6, "tcp"
+}
 
-	handle, err := inactive.Activate()
-	if err != nil {
-		return nil, fmt.Errorf("failed to activate pcap handle on %s: %v", cfg.Interface.Name, err)
+func newHandle(cfg *conf.Network, dir direction) (rawHandle, error) {
+	switch cfg.Backend {
+	case "afpacket":
+		return newAFPacketHandle(cfg, dir)
+	case "xdp":
+		return newXDPHandle(cfg, dir)
+	case "windivert":
+		return newWinDivertHandle(cfg, dir)
+	default:
+		return newPcapHandle(cfg, dir)
 	}
+}
+
+// sender injects payloads towards addr. SendHandle crafts TCP segments,
+// or UDP datagrams, on the wire; memSender hands them to the other end
+// of a mem pair.
+type sender interface {
+	Write(payload []byte, addr *net.UDPAddr) error
+	ack(addr *net.UDPAddr) error
+	setDSCP(dscp int)
+	setClientTCPF(addr net.Addr, f []conf.TCPF)
+	setTCPF(f []conf.TCPF)
+	inherit(old sender)
+	Close()
+}
 
-	return handle, nil
+// receiver returns the payloads addressed to us and who sent them. A
+// payload is leased like the frame it is cut from, until Release.
+type receiver interface {
+	Read() ([]byte, net.Addr, error)
+	Release()
+	Close()
 }
@@ -0,0 +1,12 @@
+//go:build nopcap
+
+package socket
+
+import (
+	"fmt"
+	"paqet/internal/conf"
+)
+
+func newPcapHandle(cfg *conf.Network, dir direction) (rawHandle, error) {
+	return nil, fmt.Errorf("built without pcap support (nopcap tag); set network.backend to afpacket")
+}
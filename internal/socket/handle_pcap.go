@@ -0,0 +1,130 @@
+//go:build !nopcap
+
+package socket
+
+import (
+	"fmt"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/fwmark"
+	"runtime"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// pcapHandle reads without the per-packet copy of ReadPacketData.
+type pcapHandle struct {
+	*pcap.Handle
+}
+
+func (h pcapHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return h.ZeroCopyReadPacketData()
+}
+
+// Release does nothing: libpcap reuses its buffer on the next read and
+// cannot take a frame back before it.
+func (h pcapHandle) Release() {}
+
+func newPcapHandle(cfg *conf.Network, dir direction) (rawHandle, error) {
+	// On Windows, use the GUID field to construct the NPF device name
+	// On other platforms, use the interface name directly
+	ifaceName := cfg.Interface.Name
+	if runtime.GOOS == "windows" {
+		ifaceName = cfg.GUID
+	}
+
+	inactive, err := pcap.NewInactiveHandle(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inactive pcap handle for %s: %v", cfg.Interface.Name, err)
+	}
+	defer inactive.CleanUp()
+
+	if err = inactive.SetBufferSize(cfg.PCAP.Sockbuf); err != nil {
+		return nil, fmt.Errorf("failed to set pcap buffer size to %d: %v", cfg.PCAP.Sockbuf, err)
+	}
+
+	if err = inactive.SetSnapLen(snapLen); err != nil {
+		return nil, fmt.Errorf("failed to set pcap snap length: %v", err)
+	}
+	// Promiscuous mode is NOT needed: BPF filter already selects our port.
+	// Disabling it avoids capturing and processing irrelevant traffic,
+	// which is a major CPU saver on busy servers.
+	if err = inactive.SetPromisc(false); err != nil {
+		return nil, fmt.Errorf("failed to disable promiscuous mode: %v", err)
+	}
+	if err = inactive.SetTimeout(pcap.BlockForever); err != nil {
+		return nil, fmt.Errorf("failed to set pcap timeout: %v", err)
+	}
+	if err = inactive.SetImmediateMode(true); err != nil {
+		return nil, fmt.Errorf("failed to enable immediate mode: %v", err)
+	}
+
+	// libpcap keeps its socket to itself, so the one Activate opens is
+	// found among the process's AF_PACKET sockets and marked like the
+	// afpacket backend's.
+	mark := cfg.Fwmark != 0 && dir == dirOut && runtime.GOOS == "linux"
+	if mark {
+		packetOpen.Lock()
+		defer packetOpen.Unlock()
+	}
+	before := fwmark.PacketSockets()
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to activate pcap handle on %s: %v", cfg.Interface.Name, err)
+	}
+	if mark {
+		if err := fwmark.SetOpened(before, cfg.Fwmark); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("failed to set fwmark on pcap handle: %v", err)
+		}
+	}
+
+	// SetDirection is not fully supported on Windows Npcap, so skip it
+	pdir, pname := pcap.DirectionIn, "in"
+	if dir == dirOut {
+		pdir, pname = pcap.DirectionOut, "out"
+	}
+	if runtime.GOOS != "windows" {
+		if err := handle.SetDirection(pdir); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("failed to set pcap direction %s: %v", pname, err)
+		}
+	}
+
+	if dir == dirIn {
+		if err := setPcapFilter(handle, cfg); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("failed to set BPF filter: %w", err)
+		}
+	}
+
+	return pcapHandle{handle}, nil
+}
+
+// setPcapFilter selects inbound TCP, or UDP, to the ports of cfg, from
+// its allowed sources if any. On Ethernet it uses the same program as
+// afpacket, which also lets tagged and PPPoE frames through; libpcap's
+// "vlan" and "pppoes" shift offsets for the rest of an expression, so
+// one filter string cannot cover every framing. Cooked captures keep the
+// libpcap expression, which knows their header.
+func setPcapFilter(handle *pcap.Handle, cfg *conf.Network) error {
+	if handle.LinkType() != layers.LinkTypeEthernet {
+		_, proto := l4(cfg)
+		expr := proto + " and " + portExpr(cfg.Port, cfg.Ports, false, proto)
+		if src := srcExpr(cfg.Sources, false); src != "" {
+			expr += " and " + src
+		}
+		return handle.SetBPFFilter(expr)
+	}
+	prog, err := bpf.Assemble(dstPortFilter(cfg))
+	if err != nil {
+		return err
+	}
+	insns := make([]pcap.BPFInstruction, len(prog))
+	for i := 0; i < len(prog); i++ {
+		insns[i] = pcap.BPFInstruction{Code: prog[i].Op, Jt: prog[i].Jt, Jf: prog[i].Jf, K: prog[i].K}
+	}
+	return handle.SetBPFInstructionFilter(insns)
+}
@@ -0,0 +1,173 @@
+package socket
+
+import (
+	"container/heap"
+	"context"
+	"math/rand/v2"
+	"net"
+	"paqet/internal/pkg/chaos"
+	"sync"
+	"time"
+)
+
+// impairedSender passes packets to a sender through a simulated bad link:
+// some are dropped, some sent twice and the rest delayed, with reordered
+// ones held back long enough for later packets to overtake them. The
+// decisions come from a generator seeded by the faults, so a run with the
+// same seed and traffic impairs the same packets.
+type impairedSender struct {
+	sender
+	f *chaos.Faults
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	seq   uint64
+	queue delayQueue
+	wake  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newImpairedSender wraps s. stream tells apart generators sharing a
+// seed, such as the two ends of a pair.
+func newImpairedSender(s sender, f *chaos.Faults, stream uint64) *impairedSender {
+	seed := f.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	i := &impairedSender{
+		sender: s,
+		f:      f,
+		rng:    rand.New(rand.NewPCG(seed, stream)),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go i.deliver()
+	return i
+}
+
+func (i *impairedSender) Write(payload []byte, addr *net.UDPAddr) error {
+	i.mu.Lock()
+	if i.f.Loss > 0 && i.rng.Float64() < i.f.Loss {
+		i.mu.Unlock()
+		return nil
+	}
+	copies := 1
+	if i.f.Duplicate > 0 && i.rng.Float64() < i.f.Duplicate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for n := range delays {
+		d := i.f.Delay
+		if i.f.Jitter > 0 {
+			d += time.Duration(i.rng.Int64N(int64(i.f.Jitter) + 1))
+		}
+		if i.f.Reorder > 0 && i.rng.Float64() < i.f.Reorder {
+			d += i.f.Jitter + time.Millisecond
+		}
+		delays[n] = d
+	}
+	if delays[0] == 0 && copies == 1 {
+		i.mu.Unlock()
+		return i.sender.Write(payload, addr)
+	}
+	now := time.Now()
+	for _, d := range delays {
+		i.seq++
+		heap.Push(&i.queue, &delayed{
+			data: append([]byte(nil), payload...),
+			addr: addr,
+			due:  now.Add(d),
+			seq:  i.seq,
+		})
+	}
+	i.mu.Unlock()
+	select {
+	case i.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// deliver sends queued packets as they come due.
+func (i *impairedSender) deliver() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		i.mu.Lock()
+		if len(i.queue) == 0 {
+			i.mu.Unlock()
+			select {
+			case <-i.wake:
+				continue
+			case <-i.done:
+				return
+			}
+		}
+		if wait := time.Until(i.queue[0].due); wait > 0 {
+			i.mu.Unlock()
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-i.wake:
+			case <-i.done:
+				return
+			}
+			continue
+		}
+		p := heap.Pop(&i.queue).(*delayed)
+		i.mu.Unlock()
+		i.sender.Write(p.data, p.addr)
+	}
+}
+
+// inherit unwraps old, so settings carry over between impaired handles.
+func (i *impairedSender) inherit(old sender) {
+	if o, ok := old.(*impairedSender); ok {
+		old = o.sender
+	}
+	i.sender.inherit(old)
+}
+
+// Close drops what is still queued, as a link going down would.
+func (i *impairedSender) Close() {
+	i.once.Do(func() { close(i.done) })
+	i.sender.Close()
+}
+
+type delayed struct {
+	data []byte
+	addr *net.UDPAddr
+	due  time.Time
+	seq  uint64
+}
+
+// delayQueue orders packets by due time, then by when they were sent.
+type delayQueue []*delayed
+
+func (q delayQueue) Len() int { return len(q) }
+func (q delayQueue) Less(a, b int) bool {
+	if q[a].due.Equal(q[b].due) {
+		return q[a].seq < q[b].seq
+	}
+	return q[a].due.Before(q[b].due)
+}
+func (q delayQueue) Swap(a, b int) { q[a], q[b] = q[b], q[a] }
+func (q *delayQueue) Push(x any)   { *q = append(*q, x.(*delayed)) }
+func (q *delayQueue) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return p
+}
+
+// NewImpairedPair is NewMemPair over a link impaired by f in both
+// directions, for reproducible tests of KCP modes and FEC under loss,
+// reordering, duplication and latency. Set f.Seed to repeat a run.
+func NewImpairedPair(ctx context.Context, a, b *net.UDPAddr, f *chaos.Faults) (*PacketConn, *PacketConn) {
+	ea := &memEnd{local: a, in: make(chan memPacket, memQueue), done: make(chan struct{})}
+	eb := &memEnd{local: b, in: make(chan memPacket, memQueue), done: make(chan struct{})}
+	ea.peer, eb.peer = eb, ea
+	return newMemConn(ctx, ea, newImpairedSender(ea, f, 1)), newMemConn(ctx, eb, newImpairedSender(eb, f, 2))
+}
@@ -0,0 +1,211 @@
+package socket
+
+import (
+	"fmt"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/chaos"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handles is one generation of capture and injection handles. The
+// PacketConn swaps in a new generation when the interface goes away and
+// comes back, or its index, MAC or addresses change; KCP sessions on top
+// keep running and lose only the packets sent meanwhile.
+type handles struct {
+	cfg      *conf.Network
+	send     sender
+	recv     receiver
+	workers  *recvWorkers
+	replaced chan struct{}
+	closed   chan struct{}
+	broken   atomic.Bool
+	once     sync.Once
+}
+
+func openHandles(cfg *conf.Network) (*handles, error) {
+	send, err := NewSendHandle(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create send handle on %s: %v", cfg.Interface.Name, err)
+	}
+	h := &handles{cfg: cfg, send: send, replaced: make(chan struct{}), closed: make(chan struct{})}
+	if cfg.PCAP.Workers > 1 {
+		h.workers, err = newRecvWorkers(cfg, cfg.PCAP.Workers, send.local)
+	} else {
+		h.recv, err = newRecvHandle(cfg, send.local)
+	}
+	if err != nil {
+		send.Close()
+		return nil, fmt.Errorf("failed to create receive handle on %s: %v", cfg.Interface.Name, err)
+	}
+	if f := chaos.Link(); f != nil {
+		h.send = newImpairedSender(send, f, 0)
+	}
+	return h, nil
+}
+
+// close releases the handles in the background, since a pcap read can
+// hold its handle for a while. The returned channel is closed when done.
+func (h *handles) close() <-chan struct{} {
+	h.once.Do(func() {
+		go func() {
+			h.send.Close()
+			if h.recv != nil {
+				h.recv.Close()
+			}
+			if h.workers != nil {
+				h.workers.close()
+			}
+			close(h.closed)
+		}()
+	})
+	return h.closed
+}
+
+// failed reports that h returned an error. Only the first report of a
+// generation matters; maintain then checks the interface.
+func (c *PacketConn) failed(h *handles, err error) {
+	if c.io.Load() != h || h.broken.Swap(true) {
+		return
+	}
+	flog.Debugf("packet handles on %s failed: %v", h.cfg.Interface.Name, err)
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+// maintain reopens the handles when the interface changes or they fail.
+// Link events are debounced, as a replug or DHCP renewal arrives as a
+// burst of them.
+func (c *PacketConn) maintain() {
+	events, stop := watchLink()
+	defer stop()
+
+	var broken bool
+	var settle <-chan time.Time
+	var last time.Time
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-events:
+			settle = time.After(500 * time.Millisecond)
+			continue
+		case <-c.kick:
+			broken = true
+		case <-settle:
+		}
+		settle = nil
+
+		cur := c.io.Load()
+		iface, err := net.InterfaceByName(cur.cfg.Interface.Name)
+		if err != nil || iface.Flags&net.FlagUp == 0 {
+			// Gone or down: wait for the event that brings it back.
+			broken = true
+			continue
+		}
+		next := relink(cur.cfg, iface)
+		if !broken && next == nil {
+			continue
+		}
+		if next == nil {
+			next = cur.cfg
+		}
+		// Handles that keep failing on a live interface are retried
+		// at most once a second.
+		if wait := time.Second - time.Since(last); wait > 0 {
+			settle = time.After(wait)
+			continue
+		}
+		last = time.Now()
+		if err := c.reopen(cur, next); err != nil {
+			flog.Warnf("failed to reopen packet handles on %s: %v", iface.Name, err)
+			settle = time.After(2 * time.Second)
+			broken = true
+			continue
+		}
+		broken = false
+	}
+}
+
+// reopen opens handles for cfg and swaps them in, carrying over the
+// per-connection send settings of the old generation. The old handles
+// are closed first: an afpacket fanout group stays tied to the device
+// its first socket was bound to until every member has left.
+func (c *PacketConn) reopen(old *handles, cfg *conf.Network) error {
+	old.broken.Store(true) // its readers fail next; that is expected
+	select {
+	case <-old.close():
+	case <-time.After(time.Second):
+	}
+	h, err := openHandles(cfg)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		h.close()
+		return nil
+	}
+	h.send.inherit(old.send)
+	c.io.Store(h)
+	c.mu.Unlock()
+
+	close(old.replaced)
+	flog.Infof("packet handles on %s reopened (index %d, %s)", cfg.Interface.Name, cfg.Interface.Index, cfg.Interface.HardwareAddr)
+	return nil
+}
+
+// relink returns cfg updated for iface, or nil when nothing the handles
+// depend on has changed. A source address that left the interface is
+// replaced by another of the same family, keeping the port.
+func relink(cfg *conf.Network, iface *net.Interface) *conf.Network {
+	next := *cfg
+	next.Interface = iface
+	changed := iface.Index != cfg.Interface.Index || iface.HardwareAddr.String() != cfg.Interface.HardwareAddr.String()
+
+	addrs, _ := iface.Addrs()
+	for _, a := range []*conf.Addr{&next.IPv4, &next.IPv6} {
+		if a.Addr == nil {
+			continue
+		}
+		ip := pickAddr(addrs, a.Addr.IP)
+		if ip == nil || ip.Equal(a.Addr.IP) {
+			continue
+		}
+		flog.Infof("source address on %s changed from %s to %s", iface.Name, a.Addr.IP, ip)
+		addr := *a.Addr
+		addr.IP = ip
+		a.Addr = &addr
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return &next
+}
+
+// pickAddr keeps cur while the interface still has it, and otherwise
+// returns the first global address of the same family.
+func pickAddr(addrs []net.Addr, cur net.IP) net.IP {
+	var first net.IP
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || (ipn.IP.To4() != nil) != (cur.To4() != nil) {
+			continue
+		}
+		if ipn.IP.Equal(cur) {
+			return cur
+		}
+		if first == nil && ipn.IP.IsGlobalUnicast() {
+			first = ipn.IP
+		}
+	}
+	return first
+}
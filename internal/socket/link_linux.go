@@ -0,0 +1,73 @@
+package socket
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchLink signals link and address changes from rtnetlink. Events are
+// not filtered by interface: an index may change on replug, and the
+// caller checks the interface by name anyway.
+func watchLink() (<-chan struct{}, func()) {
+	events := make(chan struct{}, 1)
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return pollLink(events)
+	}
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return pollLink(events)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 16*1024)
+		for {
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			select {
+			case <-done:
+				return
+			default:
+			}
+			switch {
+			case err == unix.EINTR:
+				continue
+			case err == unix.ENOBUFS:
+				// Events were dropped; assume one of them was ours.
+			case err != nil:
+				return
+			default:
+				msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+				if err != nil || !hasLinkEvent(msgs) {
+					continue
+				}
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	stop := func() {
+		close(done)
+		// Shutting the socket down wakes the blocked Recvfrom.
+		unix.Shutdown(fd, unix.SHUT_RDWR)
+		unix.Close(fd)
+	}
+	return events, stop
+}
+
+func hasLinkEvent(msgs []syscall.NetlinkMessage) bool {
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case unix.RTM_NEWLINK, unix.RTM_DELLINK, unix.RTM_NEWADDR, unix.RTM_DELADDR:
+			return true
+		}
+	}
+	return false
+}
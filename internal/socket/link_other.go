@@ -0,0 +1,7 @@
+//go:build !linux
+
+package socket
+
+func watchLink() (<-chan struct{}, func()) {
+	return pollLink(make(chan struct{}, 1))
+}
@@ -0,0 +1,25 @@
+package socket
+
+import "time"
+
+// pollLink signals every few seconds so the interface is rechecked where
+// no change notifications are available.
+func pollLink(events chan struct{}) (<-chan struct{}, func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, func() { close(done) }
+}
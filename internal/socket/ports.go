@@ -0,0 +1,90 @@
+package socket
+
+import (
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/hash"
+	"sync"
+)
+
+// localPorts remembers which port of a multi-port server each client
+// sends to, so that replies leave from it; a client drops packets from
+// any other port. The receive handles fill it in, the send handle reads
+// it. A nil *localPorts stands for a single port.
+type localPorts struct {
+	ranges []conf.PortRange
+	mu     sync.RWMutex
+	peers  map[uint64]uint16
+}
+
+func newLocalPorts(cfg *conf.Network) *localPorts {
+	if len(cfg.Ports) == 0 {
+		return nil
+	}
+	return &localPorts{ranges: cfg.Ports, peers: make(map[uint64]uint16)}
+}
+
+// has reports whether port is one of the extra ports.
+func (l *localPorts) has(port uint16) bool {
+	if l == nil {
+		return false
+	}
+	for _, r := range l.ranges {
+		if int(port) >= r.Lo && int(port) <= r.Hi {
+			return true
+		}
+	}
+	return false
+}
+
+// set notes that ip:port sent to local.
+func (l *localPorts) set(ip net.IP, port, local uint16) {
+	if l == nil {
+		return
+	}
+	key := hash.IPAddr(ip, port)
+	l.mu.RLock()
+	cur, ok := l.peers[key]
+	l.mu.RUnlock()
+	if ok && cur == local {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !ok && len(l.peers) >= maxClientTCPF {
+		// Clients gone quiet are not tracked; any one makes room, and
+		// returns on its next packet if still there.
+		for k := range l.peers {
+			delete(l.peers, k)
+			break
+		}
+	}
+	l.peers[key] = local
+}
+
+// get returns the port ip:port sends to, or def when not known.
+func (l *localPorts) get(ip net.IP, port, def uint16) uint16 {
+	if l == nil {
+		return def
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if local, ok := l.peers[hash.IPAddr(ip, port)]; ok {
+		return local
+	}
+	return def
+}
+
+// inherit copies the ports known to old.
+func (l *localPorts) inherit(old *localPorts) {
+	if l == nil || old == nil {
+		return
+	}
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, v := range old.peers {
+		l.peers[k] = v
+	}
+}
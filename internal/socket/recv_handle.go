@@ -4,63 +4,120 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"net/netip"
 	"paqet/internal/conf"
-	"runtime"
+	"paqet/internal/pkg/capture"
 
-	"github.com/gopacket/gopacket/pcap"
+	"github.com/gopacket/gopacket/layers"
 )
 
 type RecvHandle struct {
-	handle *pcap.Handle
+	handle rawHandle
+	link   layers.LinkType
+	port   uint16
+	local  *localPorts
+	srcs   []netip.Prefix
+	proto  uint8 // IP protocol: TCP, or UDP with a mimicked protocol
+}
+
+// linkTyper is implemented by handles that can capture something other
+// than Ethernet, such as pcap on a cooked "any" or bonded interface.
+type linkTyper interface {
+	LinkType() layers.LinkType
 }
 
 func NewRecvHandle(cfg *conf.Network) (*RecvHandle, error) {
-	handle, err := newHandle(cfg)
+	return newRecvHandle(cfg, nil)
+}
+
+// newRecvHandle also accepts packets to the ports of local, noting which
+// one each client sends to.
+func newRecvHandle(cfg *conf.Network, local *localPorts) (*RecvHandle, error) {
+	handle, err := newHandle(cfg, dirIn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open pcap handle: %w", err)
+		return nil, fmt.Errorf("failed to open %s handle: %w", cfg.Backend, err)
 	}
-
-	// SetDirection is not fully supported on Windows Npcap, so skip it
-	if runtime.GOOS != "windows" {
-		if err := handle.SetDirection(pcap.DirectionIn); err != nil {
-			return nil, fmt.Errorf("failed to set pcap direction in: %v", err)
-		}
+	h := &RecvHandle{handle: handle, link: layers.LinkTypeEthernet, port: uint16(cfg.Port), local: local, srcs: cfg.Sources}
+	h.proto, _ = l4(cfg)
+	if lt, ok := handle.(linkTyper); ok {
+		h.link = lt.LinkType()
 	}
-
-	filter := fmt.Sprintf("tcp and dst port %d", cfg.Port)
-	if err := handle.SetBPFFilter(filter); err != nil {
-		return nil, fmt.Errorf("failed to set BPF filter: %w", err)
+	switch h.link {
+	case layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL, layers.LinkTypeLinuxSLL2:
+	default:
+		handle.Close()
+		return nil, fmt.Errorf("unsupported link type %s on %s", h.link, cfg.Interface.Name)
 	}
+	return h, nil
+}
 
-	return &RecvHandle{handle: handle}, nil
+// peerAddr holds a source address and its IP bytes in one allocation.
+type peerAddr struct {
+	addr net.UDPAddr
+	ip   [16]byte
 }
 
 // Read performs zero-alloc direct byte-level parsing instead of full gopacket decode.
-// This dramatically reduces CPU and memory usage under high load.
+// This dramatically reduces CPU and memory usage under high load. The
+// payload is leased from the capture handle like the frame it is cut
+// from, until Release; only the returned address is allocated, as its
+// owner keeps it.
 func (h *RecvHandle) Read() ([]byte, net.Addr, error) {
 	data, _, err := h.handle.ReadPacketData()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Minimum Ethernet frame: 14 bytes header
-	if len(data) < 14 {
-		return nil, nil, nil
+	var etherType uint16
+	var offset int
+
+	switch h.link {
+	case layers.LinkTypeLinuxSLL: // 16 byte cooked header, protocol last
+		if len(data) < 16 {
+			return nil, nil, nil
+		}
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		offset = 16
+	case layers.LinkTypeLinuxSLL2: // 20 byte cooked header, protocol first
+		if len(data) < 20 {
+			return nil, nil, nil
+		}
+		etherType = binary.BigEndian.Uint16(data[0:2])
+		offset = 20
+	default: // Minimum Ethernet frame: 14 bytes header
+		if len(data) < 14 {
+			return nil, nil, nil
+		}
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		offset = 14
 	}
 
-	etherType := binary.BigEndian.Uint16(data[12:14])
-	offset := 14
+	// Handle stacked VLAN tags (802.1Q, 802.1ad and pre-standard QinQ)
+	for etherType == 0x8100 || etherType == 0x88A8 || etherType == 0x9100 {
+		if len(data) < offset+4 {
+			return nil, nil, nil
+		}
+		etherType = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+		offset += 4
+	}
 
-	// Handle VLAN tags (802.1Q)
-	if etherType == 0x8100 {
-		if len(data) < 18 {
+	// PPPoE session: version/type 0x11, code 0, then the PPP protocol
+	if etherType == 0x8864 {
+		if len(data) < offset+8 || data[offset] != 0x11 || data[offset+1] != 0 {
 			return nil, nil, nil
 		}
-		etherType = binary.BigEndian.Uint16(data[16:18])
-		offset = 18
+		switch binary.BigEndian.Uint16(data[offset+6 : offset+8]) {
+		case 0x0021:
+			etherType = 0x0800
+		case 0x0057:
+			etherType = 0x86DD
+		default:
+			return nil, nil, nil
+		}
+		offset += 8
 	}
 
-	addr := &net.UDPAddr{}
+	var srcIP []byte
 	var ipHeaderLen int
 
 	switch etherType {
@@ -72,45 +129,90 @@ func (h *RecvHandle) Read() ([]byte, net.Addr, error) {
 		if ipHeaderLen < 20 || len(data) < offset+ipHeaderLen {
 			return nil, nil, nil
 		}
+		// Our protocol, first fragment only
+		if data[offset+9] != h.proto || binary.BigEndian.Uint16(data[offset+6:offset+8])&0x1FFF != 0 {
+			return nil, nil, nil
+		}
 		// Source IP: bytes 12-15 of IP header
-		addr.IP = make(net.IP, 4)
-		copy(addr.IP, data[offset+12:offset+16])
+		srcIP = data[offset+12 : offset+16]
 
 	case 0x86DD: // IPv6
-		if len(data) < offset+40 {
+		if len(data) < offset+40 || data[offset+6] != h.proto {
 			return nil, nil, nil
 		}
 		ipHeaderLen = 40
 		// Source IP: bytes 8-23 of IPv6 header
-		addr.IP = make(net.IP, 16)
-		copy(addr.IP, data[offset+8:offset+24])
+		srcIP = data[offset+8 : offset+24]
 
 	default:
 		return nil, nil, nil
 	}
 
-	tcpStart := offset + ipHeaderLen
-	// TCP header minimum: 20 bytes (src port at offset 0-1)
-	if len(data) < tcpStart+20 {
+	l4Start := offset + ipHeaderLen
+	// Header minimum: 20 bytes for TCP, 8 for UDP (src port at offset 0-1)
+	minLen := 20
+	if h.proto == 17 {
+		minLen = 8
+	}
+	if len(data) < l4Start+minLen {
 		return nil, nil, nil
 	}
 
-	// Source port: first 2 bytes of TCP header
-	addr.Port = int(binary.BigEndian.Uint16(data[tcpStart : tcpStart+2]))
-
-	// TCP data offset (header length): upper 4 bits of byte 12
-	tcpHeaderLen := int(data[tcpStart+12]>>4) * 4
-	if tcpHeaderLen < 20 || len(data) < tcpStart+tcpHeaderLen {
+	// The capture filter only checks the port and source of
+	// unencapsulated frames, and the xdp one never the source.
+	dstPort := binary.BigEndian.Uint16(data[l4Start+2 : l4Start+4])
+	if dstPort != h.port && !h.local.has(dstPort) {
+		return nil, nil, nil
+	}
+	if len(h.srcs) > 0 && !allowedSource(h.srcs, srcIP) {
 		return nil, nil, nil
 	}
 
-	payloadStart := tcpStart + tcpHeaderLen
-	if payloadStart >= len(data) {
+	payloadStart, payloadEnd := 0, len(data)
+	if h.proto == 17 {
+		// The UDP length leaves out the padding of short frames.
+		udpLen := int(binary.BigEndian.Uint16(data[l4Start+4 : l4Start+6]))
+		if udpLen < 8 || len(data) < l4Start+udpLen {
+			return nil, nil, nil
+		}
+		payloadStart, payloadEnd = l4Start+8, l4Start+udpLen
+	} else {
+		// TCP data offset (header length): upper 4 bits of byte 12
+		tcpHeaderLen := int(data[l4Start+12]>>4) * 4
+		if tcpHeaderLen < 20 || len(data) < l4Start+tcpHeaderLen {
+			return nil, nil, nil
+		}
+		payloadStart = l4Start + tcpHeaderLen
+	}
+	if payloadStart >= payloadEnd {
 		// No payload (e.g. ACK-only packet)
 		return nil, nil, nil
 	}
 
-	return data[payloadStart:], addr, nil
+	// Source port: first 2 bytes of the TCP or UDP header
+	peer := &peerAddr{}
+	peer.addr.IP = peer.ip[:copy(peer.ip[:], srcIP)]
+	peer.addr.Port = int(binary.BigEndian.Uint16(data[l4Start : l4Start+2]))
+	h.local.set(peer.addr.IP, uint16(peer.addr.Port), dstPort)
+	capture.Received(h.link, data, payloadStart, &peer.addr)
+	return data[payloadStart:payloadEnd], &peer.addr, nil
+}
+
+// Release gives the frame of the last payload back to the capture
+// handle.
+func (h *RecvHandle) Release() {
+	h.handle.Release()
+}
+
+func allowedSource(srcs []netip.Prefix, ip []byte) bool {
+	addr, _ := netip.AddrFromSlice(ip)
+	addr = addr.Unmap()
+	for _, p := range srcs {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *RecvHandle) Close() {
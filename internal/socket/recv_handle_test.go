@@ -0,0 +1,129 @@
+package socket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// frameHandle is a capture handle that returns the same frame forever,
+// leased like the ring backends do or copied like pcap's ReadPacketData.
+type frameHandle struct {
+	frame  []byte
+	copied bool
+}
+
+func (h *frameHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if h.copied {
+		return append([]byte(nil), h.frame...), gopacket.CaptureInfo{}, nil
+	}
+	return h.frame, gopacket.CaptureInfo{}, nil
+}
+
+func (h *frameHandle) Release()                     {}
+func (h *frameHandle) WritePacketData([]byte) error { return nil }
+func (h *frameHandle) Close()                       {}
+
+// testFrame builds an Ethernet frame from 192.0.2.1:40000 to port 443,
+// with a VLAN tag if vlan, carrying payload in a TCP segment with the
+// 12 bytes of options paqet sends, or in a UDP datagram.
+func testFrame(proto uint8, vlan bool, payload []byte) []byte {
+	f := make([]byte, 12, 1600)
+	if vlan {
+		f = binary.BigEndian.AppendUint16(f, 0x8100)
+		f = binary.BigEndian.AppendUint16(f, 7)
+	}
+	f = binary.BigEndian.AppendUint16(f, 0x0800)
+
+	l4 := 8
+	if proto == 6 {
+		l4 = 32
+	}
+	f = append(f, 0x45, 0)
+	f = binary.BigEndian.AppendUint16(f, uint16(20+l4+len(payload)))
+	f = append(f, 0, 0, 0x40, 0, 64, proto, 0, 0)
+	f = append(f, 192, 0, 2, 1, 192, 0, 2, 2)
+
+	f = binary.BigEndian.AppendUint16(f, 40000)
+	f = binary.BigEndian.AppendUint16(f, 443)
+	if proto == 6 {
+		f = append(f, make([]byte, 8)...) // seq, ack
+		f = append(f, 8<<4, 0x18)
+		f = append(f, make([]byte, 6+12)...) // window, checksum, urgent, options
+	} else {
+		f = binary.BigEndian.AppendUint16(f, uint16(8+len(payload)))
+		f = append(f, 0, 0)
+	}
+	return append(f, payload...)
+}
+
+func TestRecvHandleRead(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xa5}, 1200)
+	for _, tc := range []struct {
+		name  string
+		proto uint8
+		vlan  bool
+		port  uint16
+		want  bool
+	}{
+		{"tcp", 6, false, 443, true},
+		{"udp", 17, false, 443, true},
+		{"tcp vlan", 6, true, 443, true},
+		{"other port", 6, false, 8443, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &RecvHandle{handle: &frameHandle{frame: testFrame(tc.proto, tc.vlan, payload)}, link: layers.LinkTypeEthernet, port: tc.port, proto: tc.proto}
+			got, addr, err := h.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Release()
+			if !tc.want {
+				if got != nil {
+					t.Fatalf("read %d bytes, want none", len(got))
+				}
+				return
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("read %d bytes, want the %d byte payload", len(got), len(payload))
+			}
+			if ua := addr.(*net.UDPAddr); !ua.IP.Equal(net.IPv4(192, 0, 2, 1)) || ua.Port != 40000 {
+				t.Fatalf("read from %v, want 192.0.2.1:40000", addr)
+			}
+		})
+	}
+}
+
+// BenchmarkRecvHandleRead parses a 1200 byte payload out of each frame,
+// leased from the handle or copied out of it first as pcap's
+// ReadPacketData does.
+func BenchmarkRecvHandleRead(b *testing.B) {
+	payload := make([]byte, 1200)
+	for _, bc := range []struct {
+		name   string
+		proto  uint8
+		copied bool
+	}{
+		{"tcp/lease", 6, false},
+		{"tcp/copy", 6, true},
+		{"udp/lease", 17, false},
+		{"udp/copy", 17, true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			frame := testFrame(bc.proto, false, payload)
+			h := &RecvHandle{handle: &frameHandle{frame: frame, copied: bc.copied}, link: layers.LinkTypeEthernet, port: 443, proto: bc.proto}
+			b.SetBytes(int64(len(frame)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if p, _, _ := h.Read(); len(p) != len(payload) {
+					b.Fatalf("read %d bytes", len(p))
+				}
+				h.Release()
+			}
+		})
+	}
+}
@@ -5,54 +5,51 @@ import (
 	"fmt"
 	"net"
 	"paqet/internal/conf"
-	"paqet/internal/pkg/hash"
+	"paqet/internal/pkg/capture"
 	"paqet/internal/pkg/iterator"
-	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/pcap"
 )
 
 type TCPF struct {
 	tcpF       iterator.Iterator[conf.TCPF]
-	clientTCPF map[uint64]*iterator.Iterator[conf.TCPF]
+	clientTCPF map[uint64]*clientFlags
+	swept      time.Time
 	mu         sync.RWMutex
 }
 
 type SendHandle struct {
-	handle      *pcap.Handle
-	srcIPv4     net.IP
-	srcIPv4RHWA net.HardwareAddr
-	srcIPv6     net.IP
-	srcIPv6RHWA net.HardwareAddr
-	srcPort     uint16
-	synOptions  []layers.TCPOption
-	ackOptions  []layers.TCPOption
-	time        uint32
-	tsCounter   uint32
-	tcpF        TCPF
-	ethPool     sync.Pool
-	ipv4Pool    sync.Pool
-	ipv6Pool    sync.Pool
-	tcpPool     sync.Pool
-	bufPool     sync.Pool
+	handle     rawHandle
+	batch      *batcher
+	srcIPv4    net.IP
+	srcIPv6    net.IP
+	gw         *gateways
+	srcPort    uint16
+	local      *localPorts
+	synOptions []layers.TCPOption
+	ackOptions []layers.TCPOption
+	time       uint32
+	tsCounter  uint32
+	tos        atomic.Uint32
+	ttl        atomic.Uint32 // 0 sends the default of 64
+	tcpF       TCPF
+	udp        bool // UDP datagrams instead of TCP segments, for network.mimic
+	ethPool    sync.Pool
+	ipv4Pool   sync.Pool
+	ipv6Pool   sync.Pool
+	tcpPool    sync.Pool
+	udpPool    sync.Pool
+	bufPool    sync.Pool
 }
 
 func NewSendHandle(cfg *conf.Network) (*SendHandle, error) {
-	handle, err := newHandle(cfg)
+	handle, err := newHandle(cfg, dirOut)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open pcap handle: %w", err)
-	}
-
-	// SetDirection is not fully supported on Windows Npcap, so skip it
-	if runtime.GOOS != "windows" {
-		if err := handle.SetDirection(pcap.DirectionOut); err != nil {
-			return nil, fmt.Errorf("failed to set pcap direction out: %v", err)
-		}
+		return nil, fmt.Errorf("failed to open %s handle: %w", cfg.Backend, err)
 	}
 
 	synOptions := []layers.TCPOption{
@@ -72,10 +69,12 @@ func NewSendHandle(cfg *conf.Network) (*SendHandle, error) {
 	sh := &SendHandle{
 		handle:     handle,
 		srcPort:    uint16(cfg.Port),
+		local:      newLocalPorts(cfg),
 		synOptions: synOptions,
 		ackOptions: ackOptions,
-		tcpF:       TCPF{tcpF: iterator.Iterator[conf.TCPF]{Items: cfg.TCP.LF}, clientTCPF: make(map[uint64]*iterator.Iterator[conf.TCPF])},
+		tcpF:       TCPF{tcpF: iterator.Iterator[conf.TCPF]{Items: cfg.TCP.LF}, clientTCPF: make(map[uint64]*clientFlags)},
 		time:       uint32(time.Now().UnixNano() / int64(time.Millisecond)),
+		udp:        cfg.UDP(),
 		ethPool: sync.Pool{
 			New: func() any {
 				return &layers.Ethernet{SrcMAC: cfg.Interface.HardwareAddr}
@@ -96,55 +95,86 @@ func NewSendHandle(cfg *conf.Network) (*SendHandle, error) {
 				return &layers.TCP{}
 			},
 		},
+		udpPool: sync.Pool{
+			New: func() any {
+				return &layers.UDP{}
+			},
+		},
 		bufPool: sync.Pool{
 			New: func() any {
 				return gopacket.NewSerializeBuffer()
 			},
 		},
 	}
+	if cfg.Batch.Size > 1 {
+		sh.batch = newBatcher(handle, cfg.Batch.Size, time.Duration(cfg.Batch.Delay)*time.Microsecond)
+	}
 	if cfg.IPv4.Addr != nil {
 		sh.srcIPv4 = cfg.IPv4.Addr.IP
-		sh.srcIPv4RHWA = cfg.IPv4.Router
 	}
 	if cfg.IPv6.Addr != nil {
 		sh.srcIPv6 = cfg.IPv6.Addr.IP
-		sh.srcIPv6RHWA = cfg.IPv6.Router
+	}
+	sh.gw, err = newGateways(cfg)
+	if err != nil {
+		handle.Close()
+		return nil, err
 	}
 	return sh, nil
 }
 
+// SetTTL sets the IPv4 TTL and IPv6 hop limit of the packets sent
+// afterwards, for tracing the path; 0 restores the default.
+func (h *SendHandle) SetTTL(ttl int) {
+	h.ttl.Store(uint32(ttl))
+}
+
+func (h *SendHandle) hops() uint8 {
+	if ttl := h.ttl.Load(); ttl != 0 {
+		return uint8(ttl)
+	}
+	return 64
+}
+
 func (h *SendHandle) buildIPv4Header(dstIP net.IP) *layers.IPv4 {
 	ip := h.ipv4Pool.Get().(*layers.IPv4)
 	*ip = layers.IPv4{
 		Version:  4,
 		IHL:      5,
-		TOS:      0, // Default TOS: avoids QoS detection by ISPs. TOS 184 is unusual and can trigger DPI.
-		TTL:      64,
+		TOS:      uint8(h.tos.Load()), // Default TOS 0: avoids QoS detection by ISPs. TOS 184 is unusual and can trigger DPI.
+		TTL:      h.hops(),
 		Flags:    layers.IPv4DontFragment,
-		Protocol: layers.IPProtocolTCP,
+		Protocol: h.proto(),
 		SrcIP:    h.srcIPv4,
 		DstIP:    dstIP,
 	}
 	return ip
 }
 
+func (h *SendHandle) proto() layers.IPProtocol {
+	if h.udp {
+		return layers.IPProtocolUDP
+	}
+	return layers.IPProtocolTCP
+}
+
 func (h *SendHandle) buildIPv6Header(dstIP net.IP) *layers.IPv6 {
 	ip := h.ipv6Pool.Get().(*layers.IPv6)
 	*ip = layers.IPv6{
 		Version:      6,
-		TrafficClass: 0, // Default: avoids QoS detection
-		HopLimit:     64,
-		NextHeader:   layers.IPProtocolTCP,
+		TrafficClass: uint8(h.tos.Load()), // Default 0: avoids QoS detection
+		HopLimit:     h.hops(),
+		NextHeader:   h.proto(),
 		SrcIP:        h.srcIPv6,
 		DstIP:        dstIP,
 	}
 	return ip
 }
 
-func (h *SendHandle) buildTCPHeader(dstPort uint16, f conf.TCPF) *layers.TCP {
+func (h *SendHandle) buildTCPHeader(srcPort, dstPort uint16, f conf.TCPF) *layers.TCP {
 	tcp := h.tcpPool.Get().(*layers.TCP)
 	*tcp = layers.TCP{
-		SrcPort: layers.TCPPort(h.srcPort),
+		SrcPort: layers.TCPPort(srcPort),
 		DstPort: layers.TCPPort(dstPort),
 		FIN:     f.FIN, SYN: f.SYN, RST: f.RST, PSH: f.PSH, ACK: f.ACK, URG: f.URG, ECE: f.ECE, CWR: f.CWR, NS: f.NS,
 		Window: 65535,
@@ -175,6 +205,15 @@ func (h *SendHandle) buildTCPHeader(dstPort uint16, f conf.TCPF) *layers.TCP {
 }
 
 func (h *SendHandle) Write(payload []byte, addr *net.UDPAddr) error {
+	return h.write(payload, addr, h.getClientTCPF(addr.IP, uint16(addr.Port)))
+}
+
+// ack sends addr a pure ACK without payload.
+func (h *SendHandle) ack(addr *net.UDPAddr) error {
+	return h.write(nil, addr, conf.TCPF{ACK: true})
+}
+
+func (h *SendHandle) write(payload []byte, addr *net.UDPAddr, f conf.TCPF) error {
 	buf := h.bufPool.Get().(gopacket.SerializeBuffer)
 	ethLayer := h.ethPool.Get().(*layers.Ethernet)
 	defer func() {
@@ -186,51 +225,86 @@ func (h *SendHandle) Write(payload []byte, addr *net.UDPAddr) error {
 	dstIP := addr.IP
 	dstPort := uint16(addr.Port)
 
-	f := h.getClientTCPF(dstIP, dstPort)
-	tcpLayer := h.buildTCPHeader(dstPort, f)
-	defer h.tcpPool.Put(tcpLayer)
+	srcPort := h.local.get(dstIP, dstPort, h.srcPort)
+	var l4Layer interface {
+		gopacket.SerializableLayer
+		SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+	}
+	if h.udp {
+		udpLayer := h.udpPool.Get().(*layers.UDP)
+		*udpLayer = layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+		defer h.udpPool.Put(udpLayer)
+		l4Layer = udpLayer
+	} else {
+		tcpLayer := h.buildTCPHeader(srcPort, dstPort, f)
+		defer h.tcpPool.Put(tcpLayer)
+		l4Layer = tcpLayer
+	}
 
 	var ipLayer gopacket.SerializableLayer
 	if dstIP.To4() != nil {
 		ip := h.buildIPv4Header(dstIP)
 		defer h.ipv4Pool.Put(ip)
 		ipLayer = ip
-		tcpLayer.SetNetworkLayerForChecksum(ip)
-		ethLayer.DstMAC = h.srcIPv4RHWA
+		l4Layer.SetNetworkLayerForChecksum(ip)
+		ethLayer.DstMAC = h.gw.v4.get()
 		ethLayer.EthernetType = layers.EthernetTypeIPv4
 	} else {
 		ip := h.buildIPv6Header(dstIP)
 		defer h.ipv6Pool.Put(ip)
 		ipLayer = ip
-		tcpLayer.SetNetworkLayerForChecksum(ip)
-		ethLayer.DstMAC = h.srcIPv6RHWA
+		l4Layer.SetNetworkLayerForChecksum(ip)
+		ethLayer.DstMAC = h.gw.v6.get()
 		ethLayer.EthernetType = layers.EthernetTypeIPv6
 	}
 
 	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
-	if err := gopacket.SerializeLayers(buf, opts, ethLayer, ipLayer, tcpLayer, gopacket.Payload(payload)); err != nil {
+	if err := gopacket.SerializeLayers(buf, opts, ethLayer, ipLayer, l4Layer, gopacket.Payload(payload)); err != nil {
 		return err
 	}
-	return h.handle.WritePacketData(buf.Bytes())
+	frame := buf.Bytes()
+	capture.Sent(frame, len(frame)-len(payload), addr)
+	var err error
+	if h.batch != nil {
+		err = h.batch.write(frame)
+	} else {
+		err = writeRetry(h.handle, frame)
+	}
+	if err != nil && classifySend(err) != sendTransient {
+		h.gw.stale()
+	}
+	return err
 }
 
-func (h *SendHandle) getClientTCPF(dstIP net.IP, dstPort uint16) conf.TCPF {
-	h.tcpF.mu.RLock()
-	defer h.tcpF.mu.RUnlock()
-	if ff := h.tcpF.clientTCPF[hash.IPAddr(dstIP, dstPort)]; ff != nil {
-		return ff.Next()
+// inherit carries over the marking, client flags and ports set on old, the
+// handle of the previous generation.
+func (h *SendHandle) inherit(old sender) {
+	o, ok := old.(*SendHandle)
+	if !ok {
+		return
+	}
+	h.tos.Store(o.tos.Load())
+	h.local.inherit(o.local)
+	o.tcpF.mu.RLock()
+	defer o.tcpF.mu.RUnlock()
+	h.tcpF.mu.Lock()
+	defer h.tcpF.mu.Unlock()
+	h.tcpF.tcpF = iterator.Iterator[conf.TCPF]{Items: o.tcpF.tcpF.Items}
+	for k, v := range o.tcpF.clientTCPF {
+		h.tcpF.clientTCPF[k] = v
 	}
-	return h.tcpF.tcpF.Next()
 }
 
-func (h *SendHandle) setClientTCPF(addr net.Addr, f []conf.TCPF) {
-	a := *addr.(*net.UDPAddr)
-	h.tcpF.mu.Lock()
-	h.tcpF.clientTCPF[hash.IPAddr(a.IP, uint16(a.Port))] = &iterator.Iterator[conf.TCPF]{Items: f}
-	h.tcpF.mu.Unlock()
+// setDSCP marks the IPv4 TOS / IPv6 traffic class of every packet sent.
+func (h *SendHandle) setDSCP(dscp int) {
+	h.tos.Store(uint32(dscp) << 2)
 }
 
 func (h *SendHandle) Close() {
+	h.gw.close()
+	if h.batch != nil {
+		h.batch.flush()
+	}
 	if h.handle != nil {
 		h.handle.Close()
 	}
@@ -0,0 +1,102 @@
+package socket
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// sendClass groups injection errors by what can be done about them.
+type sendClass int
+
+const (
+	sendTransient   sendClass = iota // queue full: retried after a pause
+	sendDown                         // interface or handle gone: reopen
+	sendUnreachable                  // no route: the packet is lost
+	sendTooBig                       // frame over the device MTU
+	sendOther
+	numSendClasses
+)
+
+var sendClassNames = [numSendClasses]string{"transient", "down", "unreachable", "too_big", "other"}
+
+func (c sendClass) String() string { return sendClassNames[c] }
+
+// sendErrs counts failed sends by class; sendRetried counts transient
+// failures that a retry got through.
+var (
+	sendErrs    [numSendClasses]atomic.Uint64
+	sendRetried atomic.Uint64
+)
+
+// classifySend sorts err by errno where the handle keeps it, and by the
+// message libpcap and WinDivert turn it into otherwise.
+func classifySend(err error) sendClass {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ENOBUFS, syscall.EAGAIN, syscall.ENOMEM, syscall.EINTR:
+			return sendTransient
+		case syscall.ENETDOWN, syscall.ENODEV, syscall.ENXIO, syscall.EBADF:
+			return sendDown
+		case syscall.ENETUNREACH, syscall.EHOSTUNREACH, syscall.EADDRNOTAVAIL:
+			return sendUnreachable
+		case syscall.EMSGSIZE:
+			return sendTooBig
+		}
+	}
+	if errors.Is(err, os.ErrClosed) {
+		return sendDown
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "no buffer space"), strings.Contains(msg, "temporarily unavailable"):
+		return sendTransient
+	case strings.Contains(msg, "network is down"), strings.Contains(msg, "no such device"),
+		strings.Contains(msg, "went down"), strings.Contains(msg, "device not configured"):
+		return sendDown
+	case strings.Contains(msg, "unreachable"):
+		return sendUnreachable
+	case strings.Contains(msg, "message too long"):
+		return sendTooBig
+	}
+	return sendOther
+}
+
+// sendRetries bounds the pauses a transient failure gets, doubling from
+// sendBackoff.
+const (
+	sendRetries = 3
+	sendBackoff = 100 * time.Microsecond
+)
+
+// writeRetry injects data, retrying transient failures, and counts the
+// failure that is finally returned.
+func writeRetry(h rawHandle, data []byte) error {
+	err := h.WritePacketData(data)
+	for i := 0; err != nil && i < sendRetries && classifySend(err) == sendTransient; i++ {
+		time.Sleep(sendBackoff << i)
+		if err = h.WritePacketData(data); err == nil {
+			sendRetried.Add(1)
+		}
+	}
+	if err != nil {
+		sendErrs[classifySend(err)].Add(1)
+	}
+	return err
+}
+
+// SendErrors returns the failed sends so far by class, and how many
+// transient failures succeeded on retry.
+func SendErrors() (map[string]uint64, uint64) {
+	m := make(map[string]uint64)
+	for i := 0; i < int(numSendClasses); i++ {
+		if n := sendErrs[i].Load(); n > 0 {
+			m[sendClassNames[i]] = n
+		}
+	}
+	return m, sendRetried.Load()
+}
@@ -7,16 +7,26 @@ import (
 	"net"
 	"os"
 	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/chaos"
+	"paqet/internal/pkg/flight"
+	"paqet/internal/pkg/hash"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type PacketConn struct {
 	cfg           *conf.Network
-	sendHandle    *SendHandle
-	recvHandle    *RecvHandle
+	io            atomic.Pointer[handles]
+	mu            sync.Mutex // serialises handle swaps, setters and Close
+	kick          chan struct{}
+	decoys        *decoys
+	cover         *cover         // nil unless network.mimic is a UDP protocol
+	held          []*net.UDPConn // see holdPorts
 	readDeadline  atomic.Value
 	writeDeadline atomic.Value
+	lastRead      atomic.Int64 // unix nanoseconds
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -28,23 +38,26 @@ func New(ctx context.Context, cfg *conf.Network) (*PacketConn, error) {
 		cfg.Port = 32768 + rand.Intn(32768)
 	}
 
-	sendHandle, err := NewSendHandle(cfg)
+	h, err := openHandles(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create send handle on %s: %v", cfg.Interface.Name, err)
-	}
-
-	recvHandle, err := NewRecvHandle(cfg)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create receive handle on %s: %v", cfg.Interface.Name, err)
+		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
 	conn := &PacketConn{
-		cfg:        cfg,
-		sendHandle: sendHandle,
-		recvHandle: recvHandle,
-		ctx:        ctx,
-		cancel:     cancel,
+		cfg:    cfg,
+		kick:   make(chan struct{}, 1),
+		decoys: newDecoys(time.Duration(cfg.TCP.Decoy) * time.Second),
+		cover:  newCover(cfg),
+		held:   holdPorts(cfg),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	conn.io.Store(h)
+	conn.lastRead.Store(time.Now().UnixNano())
+	go conn.maintain()
+	if conn.decoys != nil {
+		go conn.keepalive()
 	}
 
 	return conn, nil
@@ -59,6 +72,56 @@ func (c *PacketConn) ReadFrom(data []byte) (n int, addr net.Addr, err error) {
 		deadline = timer.C
 	}
 
+	for {
+		h := c.io.Load()
+		n, addr, err = c.read(h, data, deadline)
+		if err == nil {
+			c.lastRead.Store(time.Now().UnixNano())
+			return n, addr, nil
+		}
+		if err == os.ErrDeadlineExceeded || c.ctx.Err() != nil {
+			return 0, nil, err
+		}
+		// The handles died with the interface; wait for the next set
+		// instead of failing the sessions on top.
+		c.failed(h, err)
+		select {
+		case <-c.ctx.Done():
+			return 0, nil, c.ctx.Err()
+		case <-deadline:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-h.replaced:
+		}
+	}
+}
+
+func (c *PacketConn) read(h *handles, data []byte, deadline <-chan time.Time) (n int, addr net.Addr, err error) {
+	if w := h.workers; w != nil {
+		for {
+			select {
+			case <-c.ctx.Done():
+				return 0, nil, c.ctx.Err()
+			case <-deadline:
+				return 0, nil, os.ErrDeadlineExceeded
+			case <-w.done:
+				return 0, nil, w.err
+			case p := <-w.queue:
+				payload := p.buf
+				if c.cover != nil {
+					payload = c.cover.read(h.send, payload, p.addr)
+				}
+				n, addr = copy(data, payload), p.addr
+				w.put(p)
+				if n == 0 {
+					continue
+				}
+				chaos.Corrupt(data[:n])
+				record(flight.In, n, addr)
+				return n, addr, nil
+			}
+		}
+	}
+
 	for {
 		select {
 		case <-c.ctx.Done():
@@ -68,20 +131,27 @@ func (c *PacketConn) ReadFrom(data []byte) (n int, addr net.Addr, err error) {
 		default:
 		}
 
-		payload, addr, err := c.recvHandle.Read()
+		payload, addr, err := h.recv.Read()
 		if err != nil {
 			return 0, nil, err
 		}
 
 		if len(payload) == 0 || addr == nil {
+			h.recv.Release()
 			continue
 		}
+		if c.cover != nil {
+			payload = c.cover.read(h.send, payload, addr)
+		}
 
 		n = copy(data, payload)
+		h.recv.Release()
 		if n == 0 {
 			continue
 		}
 
+		chaos.Corrupt(data[:n])
+		record(flight.In, n, addr)
 		return n, addr, nil
 	}
 }
@@ -108,22 +178,54 @@ func (c *PacketConn) WriteTo(data []byte, addr net.Addr) (n int, err error) {
 		return 0, net.InvalidAddrError("invalid address")
 	}
 
-	err = c.sendHandle.Write(data, daddr)
+	h := c.io.Load()
+	if c.cover != nil {
+		err = c.cover.write(h.send, data, daddr)
+	} else {
+		err = h.send.Write(data, daddr)
+	}
 	if err != nil {
-		return 0, err
+		// Count the packet as lost; KCP resends it. Only a dead link
+		// (or an error we cannot place) is worth checking the handles.
+		switch cl := classifySend(err); cl {
+		case sendDown, sendOther:
+			c.failed(h, err)
+		default:
+			flog.Debugf("send to %s failed (%s): %v", daddr, cl, err)
+		}
+		return len(data), nil
 	}
+	c.decoys.seen(daddr)
+	record(flight.Out, len(data), daddr)
 
 	return len(data), nil
 }
 
+// Silence returns how long ago a packet was last read, or since c was
+// opened if none was.
+func (c *PacketConn) Silence() time.Duration {
+	return time.Duration(time.Now().UnixNano() - c.lastRead.Load())
+}
+
+func record(dir byte, n int, addr net.Addr) {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		flight.Record(dir, n, hash.IPAddr(a.IP, uint16(a.Port)))
+	}
+}
+
 func (c *PacketConn) Close() error {
 	c.cancel()
 
-	if c.sendHandle != nil {
-		go c.sendHandle.Close()
+	c.mu.Lock()
+	h := c.io.Load()
+	c.mu.Unlock()
+	h.close()
+	for _, u := range c.held {
+		u.Close()
 	}
-	if c.recvHandle != nil {
-		go c.recvHandle.Close()
+
+	if errs, retried := SendErrors(); len(errs) > 0 || retried > 0 {
+		flog.Debugf("send errors on %s: %v (%d transient ones recovered on retry)", c.cfg.Interface.Name, errs, retried)
 	}
 
 	return nil
@@ -155,9 +257,24 @@ func (c *PacketConn) SetWriteDeadline(t time.Time) error {
 }
 
 func (c *PacketConn) SetDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("invalid DSCP %d", dscp)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.io.Load().send.setDSCP(dscp)
 	return nil
 }
 
 func (c *PacketConn) SetClientTCPF(addr net.Addr, f []conf.TCPF) {
-	c.sendHandle.setClientTCPF(addr, f)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.io.Load().send.setClientTCPF(addr, f)
+}
+
+// SetTCPF replaces the flags of packets to peers without their own.
+func (c *PacketConn) SetTCPF(f []conf.TCPF) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.io.Load().send.setTCPF(f)
 }
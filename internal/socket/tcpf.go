@@ -0,0 +1,82 @@
+package socket
+
+import (
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/hash"
+	"paqet/internal/pkg/iterator"
+	"sync/atomic"
+	"time"
+)
+
+// A server keeps the flags each client asked for by address. Sessions
+// come and go without telling, so entries unused for tcpfTTL are swept,
+// and past maxClientTCPF the least recently used one makes room.
+const (
+	tcpfTTL       = 10 * time.Minute
+	maxClientTCPF = 65536
+)
+
+// Evicted client flag entries, by reason.
+var tcpfExpired, tcpfEvicted atomic.Uint64
+
+type clientFlags struct {
+	it   iterator.Iterator[conf.TCPF]
+	used atomic.Int64 // unix nanoseconds of the last packet sent with them
+}
+
+func (h *SendHandle) getClientTCPF(dstIP net.IP, dstPort uint16) conf.TCPF {
+	h.tcpF.mu.RLock()
+	defer h.tcpF.mu.RUnlock()
+	if cf := h.tcpF.clientTCPF[hash.IPAddr(dstIP, dstPort)]; cf != nil {
+		cf.used.Store(time.Now().UnixNano())
+		return cf.it.Next()
+	}
+	return h.tcpF.tcpF.Next()
+}
+
+func (h *SendHandle) setClientTCPF(addr net.Addr, f []conf.TCPF) {
+	a := *addr.(*net.UDPAddr)
+	cf := &clientFlags{it: iterator.Iterator[conf.TCPF]{Items: f}}
+	now := time.Now()
+	cf.used.Store(now.UnixNano())
+
+	h.tcpF.mu.Lock()
+	defer h.tcpF.mu.Unlock()
+	m := h.tcpF.clientTCPF
+	if now.Sub(h.tcpF.swept) > tcpfTTL/10 {
+		h.tcpF.swept = now
+		cutoff := now.Add(-tcpfTTL).UnixNano()
+		for k, v := range m {
+			if v.used.Load() < cutoff {
+				delete(m, k)
+				tcpfExpired.Add(1)
+			}
+		}
+	}
+	key := hash.IPAddr(a.IP, uint16(a.Port))
+	if _, ok := m[key]; !ok && len(m) >= maxClientTCPF {
+		var oldest uint64
+		oldestUsed := int64(1<<63 - 1)
+		for k, v := range m {
+			if u := v.used.Load(); u < oldestUsed {
+				oldest, oldestUsed = k, u
+			}
+		}
+		delete(m, oldest)
+		tcpfEvicted.Add(1)
+	}
+	m[key] = cf
+}
+
+func (h *SendHandle) setTCPF(f []conf.TCPF) {
+	h.tcpF.mu.Lock()
+	defer h.tcpF.mu.Unlock()
+	h.tcpF.tcpF = iterator.Iterator[conf.TCPF]{Items: f}
+}
+
+// TCPFEvictions returns how many client flag entries were dropped for
+// being unused too long, and to stay under the size cap.
+func TCPFEvictions() (expired, evicted uint64) {
+	return tcpfExpired.Load(), tcpfEvicted.Load()
+}
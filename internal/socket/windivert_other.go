@@ -0,0 +1,12 @@
+//go:build !windows
+
+package socket
+
+import (
+	"fmt"
+	"paqet/internal/conf"
+)
+
+func newWinDivertHandle(cfg *conf.Network, dir direction) (rawHandle, error) {
+	return nil, fmt.Errorf("windivert backend is only available on windows")
+}
@@ -0,0 +1,164 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"paqet/internal/conf"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/gopacket/gopacket"
+	"golang.org/x/sys/windows"
+)
+
+// WinDivert.dll is looked up next to the executable first, which is
+// where the WinDivert release expects it (with WinDivert64.sys).
+var (
+	winDivert       = windows.NewLazyDLL("WinDivert.dll")
+	procDivertOpen  = winDivert.NewProc("WinDivertOpen")
+	procDivertRecv  = winDivert.NewProc("WinDivertRecv")
+	procDivertSend  = winDivert.NewProc("WinDivertSend")
+	procDivertStop  = winDivert.NewProc("WinDivertShutdown")
+	procDivertClose = winDivert.NewProc("WinDivertClose")
+)
+
+const (
+	divertLayerNetwork = 0
+	divertFlagRecvOnly = 0x4
+	divertFlagSendOnly = 0x8
+	divertShutdownBoth = 0x3
+
+	divertOutbound    = 1 << 17
+	divertIPv6        = 1 << 20
+	divertIPChecksum  = 1 << 21
+	divertTCPChecksum = 1 << 22
+)
+
+// divertAddress is WINDIVERT_ADDRESS for the network layer.
+type divertAddress struct {
+	Timestamp int64
+	Flags     uint32 // Layer, Event and the Outbound/IPv6/checksum bits
+	_         uint32
+	IfIdx     uint32
+	SubIfIdx  uint32
+	_         [56]byte
+}
+
+// winDivertHandle captures and injects through the WinDivert driver.
+// WinDivert works on IP packets, so a blank Ethernet header is added on
+// receive and stripped on send. Inbound packets for our port are
+// diverted rather than copied, so the Windows TCP stack never sees them
+// and cannot answer with RSTs.
+type winDivertHandle struct {
+	h      uintptr
+	ifIdx  uint32
+	buf    []byte
+	mu     sync.Mutex
+	closed atomic.Bool
+}
+
+func newWinDivertHandle(cfg *conf.Network, dir direction) (rawHandle, error) {
+	if err := winDivert.Load(); err != nil {
+		return nil, fmt.Errorf("failed to load WinDivert.dll: %v", err)
+	}
+
+	filter, flags := "false", uint64(divertFlagSendOnly)
+	if dir == dirIn {
+		_, proto := l4(cfg)
+		filter = fmt.Sprintf("inbound and ifIdx == %d and %s", cfg.Interface.Index, portExpr(cfg.Port, cfg.Ports, true, proto))
+		if src := srcExpr(cfg.Sources, true); src != "" {
+			filter += " and " + src
+		}
+		flags = divertFlagRecvOnly
+	}
+	f, err := windows.BytePtrFromString(filter)
+	if err != nil {
+		return nil, err
+	}
+	args := []uintptr{uintptr(unsafe.Pointer(f)), divertLayerNetwork, 0, uintptr(flags)}
+	if unsafe.Sizeof(uintptr(0)) == 4 {
+		args = append(args, uintptr(flags>>32)) // UINT64 takes two slots on 386
+	}
+	h, _, err := procDivertOpen.Call(args...)
+	if h == uintptr(windows.InvalidHandle) {
+		return nil, fmt.Errorf("failed to open WinDivert handle on %s: %v", cfg.Interface.Name, err)
+	}
+	return &winDivertHandle{h: h, ifIdx: uint32(cfg.Interface.Index), buf: make([]byte, 14+0xffff)}, nil
+}
+
+func (h *winDivertHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for {
+		if h.closed.Load() {
+			return nil, gopacket.CaptureInfo{}, os.ErrClosed
+		}
+		var n uint32
+		var addr divertAddress
+		ok, _, err := procDivertRecv.Call(h.h, uintptr(unsafe.Pointer(&h.buf[14])), uintptr(len(h.buf)-14),
+			uintptr(unsafe.Pointer(&n)), uintptr(unsafe.Pointer(&addr)))
+		if ok == 0 {
+			if h.closed.Load() || errors.Is(err, windows.ERROR_NO_DATA) {
+				return nil, gopacket.CaptureInfo{}, os.ErrClosed
+			}
+			if errors.Is(err, windows.ERROR_INSUFFICIENT_BUFFER) {
+				continue
+			}
+			return nil, gopacket.CaptureInfo{}, fmt.Errorf("WinDivert receive failed: %v", err)
+		}
+		if n == 0 {
+			continue
+		}
+
+		data := h.buf[:14+n]
+		clear(data[:12])
+		if data[14]>>4 == 6 {
+			data[12], data[13] = 0x86, 0xdd
+		} else {
+			data[12], data[13] = 0x08, 0x00
+		}
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+		return data, ci, nil
+	}
+}
+
+// WritePacketData injects data, an Ethernet frame built by SendHandle,
+// as an outbound IP packet on the configured interface. Windows fills in
+// the link layer itself.
+// Release does nothing; the receive buffer is reused on the next read.
+func (h *winDivertHandle) Release() {}
+
+func (h *winDivertHandle) WritePacketData(data []byte) error {
+	if h.closed.Load() {
+		return os.ErrClosed
+	}
+	if len(data) <= 14 {
+		return fmt.Errorf("packet too short")
+	}
+	pkt := data[14:]
+	addr := divertAddress{Flags: divertOutbound | divertIPChecksum | divertTCPChecksum, IfIdx: h.ifIdx}
+	if pkt[0]>>4 == 6 {
+		addr.Flags |= divertIPv6
+	}
+	ok, _, err := procDivertSend.Call(h.h, uintptr(unsafe.Pointer(&pkt[0])), uintptr(len(pkt)), 0, uintptr(unsafe.Pointer(&addr)))
+	if ok == 0 {
+		return fmt.Errorf("WinDivert send failed: %v", err)
+	}
+	return nil
+}
+
+// Close shuts the handle down first, which wakes a blocked receive, and
+// waits for it to return before closing.
+func (h *winDivertHandle) Close() {
+	if h.closed.Swap(true) {
+		return
+	}
+	procDivertStop.Call(h.h, divertShutdownBoth)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	procDivertClose.Call(h.h)
+}
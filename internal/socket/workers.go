@@ -0,0 +1,101 @@
+package socket
+
+import (
+	"fmt"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/buffer"
+	"sync"
+)
+
+// packet is a received payload in a buffer of the size class that
+// fits it.
+type packet struct {
+	bufp *[]byte
+	buf  []byte
+	addr net.Addr
+}
+
+// newPacket copies payload into a pooled buffer.
+func newPacket(payload []byte, addr net.Addr) *packet {
+	p := &packet{bufp: buffer.Get(len(payload)), addr: addr}
+	p.buf = (*p.bufp)[:copy(*p.bufp, payload)]
+	return p
+}
+
+// release returns the buffer of p to the pool.
+func (p *packet) release() {
+	buffer.Put(p.bufp)
+	p.bufp, p.buf, p.addr = nil, nil, nil
+}
+
+// recvWorkers captures with one handle per worker, all in the same
+// kernel fanout group, so capture and parsing run on several cores.
+// The flow hash keeps each peer on one worker, which preserves the
+// order of its packets through the shared queue.
+type recvWorkers struct {
+	handles []*RecvHandle
+	queue   chan *packet
+	done    chan struct{}
+	once    sync.Once
+	err     error
+}
+
+func newRecvWorkers(cfg *conf.Network, n int, local *localPorts) (*recvWorkers, error) {
+	w := &recvWorkers{
+		queue: make(chan *packet, 1024),
+		done:  make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		h, err := newRecvHandle(cfg, local)
+		if err != nil {
+			w.close()
+			return nil, fmt.Errorf("receive worker %d: %v", i, err)
+		}
+		w.handles = append(w.handles, h)
+	}
+	for _, h := range w.handles {
+		go w.run(h)
+	}
+	return w, nil
+}
+
+func (w *recvWorkers) run(h *RecvHandle) {
+	for {
+		payload, addr, err := h.Read()
+		if err != nil {
+			w.stop(err)
+			return
+		}
+		if len(payload) == 0 || addr == nil {
+			h.Release()
+			continue
+		}
+		p := newPacket(payload, addr)
+		h.Release()
+		select {
+		case w.queue <- p:
+		case <-w.done:
+			p.release()
+			return
+		}
+	}
+}
+
+func (w *recvWorkers) put(p *packet) {
+	p.release()
+}
+
+func (w *recvWorkers) stop(err error) {
+	w.once.Do(func() {
+		w.err = err
+		close(w.done)
+	})
+}
+
+func (w *recvWorkers) close() {
+	w.stop(net.ErrClosed)
+	for _, h := range w.handles {
+		h.Close()
+	}
+}
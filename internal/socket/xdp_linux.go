@@ -0,0 +1,283 @@
+package socket
+
+import (
+	"fmt"
+	"os"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/gopacket/gopacket"
+	"golang.org/x/sys/unix"
+)
+
+const xdpFrameSize = 2048
+
+// xskRing is one mmap'd AF_XDP ring: a producer/consumer index pair in
+// front of a power-of-two array of descriptors.
+type xskRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	desc     unsafe.Pointer
+	mask     uint32
+}
+
+func mapRing(fd int, pgoff int64, off unix.XDPRingOffset, n, descSize int) (xskRing, error) {
+	mem, err := unix.Mmap(fd, pgoff, int(off.Desc)+n*descSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return xskRing{}, err
+	}
+	return xskRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[off.Producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[off.Consumer])),
+		desc:     unsafe.Pointer(&mem[off.Desc]),
+		mask:     uint32(n - 1),
+	}, nil
+}
+
+// xsk is the AF_XDP socket of one RX queue with its own UMEM.
+type xsk struct {
+	fd      int
+	umem    []byte
+	rx      xskRing
+	fill    xskRing
+	rxCons  uint32
+	fillPrd uint32
+}
+
+func (s *xsk) rxDesc(i uint32) *unix.XDPDesc {
+	return (*unix.XDPDesc)(unsafe.Add(s.rx.desc, uintptr(i&s.rx.mask)*unsafe.Sizeof(unix.XDPDesc{})))
+}
+
+func (s *xsk) refill(addr uint64) {
+	*(*uint64)(unsafe.Add(s.fill.desc, uintptr(s.fillPrd&s.fill.mask)*8)) = addr &^ (xdpFrameSize - 1)
+	s.fillPrd++
+	atomic.StoreUint32(s.fill.producer, s.fillPrd)
+}
+
+func (s *xsk) close() {
+	for _, m := range [][]byte{s.rx.mem, s.fill.mem, s.umem} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	unix.Close(s.fd)
+}
+
+// xdpHandle receives through AF_XDP: an XDP program redirects packets
+// for our port into one socket per RX queue before the kernel stack
+// sees them. Packets returned by ReadPacketData point into the UMEM and
+// are only valid until the next call.
+type xdpHandle struct {
+	socks   []*xsk
+	pollFds []unix.PollFd
+	mapFd   int
+	progFd  int
+	linkFd  int
+	next    int  // socket to read from first
+	held    *xsk // socket whose frame the caller holds
+	heldA   uint64
+	mu      sync.Mutex
+	closed  atomic.Bool
+}
+
+// newXDPHandle opens the XDP receive path, or falls back to afpacket
+// when the kernel or NIC cannot run it. Sending always uses afpacket.
+func newXDPHandle(cfg *conf.Network, dir direction) (rawHandle, error) {
+	if dir == dirIn {
+		h, err := openXDP(cfg)
+		if err == nil {
+			return h, nil
+		}
+		flog.Warnf("XDP receive path unavailable on %s, falling back to afpacket: %v", cfg.Interface.Name, err)
+	}
+	return newAFPacketHandle(cfg, dir)
+}
+
+func openXDP(cfg *conf.Network) (*xdpHandle, error) {
+	queues := rxQueues(cfg.Interface.Name)
+	h := &xdpHandle{mapFd: -1, progFd: -1, linkFd: -1}
+	fail := func(format string, a ...any) (*xdpHandle, error) {
+		h.Close()
+		return nil, fmt.Errorf(format, a...)
+	}
+
+	var err error
+	proto, _ := l4(cfg)
+	if h.mapFd, err = bpfXSKMap(queues); err != nil {
+		return fail("failed to create XSKMAP: %v", err)
+	}
+	if h.progFd, err = bpfLoadXDP(xdpRedirectProg(h.mapFd, proto, uint16(cfg.Port), cfg.Ports)); err != nil {
+		return fail("failed to load XDP program: %v", err)
+	}
+
+	frames := max(cfg.PCAP.Sockbuf/xdpFrameSize/queues, 256)
+	frames = 1 << (bitLen(frames) - 1) // ring sizes must be powers of two
+	for q := 0; q < queues; q++ {
+		s, err := openXSK(cfg.Interface.Index, q, frames)
+		if err != nil {
+			return fail("failed to open AF_XDP socket on queue %d: %v", q, err)
+		}
+		h.socks = append(h.socks, s)
+		h.pollFds = append(h.pollFds, unix.PollFd{Fd: int32(s.fd), Events: unix.POLLIN})
+		if err := bpfMapUpdate(h.mapFd, uint32(q), uint32(s.fd)); err != nil {
+			return fail("failed to register queue %d: %v", q, err)
+		}
+	}
+
+	// Native (driver) mode first, then generic mode for NICs without
+	// XDP support in their driver.
+	mode := "native"
+	if h.linkFd, err = bpfLinkXDP(h.progFd, cfg.Interface.Index, unix.XDP_FLAGS_DRV_MODE); err != nil {
+		mode = "generic"
+		if h.linkFd, err = bpfLinkXDP(h.progFd, cfg.Interface.Index, unix.XDP_FLAGS_SKB_MODE); err != nil {
+			h.linkFd = -1
+			return fail("failed to attach XDP program: %v", err)
+		}
+	}
+	flog.Infof("XDP program attached to %s in %s mode (%d queues)", cfg.Interface.Name, mode, queues)
+	return h, nil
+}
+
+func openXSK(ifindex, queue, frames int) (*xsk, error) {
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := &xsk{fd: fd}
+	fail := func(format string, a ...any) (*xsk, error) {
+		s.close()
+		return nil, fmt.Errorf(format, a...)
+	}
+
+	s.umem, err = unix.Mmap(-1, 0, frames*xdpFrameSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+	if err != nil {
+		return fail("umem: %v", err)
+	}
+	reg := unix.XDPUmemReg{Addr: uint64(uintptr(unsafe.Pointer(&s.umem[0]))), Len: uint64(len(s.umem)), Size: xdpFrameSize}
+	if err := setsockopt(fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return fail("umem register: %v", err)
+	}
+	for _, opt := range []struct{ name, size int }{
+		{unix.XDP_UMEM_FILL_RING, frames},
+		{unix.XDP_UMEM_COMPLETION_RING, 64}, // unused, but bind requires it
+		{unix.XDP_RX_RING, frames},
+	} {
+		if err := unix.SetsockoptInt(fd, unix.SOL_XDP, opt.name, opt.size); err != nil {
+			return fail("ring size: %v", err)
+		}
+	}
+
+	var off unix.XDPMmapOffsets
+	size := uint32(unsafe.Sizeof(off))
+	if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS, uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+		return fail("mmap offsets: %v", errno)
+	}
+	if s.rx, err = mapRing(fd, unix.XDP_PGOFF_RX_RING, off.Rx, frames, int(unsafe.Sizeof(unix.XDPDesc{}))); err != nil {
+		return fail("rx ring: %v", err)
+	}
+	if s.fill, err = mapRing(fd, unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, frames, 8); err != nil {
+		return fail("fill ring: %v", err)
+	}
+	for i := 0; i < frames; i++ {
+		s.refill(uint64(i * xdpFrameSize))
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrXDP{Ifindex: uint32(ifindex), QueueID: uint32(queue)}); err != nil {
+		return fail("bind: %v", err)
+	}
+	return s, nil
+}
+
+func setsockopt(fd, name int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(name), uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func rxQueues(iface string) int {
+	m, _ := filepath.Glob(filepath.Join("/sys/class/net", iface, "queues", "rx-*"))
+	return max(len(m), 1)
+}
+
+func bitLen(n int) int {
+	l := 0
+	for ; n > 0; n >>= 1 {
+		l++
+	}
+	return l
+}
+
+func (h *xdpHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.held != nil {
+		h.held.refill(h.heldA)
+		h.held = nil
+	}
+	for {
+		if h.closed.Load() {
+			return nil, gopacket.CaptureInfo{}, os.ErrClosed
+		}
+		for i := range h.socks {
+			s := h.socks[(h.next+i)%len(h.socks)]
+			if atomic.LoadUint32(s.rx.producer) == s.rxCons {
+				continue
+			}
+			d := *s.rxDesc(s.rxCons)
+			s.rxCons++
+			atomic.StoreUint32(s.rx.consumer, s.rxCons)
+			// Start with the next queue so a busy one cannot starve the rest.
+			h.next = (h.next + i + 1) % len(h.socks)
+			h.held, h.heldA = s, d.Addr
+
+			n := min(int(d.Len), snapLen)
+			ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: n, Length: int(d.Len)}
+			return s.umem[d.Addr : d.Addr+uint64(n)], ci, nil
+		}
+		if _, err := unix.Poll(h.pollFds, afPollMs); err != nil && err != unix.EINTR {
+			return nil, gopacket.CaptureInfo{}, fmt.Errorf("poll failed: %v", err)
+		}
+	}
+}
+
+// Release puts the frame of the last packet back on the fill ring.
+func (h *xdpHandle) Release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.held != nil && !h.closed.Load() {
+		h.held.refill(h.heldA)
+		h.held = nil
+	}
+}
+
+func (h *xdpHandle) WritePacketData(data []byte) error {
+	return fmt.Errorf("XDP handle is receive only")
+}
+
+// Close detaches the program first so the NIC stops redirecting into
+// sockets that are about to go away.
+func (h *xdpHandle) Close() {
+	if h.closed.Swap(true) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, fd := range []int{h.linkFd, h.progFd, h.mapFd} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+	for _, s := range h.socks {
+		s.close()
+	}
+}
@@ -0,0 +1,258 @@
+package socket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"paqet/internal/conf"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ebpf is one eBPF instruction as laid out in struct bpf_insn.
+type ebpf struct {
+	code uint8
+	regs uint8 // dst in the low nibble, src in the high nibble
+	off  int16
+	imm  int32
+}
+
+const (
+	ebpfLDX   = 0x01
+	ebpfJMP   = 0x05
+	ebpfALU   = 0x04
+	ebpfALU64 = 0x07
+	ebpfMEM   = 0x60
+	ebpfW     = 0x00
+	ebpfH     = 0x08
+	ebpfB     = 0x10
+	ebpfK     = 0x00
+	ebpfX     = 0x08
+	ebpfADD   = 0x00
+	ebpfAND   = 0x50
+	ebpfLSH   = 0x60
+	ebpfMOV   = 0xb0
+	ebpfEND   = 0xd0
+	ebpfTOBE  = 0x08
+	ebpfJA    = 0x00
+	ebpfJEQ   = 0x10
+	ebpfJGT   = 0x20
+	ebpfJGE   = 0x30
+	ebpfJNE   = 0x50
+
+	xdpPass            = 2
+	bpfFuncRedirectMap = 51
+)
+
+// ebpfAsm builds a program with forward jumps to named labels.
+type ebpfAsm struct {
+	insns  []ebpf
+	labels map[string]int
+	fixups map[int]string
+}
+
+func (a *ebpfAsm) emit(i ebpf) { a.insns = append(a.insns, i) }
+
+func (a *ebpfAsm) label(name string) { a.labels[name] = len(a.insns) }
+
+func (a *ebpfAsm) ldx(size uint8, dst, src uint8, off int16) {
+	a.emit(ebpf{code: ebpfLDX | ebpfMEM | size, regs: dst | src<<4, off: off})
+}
+
+func (a *ebpfAsm) aluK(op uint8, dst uint8, imm int32) {
+	a.emit(ebpf{code: ebpfALU64 | op | ebpfK, regs: dst, imm: imm})
+}
+
+func (a *ebpfAsm) aluX(op uint8, dst, src uint8) {
+	a.emit(ebpf{code: ebpfALU64 | op | ebpfX, regs: dst | src<<4})
+}
+
+// toBE turns the network-order halfword loaded into dst into its value.
+func (a *ebpfAsm) toBE(dst uint8) {
+	a.emit(ebpf{code: ebpfALU | ebpfEND | ebpfTOBE, regs: dst, imm: 16})
+}
+
+func (a *ebpfAsm) jmpK(op uint8, dst uint8, imm int32, to string) {
+	a.fixups[len(a.insns)] = to
+	a.emit(ebpf{code: ebpfJMP | op | ebpfK, regs: dst, imm: imm})
+}
+
+func (a *ebpfAsm) jmpX(op uint8, dst, src uint8, to string) {
+	a.fixups[len(a.insns)] = to
+	a.emit(ebpf{code: ebpfJMP | op | ebpfX, regs: dst | src<<4})
+}
+
+func (a *ebpfAsm) ldMapFd(dst uint8, fd int) {
+	a.emit(ebpf{code: 0x18, regs: dst | unix.BPF_PSEUDO_MAP_FD<<4, imm: int32(fd)})
+	a.emit(ebpf{})
+}
+
+func (a *ebpfAsm) call(fn int32) { a.emit(ebpf{code: ebpfJMP | 0x80, imm: fn}) }
+
+func (a *ebpfAsm) exit() { a.emit(ebpf{code: ebpfJMP | 0x90}) }
+
+func (a *ebpfAsm) resolve() []ebpf {
+	for pc, to := range a.fixups {
+		a.insns[pc].off = int16(a.labels[to] - pc - 1)
+	}
+	return a.insns
+}
+
+// be16 returns the value a native-endian 16-bit load sees for the
+// network-order bytes of v.
+func be16(v uint16) int32 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return int32(binary.NativeEndian.Uint16(b[:]))
+}
+
+// xdpRedirectProg redirects packets of IP protocol proto to port, or any
+// of ports, into the AF_XDP socket of their RX queue (XSKMAP mapFd) and
+// passes everything else to the stack, matching the pcap filter
+// "tcp and dst port <port>". TCP and UDP keep the port at one offset.
+func xdpRedirectProg(mapFd int, proto uint8, port uint16, ports []conf.PortRange) []ebpf {
+	a := &ebpfAsm{labels: map[string]int{}, fixups: map[int]string{}}
+	const r0, r1, r2, r3, r4, r5, r6 = 0, 1, 2, 3, 4, 5, 6
+
+	a.aluX(ebpfMOV, r6, r1)
+	a.ldx(ebpfW, r2, r6, 0) // xdp_md.data
+	a.ldx(ebpfW, r3, r6, 4) // xdp_md.data_end
+	a.aluX(ebpfMOV, r4, r2)
+	a.aluK(ebpfADD, r4, 14)
+	a.jmpX(ebpfJGT, r4, r3, "pass")
+	a.ldx(ebpfH, r5, r2, 12)
+	a.jmpK(ebpfJEQ, r5, be16(0x0800), "ipv4")
+	a.jmpK(ebpfJEQ, r5, be16(0x86dd), "ipv6")
+	a.jmpK(ebpfJA, 0, 0, "pass")
+
+	a.label("ipv4")
+	a.aluX(ebpfMOV, r4, r2)
+	a.aluK(ebpfADD, r4, 14+20)
+	a.jmpX(ebpfJGT, r4, r3, "pass")
+	a.ldx(ebpfB, r5, r2, 14+9)
+	a.jmpK(ebpfJNE, r5, int32(proto), "pass")
+	a.ldx(ebpfH, r5, r2, 14+6)
+	a.aluK(ebpfAND, r5, be16(0x1fff))
+	a.jmpK(ebpfJNE, r5, 0, "pass")
+	a.ldx(ebpfB, r5, r2, 14)
+	a.aluK(ebpfAND, r5, 0x0f)
+	a.aluK(ebpfLSH, r5, 2)
+	a.aluX(ebpfMOV, r4, r2)
+	a.aluX(ebpfADD, r4, r5)
+	a.aluK(ebpfADD, r4, 14)
+	a.aluX(ebpfMOV, r5, r4)
+	a.aluK(ebpfADD, r5, 4)
+	a.jmpX(ebpfJGT, r5, r3, "pass")
+	a.ldx(ebpfH, r5, r4, 2)
+	a.jmpK(ebpfJA, 0, 0, "port")
+
+	a.label("ipv6")
+	a.aluX(ebpfMOV, r4, r2)
+	a.aluK(ebpfADD, r4, 14+40+4)
+	a.jmpX(ebpfJGT, r4, r3, "pass")
+	a.ldx(ebpfB, r5, r2, 14+6)
+	a.jmpK(ebpfJNE, r5, int32(proto), "pass")
+	a.ldx(ebpfH, r5, r2, 14+40+2)
+
+	a.label("port")
+	if len(ports) == 0 {
+		a.jmpK(ebpfJNE, r5, be16(port), "pass")
+	} else {
+		a.toBE(r5)
+		a.jmpK(ebpfJEQ, r5, int32(port), "redirect")
+		for i, r := range ports {
+			next := fmt.Sprintf("range%d", i)
+			a.jmpK(ebpfJGT, r5, int32(r.Hi), next)
+			a.jmpK(ebpfJGE, r5, int32(r.Lo), "redirect")
+			a.label(next)
+		}
+		a.jmpK(ebpfJA, 0, 0, "pass")
+	}
+
+	a.label("redirect")
+	a.ldx(ebpfW, r2, r6, 16) // xdp_md.rx_queue_index
+	a.ldMapFd(r1, mapFd)
+	a.aluK(ebpfMOV, r3, xdpPass) // no socket on this queue: pass
+	a.call(bpfFuncRedirectMap)
+	a.exit()
+
+	a.label("pass")
+	a.aluK(ebpfMOV, r0, xdpPass)
+	a.exit()
+	return a.resolve()
+}
+
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func bpfXSKMap(entries int) (int, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries, mapFlags uint32
+	}{unix.BPF_MAP_TYPE_XSKMAP, 4, 4, uint32(entries), 0}
+	return bpfSyscall(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfMapUpdate(mapFd int, key, value uint32) error {
+	attr := struct {
+		mapFd uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{mapFd: uint32(mapFd), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+	_, err := bpfSyscall(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func bpfLoadXDP(insns []ebpf) (int, error) {
+	license := []byte("Dual MIT/GPL\x00")
+	log := make([]byte, 64*1024)
+	attr := struct {
+		progType, insnCnt  uint32
+		insns, license     uint64
+		logLevel, logSize  uint32
+		logBuf             uint64
+		kernVersion, flags uint32
+		name               [16]byte
+	}{
+		progType: unix.BPF_PROG_TYPE_XDP,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(log)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&log[0]))),
+	}
+	copy(attr.name[:], "paqet_xdp")
+	fd, err := bpfSyscall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		if n := indexNul(log); n > 0 {
+			return -1, fmt.Errorf("%v: %s", err, log[:n])
+		}
+		return -1, err
+	}
+	return fd, nil
+}
+
+// bpfLinkXDP attaches prog to ifindex; the program is detached when the
+// returned link fd is closed.
+func bpfLinkXDP(progFd, ifindex int, flags uint32) (int, error) {
+	attr := struct {
+		progFd, ifindex, attachType, flags uint32
+	}{uint32(progFd), uint32(ifindex), unix.BPF_XDP, flags}
+	return bpfSyscall(unix.BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func indexNul(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,93 @@
+package socks
+
+import (
+	"errors"
+	"net"
+	"paqet/internal/client"
+	"paqet/internal/flog"
+	"paqet/internal/tnet"
+	"paqet/internal/wire"
+	"sync"
+
+	"github.com/txthinking/socks5"
+)
+
+// coneFlow is the full-cone stream of one SOCKS5 UDP client. Datagrams
+// to every destination share it, and replies from any peer come back
+// with their source.
+type coneFlow struct {
+	strm tnet.Strm
+	mu   sync.Mutex // one frame per Write
+	buf  []byte
+}
+
+func (f *coneFlow) send(addr string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	if f.buf, err = (&wire.Datagram{Addr: addr, Data: data}).Append(f.buf[:0]); err != nil {
+		return err
+	}
+	_, err = f.strm.Write(f.buf)
+	return err
+}
+
+// udpCone relays d through the full-cone stream of addr, opening it on
+// the first datagram. It reports false when the server cannot relay
+// full-cone UDP, so the caller falls back to a stream per destination.
+func (h *Handler) udpCone(server *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram, target string) (bool, error) {
+	key := addr.String()
+	v, ok := h.cones.Load(key)
+	if !ok {
+		strm, err := h.client.Cone(h.pol)
+		if errors.Is(err, client.ErrNoCone) {
+			return false, nil
+		}
+		if err != nil {
+			flog.Errorf("SOCKS5 failed to establish full-cone UDP stream for %s: %v", addr, err)
+			return true, err
+		}
+		f := &coneFlow{strm: strm}
+		if v, ok = h.cones.LoadOrStore(key, f); ok {
+			strm.Close()
+		} else {
+			flog.Infof("SOCKS5 accepted full-cone UDP flow %s on stream %d", addr, strm.SID())
+			go h.coneReplies(server, addr, f)
+		}
+	}
+	f := v.(*coneFlow)
+	if err := f.send(target, d.Data); err != nil {
+		flog.Errorf("SOCKS5 failed to forward %d bytes from %s -> %s: %v", len(d.Data), addr, d.Address(), err)
+		h.cones.CompareAndDelete(key, f)
+		f.strm.Close()
+		return true, err
+	}
+	return true, nil
+}
+
+func (h *Handler) coneReplies(server *socks5.Server, addr *net.UDPAddr, f *coneFlow) {
+	defer func() {
+		h.cones.CompareAndDelete(addr.String(), f)
+		f.strm.Close()
+		flog.Debugf("SOCKS5 full-cone UDP stream %d closed for %s", f.strm.SID(), addr)
+	}()
+	go func() {
+		<-h.ctx.Done()
+		f.strm.Close()
+	}()
+	var dg wire.Datagram
+	for {
+		if err := dg.Decode(f.strm); err != nil {
+			return
+		}
+		atyp, host, port, err := socks5.ParseAddress(dg.Addr)
+		if err != nil {
+			continue
+		}
+		dd := socks5.NewDatagram(atyp, host, port, dg.Data)
+		if _, err := server.UDPConn.WriteToUDP(dd.Bytes(), addr); err != nil {
+			flog.Errorf("SOCKS5 failed to write UDP response %d bytes to %s: %v", len(dd.Bytes()), addr, err)
+			return
+		}
+	}
+}
@@ -2,7 +2,10 @@ package socks
 
 import (
 	"context"
+	"net"
 	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/resolve"
 	"sync"
 )
 
@@ -16,4 +19,19 @@ var rPool = sync.Pool{
 type Handler struct {
 	client *client.Client
 	ctx    context.Context
+	pol    client.Policy
+	res    *resolve.Resolver
+	route  *conf.Route
+	direct sync.Map // client addr and target -> *net.UDPConn
+	cone   bool
+	cones  sync.Map // client addr -> *coneFlow
+	bind   net.IP   // source of what goes around the tunnel
+	mark   uint32   // fwmark of the same
+}
+
+// isDirect reports whether the route sends addr, or the target it was
+// resolved to, around the tunnel, or the tunnel is down and
+// transport.health.on_down allows going direct.
+func (h *Handler) isDirect(addr, target string) bool {
+	return h.route.Direct(addr) || target != addr && h.route.Direct(target) || h.client.DownDirect()
 }
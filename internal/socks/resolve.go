@@ -0,0 +1,32 @@
+package socks
+
+import (
+	"net"
+	"paqet/internal/pkg/fwmark"
+	"paqet/internal/pkg/resolve"
+)
+
+// ResolveOnClient makes the listener look up hostname destinations
+// itself, through server (host:port) or the system nameserver if empty,
+// and send the server the address instead.
+func (s *SOCKS5) ResolveOnClient(server string) {
+	h := s.handle
+	h.res = resolve.New(server, func(network string) *net.Dialer { return fwmark.Dialer(network, h.bind, h.mark, 0) })
+}
+
+// target returns addr with its host resolved, if the listener resolves
+// on the client. IP destinations are returned as they are.
+func (h *Handler) target(addr string) (string, error) {
+	if h.res == nil {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ip, err := h.res.Resolve(h.ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
@@ -6,26 +6,44 @@ import (
 	"paqet/internal/client"
 	"paqet/internal/conf"
 	"paqet/internal/flog"
+	"paqet/internal/pkg/class"
 
 	"github.com/txthinking/socks5"
 )
 
 type SOCKS5 struct {
 	handle *Handler
+	done   chan struct{}
 }
 
 func New(client *client.Client) (*SOCKS5, error) {
 	return &SOCKS5{
 		handle: &Handler{client: client},
+		done:   make(chan struct{}),
 	}, nil
 }
 
+// Route makes the listener connect directly to the destinations r
+// sends around the tunnel.
+func (s *SOCKS5) Route(r *conf.Route) {
+	s.handle.route = r
+}
+
 func (s *SOCKS5) Start(ctx context.Context, cfg conf.SOCKS5) error {
 	s.handle.ctx = ctx
-	go s.listen(ctx, cfg)
+	s.handle.pol = client.Policy{Class: class.Parse(cfg.Priority)}
+	s.handle.cone = cfg.Cone
+	s.handle.bind, s.handle.mark = cfg.Bind, cfg.Fwmark
+	go func() {
+		defer close(s.done)
+		s.listen(ctx, cfg)
+	}()
 	return nil
 }
 
+// Wait returns once the server shut down after its context ended.
+func (s *SOCKS5) Wait() { <-s.done }
+
 func (s *SOCKS5) listen(ctx context.Context, cfg conf.SOCKS5) error {
 	listenAddr, _ := net.ResolveTCPAddr("tcp", cfg.Listen.String())
 	server, err := socks5.NewClassicServer(listenAddr.String(), listenAddr.IP.String(), cfg.Username, cfg.Password, 10, 10)
@@ -2,9 +2,12 @@ package socks
 
 import (
 	"context"
+	"io"
 	"net"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/fwmark"
+	"time"
 
 	"github.com/txthinking/socks5"
 )
@@ -51,13 +54,30 @@ func (h *Handler) handleTCPConnect(conn *net.TCPConn, r *socks5.Request) error {
 		return err
 	}
 
-	strm, err := h.client.TCP(r.Address())
+	target, err := h.target(r.Address())
 	if err != nil {
-		flog.Errorf("SOCKS5 failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), r.Address(), err)
+		flog.Errorf("SOCKS5 %s -> %s: %v", conn.RemoteAddr(), r.Address(), err)
 		return err
 	}
+	var strm io.ReadWriteCloser
+	if h.isDirect(r.Address(), target) {
+		dc, err := fwmark.Dialer("tcp", h.bind, h.mark, 10*time.Second).DialContext(h.ctx, "tcp", target)
+		if err != nil {
+			flog.Errorf("SOCKS5 failed to connect directly for %s -> %s: %v", conn.RemoteAddr(), r.Address(), err)
+			return err
+		}
+		strm = dc
+		flog.Debugf("SOCKS5 connected directly for %s -> %s", conn.RemoteAddr(), r.Address())
+	} else {
+		ts, err := h.client.TCP(target, h.pol)
+		if err != nil {
+			flog.Errorf("SOCKS5 failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), r.Address(), err)
+			return err
+		}
+		strm = ts
+		flog.Debugf("SOCKS5 stream %d created for %s -> %s", ts.SID(), conn.RemoteAddr(), r.Address())
+	}
 	defer strm.Close()
-	flog.Debugf("SOCKS5 stream %d created for %s -> %s", strm.SID(), conn.RemoteAddr(), r.Address())
 
 	copyCtx, copyCancel := context.WithCancel(h.ctx)
 	defer copyCancel()
@@ -68,11 +88,10 @@ func (h *Handler) handleTCPConnect(conn *net.TCPConn, r *socks5.Request) error {
 		copyCancel()
 		errCh <- err
 	}()
-	go func() {
-		err := buffer.CopyT(strm, conn)
+	buffer.GoCopyT(copyCtx, strm, conn, func(err error) {
 		copyCancel()
 		errCh <- err
-	}()
+	})
 
 	<-copyCtx.Done()
 	conn.Close()
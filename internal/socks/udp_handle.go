@@ -5,16 +5,30 @@ import (
 	"net"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/fwmark"
 	"time"
 
 	"github.com/txthinking/socks5"
 )
 
 func (h *Handler) UDPHandle(server *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram) error {
-	bufp := buffer.UPool.Get().(*[]byte)
-	defer buffer.UPool.Put(bufp)
+	bufp := buffer.GetU()
+	defer buffer.Put(bufp)
 	buf := *bufp
-	strm, new, k, err := h.client.UDP(addr.String(), d.Address())
+	target, err := h.target(d.Address())
+	if err != nil {
+		flog.Errorf("SOCKS5 UDP %s -> %s: %v", addr, d.Address(), err)
+		return err
+	}
+	if h.isDirect(d.Address(), target) {
+		return h.udpDirect(server, addr, d, target)
+	}
+	if h.cone {
+		if ok, err := h.udpCone(server, addr, d, target); ok {
+			return err
+		}
+	}
+	strm, new, k, err := h.client.UDP(addr.String(), target, h.pol)
 	if err != nil {
 		flog.Errorf("SOCKS5 failed to establish UDP stream for %s -> %s: %v", addr, d.Address(), err)
 		return err
@@ -60,6 +74,55 @@ func (h *Handler) UDPHandle(server *socks5.Server, addr *net.UDPAddr, d *socks5.
 	return nil
 }
 
+// udpDirect sends d to target from a socket of its own per client
+// address and target, relaying the replies until it idles out.
+func (h *Handler) udpDirect(server *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram, target string) error {
+	key := addr.String() + " " + target
+	v, ok := h.direct.Load(key)
+	if !ok {
+		c, err := fwmark.Dialer("udp", h.bind, h.mark, 0).Dial("udp", target)
+		if err != nil {
+			flog.Errorf("SOCKS5 failed to connect UDP directly for %s -> %s: %v", addr, d.Address(), err)
+			return err
+		}
+		if v, ok = h.direct.LoadOrStore(key, c); ok {
+			c.Close()
+		} else {
+			flog.Infof("SOCKS5 accepted direct UDP connection %s -> %s", addr, d.Address())
+			go h.udpDirectReplies(server, addr, d, c.(*net.UDPConn), key)
+		}
+	}
+	c := v.(*net.UDPConn)
+	if _, err := c.Write(d.Data); err != nil {
+		flog.Errorf("SOCKS5 failed to forward %d bytes directly from %s -> %s: %v", len(d.Data), addr, d.Address(), err)
+		return err
+	}
+	return nil
+}
+
+func (h *Handler) udpDirectReplies(server *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram, c *net.UDPConn, key string) {
+	defer func() {
+		h.direct.Delete(key)
+		c.Close()
+		flog.Debugf("SOCKS5 direct UDP connection closed for %s -> %s", addr, d.Address())
+	}()
+	bufp := buffer.GetU()
+	defer buffer.Put(bufp)
+	buf := *bufp
+	for h.ctx.Err() == nil {
+		c.SetReadDeadline(time.Now().Add(8 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		dd := socks5.NewDatagram(d.Atyp, d.DstAddr, d.DstPort, buf[:n])
+		if _, err := server.UDPConn.WriteToUDP(dd.Bytes(), addr); err != nil {
+			flog.Errorf("SOCKS5 failed to write UDP response %d bytes to %s: %v", len(dd.Bytes()), addr, err)
+			return
+		}
+	}
+}
+
 func (h *Handler) handleUDPAssociate(conn *net.TCPConn) error {
 	addr := conn.LocalAddr().(*net.TCPAddr)
 
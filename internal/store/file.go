@@ -0,0 +1,113 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// file keeps every bucket in memory and writes it to <dir>/<bucket>.json
+// on each change, replacing the old file atomically.
+type file struct {
+	*memory
+	dir string
+	wmu sync.Mutex
+}
+
+func newFile(dir string) (*file, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+	f := &file{memory: newMemory(), dir: dir}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read store bucket %s: %w", p, err)
+		}
+		var b map[string][]byte
+		if err := json.Unmarshal(data, &b); err != nil {
+			return nil, fmt.Errorf("failed to parse store bucket %s: %w", p, err)
+		}
+		if b != nil {
+			f.buckets[strings.TrimSuffix(filepath.Base(p), ".json")] = b
+		}
+	}
+	return f, nil
+}
+
+func (f *file) Put(bucket, key string, val []byte) error {
+	if err := validBucket(bucket); err != nil {
+		return err
+	}
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	f.memory.Put(bucket, key, val)
+	return f.flush(bucket)
+}
+
+func (f *file) Delete(bucket, key string) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	if _, err := f.memory.Get(bucket, key); errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	f.memory.Delete(bucket, key)
+	return f.flush(bucket)
+}
+
+func (f *file) flush(bucket string) error {
+	data, err := json.Marshal(f.snapshot(bucket))
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(f.dir, bucket+".json")
+	tmp := path + ".tmp"
+	if err := writeSynced(tmp, data); err != nil {
+		return fmt.Errorf("failed to write store bucket %s: %w", bucket, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace store bucket %s: %w", bucket, err)
+	}
+	// The rename reaches the disk with the directory; not every
+	// platform can sync one, and the data is safe either way.
+	if d, err := os.Open(f.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// writeSynced writes data to path and waits for it to reach the disk,
+// so a crash before the rename leaves the old bucket file whole and a
+// crash after it the new one.
+func writeSynced(path string, data []byte) error {
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func validBucket(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\.`) {
+		return fmt.Errorf("invalid store bucket name '%s'", name)
+	}
+	return nil
+}
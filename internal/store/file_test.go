@@ -0,0 +1,105 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"paqet/internal/conf"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openFile(t *testing.T, dir string) Store {
+	t.Helper()
+	st, err := Open(&conf.Store{Backend: "file", Path: dir})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return st
+}
+
+func TestFilePutGet(t *testing.T) {
+	dir := t.TempDir()
+	st := openFile(t, dir)
+	if err := st.Put("users", "alice", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put("users", "bob", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put("users", "alice", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete("users", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete("users", "nobody"); err != nil {
+		t.Fatalf("deleting a missing key: %v", err)
+	}
+	if err := st.Put("a/b", "k", nil); err == nil {
+		t.Fatal("bucket name with a slash accepted")
+	}
+	st.Close()
+
+	st = openFile(t, dir)
+	if v, err := st.Get("users", "alice"); err != nil || string(v) != "3" {
+		t.Fatalf("alice is %q, %v after reopening, want \"3\"", v, err)
+	}
+	if _, err := st.Get("users", "bob"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleted key gave %v, want ErrNotFound", err)
+	}
+	all, err := st.List("users")
+	if err != nil || len(all) != 1 {
+		t.Fatalf("list is %v, %v, want alice alone", all, err)
+	}
+
+	// A returned value is a copy.
+	v, _ := st.Get("users", "alice")
+	v[0] = 'x'
+	if v, _ := st.Get("users", "alice"); string(v) != "3" {
+		t.Fatalf("changing a returned value changed the store to %q", v)
+	}
+}
+
+// TestFileCrashedRewrite leaves behind the temporary file of a rewrite
+// cut short, as a crash before the rename would.
+func TestFileCrashedRewrite(t *testing.T) {
+	dir := t.TempDir()
+	st := openFile(t, dir)
+	if err := st.Put("usage", "alice", []byte(`{"day_bytes":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	tmp := filepath.Join(dir, "usage.json.tmp")
+	if err := os.WriteFile(tmp, []byte(`{"alice":"eyJk`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	st = openFile(t, dir)
+	if v, err := st.Get("usage", "alice"); err != nil || string(v) != `{"day_bytes":1}` {
+		t.Fatalf("after the crash alice is %q, %v, want the last complete write", v, err)
+	}
+	if err := st.Put("usage", "alice", []byte(`{"day_bytes":2}`)); err != nil {
+		t.Fatalf("rewriting over the leftover: %v", err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left after a rewrite: %v", err)
+	}
+	st.Close()
+
+	st = openFile(t, dir)
+	if v, _ := st.Get("usage", "alice"); string(v) != `{"day_bytes":2}` {
+		t.Fatalf("alice is %q after the rewrite", v)
+	}
+}
+
+func TestFileCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "users.json"), []byte(`{"alice":`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Open(&conf.Store{Backend: "file", Path: dir})
+	if err == nil || !strings.Contains(err.Error(), "users.json") {
+		t.Fatalf("corrupt bucket gave %v, want an error naming it", err)
+	}
+}
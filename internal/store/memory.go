@@ -0,0 +1,64 @@
+package store
+
+import (
+	"maps"
+	"slices"
+	"sync"
+)
+
+type memory struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemory() *memory {
+	return &memory{buckets: make(map[string]map[string][]byte)}
+}
+
+func (m *memory) Get(bucket, key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.buckets[bucket][key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return slices.Clone(v), nil
+}
+
+func (m *memory) Put(bucket, key string, val []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+	b[key] = slices.Clone(val)
+	return nil
+}
+
+func (m *memory) Delete(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *memory) List(bucket string) (map[string][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make(map[string][]byte, len(m.buckets[bucket]))
+	for k, v := range m.buckets[bucket] {
+		out[k] = slices.Clone(v)
+	}
+	return out, nil
+}
+
+func (m *memory) Close() error { return nil }
+
+// snapshot returns a copy of bucket for backends layered on memory.
+func (m *memory) snapshot(bucket string) map[string][]byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return maps.Clone(m.buckets[bucket])
+}
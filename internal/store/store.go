@@ -0,0 +1,31 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"paqet/internal/conf"
+)
+
+var ErrNotFound = errors.New("store: key not found")
+
+// Store is the persistence layer shared by subsystems that keep state
+// across restarts. Keys are grouped into buckets, one per subsystem.
+type Store interface {
+	Get(bucket, key string) ([]byte, error)
+	Put(bucket, key string, val []byte) error
+	Delete(bucket, key string) error
+	// List returns a copy of every key/value pair in bucket.
+	List(bucket string) (map[string][]byte, error)
+	Close() error
+}
+
+func Open(cfg *conf.Store) (Store, error) {
+	switch cfg.Backend {
+	case "memory":
+		return newMemory(), nil
+	case "file":
+		return newFile(cfg.Path)
+	default:
+		return nil, fmt.Errorf("store backend '%s' is not available in this build", cfg.Backend)
+	}
+}
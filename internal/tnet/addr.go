@@ -4,14 +4,25 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 )
 
+// UnixPrefix marks an address naming a unix socket path, as in
+// "unix:/run/app.sock", instead of a host:port.
+const UnixPrefix = "unix:"
+
 type Addr struct {
 	Host string
 	Port int
 }
 
 func NewAddr(s string) (*Addr, error) {
+	if path, ok := strings.CutPrefix(s, UnixPrefix); ok {
+		if path == "" {
+			return nil, fmt.Errorf("missing unix socket path in %q", s)
+		}
+		return &Addr{Host: s}, nil
+	}
 	host, portStr, err := net.SplitHostPort(s)
 	if err != nil {
 		return nil, err
@@ -25,6 +36,14 @@ func NewAddr(s string) (*Addr, error) {
 	return &Addr{Host: host, Port: port}, nil
 }
 
+// Unix returns the socket path of a unix address.
+func (e *Addr) Unix() (string, bool) {
+	return strings.CutPrefix(e.Host, UnixPrefix)
+}
+
 func (e *Addr) String() string {
+	if _, ok := e.Unix(); ok {
+		return e.Host
+	}
 	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
 }
@@ -10,6 +10,7 @@ type Conn interface {
 	AcceptStrm() (Strm, error)
 	Ping(wait bool) error
 	Close() error
+	IsClosed() bool
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
 	SetDeadline(t time.Time) error
@@ -0,0 +1,137 @@
+package kcp
+
+import (
+	"fmt"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+const autoSample = 5 * time.Second
+
+// autoProfile is one operating point of mode "auto".
+type autoProfile struct {
+	level    int // 0 calm, 1 lossy, 2 congested
+	interval int
+}
+
+func (p autoProfile) String() string {
+	return fmt.Sprintf("%s/%dms", [...]string{"calm", "lossy", "congested"}[p.level], p.interval)
+}
+
+// autoTune periodically samples the RTT and the retransmission ratio
+// and moves the session between profiles:
+//
+//	calm:      resend 2, congestion control off, full windows
+//	lossy:     resend 1 (retransmit on the first skipped ACK)
+//	congested: congestion control on, half send window
+//
+// The update interval follows RTT/8 in 10ms steps (10-40ms). With ping
+// set, as on the client, the RTT is that of a PPING through smux, which
+// also counts the time segments queue in front of KCP; the server, which
+// the client does not answer pings from, uses the KCP SRTT. A new
+// profile is applied only after two consecutive samples agree, and the
+// loss thresholds to leave a level are lower than those to enter it.
+//
+// Segments are counted per session by tap.
+func autoTune(conn *kcp.UDPSession, sess *smux.Session, cfg *conf.KCP, tap *segTap, ping bool) {
+	ticker := time.NewTicker(autoSample)
+	defer ticker.Stop()
+
+	counts := tap.session(conn.GetConv())
+	defer tap.drop(conn.GetConv())
+	load := func() (uint64, uint64) {
+		return counts.out.Load(), counts.retrans.Load()
+	}
+
+	cur := autoProfile{level: 0, interval: 20}
+	pending, seen := cur, 0
+	lastOut, lastRetrans := load()
+
+	for {
+		select {
+		case <-sess.CloseChan():
+			return
+		case <-ticker.C:
+		}
+
+		out, retrans := load()
+		dOut, dRetrans := out-lastOut, retrans-lastRetrans
+		lastOut, lastRetrans = out, retrans
+		if dOut == 0 {
+			continue
+		}
+		loss := float64(dRetrans) / float64(dOut)
+		rtt := conn.GetSRTT()
+		if ping {
+			start := time.Now()
+			if err := roundTrip(sess); err == nil {
+				rtt = int32(time.Since(start).Milliseconds())
+			}
+		}
+
+		next := autoProfile{level: autoLevel(cur.level, loss), interval: autoInterval(rtt)}
+		if next == cur {
+			seen = 0
+			continue
+		}
+		if next != pending {
+			pending, seen = next, 0
+		}
+		seen++
+		if seen < 2 {
+			continue
+		}
+
+		applyAuto(conn, cfg, next)
+		flog.Infof("KCP auto-tune %s: %s -> %s (rtt %dms, retrans %.1f%%)", conn.RemoteAddr(), cur, next, rtt, loss*100)
+		cur, seen = next, 0
+	}
+}
+
+func autoLevel(cur int, loss float64) int {
+	switch cur {
+	case 0:
+		if loss > 0.15 {
+			return 2
+		}
+		if loss > 0.02 {
+			return 1
+		}
+	case 1:
+		if loss > 0.15 {
+			return 2
+		}
+		if loss < 0.01 {
+			return 0
+		}
+	case 2:
+		if loss < 0.01 {
+			return 0
+		}
+		if loss < 0.08 {
+			return 1
+		}
+	}
+	return cur
+}
+
+func autoInterval(rtt int32) int {
+	i := int(rtt) / 8 / 10 * 10
+	return min(max(i, 10), 40)
+}
+
+func applyAuto(conn *kcp.UDPSession, cfg *conf.KCP, p autoProfile) {
+	resend, noCongestion, sndwnd := 2, 1, cfg.Sndwnd
+	switch p.level {
+	case 1:
+		resend = 1
+	case 2:
+		noCongestion, sndwnd = 0, max(cfg.Sndwnd/2, 32)
+	}
+	conn.SetNoDelay(1, p.interval, resend, noCongestion)
+	conn.SetWindowSize(sndwnd, 0) // the receive window is the client's to fit
+}
@@ -0,0 +1,104 @@
+package kcp
+
+import (
+	"fmt"
+	"paqet/internal/conf"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/xtaci/smux"
+)
+
+// supported lists the oldest kcp-go and smux releases paqet is tested
+// against. Older ones may lack options the config exposes.
+var supported = []struct{ path, min string }{
+	{"github.com/xtaci/kcp-go/v5", "v5.6.0"},
+	{"github.com/xtaci/smux", "v1.5.0"},
+}
+
+// Linked returns the versions of kcp-go and smux in this binary, keyed
+// by module path. Builds without module information report "unknown".
+func Linked() map[string]string {
+	versions := make(map[string]string)
+	for _, s := range supported {
+		versions[s.path] = "unknown"
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			if _, ok := versions[dep.Path]; ok {
+				versions[dep.Path] = dep.Version
+			}
+		}
+	}
+	return versions
+}
+
+// CheckCaps fails when cfg asks for something the linked kcp-go or smux
+// cannot do, which they would otherwise ignore or only reject once the
+// first session is set up.
+func CheckCaps(cfg *conf.KCP) error {
+	var errs []string
+
+	linked := Linked()
+	for _, s := range supported {
+		if v := linked[s.path]; olderThan(v, s.min) {
+			errs = append(errs, fmt.Sprintf("linked %s %s is older than the supported minimum %s", s.path, v, s.min))
+		}
+	}
+
+	// kcp-go silently runs without FEC when the shard pair is unusable.
+	if cfg.Dshard > 0 || cfg.Pshard > 0 {
+		if cfg.Dshard <= 0 || cfg.Pshard <= 0 {
+			errs = append(errs, "FEC needs both dshard and pshard set")
+		} else if _, err := reedsolomon.New(cfg.Dshard, cfg.Pshard); err != nil {
+			errs = append(errs, fmt.Sprintf("FEC with dshard=%d pshard=%d is not supported: %v", cfg.Dshard, cfg.Pshard, err))
+		}
+	}
+
+	if err := smux.VerifyConfig(smuxConf(cfg)); err != nil {
+		errs = append(errs, fmt.Sprintf("smux rejects the session settings: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// olderThan compares vMAJOR.MINOR.PATCH versions; anything it cannot
+// parse, such as "(devel)", is never older.
+func olderThan(v, min string) bool {
+	a, okA := parseVersion(v)
+	b, okB := parseVersion(min)
+	if !okA || !okB {
+		return false
+	}
+	for i := 0; i < 3; i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var out [3]int
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return out, false
+	}
+	for i := 0; i < 3; i++ {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
@@ -3,6 +3,8 @@ package kcp
 import (
 	"fmt"
 	"net"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/chaos"
 	"paqet/internal/protocol"
 	"paqet/internal/socket"
 	"paqet/internal/tnet"
@@ -16,9 +18,25 @@ type Conn struct {
 	PacketConn *socket.PacketConn
 	UDPSession *kcp.UDPSession
 	Session    *smux.Session
+	cfg        *conf.KCP
+}
+
+// Conv is the KCP conversation id of the session.
+func (c *Conn) Conv() uint32 { return c.UDPSession.GetConv() }
+
+// Silence returns how long the session has heard nothing from its peer.
+// Over a packet conn of its own, as a client's, any packet is from the
+// peer. An accepted session shares the listener's, which cannot tell,
+// and reports 0.
+func (c *Conn) Silence() time.Duration {
+	if c.PacketConn == nil {
+		return 0
+	}
+	return c.PacketConn.Silence()
 }
 
 func (c *Conn) OpenStrm() (tnet.Strm, error) {
+	chaos.DelayOpen()
 	strm, err := c.Session.OpenStream()
 	if err != nil {
 		return nil, err
@@ -35,28 +53,130 @@ func (c *Conn) AcceptStrm() (tnet.Strm, error) {
 }
 
 func (c *Conn) Ping(wait bool) error {
+	if wait {
+		return roundTrip(c.Session)
+	}
 	strm, err := c.Session.OpenStream()
 	if err != nil {
 		return fmt.Errorf("ping failed: %v", err)
 	}
+	return strm.Close()
+}
+
+// roundTrip sends a PPING on a new stream of sess and waits for the
+// PPONG.
+func roundTrip(sess *smux.Session) error {
+	strm, err := sess.OpenStream()
+	if err != nil {
+		return fmt.Errorf("ping failed: %v", err)
+	}
 	defer strm.Close()
-	if wait {
-		_ = strm.SetDeadline(time.Now().Add(3 * time.Second))
-		defer strm.SetDeadline(time.Time{})
-		p := protocol.Proto{Type: protocol.PPING}
-		err = p.Write(strm)
-		if err != nil {
-			return fmt.Errorf("strm ping write failed: %v", err)
+	_ = strm.SetDeadline(time.Now().Add(3 * time.Second))
+	p := protocol.Proto{Type: protocol.PPING}
+	err = p.Write(strm)
+	if err != nil {
+		return fmt.Errorf("strm ping write failed: %v", err)
+	}
+	err = p.Read(strm)
+	if err != nil {
+		return fmt.Errorf("strm ping read failed: %v", err)
+	}
+	if p.Type != protocol.PPONG {
+		return fmt.Errorf("strm pong failed: unexpected type %d", p.Type)
+	}
+	return nil
+}
+
+// Probe sets the session MTU to size and sends one padded message that
+// fills a whole segment, returning nil once the server has answered it.
+// A probe that is lost stays queued at that size, so the caller must
+// discard the connection when Probe fails.
+func (c *Conn) Probe(size int) error {
+	if !c.SetMTU(size) {
+		return fmt.Errorf("invalid probe size %d", size)
+	}
+	strm, err := c.Session.OpenStream()
+	if err != nil {
+		return fmt.Errorf("probe failed: %v", err)
+	}
+	defer strm.Close()
+	_ = strm.SetDeadline(time.Now().Add(2 * time.Second))
+
+	p := protocol.Proto{Type: protocol.PMTU, Pad: size}
+	if err := p.Write(strm); err != nil {
+		return fmt.Errorf("probe write failed: %v", err)
+	}
+	if err := p.Read(strm); err != nil {
+		return fmt.Errorf("probe read failed: %v", err)
+	}
+	if p.Type != protocol.PPONG {
+		return fmt.Errorf("unexpected probe reply type %d", p.Type)
+	}
+	return nil
+}
+
+// Bandwidth asks the server for a train of count messages of size bytes
+// and estimates the downstream bandwidth in bytes per second from how
+// far apart the first and last arrive.
+func (c *Conn) Bandwidth(count, size int) (float64, error) {
+	if count < 2 || count > protocol.MaxProbeCount {
+		return 0, fmt.Errorf("invalid probe train length %d", count)
+	}
+	strm, err := c.Session.OpenStream()
+	if err != nil {
+		return 0, fmt.Errorf("bandwidth probe failed: %v", err)
+	}
+	defer strm.Close()
+	_ = strm.SetDeadline(time.Now().Add(10 * time.Second))
+
+	p := protocol.Proto{Type: protocol.PPROBE, Count: count, Pad: size}
+	if err := p.Write(strm); err != nil {
+		return 0, fmt.Errorf("bandwidth probe write failed: %v", err)
+	}
+	var first time.Time
+	for i := 0; i < count; i++ {
+		if err := p.Read(strm); err != nil {
+			return 0, fmt.Errorf("bandwidth probe read failed after %d messages: %v", i, err)
 		}
-		err = p.Read(strm)
-		if err != nil {
-			return fmt.Errorf("strm ping read failed: %v", err)
+		if p.Type != protocol.PPROBEACK {
+			return 0, fmt.Errorf("unexpected bandwidth probe reply type %d", p.Type)
 		}
-		if p.Type != protocol.PPONG {
-			return fmt.Errorf("strm pong failed: %v", err)
+		if i == 0 {
+			first = time.Now()
 		}
 	}
-	return nil
+	elapsed := time.Since(first)
+	if elapsed <= 0 {
+		return 0, fmt.Errorf("bandwidth probe train arrived too fast to time")
+	}
+	return float64((count-1)*(3+size)) / elapsed.Seconds(), nil
+}
+
+// BDPWindow returns the receive window, in segments, that holds twice
+// the bandwidth-delay product of bw bytes per second at the session's
+// SRTT, kept between transport.kcp.rcvwnd and four times it.
+func (c *Conn) BDPWindow(bw float64) int {
+	srtt := time.Duration(c.UDPSession.GetSRTT()) * time.Millisecond
+	seg := float64(c.cfg.MTU - overhead(c.cfg) - segHeader)
+	return min(max(int(2*bw*srtt.Seconds()/seg), c.cfg.Rcvwnd), 4*c.cfg.Rcvwnd)
+}
+
+// SetRcvWnd sets the receive window the session advertises.
+func (c *Conn) SetRcvWnd(n int) { c.UDPSession.SetWindowSize(0, n) }
+
+// SetMTU sets the largest packet the session sends, obfs salt and cover
+// framing included.
+func (c *Conn) SetMTU(mtu int) bool { return c.UDPSession.SetMtu(mtu - overhead(c.cfg)) }
+
+// Tune switches the session between the interactive profile (no write
+// batching, immediate ACKs) and the profile selected by the KCP mode.
+func (c *Conn) Tune(interactive bool) {
+	wDelay, ackNoDelay := false, true
+	if !interactive {
+		_, _, _, _, wDelay, ackNoDelay = modeParams(c.cfg)
+	}
+	c.UDPSession.SetWriteDelay(wDelay)
+	c.UDPSession.SetACKNoDelay(ackNoDelay)
 }
 
 func (c *Conn) Close() error {
@@ -73,8 +193,30 @@ func (c *Conn) Close() error {
 	return err
 }
 
+func (c *Conn) IsClosed() bool                     { return c.Session.IsClosed() }
 func (c *Conn) LocalAddr() net.Addr                { return c.Session.LocalAddr() }
 func (c *Conn) RemoteAddr() net.Addr               { return c.Session.RemoteAddr() }
 func (c *Conn) SetDeadline(t time.Time) error      { return c.Session.SetDeadline(t) }
 func (c *Conn) SetReadDeadline(t time.Time) error  { return c.UDPSession.SetReadDeadline(t) }
 func (c *Conn) SetWriteDeadline(t time.Time) error { return c.UDPSession.SetWriteDeadline(t) }
+
+// Stats is a snapshot of the KCP state of a connection.
+type Stats struct {
+	Remote  string `json:"remote"`
+	Conv    uint32 `json:"conv"`
+	Streams int    `json:"streams"`
+	SRTT    int32  `json:"srtt_ms"`
+	RTTVar  int32  `json:"rttvar_ms"`
+	RTO     uint32 `json:"rto_ms"`
+}
+
+func (c *Conn) Stats() Stats {
+	return Stats{
+		Remote:  c.RemoteAddr().String(),
+		Conv:    c.UDPSession.GetConv(),
+		Streams: c.Session.NumStreams(),
+		SRTT:    c.UDPSession.GetSRTT(),
+		RTTVar:  c.UDPSession.GetSRTTVar(),
+		RTO:     c.UDPSession.GetRTO(),
+	}
+}
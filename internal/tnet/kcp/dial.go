@@ -13,7 +13,12 @@ import (
 )
 
 func Dial(addr *net.UDPAddr, cfg *conf.KCP, pConn *socket.PacketConn) (tnet.Conn, error) {
-	conn, err := kcp.NewConn(addr.String(), cfg.Block, cfg.Dshard, cfg.Pshard, pConn)
+	var tap *segTap
+	block, pc := cfg.Block, packetConn(pConn, cfg)
+	if cfg.Mode == "auto" {
+		tap, block, pc = newSegTap(cfg, pc)
+	}
+	conn, err := kcp.NewConn(addr.String(), block, cfg.Dshard, cfg.Pshard, pc)
 	if err != nil {
 		return nil, fmt.Errorf("connection attempt failed: %v", err)
 	}
@@ -25,6 +30,10 @@ func Dial(addr *net.UDPAddr, cfg *conf.KCP, pConn *socket.PacketConn) (tnet.Conn
 		return nil, fmt.Errorf("failed to create smux session: %w", err)
 	}
 
+	if cfg.Mode == "auto" {
+		go autoTune(conn, sess, cfg, tap, true)
+	}
+
 	flog.Debugf("smux session created successfully")
-	return &Conn{pConn, conn, sess}, nil
+	return &Conn{pConn, conn, sess, cfg}, nil
 }
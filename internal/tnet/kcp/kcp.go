@@ -9,8 +9,20 @@ import (
 )
 
 func aplConf(conn *kcp.UDPSession, cfg *conf.KCP) {
-	var noDelay, interval, resend, noCongestion int
-	var wDelay, ackNoDelay bool
+	noDelay, interval, resend, noCongestion, wDelay, ackNoDelay := modeParams(cfg)
+
+	conn.SetNoDelay(noDelay, interval, resend, noCongestion)
+	conn.SetWindowSize(cfg.Sndwnd, cfg.Rcvwnd)
+	conn.SetMtu(cfg.MTU - overhead(cfg))
+	conn.SetWriteDelay(wDelay)
+	conn.SetACKNoDelay(ackNoDelay)
+	// DSCP 0 (default): blends in with normal traffic.
+	// DSCP 46 (EF) is meant for VoIP and attracts ISP/DPI attention.
+	// Has no effect on accepted sessions; Listen marks the packet conn.
+	conn.SetDSCP(cfg.DSCP)
+}
+
+func modeParams(cfg *conf.KCP) (noDelay, interval, resend, noCongestion int, wDelay, ackNoDelay bool) {
 	switch cfg.Mode {
 	case "normal":
 		noDelay, interval, resend, noCongestion = 0, 40, 2, 1
@@ -24,6 +36,10 @@ func aplConf(conn *kcp.UDPSession, cfg *conf.KCP) {
 		// Throughput-first profile with balanced latency.
 		noDelay, interval, resend, noCongestion = 1, 15, 2, 1
 		wDelay, ackNoDelay = false, true
+	case "auto":
+		// Starting point for auto-tuning; see autoTune.
+		noDelay, interval, resend, noCongestion = 1, 20, 2, 1
+		wDelay, ackNoDelay = false, true
 	case "fast3":
 		noDelay, interval, resend, noCongestion = 1, 10, 2, 1
 		wDelay, ackNoDelay = false, true
@@ -55,24 +71,16 @@ func aplConf(conn *kcp.UDPSession, cfg *conf.KCP) {
 			wDelay = false
 		}
 	}
-
-	conn.SetNoDelay(noDelay, interval, resend, noCongestion)
-	conn.SetWindowSize(cfg.Sndwnd, cfg.Rcvwnd)
-	conn.SetMtu(cfg.MTU)
-	conn.SetWriteDelay(wDelay)
-	conn.SetACKNoDelay(ackNoDelay)
-	// DSCP 0 (default): blends in with normal traffic.
-	// DSCP 46 (EF) is meant for VoIP and attracts ISP/DPI attention.
-	conn.SetDSCP(0)
+	return
 }
 
 func smuxConf(cfg *conf.KCP) *smux.Config {
 	var sconf = smux.DefaultConfig()
 	sconf.Version = 2
-	sconf.KeepAliveInterval = 10 * time.Second  // 10s: lower control traffic and fewer false positives
-	sconf.KeepAliveTimeout = 40 * time.Second   // 40s: tolerate transient packet loss without disconnect flaps
-	sconf.MaxFrameSize = 8192                   // 8KB: reduces per-stream burst latency and head-of-line stalls
-	
+	sconf.KeepAliveInterval = time.Duration(cfg.KeepAlive) * time.Second
+	sconf.KeepAliveTimeout = time.Duration(cfg.KeepAliveTimeout) * time.Second
+	sconf.MaxFrameSize = 8192 // 8KB: reduces per-stream burst latency and head-of-line stalls
+
 	// For high connection counts, we need to be careful with memory.
 	// If the user hasn't explicitly set large buffers, keep them reasonable.
 	if cfg.Smuxbuf == 0 {
@@ -80,12 +88,12 @@ func smuxConf(cfg *conf.KCP) *smux.Config {
 	} else {
 		sconf.MaxReceiveBuffer = cfg.Smuxbuf
 	}
-	
+
 	if cfg.Streambuf == 0 {
 		sconf.MaxStreamBuffer = 2097152 // 2MB default (restored for high speed)
 	} else {
 		sconf.MaxStreamBuffer = cfg.Streambuf
 	}
-	
+
 	return sconf
 }
@@ -0,0 +1,232 @@
+package kcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/chaos"
+	"paqet/internal/socket"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+var (
+	clientAddr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	serverAddr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+)
+
+// testConf is a config as conf would load it, without encryption, in
+// the given mode and FEC shards.
+func testConf(mode string, dshard, pshard int) *conf.KCP {
+	return &conf.KCP{
+		Mode:             mode,
+		MTU:              1350,
+		Rcvwnd:           512,
+		Sndwnd:           512,
+		Dshard:           dshard,
+		Pshard:           pshard,
+		Block_:           "none",
+		Smuxbuf:          4 * 1024 * 1024,
+		Streambuf:        2 * 1024 * 1024,
+		KeepAlive:        10,
+		KeepAliveTimeout: 40,
+	}
+}
+
+// echo dials a session from client to server, sends size random bytes
+// on a stream, and checks that the server reads them intact and that
+// its echo of them comes back intact.
+func echo(t *testing.T, client, server *socket.PacketConn, cfg *conf.KCP, size int) {
+	t.Helper()
+	l, err := Listen(cfg, server)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+		// An accepted session shares the listener's packet conn.
+		if d := conn.(*Conn).Silence(); d != 0 {
+			accepted <- fmt.Errorf("accepted session reports %v of silence, want 0", d)
+			return
+		}
+		strm, err := conn.AcceptStrm()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer strm.Close()
+		_, err = io.CopyN(strm, strm, int64(size))
+		accepted <- err
+		// Let the echo drain before the deferred closes tear it down.
+		io.Copy(io.Discard, strm)
+	}()
+
+	conn, err := Dial(serverAddr, cfg, client)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	defer strm.Close()
+	strm.SetDeadline(time.Now().Add(60 * time.Second))
+
+	want := make([]byte, size)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range want {
+		want[i] = byte(rng.Uint32())
+	}
+	go strm.Write(want)
+
+	got := make([]byte, size)
+	if _, err := io.ReadFull(strm, got); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if err := <-accepted; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("echo differs from byte %d of %d", i, size)
+			}
+		}
+	}
+}
+
+func TestMemPair(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, server := socket.NewMemPair(ctx, clientAddr, serverAddr, nil)
+	echo(t, client, server, testConf("fast", 0, 0), 1<<20)
+}
+
+func TestMemPairDrop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var n atomic.Int64
+	drop := func([]byte) bool { return n.Add(1)%10 == 0 } // every 10th packet, both ways
+	client, server := socket.NewMemPair(ctx, clientAddr, serverAddr, drop)
+	echo(t, client, server, testConf("fast", 0, 0), 256<<10)
+}
+
+// TestImpaired runs sessions over links that lose, reorder and
+// duplicate packets, with fixed seeds so a failure repeats.
+func TestImpaired(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		mode           string
+		dshard, pshard int
+		faults         chaos.Faults
+	}{
+		{"loss", "fast", 0, 0, chaos.Faults{Loss: 0.05, Seed: 1}},
+		{"reorder", "fast", 0, 0, chaos.Faults{Reorder: 0.1, Jitter: 5 * time.Millisecond, Seed: 2}},
+		{"duplicate", "fast", 0, 0, chaos.Faults{Duplicate: 0.1, Seed: 3}},
+		{"all", "fast2", 0, 0, chaos.Faults{Loss: 0.03, Reorder: 0.05, Duplicate: 0.05, Delay: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, Seed: 4}},
+		{"all with fec", "fast", 10, 3, chaos.Faults{Loss: 0.03, Reorder: 0.05, Duplicate: 0.05, Delay: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, Seed: 5}},
+		{"all normal mode", "normal", 0, 0, chaos.Faults{Loss: 0.02, Reorder: 0.05, Duplicate: 0.05, Jitter: 5 * time.Millisecond, Seed: 6}},
+		{"loss auto mode", "auto", 0, 0, chaos.Faults{Loss: 0.05, Seed: 7}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client, server := socket.NewImpairedPair(ctx, clientAddr, serverAddr, &tc.faults)
+			echo(t, client, server, testConf(tc.mode, tc.dshard, tc.pshard), 256<<10)
+		})
+	}
+}
+
+// segment appends a KCP segment of conv with sn and data to p.
+func segment(p []byte, conv uint32, cmd byte, sn uint32, data []byte) []byte {
+	p = binary.LittleEndian.AppendUint32(p, conv)
+	p = append(p, cmd, 0, 0, 1)                // frg, wnd
+	p = binary.LittleEndian.AppendUint32(p, 0) // ts
+	p = binary.LittleEndian.AppendUint32(p, sn)
+	p = binary.LittleEndian.AppendUint32(p, 0) // una
+	p = binary.LittleEndian.AppendUint32(p, uint32(len(data)))
+	return append(p, data...)
+}
+
+func TestSegTap(t *testing.T) {
+	block, err := kcp.NewNoneBlockCrypt(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConf("auto", 10, 3)
+	cfg.Block = block
+	tap, b, _ := newSegTap(cfg, nil)
+	a, other := tap.session(1), tap.session(2)
+
+	packet := func(conv uint32, parity bool, sns ...uint32) []byte {
+		p := make([]byte, cryptHeader+4, 1500)
+		flag := uint16(0xf1)
+		if parity {
+			flag = fecParity
+		}
+		p = binary.LittleEndian.AppendUint16(p, flag)
+		p = binary.LittleEndian.AppendUint16(p, 0)
+		for _, sn := range sns {
+			p = segment(p, conv, cmdPush, sn, make([]byte, 100))
+		}
+		return segment(p, conv, 82, 0, nil) // an ACK
+	}
+	for _, p := range [][]byte{
+		packet(1, false, 0, 1, 2),
+		packet(1, false, 1, 3), // 1 again
+		packet(1, true, 0, 1),  // parity: not segments
+		packet(2, false, 0),
+		packet(1, false, 2, 3, 4), // 2 and 3 again
+		packet(9, false, 0),       // no session
+	} {
+		b.Encrypt(p, p)
+	}
+	if out, retrans := a.out.Load(), a.retrans.Load(); out != 8 || retrans != 3 {
+		t.Fatalf("session 1 counted %d segments, %d resent; want 8, 3", out, retrans)
+	}
+	if out, retrans := other.out.Load(), other.retrans.Load(); out != 1 || retrans != 0 {
+		t.Fatalf("session 2 counted %d segments, %d resent; want 1, 0", out, retrans)
+	}
+
+	cfg.Block = nil
+	if tap, _, pc := newSegTap(cfg, nil); tap == nil || pc == nil {
+		t.Fatal("no tap on the packet conn without a cipher")
+	}
+
+	// With an AEAD block the tap sees what is sealed: the packet after
+	// the nonce, which starts at the FEC header.
+	blk, _ := aes.NewCipher(make([]byte, 16))
+	cfg.AEAD, _ = cipher.NewGCMWithRandomNonce(blk)
+	cfg.Block = kcp.NewAEADCrypt(cfg.AEAD)
+	tap, b, _ = newSegTap(cfg, nil)
+	if tap == nil {
+		t.Fatal("no tap on the AEAD cipher")
+	}
+	s := tap.session(1)
+	p := packet(1, false, 0, 1)[cryptHeader:]
+	b.(interface {
+		Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	}).Seal(p[:0], nil, p, nil)
+	if out := s.out.Load(); out != 2 {
+		t.Fatalf("counted %d segments through the AEAD cipher, want 2", out)
+	}
+}
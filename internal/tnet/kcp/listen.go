@@ -11,18 +11,28 @@ import (
 )
 
 type Listener struct {
-	packetConn *socket.PacketConn
+	packetConn socket.Conn
 	cfg        *conf.KCP
 	listener   *kcp.Listener
+	tap        *segTap // counts segments per session in mode auto
 }
 
-func Listen(cfg *conf.KCP, pConn *socket.PacketConn) (tnet.Listener, error) {
-	l, err := kcp.ServeConn(cfg.Block, cfg.Dshard, cfg.Pshard, pConn)
+func Listen(cfg *conf.KCP, pConn socket.Conn) (tnet.Listener, error) {
+	var tap *segTap
+	block, pc := cfg.Block, packetConn(pConn, cfg)
+	if cfg.Mode == "auto" {
+		tap, block, pc = newSegTap(cfg, pc)
+	}
+	l, err := kcp.ServeConn(block, cfg.Dshard, cfg.Pshard, pc)
 	if err != nil {
 		return nil, err
 	}
+	if err := pConn.SetDSCP(cfg.DSCP); err != nil {
+		l.Close()
+		return nil, err
+	}
 
-	return &Listener{packetConn: pConn, cfg: cfg, listener: l}, nil
+	return &Listener{packetConn: pConn, cfg: cfg, listener: l, tap: tap}, nil
 }
 
 func (l *Listener) Accept() (tnet.Conn, error) {
@@ -35,7 +45,19 @@ func (l *Listener) Accept() (tnet.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Conn{nil, conn, sess}, nil
+	if l.cfg.Mode == "auto" {
+		go autoTune(conn, sess, l.cfg, l.tap, false)
+	}
+	return &Conn{nil, conn, sess, l.cfg}, nil
+}
+
+// Stop stops accepting sessions. Established ones keep running on the
+// packet conn until Close.
+func (l *Listener) Stop() error {
+	if l.listener != nil {
+		return l.listener.Close()
+	}
+	return nil
 }
 
 func (l *Listener) Close() error {
@@ -0,0 +1,93 @@
+package kcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"paqet/internal/conf"
+	"sync"
+)
+
+// Each scrambled packet starts with obfsSalt random bytes. The obfsLen
+// bytes after them, enough to cover the crypt, FEC and KCP headers, are
+// XORed with AES(key, salt || block number), so no header field keeps
+// the same bytes from one packet to the next.
+const (
+	obfsSalt = 8
+	obfsLen  = 64
+)
+
+var obfsPool = sync.Pool{New: func() any { b := make([]byte, obfsSalt+1500); return &b }}
+
+// obfsConn scrambles the packets KCP sends and unscrambles those it
+// reads, dropping any too short to carry a salt.
+type obfsConn struct {
+	net.PacketConn
+	key cipher.Block
+}
+
+// packetConn is what KCP runs on: pConn itself, or pConn scrambled when
+// obfs is on.
+func packetConn(pConn net.PacketConn, cfg *conf.KCP) net.PacketConn {
+	if !cfg.Obfs {
+		return pConn
+	}
+	return &obfsConn{PacketConn: pConn, key: cfg.HeaderKey}
+}
+
+// overhead is what packetConn and the cover framing of network.mimic
+// add to each packet, taken off the MTU given to KCP.
+func overhead(cfg *conf.KCP) int {
+	if cfg.Obfs {
+		return obfsSalt + cfg.Cover
+	}
+	return cfg.Cover
+}
+
+func (c *obfsConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	bufp := obfsPool.Get().(*[]byte)
+	defer obfsPool.Put(bufp)
+	buf := *bufp
+	if len(buf) < obfsSalt+len(p) {
+		buf = make([]byte, obfsSalt+len(p))
+	}
+	buf = buf[:obfsSalt+len(p)]
+	binary.LittleEndian.PutUint64(buf, rand.Uint64())
+	copy(buf[obfsSalt:], p)
+	c.scramble(buf)
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *obfsConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if n <= obfsSalt {
+			continue
+		}
+		c.scramble(p[:n])
+		return copy(p, p[obfsSalt:n]), addr, nil
+	}
+}
+
+// scramble XORs the head of pkt after its salt with the keystream;
+// doing it twice restores it.
+func (c *obfsConn) scramble(pkt []byte) {
+	var ctr, ks [aes.BlockSize]byte
+	copy(ctr[:], pkt[:obfsSalt])
+	data := pkt[obfsSalt:]
+	data = data[:min(len(data), obfsLen)]
+	for i := 0; i*aes.BlockSize < len(data); i++ {
+		ctr[aes.BlockSize-1] = byte(i)
+		c.key.Encrypt(ks[:], ctr[:])
+		subtle.XORBytes(data[i*aes.BlockSize:], data[i*aes.BlockSize:], ks[:])
+	}
+}
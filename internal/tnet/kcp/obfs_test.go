@@ -0,0 +1,67 @@
+package kcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"encoding/hex"
+	"paqet/internal/socket"
+	"strings"
+	"testing"
+)
+
+// TestObfsVector is the golden encoding of a scrambled packet: AES key
+// 00..0f (the derived header key, not the passphrase), salt a0..a7 and
+// a 72 byte payload 00..47, of which only the first obfsLen bytes are
+// scrambled. A change to it is a wire-protocol break.
+func TestObfsVector(t *testing.T) {
+	key := make([]byte, 16)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &obfsConn{key: blk}
+
+	plain := make([]byte, obfsSalt+72)
+	for i := range obfsSalt {
+		plain[i] = 0xa0 + byte(i)
+	}
+	for i := range 72 {
+		plain[obfsSalt+i] = byte(i)
+	}
+	want, _ := hex.DecodeString(strings.Join([]string{
+		"a0a1a2a3a4a5a6a7", // salt, sent as is
+		"db29969f3aa8bb676f02f6e4216d77c0",
+		"70f720894371b0a103ff55e022c9a575",
+		"980e0f5eab0820e93bde7ef5635255ba",
+		"01f9763fc8b9b3bd708601988810df48",
+		"4041424344454647", // past obfsLen, sent as is
+	}, ""))
+
+	pkt := append([]byte(nil), plain...)
+	c.scramble(pkt)
+	if !bytes.Equal(pkt, want) {
+		t.Fatalf("scrambled to %x, want %x", pkt, want)
+	}
+	c.scramble(pkt)
+	if !bytes.Equal(pkt, plain) {
+		t.Fatalf("unscrambled to %x, want %x", pkt, plain)
+	}
+}
+
+// TestMemPairObfs runs a session with scrambled headers end to end.
+func TestMemPairObfs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	blk, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConf("fast", 0, 0)
+	cfg.Obfs, cfg.HeaderKey = true, blk
+	client, server := socket.NewMemPair(ctx, clientAddr, serverAddr, nil)
+	echo(t, client, server, cfg, 256<<10)
+}
@@ -0,0 +1,151 @@
+package kcp
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"net"
+	"paqet/internal/conf"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// Offsets into a packet as kcp-go hands it to its cipher or, without
+// one, to the packet conn.
+const (
+	cryptHeader = 16 + 4 // nonce, CRC32
+	fecHeader   = 6 + 2  // sequence, type, data size
+	fecParity   = 0xf2
+	segHeader   = 24
+	cmdPush     = 81
+)
+
+// segCount counts the data segments one session sends and how many of
+// them repeat a sequence number sent before. KCP's own counters are
+// process-wide, so they cannot tell one lossy session from the others.
+type segCount struct {
+	out, retrans atomic.Uint64
+
+	// next is the sequence number after the highest sent. Only the
+	// session's sender writes it.
+	next    uint32
+	started bool
+}
+
+// packet counts the segments of p, which starts at a KCP segment.
+func (c *segCount) packet(p []byte) {
+	for len(p) >= segHeader {
+		sn, n := binary.LittleEndian.Uint32(p[12:]), binary.LittleEndian.Uint32(p[20:])
+		if p[4] == cmdPush {
+			c.out.Add(1)
+			if c.started && int32(sn-c.next) < 0 {
+				c.retrans.Add(1)
+			} else {
+				c.next, c.started = sn+1, true
+			}
+		}
+		if uint32(len(p)-segHeader) < n {
+			return
+		}
+		p = p[segHeader+n:]
+	}
+}
+
+// segTap reads the KCP segments of every session of a Dial or Listen on
+// their way out and counts them per conversation, for mode auto. It
+// sits in front of the cipher, or of the packet conn without one. kcp-go
+// seals with an AEAD block itself, so the tap goes on the cipher.AEAD
+// inside it instead, which sees the packet after the nonce.
+type segTap struct {
+	hdr int  // bytes before the first segment
+	fec bool // packets carry an FEC header, and parity ones no segments
+
+	mu    sync.RWMutex
+	convs map[uint32]*segCount
+}
+
+// newSegTap returns the block and packet conn for kcp-go to use, with
+// the tap put in front of one of them.
+func newSegTap(cfg *conf.KCP, pc net.PacketConn) (*segTap, kcp.BlockCrypt, net.PacketConn) {
+	t := &segTap{fec: cfg.Dshard > 0 || cfg.Pshard > 0, convs: make(map[uint32]*segCount)}
+	if t.fec {
+		t.hdr = fecHeader
+	}
+	switch {
+	case cfg.Block == nil:
+		return t, nil, &tapConn{PacketConn: pc, tap: t}
+	case cfg.AEAD != nil:
+		return t, kcp.NewAEADCrypt(&tapAEAD{AEAD: cfg.AEAD, tap: t}), pc
+	default:
+		t.hdr += cryptHeader
+		return t, &tapBlock{BlockCrypt: cfg.Block, tap: t}, pc
+	}
+}
+
+// session returns the counts of conversation conv; drop forgets them.
+func (t *segTap) session(conv uint32) *segCount {
+	if t == nil {
+		return nil
+	}
+	c := &segCount{}
+	t.mu.Lock()
+	t.convs[conv] = c
+	t.mu.Unlock()
+	return c
+}
+
+func (t *segTap) drop(conv uint32) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.convs, conv)
+	t.mu.Unlock()
+}
+
+func (t *segTap) count(p []byte) {
+	if len(p) < t.hdr+segHeader {
+		return
+	}
+	if t.fec && binary.LittleEndian.Uint16(p[t.hdr-fecHeader+4:]) == fecParity {
+		return
+	}
+	p = p[t.hdr:]
+	t.mu.RLock()
+	c := t.convs[binary.LittleEndian.Uint32(p)]
+	t.mu.RUnlock()
+	if c != nil {
+		c.packet(p)
+	}
+}
+
+type tapBlock struct {
+	kcp.BlockCrypt
+	tap *segTap
+}
+
+func (b *tapBlock) Encrypt(dst, src []byte) {
+	b.tap.count(src)
+	b.BlockCrypt.Encrypt(dst, src)
+}
+
+type tapAEAD struct {
+	cipher.AEAD
+	tap *segTap
+}
+
+func (a *tapAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	a.tap.count(plaintext)
+	return a.AEAD.Seal(dst, nonce, plaintext, additionalData)
+}
+
+type tapConn struct {
+	net.PacketConn
+	tap *segTap
+}
+
+func (c *tapConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.tap.count(p)
+	return c.PacketConn.WriteTo(p, addr)
+}
@@ -1,6 +1,7 @@
 package tnet
 
 import (
+	"io"
 	"net"
 )
 
@@ -8,3 +9,13 @@ type Strm interface {
 	net.Conn
 	SID() int
 }
+
+// WriteTo writes what s reads to w until s ends, out of the buffers of s
+// when it has its own io.WriterTo, as a smux stream does. A wrapper of a
+// Strm calls it from its own WriteTo to keep that path open to relays.
+func WriteTo(s Strm, w io.Writer) (int64, error) {
+	if wt, ok := s.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	return io.Copy(w, struct{ io.Reader }{s})
+}
@@ -0,0 +1,117 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// A PUDPF stream carries UDP datagrams without losing their
+// boundaries, each framed as
+//
+//	[2: len][len: data]
+//
+// the tail of a Datagram without its address. A FrameWriter may
+// coalesce the frames written within a short delay into one stream
+// write, which saves a stream write per datagram for high packet rate
+// traffic such as QUIC or games.
+
+// maxBatch is how many bytes of frames a FrameWriter holds before it
+// writes them regardless of the delay.
+const maxBatch = 16 * 1024
+
+// FrameWriter frames each Write as one datagram.
+type FrameWriter struct {
+	w     io.Writer
+	delay time.Duration
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	err   error
+}
+
+// NewFrameWriter frames datagrams onto w. With delay 0 every datagram
+// is written at once; otherwise a datagram waits up to delay for others
+// to share its write.
+func NewFrameWriter(w io.Writer, delay time.Duration) *FrameWriter {
+	return &FrameWriter{w: w, delay: delay}
+}
+
+func (w *FrameWriter) Write(p []byte) (int, error) {
+	if len(p) > 0xffff {
+		return 0, io.ErrShortWrite
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(len(p)))
+	w.buf = append(w.buf, p...)
+	if w.delay == 0 || len(w.buf) >= maxBatch {
+		return len(p), w.flush()
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.flush()
+		})
+	} else if len(w.buf) == 2+len(p) {
+		w.timer.Reset(w.delay)
+	}
+	return len(p), nil
+}
+
+// Flush writes the datagrams still waiting.
+func (w *FrameWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+// flush writes buf; w.mu must be held.
+func (w *FrameWriter) flush() error {
+	if len(w.buf) == 0 || w.err != nil {
+		return w.err
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	_, w.err = w.w.Write(w.buf)
+	w.buf = w.buf[:0]
+	return w.err
+}
+
+// FrameReader returns one datagram per Read.
+type FrameReader struct {
+	r *bufio.Reader
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReaderSize(r, maxBatch+2)}
+}
+
+// Read reads the next datagram into p. One longer than p is cut to fit,
+// as a UDP socket does.
+func (r *FrameReader) Read(p []byte) (int, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	m := min(n, len(p))
+	if err := readFull(r.r, p[:m]); err != nil {
+		return 0, err
+	}
+	if _, err := r.r.Discard(n - m); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return m, nil
+}
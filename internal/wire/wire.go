@@ -0,0 +1,532 @@
+// Package wire defines the byte layouts of the control messages client
+// and server exchange on a stream. protocol frames each of them after a
+// one-byte message type; both directions encode and decode through the
+// types here, so the two sides cannot drift apart.
+//
+// Every integer is big-endian and unsigned unless noted. Strings are raw
+// bytes after a length prefix; nothing is NUL-terminated or padded.
+package wire
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// Message is the body of one control message.
+type Message interface {
+	// Append encodes the message onto b.
+	Append(b []byte) ([]byte, error)
+	// Decode reads exactly one encoded message from r. A message cut
+	// short fails with io.ErrUnexpectedEOF.
+	Decode(r io.Reader) error
+}
+
+// Limits enforced when decoding, so a peer cannot make us allocate.
+const (
+	MaxAddrLen = 512
+	MaxFlags   = 64
+	MACSize    = sha256.Size
+	MaxExtLen  = 4096
+)
+
+// Addr is the destination of a PTCP or PUDP, in one of two layouts.
+// The compact one starts with AddrV2, which the legacy length never
+// does, so a decoder takes either:
+//
+//	[2: len][len: "host:port", IPv6 hosts in brackets]
+//	[1: AddrV2][1: AddrIPv4][4: ip][uvarint: port]
+//	[1: AddrV2][1: AddrIPv6][16: ip][uvarint: port]
+//	[1: AddrV2][1: AddrDomain][1: len][len: name][uvarint: port]
+//
+// With Compact set, Append uses the compact layout when the address
+// fits it; anything else, such as a unix socket path, stays legacy.
+type Addr struct {
+	Addr    string
+	Compact bool
+}
+
+// Compact address layout: its version marker and address types.
+const (
+	AddrV2     = 0xff
+	AddrIPv4   = 1
+	AddrDomain = 3
+	AddrIPv6   = 4
+)
+
+func (m *Addr) Append(b []byte) ([]byte, error) {
+	if m.Compact {
+		if c, ok := appendCompact(b, m.Addr); ok {
+			return c, nil
+		}
+	}
+	if len(m.Addr) > MaxAddrLen {
+		return b, fmt.Errorf("address too long: %d", len(m.Addr))
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.Addr)))
+	return append(b, m.Addr...), nil
+}
+
+func appendCompact(b []byte, addr string) ([]byte, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return b, false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return b, false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		switch {
+		case ip.Zone() != "":
+			return b, false
+		case ip.Is4():
+			a := ip.As4()
+			b = append(append(b, AddrV2, AddrIPv4), a[:]...)
+		default:
+			a := ip.As16()
+			b = append(append(b, AddrV2, AddrIPv6), a[:]...)
+		}
+	} else if validDomain(host) {
+		b = append(append(b, AddrV2, AddrDomain, byte(len(host))), host...)
+	} else {
+		return b, false
+	}
+	return binary.AppendUvarint(b, port), true
+}
+
+// validDomain accepts what the compact layout may carry as a name:
+// 1-255 printable bytes without separators.
+func validDomain(s string) bool {
+	if len(s) == 0 || len(s) > 255 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c >= 0x7f || c == ':' || c == '/' || c == '[' || c == ']' {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Addr) Decode(r io.Reader) error {
+	var hdr [2]byte
+	if err := readFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] == AddrV2 {
+		return m.decodeCompact(r, hdr[1])
+	}
+	n := binary.BigEndian.Uint16(hdr[:])
+	if n > MaxAddrLen {
+		return fmt.Errorf("address too long: %d", n)
+	}
+	buf := make([]byte, n)
+	if err := readFull(r, buf); err != nil {
+		return err
+	}
+	m.Addr, m.Compact = string(buf), false
+	return nil
+}
+
+func (m *Addr) decodeCompact(r io.Reader, typ byte) error {
+	var host string
+	switch typ {
+	case AddrIPv4:
+		var a [4]byte
+		if err := readFull(r, a[:]); err != nil {
+			return err
+		}
+		host = netip.AddrFrom4(a).String()
+	case AddrIPv6:
+		var a [16]byte
+		if err := readFull(r, a[:]); err != nil {
+			return err
+		}
+		host = netip.AddrFrom16(a).String()
+	case AddrDomain:
+		var n [1]byte
+		if err := readFull(r, n[:]); err != nil {
+			return err
+		}
+		buf := make([]byte, n[0])
+		if err := readFull(r, buf); err != nil {
+			return err
+		}
+		if host = string(buf); !validDomain(host) {
+			return fmt.Errorf("invalid domain in address: %q", host)
+		}
+	default:
+		return fmt.Errorf("unknown address type: %d", typ)
+	}
+	port, err := readPort(r)
+	if err != nil {
+		return err
+	}
+	m.Addr, m.Compact = net.JoinHostPort(host, strconv.Itoa(port)), true
+	return nil
+}
+
+// readPort reads a uvarint port in its shortest form.
+func readPort(r io.Reader) (int, error) {
+	var port uint64
+	var c [1]byte
+	for i := 0; i < 3; i++ {
+		if err := readFull(r, c[:]); err != nil {
+			return 0, err
+		}
+		port |= uint64(c[0]&0x7f) << (7 * i)
+		if c[0] < 0x80 {
+			if i > 0 && c[0] == 0 || port > 0xffff {
+				return 0, fmt.Errorf("invalid port encoding")
+			}
+			return int(port), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid port encoding")
+}
+
+// Flags is the TCP flag combinations of a PTCPF, each a bit set of
+// FIN(0) SYN(1) RST(2) PSH(3) ACK(4) URG(5) ECE(6) CWR(7) NS(8).
+//
+//	[1: count][count x 2: flags]
+type Flags struct {
+	Flags []uint16
+}
+
+func (m *Flags) Append(b []byte) ([]byte, error) {
+	if len(m.Flags) > MaxFlags {
+		return b, fmt.Errorf("too many TCPF entries: %d", len(m.Flags))
+	}
+	b = append(b, byte(len(m.Flags)))
+	for _, f := range m.Flags {
+		b = binary.BigEndian.AppendUint16(b, f)
+	}
+	return b, nil
+}
+
+func (m *Flags) Decode(r io.Reader) error {
+	var hdr [1]byte
+	if err := readFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := int(hdr[0])
+	if n > MaxFlags {
+		return fmt.Errorf("too many TCPF entries: %d", n)
+	}
+	buf := make([]byte, 2*n)
+	if err := readFull(r, buf); err != nil {
+		return err
+	}
+	m.Flags = make([]uint16, n)
+	for i := 0; i < n; i++ {
+		m.Flags[i] = binary.BigEndian.Uint16(buf[2*i:])
+	}
+	return nil
+}
+
+// Pad is the body of a PMTU or PPROBEACK: Len zero bytes that only
+// make the packet larger. The padding is discarded on decode.
+//
+//	[2: len][len: zeros]
+type Pad struct {
+	Len int
+}
+
+func (m *Pad) Append(b []byte) ([]byte, error) {
+	if m.Len < 0 || m.Len > 0xffff {
+		return b, fmt.Errorf("padding out of range: %d", m.Len)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(m.Len))
+	return append(b, make([]byte, m.Len)...), nil
+}
+
+func (m *Pad) Decode(r io.Reader) error {
+	var hdr [2]byte
+	if err := readFull(r, hdr[:]); err != nil {
+		return err
+	}
+	m.Len = int(binary.BigEndian.Uint16(hdr[:]))
+	if n, err := io.CopyN(io.Discard, r, int64(m.Len)); err != nil {
+		if err == io.EOF && n < int64(m.Len) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// Probe asks for a train of Count PPROBEACKs padded by Pad bytes each.
+//
+//	[2: count][2: pad]
+type Probe struct {
+	Count, Pad int
+}
+
+func (m *Probe) Append(b []byte) ([]byte, error) {
+	if m.Count < 0 || m.Count > 0xffff || m.Pad < 0 || m.Pad > 0xffff {
+		return b, fmt.Errorf("probe out of range: count %d, pad %d", m.Count, m.Pad)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(m.Count))
+	return binary.BigEndian.AppendUint16(b, uint16(m.Pad)), nil
+}
+
+func (m *Probe) Decode(r io.Reader) error {
+	var buf [4]byte
+	if err := readFull(r, buf[:]); err != nil {
+		return err
+	}
+	m.Count = int(binary.BigEndian.Uint16(buf[0:2]))
+	m.Pad = int(binary.BigEndian.Uint16(buf[2:4]))
+	return nil
+}
+
+// Hello advertises the sender's build and feature bits.
+//
+//	[1: len][len: version][4: features]
+type Hello struct {
+	Version  string
+	Features uint32
+}
+
+func (m *Hello) Append(b []byte) ([]byte, error) {
+	if len(m.Version) > 255 {
+		return b, fmt.Errorf("version too long: %d", len(m.Version))
+	}
+	b = append(b, byte(len(m.Version)))
+	b = append(b, m.Version...)
+	return binary.BigEndian.AppendUint32(b, m.Features), nil
+}
+
+func (m *Hello) Decode(r io.Reader) error {
+	var hdr [1]byte
+	if err := readFull(r, hdr[:]); err != nil {
+		return err
+	}
+	buf := make([]byte, int(hdr[0])+4)
+	if err := readFull(r, buf); err != nil {
+		return err
+	}
+	m.Version = string(buf[:hdr[0]])
+	m.Features = binary.BigEndian.Uint32(buf[hdr[0]:])
+	return nil
+}
+
+// Opts names what the stream it starts uses, as the feature bits both
+// sides advertised in their hellos, ahead of the request that follows
+// it on the same stream. Source is the "ip:port" the client was told
+// the connection really came from by a PROXY protocol header, empty if
+// none.
+//
+//	[4: features][1: len][len: source]
+type Opts struct {
+	Features uint32
+	Source   string
+}
+
+func (m *Opts) Append(b []byte) ([]byte, error) {
+	if len(m.Source) > 255 {
+		return b, fmt.Errorf("source too long: %d", len(m.Source))
+	}
+	b = binary.BigEndian.AppendUint32(b, m.Features)
+	b = append(b, byte(len(m.Source)))
+	return append(b, m.Source...), nil
+}
+
+func (m *Opts) Decode(r io.Reader) error {
+	var hdr [5]byte
+	if err := readFull(r, hdr[:]); err != nil {
+		return err
+	}
+	m.Features = binary.BigEndian.Uint32(hdr[:])
+	buf := make([]byte, hdr[4])
+	if err := readFull(r, buf); err != nil {
+		return err
+	}
+	m.Source = string(buf)
+	return nil
+}
+
+// Status is the outcome of a PTCP or PUDP. A Reason longer than 255
+// bytes is cut on encode.
+//
+//	[1: code][1: len][len: reason]
+type Status struct {
+	Code   byte
+	Reason string
+}
+
+func (m *Status) Append(b []byte) ([]byte, error) {
+	reason := m.Reason
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	b = append(b, m.Code, byte(len(reason)))
+	return append(b, reason...), nil
+}
+
+func (m *Status) Decode(r io.Reader) error {
+	var hdr [2]byte
+	if err := readFull(r, hdr[:]); err != nil {
+		return err
+	}
+	reason := make([]byte, hdr[1])
+	if err := readFull(r, reason); err != nil {
+		return err
+	}
+	m.Code, m.Reason = hdr[0], string(reason)
+	return nil
+}
+
+// Auth proves a session belongs to User. Time is unix seconds, signed.
+//
+//	[1: len][len: user][8: time][32: MAC]
+type Auth struct {
+	User string
+	Time int64
+	MAC  []byte
+}
+
+func (m *Auth) Append(b []byte) ([]byte, error) {
+	if len(m.User) > 255 {
+		return b, fmt.Errorf("user too long: %d", len(m.User))
+	}
+	if len(m.MAC) != MACSize {
+		return b, fmt.Errorf("auth MAC must be %d bytes", MACSize)
+	}
+	b = append(b, byte(len(m.User)))
+	b = append(b, m.User...)
+	b = binary.BigEndian.AppendUint64(b, uint64(m.Time))
+	return append(b, m.MAC...), nil
+}
+
+func (m *Auth) Decode(r io.Reader) error {
+	var hdr [1]byte
+	if err := readFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := int(hdr[0])
+	buf := make([]byte, n+8+MACSize)
+	if err := readFull(r, buf); err != nil {
+		return err
+	}
+	m.User = string(buf[:n])
+	m.Time = int64(binary.BigEndian.Uint64(buf[n:]))
+	m.MAC = buf[n+8:]
+	return nil
+}
+
+// Bench asks for a benchmark transfer of Bytes in direction Mode;
+// protocol defines the modes.
+//
+//	[1: mode][8: bytes]
+type Bench struct {
+	Mode  byte
+	Bytes uint64
+}
+
+func (m *Bench) Append(b []byte) ([]byte, error) {
+	b = append(b, m.Mode)
+	return binary.BigEndian.AppendUint64(b, m.Bytes), nil
+}
+
+func (m *Bench) Decode(r io.Reader) error {
+	var buf [9]byte
+	if err := readFull(r, buf[:]); err != nil {
+		return err
+	}
+	m.Mode, m.Bytes = buf[0], binary.BigEndian.Uint64(buf[1:])
+	return nil
+}
+
+// Ext is the body of a message in the extension range: data whose
+// meaning is up to whoever registered the type. The length prefix lets
+// a peer that does not know the type read past it.
+//
+//	[2: len][len: data]
+type Ext struct {
+	Data []byte
+}
+
+func (m *Ext) Append(b []byte) ([]byte, error) {
+	if len(m.Data) > MaxExtLen {
+		return b, fmt.Errorf("extension body too long: %d", len(m.Data))
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.Data)))
+	return append(b, m.Data...), nil
+}
+
+func (m *Ext) Decode(r io.Reader) error {
+	var hdr [2]byte
+	if err := readFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint16(hdr[:])
+	if n > MaxExtLen {
+		return fmt.Errorf("extension body too long: %d", n)
+	}
+	m.Data = make([]byte, n)
+	return readFull(r, m.Data)
+}
+
+// Datagram is one UDP datagram on a full-cone stream: addressed to its
+// destination going to the server, and from its source coming back.
+// Unlike the messages above it follows a PCONE for as long as the
+// stream lasts, without a type byte.
+//
+//	[2: addr len][addr len: "host:port"][2: len][len: data]
+//
+// A PUDPF stream frames its datagrams the same way, without the
+// address; see FrameWriter.
+type Datagram struct {
+	Addr string
+	Data []byte
+}
+
+func (m *Datagram) Append(b []byte) ([]byte, error) {
+	b, err := (&Addr{Addr: m.Addr}).Append(b)
+	if err != nil {
+		return b, err
+	}
+	if len(m.Data) > 0xffff {
+		return b, fmt.Errorf("datagram too long: %d", len(m.Data))
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(m.Data)))
+	return append(b, m.Data...), nil
+}
+
+// Decode reuses the capacity of m.Data, so a reader can keep one
+// Datagram for a whole stream.
+func (m *Datagram) Decode(r io.Reader) error {
+	a := Addr{}
+	if err := a.Decode(r); err != nil {
+		return err
+	}
+	m.Addr = a.Addr
+	var hdr [2]byte
+	if err := readFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if cap(m.Data) < n {
+		m.Data = make([]byte, n)
+	}
+	m.Data = m.Data[:n]
+	return readFull(r, m.Data)
+}
+
+// readFull is io.ReadFull for a body whose message type was already
+// read, so running out of input is never a clean EOF.
+func readFull(r io.Reader, b []byte) error {
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// vectors are golden encodings of each message body. A change to any
+// entry is a wire-protocol break.
+var vectors = []struct {
+	name string
+	msg  Message
+	wire string // hex, spaces for readability only
+}{
+	{"addr ipv4", &Addr{Addr: "1.1.1.1:443"}, "000b 312e312e312e313a343433"},
+	{"addr empty", &Addr{Addr: ""}, "0000"},
+	{"addr compact ipv4", &Addr{Addr: "1.1.1.1:443", Compact: true}, "ff 01 01010101 bb03"},
+	{"addr compact ipv6", &Addr{Addr: "[2001:db8::1]:53", Compact: true}, "ff 04 20010db8000000000000000000000001 35"},
+	{"addr compact domain", &Addr{Addr: "example.com:65535", Compact: true}, "ff 03 0b 6578616d706c652e636f6d ffff03"},
+	{"flags none", &Flags{[]uint16{}}, "00"},
+	{"flags PA,S", &Flags{[]uint16{0x0018, 0x0002}}, "02 0018 0002"},
+	{"flags high bits", &Flags{[]uint16{0xffff}}, "01 ffff"},
+	{"pad none", &Pad{0}, "0000"},
+	{"pad 3", &Pad{3}, "0003 000000"},
+	{"probe", &Probe{Count: 32, Pad: 1200}, "0020 04b0"},
+	{"probe max", &Probe{Count: 0xffff, Pad: 0xffff}, "ffff ffff"},
+	{"hello", &Hello{Version: "v1.0.0", Features: 3}, "06 76312e302e30 00000003"},
+	{"hello all features", &Hello{Version: "", Features: 0xffffffff}, "00 ffffffff"},
+	{"opts", &Opts{Features: 0x104}, "00000104 00"},
+	{"opts source", &Opts{Features: 0x104, Source: "1.2.3.4:5"}, "00000104 09 312e322e332e343a35"},
+	{"status ok", &Status{}, "00 00"},
+	{"status denied", &Status{Code: 1, Reason: "acl"}, "01 03 61636c"},
+	{"auth", &Auth{User: "bob", Time: 1, MAC: make([]byte, MACSize)}, "03 626f62 0000000000000001 " + strings.Repeat("00", MACSize)},
+	{"auth negative time", &Auth{User: "", Time: -1, MAC: bytes.Repeat([]byte{0xab}, MACSize)}, "00 ffffffffffffffff " + strings.Repeat("ab", MACSize)},
+	{"bench", &Bench{Mode: 1, Bytes: 1 << 20}, "01 0000000000100000"},
+	{"ext", &Ext{Data: []byte("hi")}, "0002 6869"},
+	{"ext empty", &Ext{Data: []byte{}}, "0000"},
+	{"datagram", &Datagram{Addr: "1.1.1.1:53", Data: []byte("hi")}, "000a 312e312e312e313a3533 0002 6869"},
+	{"datagram empty", &Datagram{Addr: "", Data: []byte{}}, "0000 0000"},
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+func fresh(m Message) Message {
+	return reflect.New(reflect.TypeOf(m).Elem()).Interface().(Message)
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			want := unhex(t, v.wire)
+			got, err := v.msg.Append(nil)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("encoded %x, want %x", got, want)
+			}
+
+			m := fresh(v.msg)
+			r := bytes.NewReader(want)
+			if err := m.Decode(r); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if r.Len() != 0 {
+				t.Fatalf("%d trailing bytes after decode", r.Len())
+			}
+			again, err := m.Append(nil)
+			if err != nil || !bytes.Equal(again, want) {
+				t.Fatalf("round trip produced %x (%v), want %x", again, err, want)
+			}
+		})
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	for _, v := range vectors {
+		t.Run(v.name, func(t *testing.T) {
+			want := unhex(t, v.wire)
+			for i := 0; i < len(want); i++ {
+				if err := fresh(v.msg).Decode(bytes.NewReader(want[:i])); !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("decoding %d of %d bytes gave %v, want %v", i, len(want), err, io.ErrUnexpectedEOF)
+				}
+			}
+		})
+	}
+}
+
+// TestDecodeRefused feeds encodings a decoder must refuse before it
+// allocates or reads on.
+func TestDecodeRefused(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		msg  Message
+		wire string
+	}{
+		{"addr too long", &Addr{}, "0201"},
+		{"addr unknown type", &Addr{}, "ff02"},
+		{"addr port too large", &Addr{}, "ff0101010101808004"},
+		{"addr port not minimal", &Addr{}, "ff01010101018000"},
+		{"addr bad domain", &Addr{}, "ff0303612f6250"},
+		{"too many flags", &Flags{}, "41"},
+		{"ext too long", &Ext{}, "1001"},
+		{"datagram addr too long", &Datagram{}, "0201"},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			err := fresh(v.msg).Decode(bytes.NewReader(unhex(t, v.wire)))
+			if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("decode gave %v, want a refusal", err)
+			}
+		})
+	}
+}
+
+// TestEncodeOversized checks that every length field refuses a value it
+// cannot carry rather than wrapping it.
+func TestEncodeOversized(t *testing.T) {
+	long := func(n int) string { return strings.Repeat("a", n) }
+	for _, v := range []struct {
+		name string
+		msg  Message
+	}{
+		{"addr", &Addr{Addr: long(MaxAddrLen + 1)}},
+		{"flags", &Flags{make([]uint16, MaxFlags+1)}},
+		{"pad", &Pad{0x10000}},
+		{"pad negative", &Pad{-1}},
+		{"probe count", &Probe{Count: 0x10000}},
+		{"probe pad", &Probe{Pad: 0x10000}},
+		{"hello version", &Hello{Version: long(256)}},
+		{"opts source", &Opts{Source: long(256)}},
+		{"auth user", &Auth{User: long(256), MAC: make([]byte, MACSize)}},
+		{"auth short MAC", &Auth{MAC: make([]byte, MACSize-1)}},
+		{"ext", &Ext{Data: make([]byte, MaxExtLen+1)}},
+		{"datagram addr", &Datagram{Addr: long(MaxAddrLen + 1)}},
+		{"datagram data", &Datagram{Data: make([]byte, 0x10000)}},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			if b, err := v.msg.Append(nil); err == nil {
+				t.Fatalf("encoded %d bytes, want an error", len(b))
+			}
+		})
+	}
+
+	// Status cuts its reason instead, and the result still decodes.
+	b, err := (&Status{Code: 1, Reason: long(300)}).Append(nil)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var s Status
+	if err := s.Decode(bytes.NewReader(b)); err != nil || len(s.Reason) != 255 {
+		t.Fatalf("status reason decoded to %d bytes (%v), want 255", len(s.Reason), err)
+	}
+}
+
+// TestCoverage keeps a new message type from going without vectors.
+func TestCoverage(t *testing.T) {
+	seen := make(map[reflect.Type]bool)
+	for _, v := range vectors {
+		seen[reflect.TypeOf(v.msg)] = true
+	}
+	for _, m := range []Message{&Addr{}, &Flags{}, &Pad{}, &Probe{}, &Hello{}, &Opts{}, &Status{}, &Auth{}, &Bench{}, &Ext{}, &Datagram{}} {
+		if !seen[reflect.TypeOf(m)] {
+			t.Errorf("no vector for %T", m)
+		}
+	}
+}
+
+// TestFrames checks the PUDPF framing against a golden encoding, with
+// two datagrams sharing one batched write.
+func TestFrames(t *testing.T) {
+	var out bytes.Buffer
+	w := NewFrameWriter(&out, time.Hour)
+	w.Write([]byte("hi"))
+	w.Write([]byte{})
+	if out.Len() != 0 {
+		t.Fatalf("wrote %d bytes before the delay or a flush", out.Len())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex(t, "0002 6869 0000"); !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("encoded %x, want %x", out.Bytes(), want)
+	}
+
+	r := NewFrameReader(bytes.NewReader(unhex(t, "0003 616263 0001")))
+	p := make([]byte, 2)
+	if n, err := r.Read(p); err != nil || string(p[:n]) != "ab" {
+		t.Fatalf("long datagram read as %q, %v, want it cut to \"ab\"", p[:n], err)
+	}
+	if _, err := r.Read(p); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated datagram gave %v", err)
+	}
+}